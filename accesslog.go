@@ -0,0 +1,169 @@
+package httpproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogFormat selects the line format written by an AccessLog.
+type AccessLogFormat int
+
+const (
+	AccessLogSquid    AccessLogFormat = iota // Squid native access.log format
+	AccessLogCombined                        // Apache Combined Log Format
+	AccessLogJSON                            // one JSON object per line
+)
+
+// AccessLog writes one line for every completed CONNECT tunnel, WebSocket relay or proxied request.
+// It implements UsageReporter, so it may also be used as Server.UsageReporter.
+type AccessLog struct {
+	Writer io.Writer       // where lines are written, see RotatingFile for size-based rotation
+	Format AccessLogFormat // line format, defaults to AccessLogSquid
+	Logger Logger          // optional logger for write errors
+	mu     sync.Mutex      // serializes writes
+}
+
+// accessLogEntry is the JSON representation of a log line.
+type accessLogEntry struct {
+	Time time.Time `json:"time"` // completion time
+	ConnInfo
+	DurationMS int64  `json:"duration_ms"`
+	Status     int    `json:"status"`
+	Error      string `json:"error,omitempty"`
+}
+
+func (al *AccessLog) log(u Usage) {
+	if al != nil {
+		al.ReportUsage(u)
+	}
+}
+
+// ReportUsage writes the log line for u.
+func (al *AccessLog) ReportUsage(u Usage) {
+	line := al.Format.appendLine(nil, u, u.Start.Add(u.Duration))
+	al.mu.Lock()
+	_, err := al.Writer.Write(line)
+	al.mu.Unlock()
+	if err != nil && al.Logger != nil {
+		al.Logger.Error("accesslog", "error", err)
+	}
+}
+
+func (f AccessLogFormat) appendLine(b []byte, u Usage, end time.Time) []byte {
+	switch f {
+	case AccessLogCombined:
+		return appendCombined(b, u)
+	case AccessLogJSON:
+		return appendJSON(b, u, end)
+	default:
+		return appendSquid(b, u, end)
+	}
+}
+
+// appendSquid formats u as
+// "time elapsed client action/code bytes method URL user hierarchy/peer type".
+func appendSquid(b []byte, u Usage, end time.Time) []byte {
+	ms := end.UnixMilli()
+	return fmt.Appendf(b, "%d.%03d %6d %s %s/%03d %d %s %s %s %s -\n",
+		ms/1000, ms%1000,
+		u.Duration.Milliseconds(),
+		logField(clientHost(u.Client)),
+		squidAction(u), u.StatusCode,
+		u.BytesReceived,
+		logField(u.Method),
+		logField(u.URL),
+		logField(u.Username),
+		squidHierarchy(u),
+	)
+}
+
+func squidAction(u Usage) string {
+	switch {
+	case u.StatusCode == http.StatusUnauthorized || u.StatusCode == http.StatusForbidden || u.StatusCode == http.StatusProxyAuthRequired:
+		return "TCP_DENIED"
+	case u.Kind == ConnKindConnect:
+		return "TCP_TUNNEL"
+	case u.Err != nil && u.StatusCode == 0:
+		return "NONE"
+	}
+	return "TCP_MISS"
+}
+
+func squidHierarchy(u Usage) string {
+	switch u.Dialer {
+	case "":
+		return "HIER_NONE/-"
+	case "direct":
+		host, _, _ := net.SplitHostPort(u.Target)
+		return "HIER_DIRECT/" + logField(host)
+	}
+	return "FIRSTUP_PARENT/" + logField(u.Dialer)
+}
+
+// appendCombined formats u as
+// `client - user [time] "method URL proto" status bytes "referer" "user-agent"`.
+func appendCombined(b []byte, u Usage) []byte {
+	size := "-"
+	if u.BytesReceived > 0 {
+		size = fmt.Sprint(u.BytesReceived)
+	}
+	return fmt.Appendf(b, "%s - %s [%s] %q %d %s %q %q\n",
+		logField(clientHost(u.Client)),
+		logField(u.Username),
+		u.Start.Format("02/Jan/2006:15:04:05 -0700"),
+		u.Method+" "+u.URL+" "+u.Proto,
+		u.StatusCode,
+		size,
+		orDash(u.Referer),
+		orDash(u.UserAgent),
+	)
+}
+
+func appendJSON(b []byte, u Usage, end time.Time) []byte {
+	e := accessLogEntry{
+		Time:       end,
+		ConnInfo:   u.ConnInfo,
+		DurationMS: u.Duration.Milliseconds(),
+		Status:     u.StatusCode,
+	}
+	if u.Err != nil {
+		e.Error = u.Err.Error()
+	}
+	buf := bytes.NewBuffer(b)
+	_ = json.NewEncoder(buf).Encode(e)
+	return buf.Bytes()
+}
+
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// logField returns s suitable for a space-separated log field.
+func logField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return '_'
+		}
+		return r
+	}, s)
+}
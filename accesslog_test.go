@@ -0,0 +1,90 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogFormats(t *testing.T) {
+	start := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	u := Usage{
+		ConnInfo: ConnInfo{
+			ID:            7,
+			Kind:          ConnKindRequest,
+			Method:        http.MethodGet,
+			Username:      "foo",
+			Client:        "192.0.2.1:5000",
+			Target:        "example.com:80",
+			URL:           "http://example.com/a b",
+			Proto:         "HTTP/1.1",
+			UserAgent:     "test/1.0",
+			Dialer:        "direct",
+			Start:         start,
+			BytesReceived: 1234,
+		},
+		Duration:   1500 * time.Millisecond,
+		StatusCode: http.StatusOK,
+	}
+	end := start.Add(u.Duration)
+
+	if got, want := string(AccessLogSquid.appendLine(nil, u, end)),
+		"1709294401.500   1500 192.0.2.1 TCP_MISS/200 1234 GET http://example.com/a_b foo HIER_DIRECT/example.com -\n"; got != want {
+		t.Errorf("\n got %q\nwant %q", got, want)
+	}
+	if got, want := string(AccessLogCombined.appendLine(nil, u, end)),
+		`192.0.2.1 - foo [01/Mar/2024:12:00:00 +0000] "GET http://example.com/a b HTTP/1.1" 200 1234 "-" "test/1.0"`+"\n"; got != want {
+		t.Errorf("\n got %q\nwant %q", got, want)
+	}
+
+	u.Err = errors.New("boom")
+	var e map[string]any
+	maybeFatal(t, json.Unmarshal(AccessLogJSON.appendLine(nil, u, end), &e))
+	if e["username"] != "foo" || e["status"] != 200.0 || e["duration_ms"] != 1500.0 || e["dialer"] != "direct" || e["error"] != "boom" {
+		t.Error(e)
+	}
+
+	u.Kind, u.Method, u.URL, u.Username, u.Dialer = ConnKindConnect, http.MethodConnect, "example.com:443", "", ""
+	u.StatusCode = http.StatusForbidden
+	if got := string(AccessLogSquid.appendLine(nil, u, end)); !strings.Contains(got, " TCP_DENIED/403 1234 CONNECT example.com:443 - HIER_NONE/- -") {
+		t.Error(got)
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	destsrv := makeHTTPDestSrv(t)
+	defer destsrv.Close()
+
+	var logbuf syncBuffer
+	rur := newRecordingUsageReporter()
+	srv := &Server{
+		CredentialsValidator: StaticCredentials{"foo": "secret"},
+		UsageReporter:        rur,
+		AccessLog:            &AccessLog{Writer: &logbuf, Format: AccessLogJSON},
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, destsrv.URL+"/", nil)
+	req.Header.Set("User-Agent", "accesslog-test")
+	SetBasicAuth(req.Header, "foo", "secret")
+	resp, err := makeClient(t, proxysrv.URL).Do(req)
+	maybeFatal(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	rur.next(t)
+
+	var e accessLogEntry
+	maybeFatal(t, json.Unmarshal([]byte(logbuf.String()), &e))
+	if e.Kind != ConnKindRequest || e.Username != "foo" || e.Status != http.StatusOK || e.Dialer != "direct" {
+		t.Errorf("%#v", e)
+	}
+	if e.URL != destsrv.URL+"/" || e.UserAgent != "accesslog-test" || e.BytesReceived == 0 {
+		t.Errorf("%#v", e)
+	}
+}
@@ -0,0 +1,192 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Blocklist is a HostFilter that blocks the domains listed in
+// hosts-files or Adblock Plus domain rule lists.
+//
+// Supported rules are hosts-file lines ("0.0.0.0 ads.example.com" matches
+// only that name), plain domains ("example.com" matches the domain and its
+// subdomains), wildcards ("*.example.com" matches subdomains only) and Adblock Plus domain rules ("||example.com^"
+// matches the domain and its subdomains, "@@||example.com^" is an exception).
+// Lines with other Adblock Plus rules are ignored.
+type Blocklist struct {
+	Files  []string // files to load rules from
+	Logger Logger   // optional logger for errors when reloading in Watch
+	mu     sync.RWMutex
+	trie   *domainTrie          // current rules
+	mtimes map[string]time.Time // file modification times when last loaded
+}
+
+var _ HostFilter = (*Blocklist)(nil)
+
+var blocklistHostsIgnored = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+func validBlocklistDomain(domain string) bool {
+	return domain != "" && !strings.ContainsAny(domain, "*/:|^$@!#[]= ")
+}
+
+func addBlocklistDomain(dt *domainTrie, domain string, flags domainFlags) {
+	if subdomain, ok := strings.CutPrefix(domain, "*."); ok {
+		// a wildcard matches subdomains only, even in a hosts-file line
+		domain = subdomain
+		if flags&blockExact != 0 {
+			flags |= blockSubdomains
+		}
+		if flags&allowExact != 0 {
+			flags |= allowSubdomains
+		}
+		flags &^= blockExact | allowExact
+	}
+	if validBlocklistDomain(domain) {
+		dt.add(domain, flags)
+	}
+}
+
+func parseAdblockRule(dt *domainTrie, line string) {
+	flags := blockExact | blockSubdomains
+	if rule, ok := strings.CutPrefix(line, "@@"); ok {
+		line = rule
+		flags = allowExact | allowSubdomains
+	}
+	if rule, ok := strings.CutPrefix(line, "||"); ok {
+		rule, options, _ := strings.Cut(rule, "$")
+		for option := range strings.SplitSeq(options, ",") {
+			if option != "" && option != "important" && option != "all" && option != "document" {
+				return
+			}
+		}
+		if domain, ok := strings.CutSuffix(rule, "^"); ok || validBlocklistDomain(rule) {
+			if !ok {
+				domain = rule
+			}
+			addBlocklistDomain(dt, domain, flags)
+		}
+	}
+}
+
+func parseBlocklist(dt *domainTrie, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "", line[0] == '!', line[0] == '[':
+			// empty line, Adblock Plus comment or header
+		case strings.HasPrefix(line, "||"), strings.HasPrefix(line, "@@"):
+			parseAdblockRule(dt, line)
+		default:
+			line, _, _ = strings.Cut(line, "#")
+			fields := strings.Fields(line)
+			if len(fields) > 1 {
+				if _, err := netip.ParseAddr(fields[0]); err == nil {
+					for _, domain := range fields[1:] {
+						if !blocklistHostsIgnored[normalizeHost(domain)] {
+							addBlocklistDomain(dt, domain, blockExact)
+						}
+					}
+				}
+			} else if len(fields) == 1 {
+				addBlocklistDomain(dt, fields[0], blockExact|blockSubdomains)
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+func (bl *Blocklist) modified() (mtimes map[string]time.Time, changed bool, err error) {
+	mtimes = make(map[string]time.Time)
+	changed = len(bl.Files) != len(bl.mtimes)
+	for _, fn := range bl.Files {
+		var fi os.FileInfo
+		if fi, err = os.Stat(fn); err != nil {
+			return
+		}
+		mtimes[fn] = fi.ModTime()
+		if prev, ok := bl.mtimes[fn]; !ok || !prev.Equal(fi.ModTime()) {
+			changed = true
+		}
+	}
+	return
+}
+
+func loadBlocklistFile(dt *domainTrie, fn string) (err error) {
+	var f *os.File
+	if f, err = os.Open(fn); err == nil {
+		err = errors.Join(parseBlocklist(dt, f), f.Close())
+	}
+	return
+}
+
+// Load (re)loads the rules from Files if any of them have been modified
+// since they were last loaded. If an error occurs, the previous rules remain in effect.
+func (bl *Blocklist) Load() (err error) {
+	bl.mu.RLock()
+	mtimes, changed, err := bl.modified()
+	bl.mu.RUnlock()
+	if err == nil && changed {
+		dt := &domainTrie{}
+		for _, fn := range bl.Files {
+			if err = loadBlocklistFile(dt, fn); err != nil {
+				return
+			}
+		}
+		bl.mu.Lock()
+		bl.trie = dt
+		bl.mtimes = mtimes
+		bl.mu.Unlock()
+	}
+	return
+}
+
+// Watch calls Load every interval until ctx is done.
+func (bl *Blocklist) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := bl.Load(); err != nil && bl.Logger != nil {
+				bl.Logger.Error("blocklist", "error", err)
+			}
+		}
+	}
+}
+
+// Blocked returns true if host is blocked by the currently loaded rules.
+func (bl *Blocklist) Blocked(host string) (yes bool) {
+	bl.mu.RLock()
+	defer bl.mu.RUnlock()
+	if bl.trie != nil {
+		yes = bl.trie.blocked(host)
+	}
+	return
+}
+
+func (bl *Blocklist) BlockHost(_, host string) bool {
+	return bl.Blocked(host)
+}
@@ -0,0 +1,139 @@
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHostsFile = `# hosts file
+127.0.0.1 localhost
+::1 localhost ip6-localhost
+0.0.0.0 ads.example.com tracker.example.com # trailing comment
+0.0.0.0 0.0.0.0
+0.0.0.0 *.wild.example.com
+`
+
+const testAdblockFile = `[Adblock Plus 2.0]
+! comment
+||doubleclick.example^
+||*.cdn.example^
+||important.example^$important
+||thirdparty.example^$third-party
+||path.example/ads^
+@@||good.doubleclick.example^
+example.net
+`
+
+func writeBlocklistFile(t *testing.T, fn, content string, mtime time.Time) {
+	t.Helper()
+	maybeFatal(t, os.WriteFile(fn, []byte(content), 0o600))
+	maybeFatal(t, os.Chtimes(fn, mtime, mtime))
+}
+
+func TestBlocklist(t *testing.T) {
+	dir := t.TempDir()
+	hostsfn := filepath.Join(dir, "hosts")
+	adblockfn := filepath.Join(dir, "adblock.txt")
+	mtime := time.Now().Add(-time.Hour)
+	writeBlocklistFile(t, hostsfn, testHostsFile, mtime)
+	writeBlocklistFile(t, adblockfn, testAdblockFile, mtime)
+
+	bl := &Blocklist{Files: []string{hostsfn, adblockfn}}
+	if bl.Blocked("ads.example.com") {
+		t.Error("blocked before Load")
+	}
+	maybeFatal(t, bl.Load())
+
+	for host, want := range map[string]bool{
+		"localhost":                  false,
+		"ads.example.com":            true,
+		"ADS.Example.com.":           true,
+		"sub.ads.example.com":        false,
+		"tracker.example.com":        true,
+		"example.com":                false,
+		"doubleclick.example":        true,
+		"x.y.doubleclick.example":    true,
+		"good.doubleclick.example":   false,
+		"a.good.doubleclick.example": false,
+		"cdn.example":                false,
+		"img.cdn.example":            true,
+		"important.example":          true,
+		"thirdparty.example":         false,
+		"path.example":               false,
+		"example.net":                true,
+		"www.example.net":            true,
+		"0.0.0.0":                    false,
+		"wild.example.com":           false,
+		"a.wild.example.com":         true,
+		"a.b.wild.example.com":       true,
+	} {
+		if got := bl.BlockHost("", host); got != want {
+			t.Errorf("%q: got %v want %v", host, got, want)
+		}
+	}
+
+	writeBlocklistFile(t, hostsfn, "0.0.0.0 new.example.com\n", mtime)
+	maybeFatal(t, bl.Load())
+	if bl.Blocked("new.example.com") {
+		t.Error("reloaded without modification time change")
+	}
+	writeBlocklistFile(t, hostsfn, "0.0.0.0 new.example.com\n", mtime.Add(time.Minute))
+	maybeFatal(t, bl.Load())
+	if !bl.Blocked("new.example.com") || bl.Blocked("ads.example.com") {
+		t.Error("not reloaded")
+	}
+
+	maybeFatal(t, os.Remove(adblockfn))
+	if err := bl.Load(); err == nil {
+		t.Error("expected error")
+	}
+	if !bl.Blocked("doubleclick.example") {
+		t.Error("rules should remain after failed Load")
+	}
+}
+
+func TestBlocklistServer(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "hosts")
+	writeBlocklistFile(t, fn, "0.0.0.0 blocked.example\n", time.Now())
+	bl := &Blocklist{Files: []string{fn}}
+	maybeFatal(t, bl.Load())
+
+	srv := &Server{HostFilter: bl}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+	client := makeClient(t, proxysrv.URL)
+
+	resp, err := client.Get("http://blocked.example/")
+	maybeFatal(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error(resp.StatusCode)
+	}
+	if !strings.Contains(string(body), ErrBlocked.Error()) {
+		t.Errorf("%q", body)
+	}
+
+	srv.BlockHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = io.WriteString(w, "blocked by policy: "+r.URL.Hostname())
+	})
+	resp, err = client.Get("http://blocked.example/")
+	maybeFatal(t, err)
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden || string(body) != "blocked by policy: blocked.example" {
+		t.Error(resp.StatusCode, string(body))
+	}
+
+	resp, _ = rawConnect(t, proxysrv.Listener.Addr().String(), "blocked.example:443", "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error(resp.StatusCode)
+	}
+}
@@ -0,0 +1,452 @@
+package httpproxy
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultCacheMaxObjectSize is the default maximum body size of responses stored by a Cache.
+var DefaultCacheMaxObjectSize int64 = 64 << 20
+
+// DefaultCacheRevalidateTimeout limits background revalidations done for stale-while-revalidate.
+var DefaultCacheRevalidateTimeout = 30 * time.Second
+
+// Cache is a shared HTTP cache as described in RFC 9111 for GET requests proxied by a Server.
+//
+// Responses are stored once their body has been read completely, and are served
+// with Age and RFC 9211 Cache-Status header fields. Stale responses are
+// revalidated using ETag and Last-Modified, and may be served while revalidating
+// or on errors if the response allows it with stale-while-revalidate or stale-if-error.
+//
+// Concurrent cache misses for the same URL and variant are coalesced into a
+// single upstream request whose response is streamed to all of the clients.
+//
+// Responses with Set-Cookie header fields are not stored.
+type Cache struct {
+	Store         CacheStore               // where responses are stored
+	MaxObjectSize int64                    // optional maximum body size of stored responses, defaults to DefaultCacheMaxObjectSize
+	MaxSize       int64                    // optional maximum total body size of stored responses, least recently used are evicted first
+	Pin           []*regexp.Regexp         // optional URL patterns of responses never evicted
+	Exclude       []*regexp.Regexp         // optional URL patterns of requests never answered from or stored in the cache
+	Admins        []string                 // optional usernames allowed to use the PURGE method
+	Logger        Logger                   // optional logger for store errors
+	mu            sync.Mutex               // protects following
+	revalidating  map[string]struct{}      // store keys being revalidated in the background
+	lru           list.List                // *cacheObject, most recently used first
+	objects       map[string]*list.Element // store key -> element in lru
+	size          int64                    // total body size of stored responses
+	hits          uint64
+	misses        uint64
+	revalidations uint64
+	evictions     uint64
+	collapsed     uint64
+	inflight      map[string]*coalescedFetch // fetches for cache misses clients may join
+}
+
+var conditionalHeaders = []string{"If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since", "If-Range"}
+
+func cacheKey(u *url.URL) string {
+	return u.String()
+}
+
+// variantKey returns the store key for the variant of key selected by r's values for the header fields names.
+func variantKey(key string, names []string, r *http.Request) string {
+	var sb strings.Builder
+	sb.WriteString(key)
+	for _, name := range names {
+		sb.WriteByte(0)
+		sb.WriteString(name)
+		sb.WriteByte(':')
+		for i, v := range r.Header.Values(name) {
+			if i > 0 {
+				sb.WriteByte(',')
+			}
+			sb.WriteString(strings.TrimSpace(v))
+		}
+	}
+	return sb.String()
+}
+
+func (c *Cache) maxObjectSize() int64 {
+	if c.MaxObjectSize > 0 {
+		return c.MaxObjectSize
+	}
+	return DefaultCacheMaxObjectSize
+}
+
+func (c *Cache) logError(err error) {
+	if err != nil && !errors.Is(err, ErrCacheMiss) && c.Logger != nil {
+		c.Logger.Error("cache", "error", err)
+	}
+}
+
+// lookup returns the stored response for r and the key it is stored under.
+// If there is none, entry is nil.
+func (c *Cache) lookup(key string, r *http.Request) (storeKey string, entry *CacheEntry, body io.ReadCloser) {
+	storeKey = key
+	var err error
+	if entry, body, err = c.Store.Get(key); err == nil && entry.StatusCode == 0 {
+		// Vary marker, look up the variant
+		_ = body.Close()
+		storeKey = variantKey(key, entry.Vary, r)
+		entry, body, err = c.Store.Get(storeKey)
+	}
+	if err != nil {
+		c.logError(err)
+		entry, body = nil, nil
+	}
+	return
+}
+
+func (c *Cache) put(key, storeKey string, entry *CacheEntry, body []byte) {
+	entry.Size = int64(len(body))
+	var err error
+	if storeKey != key {
+		marker := &CacheEntry{URL: entry.URL, Vary: entry.Vary, RequestTime: entry.RequestTime, ResponseTime: entry.ResponseTime}
+		err = c.Store.Put(key, marker, nil)
+	}
+	if err == nil {
+		if err = c.Store.Put(storeKey, entry, body); err == nil {
+			c.stored(storeKey, entry)
+		}
+	}
+	c.logError(err)
+}
+
+// cacheFiller stores the response body read through it once it has been read completely.
+type cacheFiller struct {
+	io.ReadCloser
+	c        *Cache
+	key      string
+	storeKey string
+	entry    *CacheEntry
+	want     int64 // expected body size, or -1 if unknown
+	buf      bytes.Buffer
+	done     bool // true if stored or abandoned
+}
+
+func (cf *cacheFiller) Read(p []byte) (n int, err error) {
+	n, err = cf.ReadCloser.Read(p)
+	if !cf.done {
+		if int64(cf.buf.Len()+n) > cf.c.maxObjectSize() {
+			cf.done = true
+		} else {
+			cf.buf.Write(p[:n])
+			if err == io.EOF {
+				cf.done = true
+				if cf.want < 0 || cf.want == int64(cf.buf.Len()) {
+					cf.c.put(cf.key, cf.storeKey, cf.entry, cf.buf.Bytes())
+				}
+			} else if err != nil {
+				cf.done = true
+			}
+		}
+		if cf.done {
+			cf.buf = bytes.Buffer{}
+		}
+	}
+	return
+}
+
+// storableEntry returns the entry to store resp to r with and the key to store it under,
+// or a nil entry if resp may not be stored.
+func (c *Cache) storableEntry(r *http.Request, key string, resp *http.Response, reqCC cacheControl, reqTime, respTime time.Time) (storeKey string, entry *CacheEntry) {
+	respCC := parseCacheControl(resp.Header)
+	if storable(r, resp, reqCC, respCC) && resp.ContentLength <= c.maxObjectSize() {
+		entry = &CacheEntry{
+			URL:          key,
+			StatusCode:   resp.StatusCode,
+			Header:       resp.Header.Clone(),
+			Vary:         varyFields(resp.Header),
+			RequestTime:  reqTime,
+			ResponseTime: respTime,
+		}
+		storeKey = key
+		if len(entry.Vary) > 0 {
+			storeKey = variantKey(key, entry.Vary, r)
+		}
+	}
+	return
+}
+
+// maybeStore arranges for resp to r to be stored when its body has been read completely, if it may be stored.
+func (c *Cache) maybeStore(r *http.Request, key string, resp *http.Response, reqCC cacheControl, reqTime, respTime time.Time) (stored bool) {
+	storeKey, entry := c.storableEntry(r, key, resp, reqCC, reqTime, respTime)
+	if stored = entry != nil; stored {
+		resp.Body = &cacheFiller{ReadCloser: resp.Body, c: c, key: key, storeKey: storeKey, entry: entry, want: resp.ContentLength}
+	}
+	return
+}
+
+// refresh updates the stored entry with the header fields from a 304 Not Modified response.
+func (c *Cache) refresh(storeKey string, entry *CacheEntry, hdr http.Header, reqTime, respTime time.Time) *CacheEntry {
+	entry = entry.clone()
+	entry.Header.Del("Age")
+	for k, vv := range hdr {
+		if k != "Content-Length" {
+			entry.Header[k] = vv
+		}
+	}
+	entry.RequestTime, entry.ResponseTime = reqTime, respTime
+	c.logError(c.Store.Update(storeKey, entry))
+	return entry
+}
+
+func setCacheStatus(hdr http.Header, format string, args ...any) {
+	hdr.Set("Cache-Status", ProxyStatusName+"; "+fmt.Sprintf(format, args...))
+}
+
+func drainAndClose(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, 64*1024))
+	_ = body.Close()
+}
+
+// cachedResponse returns the response to r from the stored entry and body,
+// or a 304 Not Modified response if r is a conditional request it satisfies.
+func cachedResponse(r *http.Request, entry *CacheEntry, body io.ReadCloser, now time.Time) (resp *http.Response) {
+	hdr := entry.Header.Clone()
+	hdr.Set("Age", strconv.FormatInt(int64(entry.currentAge(now)/time.Second), 10))
+	resp = &http.Response{
+		Status:        fmt.Sprintf("%03d %s", entry.StatusCode, http.StatusText(entry.StatusCode)),
+		StatusCode:    entry.StatusCode,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        hdr,
+		Body:          body,
+		ContentLength: entry.Size,
+		Request:       r,
+	}
+	if entry.StatusCode == http.StatusOK && notModified(r, hdr) {
+		_ = body.Close()
+		for k := range hdr {
+			switch k {
+			case "Age", "Cache-Control", "Content-Location", "Date", "Etag", "Expires", "Last-Modified", "Vary":
+			default:
+				delete(hdr, k)
+			}
+		}
+		resp.StatusCode = http.StatusNotModified
+		resp.Status = "304 " + http.StatusText(http.StatusNotModified)
+		resp.Body = http.NoBody
+		resp.ContentLength = 0
+	} else if entry.StatusCode != http.StatusNoContent {
+		hdr.Set("Content-Length", strconv.FormatInt(entry.Size, 10))
+	}
+	return
+}
+
+// conditionalRequest returns a copy of r with ctx validating the stored entry.
+func conditionalRequest(ctx context.Context, r *http.Request, entry *CacheEntry) (creq *http.Request) {
+	creq = r.Clone(ctx)
+	for _, k := range conditionalHeaders {
+		creq.Header.Del(k)
+	}
+	if etag := entry.Header.Get("ETag"); etag != "" {
+		creq.Header.Set("If-None-Match", etag)
+	}
+	if lm := entry.Header.Get("Last-Modified"); lm != "" {
+		creq.Header.Set("If-Modified-Since", lm)
+	}
+	return
+}
+
+func (c *Cache) revalidateInBackground(rt http.RoundTripper, r *http.Request, key, storeKey string, entry *CacheEntry) {
+	c.mu.Lock()
+	_, busy := c.revalidating[storeKey]
+	if !busy {
+		if c.revalidating == nil {
+			c.revalidating = make(map[string]struct{})
+		}
+		c.revalidating[storeKey] = struct{}{}
+	}
+	c.mu.Unlock()
+	if !busy {
+		ctx, cancel := context.WithTimeout(context.Background(), DefaultCacheRevalidateTimeout)
+		creq := conditionalRequest(ctx, r, entry)
+		go func() {
+			defer func() {
+				cancel()
+				c.mu.Lock()
+				delete(c.revalidating, storeKey)
+				c.mu.Unlock()
+			}()
+			reqTime := time.Now()
+			resp, err := rt.RoundTrip(creq)
+			if err == nil {
+				if resp.StatusCode == http.StatusNotModified {
+					c.refresh(storeKey, entry, resp.Header, reqTime, time.Now())
+					c.revalidated()
+				} else {
+					c.maybeStore(creq, key, resp, cacheControl{}, reqTime, time.Now())
+					_, _ = io.Copy(io.Discard, resp.Body)
+				}
+				_ = resp.Body.Close()
+			}
+			c.logError(err)
+		}()
+	}
+}
+
+func onlyIfCachedResponse(r *http.Request) (resp *http.Response) {
+	resp = &http.Response{
+		Status:     "504 " + http.StatusText(http.StatusGatewayTimeout),
+		StatusCode: http.StatusGatewayTimeout,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{},
+		Body:       http.NoBody,
+		Request:    r,
+	}
+	setCacheStatus(resp.Header, "fwd=miss; detail=only-if-cached")
+	return
+}
+
+// invalidate removes stored responses for the target of an unsafe request, see RFC 9111 section 4.4.
+func (c *Cache) invalidate(r *http.Request, resp *http.Response) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+		return
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 400 {
+		c.Purge(cacheKey(r.URL))
+		for _, k := range []string{"Location", "Content-Location"} {
+			if v := resp.Header.Get(k); v != "" {
+				if u, err := r.URL.Parse(v); err == nil && u.Host == r.URL.Host {
+					c.Purge(cacheKey(u))
+				}
+			}
+		}
+	}
+}
+
+// fetch forwards r using rt, storing the response if possible.
+func (c *Cache) fetch(rt http.RoundTripper, r *http.Request, key string, reqCC cacheControl, fwd string) (resp *http.Response, err error) {
+	reqTime := time.Now()
+	if resp, err = rt.RoundTrip(r); err == nil {
+		c.served("", false)
+		if c.maybeStore(r, key, resp, reqCC, reqTime, time.Now()) {
+			fwd += "; stored"
+		}
+		setCacheStatus(resp.Header, "fwd=%s", fwd)
+	}
+	return
+}
+
+// revalidate forwards a conditional request for the stored entry, serving
+// it if it is still valid or if stale-if-error allows it.
+func (c *Cache) revalidate(rt http.RoundTripper, r *http.Request, key, storeKey string, entry *CacheEntry, body io.ReadCloser, reqCC, respCC cacheControl, staleness time.Duration) (resp *http.Response, err error) {
+	reqTime := time.Now()
+	resp, err = rt.RoundTrip(conditionalRequest(r.Context(), r, entry))
+	now := time.Now()
+	if err == nil && resp.StatusCode == http.StatusNotModified {
+		drainAndClose(resp.Body)
+		entry = c.refresh(storeKey, entry, resp.Header, reqTime, now)
+		c.revalidated()
+		c.served(storeKey, true)
+		resp = cachedResponse(r, entry, body, now)
+		setCacheStatus(resp.Header, "fwd=stale; fwd-status=304")
+		return
+	}
+	if err != nil || resp.StatusCode >= 500 {
+		window, ok := reqCC.seconds("stale-if-error")
+		if !ok {
+			window, ok = respCC.seconds("stale-if-error")
+		}
+		if ok && staleness <= window && mayServeStale(respCC) {
+			status := "fwd=stale; detail=stale-if-error"
+			if err == nil {
+				status = fmt.Sprintf("fwd=stale; fwd-status=%d; detail=stale-if-error", resp.StatusCode)
+				drainAndClose(resp.Body)
+			}
+			c.logError(err)
+			c.served(storeKey, true)
+			resp, err = cachedResponse(r, entry, body, now), nil
+			setCacheStatus(resp.Header, "%s", status)
+			return
+		}
+	}
+	_ = body.Close()
+	if err == nil {
+		c.served("", false)
+		status := fmt.Sprintf("fwd=stale; fwd-status=%d", resp.StatusCode)
+		if c.maybeStore(r, key, resp, reqCC, reqTime, now) {
+			status += "; stored"
+		}
+		setCacheStatus(resp.Header, "%s", status)
+	}
+	return
+}
+
+// roundTrip answers r from the cache if possible, otherwise forwards it using rt.
+func (c *Cache) roundTrip(rt http.RoundTripper, r *http.Request) (resp *http.Response, err error) {
+	if r.Method != http.MethodGet || r.Header.Get("Range") != "" || r.Header.Get("Upgrade") != "" || c.excluded(cacheKey(r.URL)) {
+		if resp, err = rt.RoundTrip(r); err == nil {
+			c.invalidate(r, resp)
+		}
+		return
+	}
+	reqCC := parseCacheControl(r.Header)
+	if len(reqCC) == 0 && strings.EqualFold(r.Header.Get("Pragma"), "no-cache") {
+		reqCC["no-cache"] = ""
+	}
+	key := cacheKey(r.URL)
+	storeKey, entry, body := c.lookup(key, r)
+	if entry == nil {
+		if reqCC.has("only-if-cached") {
+			return onlyIfCachedResponse(r), nil
+		}
+		return c.coalesce(rt, r, key, storeKey, reqCC)
+	}
+
+	now := time.Now()
+	respCC := parseCacheControl(entry.Header)
+	age := entry.currentAge(now)
+	lifetime := entry.freshnessLifetime()
+	staleness := age - lifetime
+	acceptable := staleness <= 0
+	if v, ok := reqCC["max-stale"]; ok && !acceptable && mayServeStale(respCC) {
+		d, ok := reqCC.seconds("max-stale")
+		acceptable = v == "" || (ok && staleness <= d)
+	}
+	if d, ok := reqCC.seconds("max-age"); ok && age > d {
+		acceptable = false
+	}
+	if d, ok := reqCC.seconds("min-fresh"); ok && lifetime-age < d {
+		acceptable = false
+	}
+	mustValidate := reqCC.has("no-cache") || respCC.has("no-cache")
+
+	if (acceptable && !mustValidate) || reqCC.has("only-if-cached") {
+		if !acceptable {
+			_ = body.Close()
+			return onlyIfCachedResponse(r), nil
+		}
+		c.served(storeKey, true)
+		resp = cachedResponse(r, entry, body, now)
+		setCacheStatus(resp.Header, "hit; ttl=%d", int64(-staleness/time.Second))
+		return
+	}
+
+	if d, ok := respCC.seconds("stale-while-revalidate"); ok && staleness > 0 && staleness <= d && !mustValidate && mayServeStale(respCC) {
+		c.revalidateInBackground(rt, r, key, storeKey, entry)
+		c.served(storeKey, true)
+		resp = cachedResponse(r, entry, body, now)
+		setCacheStatus(resp.Header, "hit; ttl=%d; detail=stale-while-revalidate", int64(-staleness/time.Second))
+		return
+	}
+
+	return c.revalidate(rt, r, key, storeKey, entry, body, reqCC, respCC, staleness)
+}
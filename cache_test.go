@@ -0,0 +1,189 @@
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testOrigin struct {
+	hits    atomic.Int32
+	handler http.HandlerFunc
+}
+
+func (o *testOrigin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	o.hits.Add(1)
+	o.handler(w, r)
+}
+
+func newCacheTest(t *testing.T, handler http.HandlerFunc) (o *testOrigin, client *http.Client, originURL string, get func(hdr ...string) (*http.Response, string)) {
+	t.Helper()
+	o = &testOrigin{handler: handler}
+	origin := httptest.NewServer(o)
+	t.Cleanup(origin.Close)
+	srv := &Server{Cache: &Cache{Store: &MemoryCacheStore{}}}
+	proxysrv := httptest.NewServer(srv)
+	t.Cleanup(proxysrv.Close)
+	client = makeClient(t, proxysrv.URL)
+	originURL = origin.URL + "/file"
+	get = func(hdr ...string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, originURL, nil)
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := client.Do(req)
+		maybeFatal(t, err)
+		b, err := io.ReadAll(resp.Body)
+		maybeFatal(t, err)
+		maybeFatal(t, resp.Body.Close())
+		return resp, string(b)
+	}
+	return
+}
+
+func TestCacheFresh(t *testing.T) {
+	o, _, _, get := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "hello")
+	})
+	resp, body := get()
+	if body != "hello" || resp.Header.Get("Cache-Status") != "httpproxy; fwd=uri-miss; stored" {
+		t.Error(body, resp.Header)
+	}
+	resp, body = get()
+	if body != "hello" || !strings.HasPrefix(resp.Header.Get("Cache-Status"), "httpproxy; hit; ttl=") || resp.Header.Get("Age") == "" {
+		t.Error(body, resp.Header)
+	}
+	if n := o.hits.Load(); n != 1 {
+		t.Error(n)
+	}
+	resp, _ = get("Cache-Control", "no-cache")
+	if n := o.hits.Load(); n != 2 || resp.Header.Get("Cache-Status") != "httpproxy; fwd=stale; fwd-status=200; stored" {
+		t.Error(n, resp.Header)
+	}
+}
+
+func TestCacheRevalidate(t *testing.T) {
+	o, _, _, get := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		_, _ = io.WriteString(w, "hello")
+	})
+	get()
+	resp, body := get()
+	if body != "hello" || resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Status") != "httpproxy; fwd=stale; fwd-status=304" {
+		t.Error(resp.Status, body, resp.Header)
+	}
+	resp, body = get("If-None-Match", `"v1"`)
+	if resp.StatusCode != http.StatusNotModified || body != "" {
+		t.Error(resp.Status, body)
+	}
+	if n := o.hits.Load(); n != 3 {
+		t.Error(n)
+	}
+}
+
+func TestCacheVary(t *testing.T) {
+	o, _, _, get := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "X-Lang")
+		_, _ = io.WriteString(w, "hello "+r.Header.Get("X-Lang"))
+	})
+	for _, lang := range []string{"en", "sv", "en", "sv"} {
+		if _, body := get("X-Lang", lang); body != "hello "+lang {
+			t.Error(body)
+		}
+	}
+	if n := o.hits.Load(); n != 2 {
+		t.Error(n)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var version atomic.Int32
+	o, _, _, get := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0, stale-while-revalidate=60")
+		_, _ = io.WriteString(w, strings.Repeat("v", int(version.Add(1))))
+	})
+	get()
+	resp, body := get()
+	if body != "v" || !strings.Contains(resp.Header.Get("Cache-Status"), "detail=stale-while-revalidate") {
+		t.Error(body, resp.Header)
+	}
+	for range 100 {
+		if _, body = get("Cache-Control", "max-stale"); body == "vv" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if body != "vv" || o.hits.Load() < 2 {
+		t.Error(body, o.hits.Load())
+	}
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	var fail atomic.Bool
+	_, _, _, get := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		_, _ = io.WriteString(w, "hello")
+	})
+	get()
+	fail.Store(true)
+	resp, body := get()
+	if body != "hello" || resp.StatusCode != http.StatusOK || resp.Header.Get("Cache-Status") != "httpproxy; fwd=stale; fwd-status=503; detail=stale-if-error" {
+		t.Error(resp.Status, body, resp.Header)
+	}
+}
+
+func TestCacheNotStored(t *testing.T) {
+	o, client, originURL, get := newCacheTest(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		if cc := r.URL.Query().Get("cc"); cc != "" {
+			w.Header().Set("Cache-Control", cc)
+		}
+		_, _ = io.WriteString(w, r.Method)
+	})
+	get()
+	get()
+	if n := o.hits.Load(); n != 1 {
+		t.Fatal(n)
+	}
+	resp, err := client.Post(originURL, "text/plain", strings.NewReader("x"))
+	maybeFatal(t, err)
+	resp.Body.Close()
+	get()
+	if n := o.hits.Load(); n != 3 {
+		t.Error("POST did not invalidate", n)
+	}
+
+	for range 2 {
+		resp, err = client.Get(originURL + "?cc=no-store")
+		maybeFatal(t, err)
+		resp.Body.Close()
+	}
+	if n := o.hits.Load(); n != 5 {
+		t.Error("no-store response was cached", n)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, originURL+"?uncached", nil)
+	req.Header.Set("Cache-Control", "only-if-cached")
+	resp, err = client.Do(req)
+	maybeFatal(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout || o.hits.Load() != 5 {
+		t.Error(resp.Status)
+	}
+}
@@ -0,0 +1,166 @@
+package httpproxy
+
+import (
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxHeuristicFreshness caps the freshness lifetime derived from Last-Modified.
+const maxHeuristicFreshness = 24 * time.Hour
+
+// heuristicallyCacheable lists the status codes that may be cached without
+// explicit freshness information, see RFC 9110 section 15.1.
+var heuristicallyCacheable = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+// cacheControl holds Cache-Control directives by lowercase name.
+type cacheControl map[string]string
+
+func parseCacheControl(hdr http.Header) (cc cacheControl) {
+	cc = cacheControl{}
+	for _, v := range hdr.Values("Cache-Control") {
+		for _, part := range strings.Split(v, ",") {
+			name, val, _ := strings.Cut(part, "=")
+			if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+				cc[name] = strings.Trim(strings.TrimSpace(val), `"`)
+			}
+		}
+	}
+	return
+}
+
+func (cc cacheControl) has(name string) (ok bool) {
+	_, ok = cc[name]
+	return
+}
+
+// seconds returns the delta-seconds value of the named directive.
+func (cc cacheControl) seconds(name string) (d time.Duration, ok bool) {
+	var v string
+	if v, ok = cc[name]; ok {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if ok = err == nil && n >= 0; ok {
+			d = time.Duration(min(n, math.MaxInt64/int64(time.Second))) * time.Second
+		}
+	}
+	return
+}
+
+// date returns the response's Date, or the time it was received if that is missing or invalid.
+func (e *CacheEntry) date() time.Time {
+	if t, err := http.ParseTime(e.Header.Get("Date")); err == nil {
+		return t
+	}
+	return e.ResponseTime
+}
+
+// freshnessLifetime returns the freshness lifetime of the response for a shared cache,
+// see RFC 9111 section 4.2.1.
+func (e *CacheEntry) freshnessLifetime() (lifetime time.Duration) {
+	cc := parseCacheControl(e.Header)
+	var ok bool
+	if lifetime, ok = cc.seconds("s-maxage"); !ok {
+		if lifetime, ok = cc.seconds("max-age"); !ok {
+			date := e.date()
+			if expires := e.Header.Get("Expires"); expires != "" {
+				if t, err := http.ParseTime(expires); err == nil {
+					lifetime = max(0, t.Sub(date))
+				}
+			} else if heuristicallyCacheable[e.StatusCode] || cc.has("public") {
+				if lm, err := http.ParseTime(e.Header.Get("Last-Modified")); err == nil && lm.Before(date) {
+					lifetime = min(date.Sub(lm)/10, maxHeuristicFreshness)
+				}
+			}
+		}
+	}
+	return
+}
+
+// currentAge returns the age of the response at now, see RFC 9111 section 4.2.3.
+func (e *CacheEntry) currentAge(now time.Time) time.Duration {
+	apparentAge := max(0, e.ResponseTime.Sub(e.date()))
+	var ageValue time.Duration
+	if n, err := strconv.ParseInt(e.Header.Get("Age"), 10, 64); err == nil && n > 0 {
+		ageValue = time.Duration(n) * time.Second
+	}
+	correctedAgeValue := ageValue + e.ResponseTime.Sub(e.RequestTime)
+	return max(apparentAge, correctedAgeValue) + now.Sub(e.ResponseTime)
+}
+
+// mayServeStale returns true if the response directives cc do not forbid serving it stale.
+func mayServeStale(cc cacheControl) bool {
+	return !cc.has("must-revalidate") && !cc.has("proxy-revalidate") && !cc.has("no-cache") && !cc.has("s-maxage")
+}
+
+// storable returns true if resp to r may be stored by a shared cache, see RFC 9111 section 3.
+func storable(r *http.Request, resp *http.Response, reqCC, respCC cacheControl) bool {
+	switch {
+	case r.Method != http.MethodGet:
+	case reqCC.has("no-store"), respCC.has("no-store"), respCC.has("private"):
+	case resp.StatusCode < 200, resp.StatusCode == http.StatusPartialContent, resp.StatusCode == http.StatusNotModified:
+	case resp.Header.Get("Set-Cookie") != "":
+	case r.Header.Get("Authorization") != "" && !respCC.has("public") && !respCC.has("s-maxage") && !respCC.has("must-revalidate"):
+	case hasVaryStar(resp.Header):
+	default:
+		return heuristicallyCacheable[resp.StatusCode] || respCC.has("public") ||
+			respCC.has("max-age") || respCC.has("s-maxage") || resp.Header.Get("Expires") != ""
+	}
+	return false
+}
+
+// varyFields returns the canonical, sorted request header names listed in hdr's Vary fields.
+func varyFields(hdr http.Header) (names []string) {
+	for _, v := range hdr.Values("Vary") {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	slices.Sort(names)
+	return slices.Compact(names)
+}
+
+func hasVaryStar(hdr http.Header) bool {
+	return slices.Contains(varyFields(hdr), "*")
+}
+
+// etagsMatch compares entity tags using the weak comparison function.
+func etagsMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// notModified returns true if the conditional request r is satisfied by a stored response with header hdr.
+func notModified(r *http.Request, hdr http.Header) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		if etag := hdr.Get("ETag"); etag != "" {
+			for _, tag := range strings.Split(inm, ",") {
+				if tag = strings.TrimSpace(tag); tag == "*" || etagsMatch(tag, etag) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	if ims, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil {
+		if lm, err := http.ParseTime(hdr.Get("Last-Modified")); err == nil {
+			return !lm.After(ims)
+		}
+	}
+	return false
+}
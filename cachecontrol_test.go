@@ -0,0 +1,70 @@
+package httpproxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseCacheControl(t *testing.T) {
+	cc := parseCacheControl(http.Header{"Cache-Control": {`Max-Age=60, no-cache, private="Set-Cookie"`, "s-maxage=x"}})
+	if d, ok := cc.seconds("max-age"); !ok || d != time.Minute {
+		t.Error(d, ok)
+	}
+	if !cc.has("no-cache") || cc["private"] != "Set-Cookie" {
+		t.Error(cc)
+	}
+	if _, ok := cc.seconds("s-maxage"); ok {
+		t.Error("invalid s-maxage accepted")
+	}
+}
+
+func TestCacheEntryFreshness(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	date := now.Add(-10 * time.Second).Format(http.TimeFormat)
+	for _, tc := range []struct {
+		hdr      http.Header
+		lifetime time.Duration
+	}{
+		{http.Header{"Cache-Control": {"max-age=60, s-maxage=120"}}, 120 * time.Second},
+		{http.Header{"Cache-Control": {"max-age=60"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Minute},
+		{http.Header{"Date": {date}, "Expires": {now.Add(50 * time.Second).Format(http.TimeFormat)}}, time.Minute},
+		{http.Header{"Date": {date}, "Expires": {"0"}}, 0},
+		{http.Header{"Date": {date}, "Last-Modified": {now.Add(-1000 * time.Second).Format(http.TimeFormat)}}, 99 * time.Second},
+		{http.Header{"Date": {date}, "Last-Modified": {now.Add(-10000 * time.Hour).Format(http.TimeFormat)}}, maxHeuristicFreshness},
+	} {
+		e := &CacheEntry{StatusCode: http.StatusOK, Header: tc.hdr, RequestTime: now, ResponseTime: now}
+		if got := e.freshnessLifetime(); got != tc.lifetime {
+			t.Errorf("%v: got %v want %v", tc.hdr, got, tc.lifetime)
+		}
+	}
+
+	e := &CacheEntry{Header: http.Header{"Date": {date}, "Age": {"30"}}, RequestTime: now.Add(-2 * time.Second), ResponseTime: now}
+	if got := e.currentAge(now.Add(5 * time.Second)); got != 37*time.Second {
+		t.Error(got)
+	}
+	e.Header.Del("Age")
+	if got := e.currentAge(now); got != 10*time.Second {
+		t.Error(got)
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	hdr := http.Header{"Etag": {`W/"x"`}, "Last-Modified": {"Mon, 01 Jan 2024 00:00:00 GMT"}}
+	for _, tc := range []struct {
+		k, v string
+		want bool
+	}{
+		{"If-None-Match", `"y", "x"`, true},
+		{"If-None-Match", `"y"`, false},
+		{"If-None-Match", `*`, true},
+		{"If-Modified-Since", "Mon, 01 Jan 2024 00:00:00 GMT", true},
+		{"If-Modified-Since", "Sun, 31 Dec 2023 00:00:00 GMT", false},
+	} {
+		r, _ := http.NewRequest(http.MethodGet, "http://example.com/", nil)
+		r.Header.Set(tc.k, tc.v)
+		if got := notModified(r, hdr); got != tc.want {
+			t.Errorf("%s: %s: got %v", tc.k, tc.v, got)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package httpproxy
+
+import (
+	"cmp"
+	"container/list"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A CacheStoreRanger is a CacheStore that can list its entries,
+// allowing a Cache to account for responses stored before it started.
+type CacheStoreRanger interface {
+	// Range calls fn for each stored entry until fn returns false.
+	Range(fn func(key string, entry *CacheEntry) bool) error
+}
+
+// CacheObjectStats describes a stored response.
+type CacheObjectStats struct {
+	URL      string    `json:"url"`
+	Size     int64     `json:"size"`
+	Hits     uint64    `json:"hits"`
+	Accessed time.Time `json:"accessed"`
+	Pinned   bool      `json:"pinned,omitempty"`
+}
+
+// CacheStats describes the usage of a Cache.
+type CacheStats struct {
+	Hits          uint64             `json:"hits"`          // requests answered from the cache, including after revalidation
+	Misses        uint64             `json:"misses"`        // requests answered with a response from the origin
+	Revalidations uint64             `json:"revalidations"` // stored responses revalidated with 304 Not Modified
+	Evictions     uint64             `json:"evictions"`     // responses evicted to stay within MaxSize
+	Collapsed     uint64             `json:"collapsed"`     // requests answered by sharing the response to an identical request in flight
+	HitRatio      float64            `json:"hit_ratio"`     // Hits divided by Hits plus Misses
+	Objects       int                `json:"objects"`       // number of stored responses
+	Size          int64              `json:"size"`          // total body size of stored responses in bytes
+	MaxSize       int64              `json:"max_size"`      // MaxSize of the Cache
+	Top           []CacheObjectStats `json:"top"`           // most requested stored responses
+}
+
+// cacheObject is a stored response in the Cache's LRU list.
+type cacheObject struct {
+	key string // store key
+	CacheObjectStats
+}
+
+// isVariantOf returns true if storeKey is key or one of its variants.
+func isVariantOf(storeKey, key string) bool {
+	return storeKey == key || strings.HasPrefix(storeKey, key+"\x00")
+}
+
+func (c *Cache) pinned(rawURL string) bool {
+	for _, re := range c.Pin {
+		if re.MatchString(rawURL) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Cache) excluded(rawURL string) bool {
+	for _, re := range c.Exclude {
+		if re.MatchString(rawURL) {
+			return true
+		}
+	}
+	return false
+}
+
+// loadLocked fills the LRU list from the Store if it is a CacheStoreRanger.
+func (c *Cache) loadLocked() {
+	if c.objects == nil {
+		c.objects = make(map[string]*list.Element)
+		if ranger, ok := c.Store.(CacheStoreRanger); ok {
+			var objs []*cacheObject
+			c.logError(ranger.Range(func(key string, entry *CacheEntry) bool {
+				if entry.StatusCode != 0 {
+					objs = append(objs, &cacheObject{key: key, CacheObjectStats: CacheObjectStats{
+						URL:      entry.URL,
+						Size:     entry.Size,
+						Accessed: entry.ResponseTime,
+						Pinned:   c.pinned(entry.URL),
+					}})
+				}
+				return true
+			}))
+			slices.SortFunc(objs, func(a, b *cacheObject) int { return b.Accessed.Compare(a.Accessed) })
+			for _, obj := range objs {
+				c.objects[obj.key] = c.lru.PushBack(obj)
+				c.size += obj.Size
+			}
+		}
+	}
+}
+
+// stored records that entry has been stored under storeKey and evicts
+// the least recently used responses if the Cache exceeds MaxSize.
+func (c *Cache) stored(storeKey string, entry *CacheEntry) {
+	c.mu.Lock()
+	c.loadLocked()
+	if elem := c.objects[storeKey]; elem != nil {
+		obj := elem.Value.(*cacheObject)
+		c.size += entry.Size - obj.Size
+		obj.Size = entry.Size
+		obj.Accessed = time.Now()
+		c.lru.MoveToFront(elem)
+	} else {
+		c.objects[storeKey] = c.lru.PushFront(&cacheObject{key: storeKey, CacheObjectStats: CacheObjectStats{
+			URL:      entry.URL,
+			Size:     entry.Size,
+			Accessed: time.Now(),
+			Pinned:   c.pinned(entry.URL),
+		}})
+		c.size += entry.Size
+	}
+	var victims []string
+	if c.MaxSize > 0 {
+		for elem := c.lru.Back(); elem != nil && c.size > c.MaxSize; {
+			prev := elem.Prev()
+			if obj := elem.Value.(*cacheObject); !obj.Pinned && obj.key != storeKey {
+				victims = append(victims, obj.key)
+				c.removeLocked(elem)
+				c.evictions++
+			}
+			elem = prev
+		}
+	}
+	c.mu.Unlock()
+	for _, key := range victims {
+		c.logError(c.Store.Delete(key))
+	}
+}
+
+func (c *Cache) removeLocked(elem *list.Element) {
+	obj := c.lru.Remove(elem).(*cacheObject)
+	delete(c.objects, obj.key)
+	c.size -= obj.Size
+}
+
+// served counts a request answered from the response stored under storeKey if hit is true, or from the origin.
+func (c *Cache) served(storeKey string, hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !hit {
+		c.misses++
+		return
+	}
+	c.hits++
+	c.loadLocked()
+	if elem := c.objects[storeKey]; elem != nil {
+		obj := elem.Value.(*cacheObject)
+		obj.Hits++
+		obj.Accessed = time.Now()
+		c.lru.MoveToFront(elem)
+	}
+}
+
+func (c *Cache) revalidated() {
+	c.mu.Lock()
+	c.revalidations++
+	c.mu.Unlock()
+}
+
+// Purge removes all stored responses for rawURL, returning the number removed.
+func (c *Cache) Purge(rawURL string) (n int) {
+	c.mu.Lock()
+	c.loadLocked()
+	var keys []string
+	for key, elem := range c.objects {
+		if isVariantOf(key, rawURL) {
+			keys = append(keys, key)
+			c.removeLocked(elem)
+		}
+	}
+	c.mu.Unlock()
+	n = len(keys)
+	if !slices.Contains(keys, rawURL) {
+		// a Vary marker, or a response the Cache has not accounted for
+		if entry, body, err := c.Store.Get(rawURL); err == nil {
+			_ = body.Close()
+			if entry.StatusCode != 0 {
+				n++
+			}
+			keys = append(keys, rawURL)
+		}
+	}
+	for _, key := range keys {
+		c.logError(c.Store.Delete(key))
+	}
+	return
+}
+
+// Stats returns the Cache usage statistics with the top most requested responses.
+func (c *Cache) Stats(top int) (stats CacheStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.loadLocked()
+	stats = CacheStats{
+		Hits:          c.hits,
+		Misses:        c.misses,
+		Revalidations: c.revalidations,
+		Evictions:     c.evictions,
+		Collapsed:     c.collapsed,
+		Objects:       len(c.objects),
+		Size:          c.size,
+		MaxSize:       c.MaxSize,
+		Top:           []CacheObjectStats{},
+	}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRatio = float64(c.hits) / float64(total)
+	}
+	for elem := c.lru.Front(); elem != nil; elem = elem.Next() {
+		stats.Top = append(stats.Top, elem.Value.(*cacheObject).CacheObjectStats)
+	}
+	slices.SortStableFunc(stats.Top, func(a, b CacheObjectStats) int { return cmp.Compare(b.Hits, a.Hits) })
+	stats.Top = stats.Top[:min(top, len(stats.Top))]
+	return
+}
+
+// isCacheAdmin returns true if username may PURGE responses.
+func (c *Cache) isCacheAdmin(username string) bool {
+	return username != "" && slices.Contains(c.Admins, username)
+}
+
+// purge answers a PURGE request for r.URL from username.
+func (c *Cache) purge(w http.ResponseWriter, r *http.Request, username string) (code int) {
+	code = http.StatusForbidden
+	if c.isCacheAdmin(username) {
+		code = http.StatusNotFound
+		if c.Purge(cacheKey(r.URL)) > 0 {
+			code = http.StatusOK
+		}
+	}
+	w.WriteHeader(code)
+	return
+}
+
+// StatsHandler returns a http.Handler for cache administration.
+//
+// GET responds with the CacheStats as JSON, including the number of
+// top objects given by the "top" query parameter, by default 20.
+// DELETE purges the responses for the URL given by the "url" query parameter.
+//
+// The handler performs no authorization of its own.
+func (c *Cache) StatsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			top := 20
+			if s := r.URL.Query().Get("top"); s != "" {
+				var err error
+				if top, err = strconv.Atoi(s); err != nil || top < 0 {
+					http.Error(w, "invalid top", http.StatusBadRequest)
+					return
+				}
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(c.Stats(top))
+		case http.MethodDelete:
+			rawURL := r.URL.Query().Get("url")
+			if rawURL == "" {
+				http.Error(w, "missing url", http.StatusBadRequest)
+				return
+			}
+			if c.Purge(rawURL) == 0 {
+				http.NotFound(w, r)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,171 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func putTestEntry(c *Cache, rawURL, body string) {
+	now := time.Now()
+	entry := &CacheEntry{URL: rawURL, StatusCode: http.StatusOK, Header: http.Header{}, RequestTime: now, ResponseTime: now}
+	c.put(rawURL, rawURL, entry, []byte(body))
+}
+
+func TestCacheMaxSize(t *testing.T) {
+	c := &Cache{
+		Store:   &MemoryCacheStore{},
+		MaxSize: 12,
+		Pin:     []*regexp.Regexp{regexp.MustCompile(`/pinned$`)},
+	}
+	putTestEntry(c, "http://x/pinned", "1234")
+	putTestEntry(c, "http://x/a", "1234")
+	putTestEntry(c, "http://x/b", "1234")
+	c.served("http://x/a", true)
+	putTestEntry(c, "http://x/c", "1234")
+	if _, _, err := c.Store.Get("http://x/b"); err != ErrCacheMiss {
+		t.Error(err)
+	}
+	for _, key := range []string{"http://x/pinned", "http://x/a", "http://x/c"} {
+		if _, body, err := c.Store.Get(key); err != nil {
+			t.Error(key, err)
+		} else {
+			body.Close()
+		}
+	}
+	stats := c.Stats(10)
+	if stats.Objects != 3 || stats.Size != 12 || stats.Evictions != 1 || stats.Hits != 1 {
+		t.Errorf("%+v", stats)
+	}
+	if len(stats.Top) != 3 || stats.Top[0].URL != "http://x/a" || !stats.Top[2].Pinned {
+		t.Errorf("%+v", stats.Top)
+	}
+}
+
+func newCacheTestOrigin(t *testing.T) (o *testOrigin, originURL string) {
+	t.Helper()
+	o = &testOrigin{handler: func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "hello")
+	}}
+	origin := httptest.NewServer(o)
+	t.Cleanup(origin.Close)
+	return o, origin.URL + "/file"
+}
+
+func TestCacheExclude(t *testing.T) {
+	o, originURL := newCacheTestOrigin(t)
+	c := &Cache{Store: &MemoryCacheStore{}, Exclude: []*regexp.Regexp{regexp.MustCompile(`/file$`)}}
+	proxysrv := httptest.NewServer(&Server{Cache: c})
+	defer proxysrv.Close()
+	client := makeClient(t, proxysrv.URL)
+	for range 2 {
+		resp, err := client.Get(originURL)
+		maybeFatal(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.Header.Get("Cache-Status") != "" {
+			t.Error(resp.Header)
+		}
+	}
+	if n := o.hits.Load(); n != 2 {
+		t.Error(n)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	o, originURL := newCacheTestOrigin(t)
+	c := &Cache{Store: &MemoryCacheStore{}, Admins: []string{"admin"}}
+	proxysrv := httptest.NewServer(&Server{
+		CredentialsValidator: StaticCredentials{"admin": "secret", "user": "secret"},
+		Cache:                c,
+	})
+	defer proxysrv.Close()
+	client := makeClient(t, proxysrv.URL)
+	do := func(method, username string) int {
+		t.Helper()
+		req, _ := http.NewRequest(method, originURL, nil)
+		SetBasicAuth(req.Header, username, "secret")
+		resp, err := client.Do(req)
+		maybeFatal(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	do(http.MethodGet, "user")
+	if code := do("PURGE", "user"); code != http.StatusForbidden {
+		t.Error(code)
+	}
+	if code := do("PURGE", "admin"); code != http.StatusOK {
+		t.Error(code)
+	}
+	if code := do("PURGE", "admin"); code != http.StatusNotFound {
+		t.Error(code)
+	}
+	do(http.MethodGet, "user")
+	if n := o.hits.Load(); n != 2 {
+		t.Error(n)
+	}
+	if stats := c.Stats(0); stats.Objects != 1 || stats.Misses != 2 || stats.Hits != 0 {
+		t.Errorf("%+v", stats)
+	}
+}
+
+func TestCacheStatsHandler(t *testing.T) {
+	c := &Cache{Store: &MemoryCacheStore{}}
+	putTestEntry(c, "http://x/a", "12")
+	putTestEntry(c, "http://x/b", "1234")
+	c.served("http://x/b", true)
+	c.served("", false)
+	h := c.StatsHandler()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/?top=1", nil))
+	var stats CacheStats
+	maybeFatal(t, json.Unmarshal(rec.Body.Bytes(), &stats))
+	if stats.Objects != 2 || stats.Size != 6 || stats.HitRatio != 0.5 || len(stats.Top) != 1 || stats.Top[0].URL != "http://x/b" {
+		t.Errorf("%+v", stats)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/?url="+url.QueryEscape("http://x/a"), nil))
+	if rec.Code != http.StatusNoContent {
+		t.Error(rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/?url="+url.QueryEscape("http://x/a"), nil))
+	if rec.Code != http.StatusNotFound {
+		t.Error(rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") == "" {
+		t.Error(rec.Code, rec.Header())
+	}
+	if stats := c.Stats(0); stats.Objects != 1 || stats.Size != 4 {
+		t.Errorf("%+v", stats)
+	}
+}
+
+func TestCacheLoadsDiskStore(t *testing.T) {
+	store := &DiskCacheStore{Dir: t.TempDir()}
+	putTestEntry(&Cache{Store: store}, "http://x/a", "1234")
+	putTestEntry(&Cache{Store: store}, "http://x/b", "12")
+	c := &Cache{Store: store, MaxSize: 5}
+	if stats := c.Stats(10); stats.Objects != 2 || stats.Size != 6 {
+		t.Errorf("%+v", stats)
+	}
+	putTestEntry(c, "http://x/c", "1")
+	if stats := c.Stats(10); stats.Objects != 2 || stats.Size != 3 || stats.Evictions != 1 {
+		t.Errorf("%+v", stats)
+	}
+	if c.Purge("http://x/c") != 1 {
+		t.Error("purge failed")
+	}
+}
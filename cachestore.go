@@ -0,0 +1,239 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var ErrCacheMiss = errors.New("cache miss")
+
+// CacheEntry describes a stored response.
+type CacheEntry struct {
+	URL          string      `json:"url"`              // request URL
+	StatusCode   int         `json:"status_code"`      // zero for a Vary marker entry
+	Header       http.Header `json:"header,omitempty"` // response header as received
+	Vary         []string    `json:"vary,omitempty"`   // canonical request header names the response varies on
+	RequestTime  time.Time   `json:"request_time"`     // when the request that produced the response was sent
+	ResponseTime time.Time   `json:"response_time"`    // when the response was received
+	Size         int64       `json:"size"`             // size of the body in bytes
+}
+
+func (e *CacheEntry) clone() *CacheEntry {
+	c := *e
+	c.Header = e.Header.Clone()
+	c.Vary = append([]string(nil), e.Vary...)
+	return &c
+}
+
+// A CacheStore stores responses for a Cache. Implementations must be safe for concurrent use.
+type CacheStore interface {
+	// Get returns the entry stored under key and its body, or ErrCacheMiss.
+	// The caller must close the body.
+	Get(key string) (entry *CacheEntry, body io.ReadCloser, err error)
+	// Put stores entry and body under key, replacing any existing entry.
+	Put(key string, entry *CacheEntry, body []byte) error
+	// Update replaces the entry stored under key, keeping its body.
+	Update(key string, entry *CacheEntry) error
+	// Delete removes the entry stored under key, if any.
+	Delete(key string) error
+}
+
+type memoryCacheItem struct {
+	entry *CacheEntry
+	body  []byte
+}
+
+// MemoryCacheStore is a CacheStore keeping responses in memory.
+type MemoryCacheStore struct {
+	mu    sync.Mutex
+	items map[string]memoryCacheItem
+}
+
+var _ CacheStore = (*MemoryCacheStore)(nil)
+var _ CacheStoreRanger = (*MemoryCacheStore)(nil)
+
+func (ms *MemoryCacheStore) Get(key string) (entry *CacheEntry, body io.ReadCloser, err error) {
+	ms.mu.Lock()
+	item, ok := ms.items[key]
+	ms.mu.Unlock()
+	err = ErrCacheMiss
+	if ok {
+		err = nil
+		entry = item.entry.clone()
+		body = io.NopCloser(bytes.NewReader(item.body))
+	}
+	return
+}
+
+func (ms *MemoryCacheStore) Put(key string, entry *CacheEntry, body []byte) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.items == nil {
+		ms.items = make(map[string]memoryCacheItem)
+	}
+	ms.items[key] = memoryCacheItem{entry: entry.clone(), body: bytes.Clone(body)}
+	return nil
+}
+
+func (ms *MemoryCacheStore) Update(key string, entry *CacheEntry) (err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	err = ErrCacheMiss
+	if item, ok := ms.items[key]; ok {
+		err = nil
+		item.entry = entry.clone()
+		ms.items[key] = item
+	}
+	return
+}
+
+func (ms *MemoryCacheStore) Delete(key string) error {
+	ms.mu.Lock()
+	delete(ms.items, key)
+	ms.mu.Unlock()
+	return nil
+}
+
+func (ms *MemoryCacheStore) Range(fn func(key string, entry *CacheEntry) bool) error {
+	ms.mu.Lock()
+	entries := make(map[string]*CacheEntry, len(ms.items))
+	for key, item := range ms.items {
+		entries[key] = item.entry.clone()
+	}
+	ms.mu.Unlock()
+	for key, entry := range entries {
+		if !fn(key, entry) {
+			break
+		}
+	}
+	return nil
+}
+
+// DiskCacheStore is a CacheStore keeping each response in a file in Dir.
+// Files hold the key and JSON encoded CacheEntry on the first line followed by the body.
+type DiskCacheStore struct {
+	Dir string // directory to store files in, created if needed
+}
+
+var _ CacheStore = (*DiskCacheStore)(nil)
+var _ CacheStoreRanger = (*DiskCacheStore)(nil)
+
+// diskCacheHeader is the first line of a DiskCacheStore file.
+type diskCacheHeader struct {
+	Key string `json:"key"`
+	*CacheEntry
+}
+
+func (ds *DiskCacheStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(ds.Dir, name[:2], name)
+}
+
+type diskCacheBody struct {
+	io.Reader
+	io.Closer
+}
+
+// open returns the header of the file fn and a reader positioned at the body.
+func (ds *DiskCacheStore) open(fn string) (hdr diskCacheHeader, body io.ReadCloser, err error) {
+	var f *os.File
+	if f, err = os.Open(fn); err == nil {
+		br := bufio.NewReader(f)
+		var line []byte
+		if line, err = br.ReadBytes('\n'); err == nil {
+			hdr.CacheEntry = &CacheEntry{}
+			if err = json.Unmarshal(line, &hdr); err == nil {
+				return hdr, diskCacheBody{Reader: br, Closer: f}, nil
+			}
+		}
+		_ = f.Close()
+		hdr = diskCacheHeader{}
+	}
+	return
+}
+
+func (ds *DiskCacheStore) Get(key string) (entry *CacheEntry, body io.ReadCloser, err error) {
+	var hdr diskCacheHeader
+	if hdr, body, err = ds.open(ds.path(key)); err == nil {
+		entry = hdr.CacheEntry
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		err = ErrCacheMiss
+	}
+	return
+}
+
+// write atomically replaces the file for key with entry followed by body.
+func (ds *DiskCacheStore) write(key string, entry *CacheEntry, body io.Reader) (err error) {
+	fn := ds.path(key)
+	if err = os.MkdirAll(filepath.Dir(fn), 0o755); err == nil {
+		var f *os.File
+		if f, err = os.CreateTemp(filepath.Dir(fn), ".tmp-*"); err == nil {
+			defer os.Remove(f.Name())
+			var line []byte
+			if line, err = json.Marshal(diskCacheHeader{Key: key, CacheEntry: entry}); err == nil {
+				bw := bufio.NewWriter(f)
+				_, _ = bw.Write(append(line, '\n'))
+				if _, err = io.Copy(bw, body); err == nil {
+					err = bw.Flush()
+				}
+			}
+			err = errors.Join(err, f.Close())
+			if err == nil {
+				err = os.Rename(f.Name(), fn)
+			}
+		}
+	}
+	return
+}
+
+func (ds *DiskCacheStore) Put(key string, entry *CacheEntry, body []byte) error {
+	return ds.write(key, entry, bytes.NewReader(body))
+}
+
+func (ds *DiskCacheStore) Update(key string, entry *CacheEntry) (err error) {
+	var body io.ReadCloser
+	if _, body, err = ds.Get(key); err == nil {
+		err = errors.Join(ds.write(key, entry, body), body.Close())
+	}
+	return
+}
+
+func (ds *DiskCacheStore) Delete(key string) (err error) {
+	if err = os.Remove(ds.path(key)); errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return
+}
+
+// Range calls fn for each entry in Dir. Files that can not be read are skipped.
+func (ds *DiskCacheStore) Range(fn func(key string, entry *CacheEntry) bool) (err error) {
+	err = filepath.WalkDir(ds.Dir, func(name string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() && !strings.HasPrefix(d.Name(), ".tmp-") {
+			if hdr, body, err := ds.open(name); err == nil {
+				_ = body.Close()
+				if !fn(hdr.Key, hdr.CacheEntry) {
+					return filepath.SkipAll
+				}
+			}
+		}
+		return err
+	})
+	if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,63 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func testCacheStore(t *testing.T, store CacheStore) {
+	t.Helper()
+	if _, _, err := store.Get("k"); !errors.Is(err, ErrCacheMiss) {
+		t.Error(err)
+	}
+	entry := &CacheEntry{URL: "http://example.com/", StatusCode: http.StatusOK, Header: http.Header{"Etag": {`"a"`}}, Size: 5, ResponseTime: time.Now()}
+	maybeFatal(t, store.Put("k", entry, []byte("hello")))
+	entry.Header.Set("Etag", "changed")
+
+	got, body, err := store.Get("k")
+	maybeFatal(t, err)
+	b, _ := io.ReadAll(body)
+	maybeFatal(t, body.Close())
+	if string(b) != "hello" || got.Header.Get("Etag") != `"a"` || got.StatusCode != http.StatusOK || got.Size != 5 {
+		t.Errorf("%q %#v", b, got)
+	}
+
+	got.Header.Set("Etag", `"b"`)
+	maybeFatal(t, store.Update("k", got))
+	got, body, err = store.Get("k")
+	maybeFatal(t, err)
+	b, _ = io.ReadAll(body)
+	maybeFatal(t, body.Close())
+	if string(b) != "hello" || got.Header.Get("Etag") != `"b"` {
+		t.Errorf("%q %#v", b, got)
+	}
+
+	var keys []string
+	maybeFatal(t, store.(CacheStoreRanger).Range(func(key string, entry *CacheEntry) bool {
+		keys = append(keys, key+" "+entry.URL)
+		return true
+	}))
+	if len(keys) != 1 || keys[0] != "k http://example.com/" {
+		t.Error(keys)
+	}
+
+	maybeFatal(t, store.Delete("k"))
+	maybeFatal(t, store.Delete("k"))
+	if _, _, err = store.Get("k"); !errors.Is(err, ErrCacheMiss) {
+		t.Error(err)
+	}
+	if err = store.Update("k", got); !errors.Is(err, ErrCacheMiss) {
+		t.Error(err)
+	}
+}
+
+func TestMemoryCacheStore(t *testing.T) {
+	testCacheStore(t, &MemoryCacheStore{})
+}
+
+func TestDiskCacheStore(t *testing.T) {
+	testCacheStore(t, &DiskCacheStore{Dir: t.TempDir()})
+}
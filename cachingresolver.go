@@ -0,0 +1,214 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultDNSCacheTTL is the default time a CachingResolver caches addresses from a Resolver that doesn't report TTLs.
+var DefaultDNSCacheTTL = time.Minute
+
+// DefaultDNSNegativeTTL is the default longest time a CachingResolver caches that a name doesn't exist.
+var DefaultDNSNegativeTTL = 30 * time.Second
+
+// DefaultDNSCacheSize is the default maximum number of names a CachingResolver caches.
+var DefaultDNSCacheSize = 10000
+
+// CachingResolver is a Resolver caching lookups in memory for the TTL reported by
+// a TTLResolver, or for TTL otherwise. Names that don't exist are cached for at most NegativeTTL.
+// Concurrent lookups of the same name share one query.
+//
+// Names in Hosts resolve to the given addresses without querying. Names in Domains, or
+// subdomains of them, are resolved by that Resolver instead of Resolver, allowing split-horizon DNS.
+// Keys in Hosts and Domains must be lower case without a trailing dot.
+//
+// To make the built-in dialers use it, set DefaultResolver to a CachingResolver
+// and DefaultContextDialer to a ResolvingDialer.
+type CachingResolver struct {
+	Resolver    Resolver                // optional resolver to use, otherwise uses net.DefaultResolver
+	Hosts       map[string][]netip.Addr // optional static addresses for host names
+	Domains     map[string]Resolver     // optional resolvers for domains and their subdomains
+	TTL         time.Duration           // optional time to cache results lacking a TTL, defaults to DefaultDNSCacheTTL
+	MinTTL      time.Duration           // optional lower bound on the time to cache addresses
+	MaxTTL      time.Duration           // optional upper bound on the time to cache addresses
+	NegativeTTL time.Duration           // optional longest time to cache names that don't exist, defaults to DefaultDNSNegativeTTL, negative disables
+	MaxEntries  int                     // optional maximum number of cached lookups, defaults to DefaultDNSCacheSize
+	mu          sync.Mutex              // protects following
+	entries     map[string]*dnsCacheEntry
+}
+
+var _ Resolver = (*CachingResolver)(nil)
+
+type dnsCacheEntry struct {
+	ready     chan struct{} // closed when the following are set
+	addrs     []netip.Addr
+	err       error
+	expires   time.Time
+	abandoned bool // the client looking it up went away before it completed
+}
+
+// resolverFor returns the Resolver to use for name.
+func (cr *CachingResolver) resolverFor(name string) Resolver {
+	for suffix := name; len(cr.Domains) > 0; {
+		if r, ok := cr.Domains[suffix]; ok {
+			return r
+		}
+		i := strings.IndexByte(suffix, '.')
+		if i < 0 {
+			break
+		}
+		suffix = suffix[i+1:]
+	}
+	if cr.Resolver != nil {
+		return cr.Resolver
+	}
+	return net.DefaultResolver
+}
+
+// cacheTime returns how long the result of a lookup by r may be cached.
+func (cr *CachingResolver) cacheTime(r Resolver, ttl time.Duration, err error) time.Duration {
+	if _, ok := r.(TTLResolver); !ok {
+		ttl = cr.TTL
+		if ttl <= 0 {
+			ttl = DefaultDNSCacheTTL
+		}
+	}
+	if err == nil {
+		ttl = max(ttl, cr.MinTTL)
+		if cr.MaxTTL > 0 {
+			ttl = min(ttl, cr.MaxTTL)
+		}
+		return ttl
+	}
+	if dnsErr := (*net.DNSError)(nil); errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		negttl := cr.NegativeTTL
+		if negttl == 0 {
+			negttl = DefaultDNSNegativeTTL
+		}
+		if ttl > 0 {
+			negttl = min(negttl, ttl)
+		}
+		return max(negttl, 0)
+	}
+	return 0
+}
+
+func filterAddrs(addrs []netip.Addr, network string) (filtered []netip.Addr) {
+	for _, addr := range addrs {
+		if network == "ip" || (network == "ip4") == addr.Unmap().Is4() {
+			filtered = append(filtered, addr)
+		}
+	}
+	return
+}
+
+// prune removes expired entries, and others as needed to make room for a new one.
+// The caller must hold cr.mu.
+func (cr *CachingResolver) prune(now time.Time) {
+	maxEntries := cr.MaxEntries
+	if maxEntries <= 0 {
+		maxEntries = DefaultDNSCacheSize
+	}
+	if len(cr.entries) >= maxEntries {
+		for _, expiredOnly := range []bool{true, false} {
+			for key, e := range cr.entries {
+				select {
+				case <-e.ready:
+					if !expiredOnly || !now.Before(e.expires) {
+						delete(cr.entries, key)
+					}
+				default:
+				}
+				if !expiredOnly && len(cr.entries) < maxEntries {
+					return
+				}
+			}
+		}
+	}
+}
+
+// LookupNetIP implements Resolver.
+func (cr *CachingResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	return cr.lookup(ctx, network, host, time.Now)
+}
+
+func (cr *CachingResolver) lookup(ctx context.Context, network, host string, now func() time.Time) (addrs []netip.Addr, err error) {
+	if addr, perr := netip.ParseAddr(host); perr == nil {
+		return []netip.Addr{addr}, nil
+	}
+	network = lookupNetwork(network)
+	name := normalizeHost(host)
+	if hostAddrs, ok := cr.Hosts[name]; ok {
+		if addrs = filterAddrs(hostAddrs, network); len(addrs) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+		}
+		return
+	}
+	key := network + " " + name
+	for {
+		cr.mu.Lock()
+		e := cr.entries[key]
+		if e != nil {
+			select {
+			case <-e.ready:
+				if now().Before(e.expires) {
+					cr.mu.Unlock()
+					return slices.Clone(e.addrs), e.err
+				}
+				delete(cr.entries, key)
+				e = nil
+			default:
+			}
+		}
+		if e != nil {
+			cr.mu.Unlock()
+			select {
+			case <-e.ready:
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+			if e.abandoned {
+				continue
+			}
+			return slices.Clone(e.addrs), e.err
+		}
+		cr.prune(now())
+		e = &dnsCacheEntry{ready: make(chan struct{})}
+		if cr.entries == nil {
+			cr.entries = make(map[string]*dnsCacheEntry)
+		}
+		cr.entries[key] = e
+		cr.mu.Unlock()
+
+		r := cr.resolverFor(name)
+		var ttl time.Duration
+		if ttlr, ok := r.(TTLResolver); ok {
+			e.addrs, ttl, e.err = ttlr.LookupNetIPTTL(ctx, network, name)
+		} else {
+			e.addrs, e.err = r.LookupNetIP(ctx, network, name)
+		}
+		e.expires = now().Add(cr.cacheTime(r, ttl, e.err))
+		e.abandoned = e.err != nil && ctx.Err() != nil
+		close(e.ready)
+		return slices.Clone(e.addrs), e.err
+	}
+}
+
+// Flush removes all cached lookups.
+func (cr *CachingResolver) Flush() {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	for key, e := range cr.entries {
+		select {
+		case <-e.ready:
+			delete(cr.entries, key)
+		default:
+		}
+	}
+}
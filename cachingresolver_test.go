@@ -0,0 +1,230 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeResolver resolves names in addrs, counting lookups and blocking them while block is non-nil.
+type fakeResolver struct {
+	addrs map[string][]netip.Addr
+	err   error // returned for names not in addrs, otherwise a not found error
+	calls atomic.Int32
+	block chan struct{}
+}
+
+func (fr *fakeResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	fr.calls.Add(1)
+	if fr.block != nil {
+		<-fr.block
+	}
+	if addrs, ok := fr.addrs[host]; ok {
+		return filterAddrs(addrs, network), nil
+	}
+	if fr.err != nil {
+		return nil, fr.err
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+type fakeTTLResolver struct {
+	*fakeResolver
+	ttl time.Duration
+}
+
+func (fr fakeTTLResolver) LookupNetIPTTL(ctx context.Context, network, host string) ([]netip.Addr, time.Duration, error) {
+	addrs, err := fr.LookupNetIP(ctx, network, host)
+	return addrs, fr.ttl, err
+}
+
+type fakeClock struct{ t time.Time }
+
+func (fc *fakeClock) now() time.Time { return fc.t }
+
+func TestCachingResolver(t *testing.T) {
+	ctx := context.Background()
+	fr := &fakeResolver{addrs: map[string][]netip.Addr{
+		"www.example.com": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("2001:db8::1")},
+	}}
+	cr := &CachingResolver{Resolver: fr}
+	clock := &fakeClock{t: time.Now()}
+	lookup := func(network, host string, wantCalls int32) ([]netip.Addr, error) {
+		t.Helper()
+		addrs, err := cr.lookup(ctx, network, host, clock.now)
+		if calls := fr.calls.Load(); calls != wantCalls {
+			t.Errorf("%s %s: %d calls, want %d", network, host, calls, wantCalls)
+		}
+		return addrs, err
+	}
+
+	addrs, err := lookup("ip", "www.example.com", 1)
+	if err != nil || len(addrs) != 2 {
+		t.Error(addrs, err)
+	}
+	addrs[0] = netip.Addr{}
+	if addrs, _ = lookup("tcp", "www.example.com", 1); len(addrs) != 2 || !addrs[0].IsValid() {
+		t.Error(addrs)
+	}
+	if addrs, _ = lookup("ip6", "www.example.com", 2); len(addrs) != 1 || !addrs[0].Is6() {
+		t.Error(addrs)
+	}
+	clock.t = clock.t.Add(DefaultDNSCacheTTL)
+	_, _ = lookup("ip", "www.example.com", 3)
+
+	if _, err = lookup("ip", "missing.example.com", 4); !isNotFound(err) {
+		t.Error(err)
+	}
+	_, _ = lookup("ip", "missing.example.com", 4)
+	clock.t = clock.t.Add(DefaultDNSNegativeTTL)
+	_, _ = lookup("ip", "missing.example.com", 5)
+
+	fr.err = errors.New("server down")
+	_, _ = lookup("ip", "down.example.com", 6)
+	if _, err = lookup("ip", "down.example.com", 7); err != fr.err {
+		t.Error(err)
+	}
+
+	if addrs, err = lookup("ip", "192.0.2.9", 7); err != nil || len(addrs) != 1 {
+		t.Error(addrs, err)
+	}
+
+	_, _ = lookup("ip", "www.example.com", 7)
+	cr.Flush()
+	_, _ = lookup("ip", "www.example.com", 8)
+}
+
+func TestCachingResolverTTL(t *testing.T) {
+	ctx := context.Background()
+	fr := fakeTTLResolver{fakeResolver: &fakeResolver{addrs: map[string][]netip.Addr{
+		"www.example.com": {netip.MustParseAddr("192.0.2.1")},
+	}}, ttl: 5 * time.Second}
+	tests := []struct {
+		cr   *CachingResolver
+		host string
+		want time.Duration
+	}{
+		{&CachingResolver{}, "www.example.com", 5 * time.Second},
+		{&CachingResolver{MinTTL: 10 * time.Second}, "www.example.com", 10 * time.Second},
+		{&CachingResolver{MaxTTL: 2 * time.Second}, "www.example.com", 2 * time.Second},
+		{&CachingResolver{}, "missing.example.com", 5 * time.Second},
+		{&CachingResolver{NegativeTTL: time.Second}, "missing.example.com", time.Second},
+		{&CachingResolver{NegativeTTL: -1}, "missing.example.com", 0},
+	}
+	for _, tt := range tests {
+		tt.cr.Resolver = fr
+		start := time.Now()
+		clock := &fakeClock{t: start}
+		calls := fr.calls.Load()
+		_, _ = tt.cr.lookup(ctx, "ip", tt.host, clock.now)
+		if tt.want > 0 {
+			clock.t = start.Add(tt.want - time.Millisecond)
+			_, _ = tt.cr.lookup(ctx, "ip", tt.host, clock.now)
+			if fr.calls.Load() != calls+1 {
+				t.Errorf("%s: not cached for %v", tt.host, tt.want)
+			}
+		}
+		clock.t = start.Add(tt.want)
+		_, _ = tt.cr.lookup(ctx, "ip", tt.host, clock.now)
+		if fr.calls.Load() != calls+2 {
+			t.Errorf("%s: cached longer than %v", tt.host, tt.want)
+		}
+	}
+}
+
+func TestCachingResolverHosts(t *testing.T) {
+	ctx := context.Background()
+	fr := &fakeResolver{addrs: map[string][]netip.Addr{
+		"www.example.com":       {netip.MustParseAddr("192.0.2.1")},
+		"www.corp.example.com":  {netip.MustParseAddr("203.0.113.1")},
+		"xcorp.example.com":     {netip.MustParseAddr("203.0.113.2")},
+		"corp.example.com":      {netip.MustParseAddr("203.0.113.3")},
+		"intranet.example.com":  {netip.MustParseAddr("203.0.113.4")},
+		"fileserver.corp.local": {netip.MustParseAddr("203.0.113.5")},
+	}}
+	internal := &fakeResolver{addrs: map[string][]netip.Addr{
+		"www.corp.example.com": {netip.MustParseAddr("10.0.0.1")},
+		"corp.example.com":     {netip.MustParseAddr("10.0.0.2")},
+	}}
+	cr := &CachingResolver{
+		Resolver: fr,
+		Hosts: map[string][]netip.Addr{
+			"intranet.example.com": {netip.MustParseAddr("10.1.1.1")},
+		},
+		Domains: map[string]Resolver{"corp.example.com": internal},
+	}
+	tests := []struct {
+		network, host, want string
+	}{
+		{"ip", "www.example.com", "192.0.2.1"},
+		{"ip", "www.corp.example.com", "10.0.0.1"},
+		{"ip", "Corp.Example.com.", "10.0.0.2"},
+		{"ip", "xcorp.example.com", "203.0.113.2"},
+		{"ip", "intranet.example.com", "10.1.1.1"},
+		{"ip4", "INTRANET.example.com", "10.1.1.1"},
+		{"ip6", "intranet.example.com", ""},
+	}
+	for _, tt := range tests {
+		addrs, err := cr.LookupNetIP(ctx, tt.network, tt.host)
+		got := ""
+		if len(addrs) > 0 {
+			got = addrs[0].String()
+		}
+		if got != tt.want || (tt.want == "") != isNotFound(err) {
+			t.Errorf("%s %s: got %q %v, want %q", tt.network, tt.host, got, err, tt.want)
+		}
+	}
+	if n := internal.calls.Load(); n != 2 {
+		t.Error(n)
+	}
+}
+
+func TestCachingResolverCoalesce(t *testing.T) {
+	fr := &fakeResolver{
+		addrs: map[string][]netip.Addr{"www.example.com": {netip.MustParseAddr("192.0.2.1")}},
+		block: make(chan struct{}),
+	}
+	cr := &CachingResolver{Resolver: fr}
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if addrs, err := cr.LookupNetIP(context.Background(), "ip", "www.example.com"); err != nil || len(addrs) != 1 {
+				t.Error(addrs, err)
+			}
+		}()
+	}
+	for fr.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := cr.LookupNetIP(ctx, "ip", "www.example.com"); !errors.Is(err, context.Canceled) {
+		t.Error(err)
+	}
+	close(fr.block)
+	wg.Wait()
+	if n := fr.calls.Load(); n != 1 {
+		t.Error(n)
+	}
+}
+
+func TestCachingResolverMaxEntries(t *testing.T) {
+	fr := &fakeResolver{}
+	cr := &CachingResolver{Resolver: fr, MaxEntries: 3}
+	for _, host := range []string{"a", "b", "c", "d", "e"} {
+		_, _ = cr.LookupNetIP(context.Background(), "ip", host)
+	}
+	cr.mu.Lock()
+	n := len(cr.entries)
+	cr.mu.Unlock()
+	if n != 3 {
+		t.Error(n)
+	}
+}
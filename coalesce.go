@@ -0,0 +1,306 @@
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// coalesceWindow limits how far a coalesced fetch too large to store may read ahead of its slowest client.
+const coalesceWindow = 1 << 20
+
+// coalescedFetch is an upstream fetch for a cache miss shared by all clients requesting the same
+// URL and variant while it is in flight. The upstream request is detached from the clients,
+// so it continues as long as any of them remain and is canceled when the last one leaves.
+type coalescedFetch struct {
+	c        *Cache
+	inflight string // key in Cache.inflight
+	key      string // cache key of the request
+	reqCC    cacheControl
+	cancel   context.CancelFunc
+	ready    chan struct{} // closed when the following are set
+	resp     *http.Response
+	err      error
+	storeKey string      // where the response is stored
+	entry    *CacheEntry // nil if the response may not be shared
+	mu       sync.Mutex  // protects following
+	cond     sync.Cond
+	refs     int // clients waiting for or reading the response
+	bodies   map[*coalescedBody]struct{}
+	buf      []byte // body read so far, starting at offset base
+	base     int64
+	bodyErr  error // io.EOF when the body has been read completely
+	tooLarge bool  // body exceeds MaxObjectSize, buf only holds what some client has yet to read
+}
+
+// join returns the fetch in flight for inflight, starting a new one for r if there is none.
+// The caller must release the returned fetch unless it closes a body returned by it.
+func (c *Cache) join(rt http.RoundTripper, r *http.Request, key, inflight string, reqCC cacheControl) (cf *coalescedFetch, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cf = c.inflight[inflight]; cf != nil {
+		cf.mu.Lock()
+		if cf.refs > 0 && !cf.tooLarge {
+			cf.refs++
+			cf.mu.Unlock()
+			return
+		}
+		cf.mu.Unlock()
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	cf = &coalescedFetch{
+		c:        c,
+		inflight: inflight,
+		key:      key,
+		reqCC:    reqCC,
+		cancel:   cancel,
+		ready:    make(chan struct{}),
+		refs:     1,
+		bodies:   make(map[*coalescedBody]struct{}),
+	}
+	cf.cond.L = &cf.mu
+	if c.inflight == nil {
+		c.inflight = make(map[string]*coalescedFetch)
+	}
+	c.inflight[inflight] = cf
+	go cf.run(rt, r.WithContext(ctx))
+	return cf, true
+}
+
+// forget removes cf from the fetches new clients may join.
+func (cf *coalescedFetch) forget() {
+	cf.c.mu.Lock()
+	if cf.c.inflight[cf.inflight] == cf {
+		delete(cf.c.inflight, cf.inflight)
+	}
+	cf.c.mu.Unlock()
+}
+
+// release is called when a client no longer waits for or reads the response.
+func (cf *coalescedFetch) release() {
+	cf.mu.Lock()
+	cf.refs--
+	last := cf.refs == 0
+	cf.cond.Broadcast()
+	cf.mu.Unlock()
+	if last {
+		cf.forget()
+		cf.cancel()
+	}
+}
+
+func (cf *coalescedFetch) run(rt http.RoundTripper, r *http.Request) {
+	reqTime := time.Now()
+	cf.resp, cf.err = rt.RoundTrip(r)
+	if cf.err == nil {
+		cf.storeKey, cf.entry = cf.c.storableEntry(r, cf.key, cf.resp, cf.reqCC, reqTime, time.Now())
+	}
+	if cf.entry == nil {
+		cf.forget()
+		close(cf.ready)
+		return
+	}
+	body := cf.resp.Body
+	cf.resp.Body = nil
+	close(cf.ready)
+	cf.fill(body)
+}
+
+// fill reads the shared response body, storing it once read completely.
+func (cf *coalescedFetch) fill(body io.ReadCloser) {
+	defer func() {
+		_ = body.Close()
+		cf.forget()
+		cf.cancel()
+	}()
+	maxSize := cf.c.maxObjectSize()
+	p := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(p)
+		cf.mu.Lock()
+		cf.buf = append(cf.buf, p[:n]...)
+		forget := !cf.tooLarge && cf.base+int64(len(cf.buf)) > maxSize
+		if forget {
+			cf.tooLarge = true
+		}
+		if err != nil {
+			cf.bodyErr = err
+		}
+		cf.cond.Broadcast()
+		for cf.tooLarge && cf.bodyErr == nil && cf.refs > 0 && cf.trimLocked() > coalesceWindow {
+			cf.cond.Wait()
+		}
+		stop := cf.bodyErr != nil || cf.refs == 0
+		store := cf.bodyErr == io.EOF && !cf.tooLarge && (cf.resp.ContentLength < 0 || cf.resp.ContentLength == int64(len(cf.buf)))
+		cf.mu.Unlock()
+		if forget {
+			cf.forget()
+		}
+		if store {
+			// buf is no longer appended to, so it may be stored without copying
+			cf.c.put(cf.key, cf.storeKey, cf.entry, cf.buf)
+		}
+		if stop {
+			return
+		}
+	}
+}
+
+// trimLocked discards the part of buf all clients have read, returning the remaining length.
+// Until the body is known to be too large to store and all clients have started reading,
+// nothing is discarded.
+func (cf *coalescedFetch) trimLocked() int {
+	if cf.tooLarge && len(cf.bodies) == cf.refs {
+		off := cf.base + int64(len(cf.buf))
+		for b := range cf.bodies {
+			off = min(off, b.off)
+		}
+		cf.buf = append([]byte(nil), cf.buf[off-cf.base:]...)
+		cf.base = off
+	}
+	return len(cf.buf)
+}
+
+// wait waits for the response headers and returns the response for r.
+// If r may not share the response, it returns a nil response and error.
+func (cf *coalescedFetch) wait(r *http.Request, leader bool) (resp *http.Response, err error) {
+	select {
+	case <-cf.ready:
+	case <-r.Context().Done():
+		if leader {
+			go func() {
+				// nobody else may read a response that is not shared
+				if <-cf.ready; cf.err == nil && cf.entry == nil {
+					_ = cf.resp.Body.Close()
+				}
+			}()
+		}
+		cf.release()
+		return nil, r.Context().Err()
+	}
+	if err = cf.err; err != nil {
+		cf.release()
+		return
+	}
+	if cf.entry == nil {
+		if leader {
+			resp = cf.response(r, &releasingBody{ReadCloser: cf.resp.Body, cf: cf})
+		} else {
+			cf.release()
+		}
+		return
+	}
+	if !leader && !cf.shareable(r) {
+		cf.release()
+		return
+	}
+	cf.mu.Lock()
+	b := &coalescedBody{cf: cf, off: cf.base}
+	cf.bodies[b] = struct{}{}
+	cf.mu.Unlock()
+	return cf.response(r, b), nil
+}
+
+// shareable returns true if the response to the fetch may be used for r as if it had been stored.
+func (cf *coalescedFetch) shareable(r *http.Request) bool {
+	if len(cf.entry.Vary) > 0 && variantKey(cf.key, cf.entry.Vary, r) != cf.storeKey {
+		return false
+	}
+	return storable(r, cf.resp, parseCacheControl(r.Header), parseCacheControl(cf.resp.Header))
+}
+
+func (cf *coalescedFetch) response(r *http.Request, body io.ReadCloser) *http.Response {
+	resp := *cf.resp
+	resp.Header = cf.resp.Header.Clone()
+	resp.Body = body
+	resp.Request = r
+	return &resp
+}
+
+// releasingBody is the body of a response that is not shared, given to the client that started the fetch.
+type releasingBody struct {
+	io.ReadCloser
+	cf   *coalescedFetch
+	once sync.Once
+}
+
+func (rb *releasingBody) Close() (err error) {
+	err = rb.ReadCloser.Close()
+	rb.once.Do(rb.cf.release)
+	return
+}
+
+// coalescedBody reads the shared response body of a coalescedFetch.
+type coalescedBody struct {
+	cf     *coalescedFetch
+	off    int64 // offset of the next byte to read
+	closed bool
+}
+
+func (b *coalescedBody) Read(p []byte) (n int, err error) {
+	cf := b.cf
+	cf.mu.Lock()
+	defer cf.mu.Unlock()
+	for !b.closed && cf.bodyErr == nil && b.off == cf.base+int64(len(cf.buf)) {
+		cf.cond.Wait()
+	}
+	switch {
+	case b.closed:
+		err = http.ErrBodyReadAfterClose
+	case b.off < cf.base+int64(len(cf.buf)):
+		n = copy(p, cf.buf[b.off-cf.base:])
+		b.off += int64(n)
+		if cf.tooLarge {
+			cf.cond.Broadcast()
+		}
+	default:
+		err = cf.bodyErr
+	}
+	return
+}
+
+func (b *coalescedBody) Close() error {
+	cf := b.cf
+	cf.mu.Lock()
+	closed := b.closed
+	b.closed = true
+	delete(cf.bodies, b)
+	cf.mu.Unlock()
+	if !closed {
+		cf.release()
+	}
+	return nil
+}
+
+// coalesce answers the cache miss r by joining an identical fetch in flight or starting a new one.
+// inflight identifies the URL and variant, if known.
+func (c *Cache) coalesce(rt http.RoundTripper, r *http.Request, key, inflight string, reqCC cacheControl) (resp *http.Response, err error) {
+	cf, leader := c.join(rt, r, key, inflight, reqCC)
+	if resp, err = cf.wait(r, leader); err == nil {
+		switch {
+		case resp == nil:
+			if inflight == key && cf.entry != nil && len(cf.entry.Vary) > 0 {
+				// another variant, coalesce with requests for the same one
+				if vk := variantKey(key, cf.entry.Vary, r); vk != key {
+					return c.coalesce(rt, r, key, vk, reqCC)
+				}
+			}
+			return c.fetch(rt, r, key, reqCC, "uri-miss")
+		case leader:
+			c.served("", false)
+			status := "fwd=uri-miss"
+			if cf.entry != nil {
+				status += "; stored"
+			}
+			setCacheStatus(resp.Header, "%s", status)
+		default:
+			c.mu.Lock()
+			c.collapsed++
+			c.mu.Unlock()
+			setCacheStatus(resp.Header, "fwd=uri-miss; collapsed")
+		}
+	}
+	return
+}
@@ -0,0 +1,175 @@
+package httpproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func newCoalesceTest(t *testing.T, c *Cache, handler http.HandlerFunc) (o *testOrigin, originURL string, do func(hdr ...string) *http.Response) {
+	t.Helper()
+	o = &testOrigin{handler: handler}
+	origin := httptest.NewServer(o)
+	t.Cleanup(origin.Close)
+	proxysrv := httptest.NewServer(&Server{Cache: c})
+	t.Cleanup(proxysrv.Close)
+	client := makeClient(t, proxysrv.URL)
+	originURL = origin.URL + "/artifact"
+	do = func(hdr ...string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, originURL, nil)
+		for i := 0; i+1 < len(hdr); i += 2 {
+			req.Header.Set(hdr[i], hdr[i+1])
+		}
+		resp, err := client.Do(req)
+		maybeFatal(t, err)
+		return resp
+	}
+	return
+}
+
+func readBody(t *testing.T, resp *http.Response) string {
+	t.Helper()
+	b, err := io.ReadAll(resp.Body)
+	maybeFatal(t, err)
+	maybeFatal(t, resp.Body.Close())
+	return string(b)
+}
+
+func TestCacheCoalesce(t *testing.T) {
+	release := make(chan struct{})
+	c := &Cache{Store: &MemoryCacheStore{}}
+	o, _, do := newCoalesceTest(t, c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "hel")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "lo")
+	})
+
+	var resps []*http.Response
+	for range 4 {
+		resps = append(resps, do())
+	}
+	close(release)
+	for i, resp := range resps {
+		want := "httpproxy; fwd=uri-miss; collapsed"
+		if i == 0 {
+			want = "httpproxy; fwd=uri-miss; stored"
+		}
+		if body := readBody(t, resp); body != "hello" || resp.Header.Get("Cache-Status") != want {
+			t.Error(i, body, resp.Header)
+		}
+	}
+	if n := o.hits.Load(); n != 1 {
+		t.Error(n)
+	}
+	resp := do()
+	if body := readBody(t, resp); body != "hello" || !strings.HasPrefix(resp.Header.Get("Cache-Status"), "httpproxy; hit") {
+		t.Error(body, resp.Header)
+	}
+	if stats := c.Stats(0); stats.Collapsed != 3 || stats.Misses != 1 || stats.Hits != 1 {
+		t.Errorf("%+v", stats)
+	}
+}
+
+func TestCacheCoalesceNotShared(t *testing.T) {
+	release := make(chan struct{})
+	o, _, do := newCoalesceTest(t, &Cache{Store: &MemoryCacheStore{}}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		if r.Header.Get("Accept-Language") == "sv" {
+			w.Header().Set("Cache-Control", "private")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=60")
+		}
+		_, _ = io.WriteString(w, r.Header.Get("Accept-Language"))
+		w.(http.Flusher).Flush()
+		<-release
+	})
+
+	en1 := do("Accept-Language", "en")
+	de1 := do("Accept-Language", "de")
+	de2 := do("Accept-Language", "de")
+	en2 := do("Accept-Language", "en")
+	sv1 := do("Accept-Language", "sv")
+	sv2 := do("Accept-Language", "sv")
+	close(release)
+	for _, x := range []struct {
+		resp *http.Response
+		want string
+	}{{en1, "en"}, {de1, "de"}, {de2, "de"}, {en2, "en"}, {sv1, "sv"}, {sv2, "sv"}} {
+		if body := readBody(t, x.resp); body != x.want {
+			t.Error(body, x.want)
+		}
+	}
+	if n := o.hits.Load(); n != 4 {
+		t.Error(n)
+	}
+	for _, resp := range []*http.Response{de2, en2} {
+		if resp.Header.Get("Cache-Status") != "httpproxy; fwd=uri-miss; collapsed" {
+			t.Error(resp.Header)
+		}
+	}
+}
+
+func TestCacheCoalesceTooLarge(t *testing.T) {
+	release := make(chan struct{})
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 3*coalesceWindow/16)
+	c := &Cache{Store: &MemoryCacheStore{}, MaxObjectSize: 10}
+	o, _, do := newCoalesceTest(t, c, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = w.Write(payload[:4])
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = w.Write(payload[4:])
+	})
+
+	resps := []*http.Response{do(), do()}
+	close(release)
+	var wg sync.WaitGroup
+	for _, resp := range resps {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if body := readBody(t, resp); body != string(payload) {
+				t.Error(len(body))
+			}
+		}()
+	}
+	wg.Wait()
+	if n := o.hits.Load(); n != 1 {
+		t.Error(n)
+	}
+	if stats := c.Stats(0); stats.Objects != 0 || stats.Collapsed != 1 {
+		t.Errorf("%+v", stats)
+	}
+}
+
+func TestCacheCoalesceLeaderGone(t *testing.T) {
+	release := make(chan struct{})
+	o, _, do := newCoalesceTest(t, &Cache{Store: &MemoryCacheStore{}}, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		_, _ = io.WriteString(w, "hel")
+		w.(http.Flusher).Flush()
+		<-release
+		_, _ = io.WriteString(w, "lo")
+	})
+
+	leader := do()
+	follower := do()
+	maybeFatal(t, leader.Body.Close())
+	close(release)
+	if body := readBody(t, follower); body != "hello" {
+		t.Error(body)
+	}
+	if body := readBody(t, do()); body != "hello" {
+		t.Error(body)
+	}
+	if n := o.hits.Load(); n != 1 {
+		t.Error(n)
+	}
+}
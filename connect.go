@@ -4,49 +4,105 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"time"
 )
 
-func (srv *Server) connect(w http.ResponseWriter, r *http.Request) {
-	var err error
-	var clientConn net.Conn
-	if clientConn, err = hijack(w); err == nil {
-		var cd ContextDialer
-		var address string
-		if cd, address, err = srv.getDialer(r); err == nil {
-			var targetConn net.Conn
-			if targetConn, err = cd.DialContext(r.Context(), "tcp", address); err == nil {
-				if err = (fakeRoundTripper{}.WriteConnectResponse(clientConn)); err == nil {
-					targetTCP, targetOK := targetConn.(halfClosable)
-					clientTCP, clientOK := clientConn.(halfClosable)
-					if targetOK && clientOK {
-						go func() {
-							defer clientTCP.Close()
-							defer targetTCP.Close()
-							var wg sync.WaitGroup
-							wg.Add(2)
-							go copyAndClose(targetTCP, clientTCP, &wg)
-							go copyAndClose(clientTCP, targetTCP, &wg)
-							wg.Wait()
-						}()
-					} else {
-						go func() {
-							defer clientConn.Close()
-							defer targetConn.Close()
-							_ = proxyUntilClosed(targetConn, clientConn)
-						}()
-					}
-					// successfully started proxying
-					return
+func (srv *Server) dialConnect(sess *session, r *http.Request) (targetConn net.Conn, username, address string, err error) {
+	var cds []ContextDialer
+	start := time.Now()
+	cds, address, username, err = srv.getDialer(r)
+	sess.trace.add("auth", start, err)
+	if err == nil {
+		sess.setUsername(username)
+		if err = srv.checkConnectPort(username, address); err == nil {
+			if srv.Limits != nil {
+				var release func()
+				if release, err = srv.Limits.acquireTunnel(username, r.RemoteAddr); err == nil {
+					sess.add(releaser(release))
+				}
+			}
+			if err == nil {
+				if targetConn, err = srv.dial(sess, cds, address); err != nil {
+					err = upstreamError{err, "destination_unavailable"}
+				} else {
+					sess.add(targetConn)
 				}
-				// hijacked ok, but writing connect response failed
-				_ = targetConn.Close()
 			}
 		}
-		// hijacked ok, but dial or writing connect response failed
-		_ = (fakeRoundTripper{err}.WriteConnectResponse(clientConn))
-		_ = clientConn.Close()
 	}
-	if clientConn == nil {
+	return
+}
+
+func (srv *Server) startTunnel(sess *session, clientConn, targetConn net.Conn) (err error) {
+	if clientConn, err = unwrapHijacked(clientConn, sentWriter{Writer: targetConn, sess: sess}); err != nil {
+		return
+	}
+	srv.watchTunnel(sess, clientConn, targetConn)
+	start := time.Now()
+	targetTCP, targetOK := targetConn.(halfClosable)
+	clientTCP, clientOK := clientConn.(halfClosable)
+	if targetOK && clientOK {
+		go func() {
+			defer srv.removeSession(sess)
+			defer func() { sess.trace.add("transfer", start, nil) }()
+			var wg sync.WaitGroup
+			wg.Add(2)
+			go copyAndClose(sess, targetTCP, clientTCP, true, &wg)
+			go copyAndClose(sess, clientTCP, targetTCP, false, &wg)
+			wg.Wait()
+		}()
+	} else {
+		go func() {
+			defer srv.removeSession(sess)
+			err := proxyUntilClosed(sess, targetConn, clientConn)
+			sess.trace.add("transfer", start, err)
+			sess.setErr(err)
+		}()
+	}
+	return
+}
+
+// connectTunnel dials the target and starts proxying data between it and clientConn.
+func (srv *Server) connectTunnel(sess *session, clientConn net.Conn, r *http.Request) (err error) {
+	var targetConn net.Conn
+	var username, address string
+	if targetConn, username, address, err = srv.dialConnect(sess, r); err == nil {
+		if err = (fakeRoundTripper{}.WriteConnectResponse(clientConn)); err == nil {
+			sess.setStatus(http.StatusOK)
+			if srv.SNIInspector != nil {
+				err = srv.SNIInspector.inspect(srv, clientConn, sentWriter{Writer: targetConn, sess: sess}, username, address)
+			}
+			if err == nil {
+				err = srv.startTunnel(sess, clientConn, targetConn)
+			}
+		}
+	} else {
+		// dial failed
+		_ = srv.writeConnectError(clientConn, r, sess.id, err)
+	}
+	return
+}
+
+func (srv *Server) connect(w http.ResponseWriter, r *http.Request) {
+	clientConn, err := hijack(w)
+	if err == nil {
+		var sess *session
+		if sess, err = srv.addSession(r, ConnKindConnect); err == nil {
+			sess.add(clientConn)
+			if err = srv.connectTunnel(sess, clientConn, r); err == nil {
+				// successfully started proxying
+				return
+			}
+			// if the 200 response was already sent, the status stays and only err is recorded
+			sess.setStatus(fakeRoundTripper{err}.StatusCode(http.StatusInternalServerError))
+			sess.setErr(err)
+			srv.Metrics.connectFailed(err)
+			srv.removeSession(sess)
+		} else {
+			_ = srv.writeConnectError(clientConn, r, 0, err)
+			_ = clientConn.Close()
+		}
+	} else {
 		// w was not a http.Hijacker or hijack failed
 		w.WriteHeader(http.StatusInternalServerError)
 	}
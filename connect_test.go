@@ -27,7 +27,7 @@ func TestSimpleHTTPSRequestViaHTTP(t *testing.T) {
 	destsrv := makeHTTPSDestSrv(t)
 	defer destsrv.Close()
 
-	proxysrv := httptest.NewServer(&Server{})
+	proxysrv := httptest.NewServer(&Server{ConnectPortPolicy: AnyConnectPort{}})
 	defer proxysrv.Close()
 
 	resp, err := makeClient(t, proxysrv.URL).Get(destsrv.URL)
@@ -46,7 +46,7 @@ func TestSimpleHTTPSRequestViaHTTPS(t *testing.T) {
 	destsrv := makeHTTPSDestSrv(t)
 	defer destsrv.Close()
 
-	proxysrv := httptest.NewTLSServer(&Server{})
+	proxysrv := httptest.NewTLSServer(&Server{ConnectPortPolicy: AnyConnectPort{}})
 	defer proxysrv.Close()
 
 	resp, err := makeClient(t, proxysrv.URL).Get(destsrv.URL)
@@ -93,7 +93,8 @@ func TestFailHTTPSRequestViaHTTP(t *testing.T) {
 	defer destsrv.Close()
 
 	proxysrv := httptest.NewServer(&Server{
-		Logger: slog.Default(),
+		Logger:            slog.Default(),
+		ConnectPortPolicy: AnyConnectPort{},
 	})
 	defer proxysrv.Close()
 
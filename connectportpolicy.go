@@ -0,0 +1,32 @@
+package httpproxy
+
+// A ConnectPortPolicy decides which ports CONNECT requests may tunnel to.
+//
+// If Server.ConnectPortPolicy is nil and the Server's DialerSelector or CredentialsValidator
+// implements ConnectPortPolicy, it is used instead, allowing per-user policies.
+type ConnectPortPolicy interface {
+	// AllowConnectPort returns true if username may CONNECT to port.
+	//
+	// If username is the empty string no authorization has taken place (anonymous usage).
+	AllowConnectPort(username string, port uint16) bool
+}
+
+// ConnectPorts enables using a set of ports directly as a ConnectPortPolicy.
+type ConnectPorts map[uint16]bool
+
+func (cp ConnectPorts) AllowConnectPort(_ string, port uint16) bool {
+	return cp[port]
+}
+
+// AnyConnectPort is a ConnectPortPolicy that allows CONNECT to any port.
+type AnyConnectPort struct{}
+
+func (AnyConnectPort) AllowConnectPort(string, uint16) bool {
+	return true
+}
+
+// DefaultConnectPortPolicy is used if no other ConnectPortPolicy is available.
+//
+// Earlier versions of Server allowed CONNECT to any port. Set Server.ConnectPortPolicy
+// to AnyConnectPort{} to keep doing so.
+var DefaultConnectPortPolicy ConnectPortPolicy = ConnectPorts{443: true, 563: true, 8443: true}
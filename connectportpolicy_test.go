@@ -0,0 +1,87 @@
+package httpproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type userConnectPorts map[string]ConnectPorts
+
+func (u userConnectPorts) ValidateCredentials(username, password, address string) bool {
+	return password == "secret"
+}
+
+func (u userConnectPorts) AllowConnectPort(username string, port uint16) bool {
+	return u[username].AllowConnectPort(username, port)
+}
+
+func rawConnect(t *testing.T, proxyaddr, target, username string) (resp *http.Response, body string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyaddr)
+	maybeFatal(t, err)
+	defer conn.Close()
+	req, err := http.NewRequest(http.MethodConnect, "", nil)
+	maybeFatal(t, err)
+	req.Host = target
+	if username != "" {
+		SetBasicAuth(req.Header, username, "secret")
+	}
+	maybeFatal(t, req.Write(conn))
+	resp, err = http.ReadResponse(bufio.NewReader(conn), req)
+	maybeFatal(t, err)
+	if resp.StatusCode != http.StatusOK {
+		b, err := io.ReadAll(resp.Body)
+		maybeFatal(t, err)
+		body = string(b)
+	}
+	return
+}
+
+func TestConnectPortPolicy(t *testing.T) {
+	destsrv := makeHTTPSDestSrv(t)
+	defer destsrv.Close()
+	_, port, _ := net.SplitHostPort(destsrv.Listener.Addr().String())
+
+	srv := &Server{}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+	proxyaddr := proxysrv.Listener.Addr().String()
+	target := destsrv.Listener.Addr().String()
+
+	resp, body := rawConnect(t, proxyaddr, target, "")
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error(resp.StatusCode)
+	}
+	if !strings.Contains(body, "port \""+port+"\" not allowed") {
+		t.Errorf("%q", body)
+	}
+
+	portnum := uint16(destsrv.Listener.Addr().(*net.TCPAddr).Port)
+	srv.CredentialsValidator = userConnectPorts{"admin": {portnum: true}, "user": {443: true}}
+	if resp, _ = rawConnect(t, proxyaddr, target, "admin"); resp.StatusCode != http.StatusOK {
+		t.Error(resp.StatusCode)
+	}
+	if resp, _ = rawConnect(t, proxyaddr, target, "user"); resp.StatusCode != http.StatusForbidden {
+		t.Error(resp.StatusCode)
+	}
+
+	// an explicitly set policy takes precedence over the CredentialsValidator's
+	srv.ConnectPortPolicy = AnyConnectPort{}
+	if resp, _ = rawConnect(t, proxyaddr, target, "user"); resp.StatusCode != http.StatusOK {
+		t.Error(resp.StatusCode)
+	}
+
+	srv.CredentialsValidator = nil
+	if resp, _ = rawConnect(t, proxyaddr, target, ""); resp.StatusCode != http.StatusOK {
+		t.Error(resp.StatusCode)
+	}
+
+	if resp, body = rawConnect(t, proxyaddr, "www.example.com", ""); resp.StatusCode != http.StatusForbidden || !strings.Contains(body, "without a port") {
+		t.Error(resp.StatusCode, body)
+	}
+}
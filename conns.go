@@ -0,0 +1,63 @@
+package httpproxy
+
+import (
+	"cmp"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+// Conns returns information about the active CONNECT tunnels,
+// WebSocket relays and proxied requests, ordered by ID.
+func (srv *Server) Conns() (conns []ConnInfo) {
+	srv.mu.Lock()
+	sessions := make([]*session, 0, len(srv.sessions))
+	for _, sess := range srv.sessions {
+		sessions = append(sessions, sess)
+	}
+	srv.mu.Unlock()
+	for _, sess := range sessions {
+		conns = append(conns, sess.info())
+	}
+	slices.SortFunc(conns, func(a, b ConnInfo) int { return cmp.Compare(a.ID, b.ID) })
+	return
+}
+
+// KillConn closes the active CONNECT tunnel or WebSocket relay, or cancels
+// the proxied request, with the given ID. Returns false if it wasn't found.
+func (srv *Server) KillConn(id uint64) (found bool) {
+	srv.mu.Lock()
+	sess := srv.sessions[id]
+	srv.mu.Unlock()
+	if found = sess != nil; found {
+		sess.close(ErrConnKilled)
+	}
+	return
+}
+
+// ConnsHandler returns a http.Handler that responds to GET requests with
+// the JSON encoded result of Conns, and to DELETE requests with a
+// query parameter "id" by calling KillConn.
+//
+// The handler does no authorization of its own.
+func (srv *Server) ConnsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(srv.Conns())
+		case http.MethodDelete:
+			if id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+			} else if srv.KillConn(id) {
+				w.WriteHeader(http.StatusNoContent)
+			} else {
+				http.NotFound(w, r)
+			}
+		default:
+			w.Header().Set("Allow", "GET, DELETE")
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,123 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func waitForConns(t *testing.T, srv *Server, n int) (conns []ConnInfo) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		if conns = srv.Conns(); len(conns) == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("expected %d conns, have %v", n, conns)
+	return
+}
+
+func TestConnsTunnel(t *testing.T) {
+	l := makeEchoListener(t, false)
+	defer l.Close()
+	srv := &Server{
+		ConnectPortPolicy:    AnyConnectPort{},
+		CredentialsValidator: StaticCredentials{"foo": "secret"},
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+	adminsrv := httptest.NewServer(srv.ConnsHandler())
+	defer adminsrv.Close()
+
+	conn, br, resp := openTunnelAuth(t, proxysrv.Listener.Addr().String(), l.Addr().String(), "foo")
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	_, err := io.WriteString(conn, "hello")
+	maybeFatal(t, err)
+	readEchoed(t, br, "hello")
+
+	conns := waitForConns(t, srv, 1)
+	ci := conns[0]
+	if ci.Kind != ConnKindConnect || ci.Username != "foo" || ci.Target != l.Addr().String() || ci.Client == "" || ci.Start.IsZero() {
+		t.Errorf("%#v", ci)
+	}
+	if ci.BytesSent != 5 || ci.BytesReceived != 5 {
+		t.Errorf("%#v", ci)
+	}
+
+	resp, err = http.Get(adminsrv.URL)
+	maybeFatal(t, err)
+	var listed []ConnInfo
+	maybeFatal(t, json.NewDecoder(resp.Body).Decode(&listed))
+	resp.Body.Close()
+	if len(listed) != 1 || listed[0].ID != ci.ID || listed[0].Username != "foo" {
+		t.Errorf("%#v", listed)
+	}
+
+	for id, want := range map[string]int{
+		"x":                                http.StatusBadRequest,
+		strconv.FormatUint(ci.ID+1000, 10): http.StatusNotFound,
+		strconv.FormatUint(ci.ID, 10):      http.StatusNoContent,
+	} {
+		req, _ := http.NewRequest(http.MethodDelete, adminsrv.URL+"?id="+id, nil)
+		resp, err = http.DefaultClient.Do(req)
+		maybeFatal(t, err)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Error(id, resp.Status)
+		}
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Error(err)
+	}
+	waitForConns(t, srv, 0)
+}
+
+func TestConnsRequest(t *testing.T) {
+	release := make(chan struct{})
+	destsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+		w.Write(testBody)
+	}))
+	defer destsrv.Close()
+	defer close(release)
+
+	srv := &Server{}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	errch := make(chan error, 1)
+	go func() {
+		resp, err := makeClient(t, proxysrv.URL).Get(destsrv.URL)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				err = io.ErrUnexpectedEOF
+			}
+		}
+		errch <- err
+	}()
+
+	conns := waitForConns(t, srv, 1)
+	if conns[0].Kind != ConnKindRequest || conns[0].Target != destsrv.Listener.Addr().String() {
+		t.Errorf("%#v", conns[0])
+	}
+	if !srv.KillConn(conns[0].ID) {
+		t.Error("KillConn failed")
+	}
+	if err := <-errch; err == io.ErrUnexpectedEOF {
+		t.Error("request not canceled")
+	}
+	waitForConns(t, srv, 0)
+}
@@ -0,0 +1,322 @@
+package httpproxy
+
+import (
+	"cmp"
+	"context"
+	"hash/fnv"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BalanceStrategy selects which member of a DialerPool to use.
+type BalanceStrategy int
+
+const (
+	BalanceRoundRobin       BalanceStrategy = iota // members in turn
+	BalanceLeastConnections                        // member with the fewest open connections
+	BalanceHashDestination                         // consistent hash of the destination host
+	BalanceHashUser                                // consistent hash of the username, or destination host if none
+)
+
+// DefaultPoolMaxFails is the default number of consecutive dial failures after which a DialerPool member is ejected.
+var DefaultPoolMaxFails = 3
+
+// DefaultPoolEjectTime is the default time an ejected DialerPool member is not used.
+var DefaultPoolEjectTime = 30 * time.Second
+
+// DefaultPoolHealthCheckInterval is the default time between active health checks of DialerPool members.
+var DefaultPoolHealthCheckInterval = 10 * time.Second
+
+// poolVirtualNodes is the number of points each member has on the consistent hash ring.
+const poolVirtualNodes = 64
+
+// DialerPool is a ContextDialer balancing connections across a set of ContextDialers,
+// such as several egress gateways.
+//
+// Members failing MaxFails consecutive dials are ejected for EjectTime. If HealthCheckAddress
+// is set, it is dialed through each member every HealthCheckInterval and members that fail are
+// not used until a check succeeds. If no member is usable, all of them are.
+//
+// As a DialerSelector the DialerPool returns the selected member, so the Server keeps
+// a RoundTripper per member, and as a DialerListSelector the remaining members follow it
+// for failover. BalanceHashUser requires it to be used as a DialerSelector, as the
+// username is not known when used as a ContextDialer.
+//
+// The fields must not be changed after the DialerPool is first used.
+type DialerPool struct {
+	Dialers             []ContextDialer // members of the pool
+	Strategy            BalanceStrategy // how members are selected
+	MaxFails            int             // optional consecutive dial failures ejecting a member, defaults to DefaultPoolMaxFails
+	EjectTime           time.Duration   // optional time ejected members are not used, defaults to DefaultPoolEjectTime
+	HealthCheckAddress  string          // optional address dialed through each member to check its health
+	HealthCheckInterval time.Duration   // optional time between health checks, defaults to DefaultPoolHealthCheckInterval
+	Logger              Logger          // optional logger for member state changes
+	mu                  sync.Mutex      // protects following
+	members             []*poolMember
+	ring                []poolRingPoint // sorted by hash
+	next                int             // round robin position
+	stop                chan struct{}   // closed by Close
+	done                chan struct{}   // closed when the health checker has stopped
+}
+
+var _ ContextDialer = (*DialerPool)(nil)
+var _ DialerSelector = (*DialerPool)(nil)
+var _ DialerListSelector = (*DialerPool)(nil)
+
+type poolRingPoint struct {
+	hash   uint64
+	member int
+}
+
+// poolMember is a member of a DialerPool, tracking its connections and health.
+type poolMember struct {
+	ContextDialer
+	pool      *DialerPool
+	index     int
+	conns     atomic.Int64 // open connections
+	fails     int          // consecutive dial failures, protected by pool.mu
+	ejected   time.Time    // not used until, protected by pool.mu
+	unhealthy bool         // failed the last health check, protected by pool.mu
+}
+
+func (m *poolMember) String() string {
+	return dialerName(m.ContextDialer)
+}
+
+// poolHash returns the FNV-1a hash of s, finalized to spread similar strings across the ring.
+func poolHash(s string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s))
+	x := h.Sum64()
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+// initLocked creates the members and starts the health checker on first use.
+func (p *DialerPool) initLocked() {
+	if p.members == nil {
+		p.members = make([]*poolMember, len(p.Dialers))
+		for i, cd := range p.Dialers {
+			p.members[i] = &poolMember{ContextDialer: cd, pool: p, index: i}
+			for v := range poolVirtualNodes {
+				p.ring = append(p.ring, poolRingPoint{hash: poolHash(strconv.Itoa(i) + "#" + strconv.Itoa(v)), member: i})
+			}
+		}
+		slices.SortFunc(p.ring, func(a, b poolRingPoint) int {
+			return cmp.Or(cmp.Compare(a.hash, b.hash), a.member-b.member)
+		})
+		if p.HealthCheckAddress != "" && p.stop == nil {
+			p.stop = make(chan struct{})
+			p.done = make(chan struct{})
+			go p.checkHealth(p.stop, p.done)
+		}
+	}
+}
+
+func (p *DialerPool) usableLocked(m *poolMember, now time.Time) bool {
+	return !m.unhealthy && !now.Before(m.ejected)
+}
+
+// orderLocked returns the members in the order they should be tried for key, most preferred first.
+func (p *DialerPool) orderLocked(key string) (order []*poolMember) {
+	order = make([]*poolMember, 0, len(p.members))
+	switch p.Strategy {
+	case BalanceHashDestination, BalanceHashUser:
+		h := poolHash(key)
+		i, _ := slices.BinarySearchFunc(p.ring, h, func(pt poolRingPoint, h uint64) int { return cmp.Compare(pt.hash, h) })
+		seen := make([]bool, len(p.members))
+		for j := range p.ring {
+			if pt := p.ring[(i+j)%len(p.ring)]; !seen[pt.member] {
+				seen[pt.member] = true
+				order = append(order, p.members[pt.member])
+			}
+		}
+	default:
+		start := p.next % len(p.members)
+		p.next++
+		for j := range p.members {
+			order = append(order, p.members[(start+j)%len(p.members)])
+		}
+		if p.Strategy == BalanceLeastConnections {
+			slices.SortStableFunc(order, func(a, b *poolMember) int { return int(a.conns.Load() - b.conns.Load()) })
+		}
+	}
+	now := time.Now()
+	usable := slices.DeleteFunc(slices.Clone(order), func(m *poolMember) bool { return !p.usableLocked(m, now) })
+	if len(usable) > 0 {
+		order = usable
+	}
+	return
+}
+
+// order returns the members to try for username and address, most preferred first.
+func (p *DialerPool) order(username, address string) (order []*poolMember) {
+	key := address
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		key = host
+	}
+	if p.Strategy == BalanceHashUser && username != "" {
+		key = username
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.initLocked()
+	if len(p.members) > 0 {
+		order = p.orderLocked(key)
+	}
+	return
+}
+
+func (p *DialerPool) SelectDialer(username, network, address string) (cd ContextDialer, err error) {
+	err = ErrNoDialer
+	if order := p.order(username, address); len(order) > 0 {
+		cd, err = order[0], nil
+	}
+	return
+}
+
+func (p *DialerPool) SelectDialers(username, network, address string) (cds []ContextDialer, err error) {
+	for _, m := range p.order(username, address) {
+		cds = append(cds, m)
+	}
+	return
+}
+
+// DialContext connects to address using the member selected by the Strategy.
+func (p *DialerPool) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	err = ErrNoDialer
+	if order := p.order("", address); len(order) > 0 {
+		conn, err = order[0].DialContext(ctx, network, address)
+	}
+	return
+}
+
+func (p *DialerPool) log(msg string, m *poolMember, keyValuePairs ...any) {
+	if p.Logger != nil {
+		p.Logger.Warn(msg, append([]any{"member", m.index, "dialer", m.String()}, keyValuePairs...)...)
+	}
+}
+
+// dialed records the outcome of a dial through m, ejecting it after too many consecutive failures.
+func (m *poolMember) dialed(ctx context.Context, err error) {
+	p := m.pool
+	if err != nil {
+		switch errorClass(err) {
+		case errClassUnauthorized, errClassForbidden, errClassLimit, errClassClosed, errClassCanceled, errClassDNS:
+			// not caused by the member
+			return
+		}
+		if ctx.Err() != nil {
+			return
+		}
+	}
+	maxFails := p.MaxFails
+	if maxFails <= 0 {
+		maxFails = DefaultPoolMaxFails
+	}
+	ejectTime := p.EjectTime
+	if ejectTime <= 0 {
+		ejectTime = DefaultPoolEjectTime
+	}
+	p.mu.Lock()
+	var ejected bool
+	if err == nil {
+		m.fails = 0
+	} else if m.fails++; m.fails >= maxFails {
+		m.fails = 0
+		m.ejected = time.Now().Add(ejectTime)
+		ejected = true
+	}
+	p.mu.Unlock()
+	if ejected {
+		p.log("dialerpool ejected", m, "error", err, "duration", ejectTime)
+	}
+}
+
+func (m *poolMember) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	if conn, err = m.ContextDialer.DialContext(ctx, network, address); err == nil {
+		m.conns.Add(1)
+		conn = &poolConn{Conn: conn, m: m}
+	}
+	m.dialed(ctx, err)
+	return
+}
+
+// poolConn is a connection made through a poolMember.
+type poolConn struct {
+	net.Conn
+	m    *poolMember
+	once sync.Once
+}
+
+func (pc *poolConn) Close() error {
+	pc.once.Do(func() { pc.m.conns.Add(-1) })
+	return pc.Conn.Close()
+}
+
+// checkHealth dials HealthCheckAddress through each member every HealthCheckInterval until Close is called.
+func (p *DialerPool) checkHealth(stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	interval := p.HealthCheckInterval
+	if interval <= 0 {
+		interval = DefaultPoolHealthCheckInterval
+	}
+	tkr := time.NewTicker(interval)
+	defer tkr.Stop()
+	for {
+		var wg sync.WaitGroup
+		for _, m := range p.members {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ctx, cancel := context.WithTimeout(context.Background(), interval)
+				defer cancel()
+				conn, err := m.ContextDialer.DialContext(ctx, "tcp", p.HealthCheckAddress)
+				if err == nil {
+					_ = conn.Close()
+				}
+				p.mu.Lock()
+				changed := m.unhealthy != (err != nil)
+				m.unhealthy = err != nil
+				p.mu.Unlock()
+				if changed {
+					if err != nil {
+						p.log("dialerpool unhealthy", m, "error", err)
+					} else {
+						p.log("dialerpool healthy", m)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		select {
+		case <-tkr.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// Close stops the health checks. Members that failed them are used again,
+// as nothing would mark them healthy if the DialerPool keeps being used.
+func (p *DialerPool) Close() error {
+	p.mu.Lock()
+	stop, done := p.stop, p.done
+	p.stop = nil
+	p.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+		p.mu.Lock()
+		for _, m := range p.members {
+			m.unhealthy = false
+		}
+		p.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingDialer counts its dials, failing those to addresses in fail.
+type countingDialer struct {
+	name  string
+	dials atomic.Int32
+	fail  map[string]bool
+}
+
+func (cd *countingDialer) String() string { return cd.name }
+
+func (cd *countingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	cd.dials.Add(1)
+	if cd.fail[address] || cd.fail["*"] {
+		return nil, errTestDial
+	}
+	return DefaultContextDialer.DialContext(ctx, network, address)
+}
+
+func makeCountingDialers(n int) (cds []ContextDialer, counters []*countingDialer) {
+	for i := range n {
+		cd := &countingDialer{name: "gw" + strconv.Itoa(i)}
+		cds = append(cds, cd)
+		counters = append(counters, cd)
+	}
+	return
+}
+
+func makeAcceptListener(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	maybeFatal(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(io.Discard, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+func TestDialerPoolRoundRobin(t *testing.T) {
+	l := makeAcceptListener(t)
+	cds, counters := makeCountingDialers(3)
+	pool := &DialerPool{Dialers: cds}
+	for range 6 {
+		conn, err := pool.DialContext(context.Background(), "tcp", l.Addr().String())
+		maybeFatal(t, err)
+		_ = conn.Close()
+	}
+	for _, cd := range counters {
+		if n := cd.dials.Load(); n != 2 {
+			t.Error(cd.name, n)
+		}
+	}
+}
+
+func TestDialerPoolLeastConnections(t *testing.T) {
+	l := makeAcceptListener(t)
+	cds, counters := makeCountingDialers(2)
+	pool := &DialerPool{Dialers: cds, Strategy: BalanceLeastConnections}
+	conn1, err := pool.DialContext(context.Background(), "tcp", l.Addr().String())
+	maybeFatal(t, err)
+	for range 3 {
+		conn, err := pool.DialContext(context.Background(), "tcp", l.Addr().String())
+		maybeFatal(t, err)
+		_ = conn.Close()
+	}
+	_ = conn1.Close()
+	if n0, n1 := counters[0].dials.Load(), counters[1].dials.Load(); n0 != 1 || n1 != 3 {
+		t.Error(n0, n1)
+	}
+}
+
+func TestDialerPoolHash(t *testing.T) {
+	cds, _ := makeCountingDialers(4)
+	pool := &DialerPool{Dialers: cds, Strategy: BalanceHashUser}
+	used := map[ContextDialer]bool{}
+	for i := range 50 {
+		user := "user" + strconv.Itoa(i)
+		cd, err := pool.SelectDialer(user, "tcp", "example.com:443")
+		maybeFatal(t, err)
+		used[cd] = true
+		cds, err := pool.SelectDialers(user, "tcp", "other.example.com:443")
+		maybeFatal(t, err)
+		if len(cds) != 4 || cds[0] != cd {
+			t.Error(user, cd, cds)
+		}
+	}
+	if len(used) != 4 {
+		t.Error(len(used))
+	}
+
+	pool = &DialerPool{Dialers: cds, Strategy: BalanceHashDestination}
+	a, _ := pool.SelectDialer("x", "tcp", "a.example.com:443")
+	b, _ := pool.SelectDialer("y", "tcp", "a.example.com:80")
+	if a != b {
+		t.Error(a, b)
+	}
+}
+
+func TestDialerPoolEjection(t *testing.T) {
+	l := makeAcceptListener(t)
+	cds, counters := makeCountingDialers(2)
+	counters[0].fail = map[string]bool{"*": true}
+	pool := &DialerPool{Dialers: cds, Strategy: BalanceHashDestination, MaxFails: 2, EjectTime: 50 * time.Millisecond}
+	first, _ := pool.SelectDialer("", "tcp", l.Addr().String())
+	if first.(*poolMember).ContextDialer != counters[0] {
+		// make the failing member the preferred one
+		counters[0].fail, counters[1].fail = nil, map[string]bool{"*": true}
+		counters[0], counters[1] = counters[1], counters[0]
+	}
+	for range 2 {
+		if _, err := pool.DialContext(context.Background(), "tcp", l.Addr().String()); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	conn, err := pool.DialContext(context.Background(), "tcp", l.Addr().String())
+	maybeFatal(t, err)
+	_ = conn.Close()
+	if n := counters[1].dials.Load(); n != 1 {
+		t.Error(n)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if cd, _ := pool.SelectDialer("", "tcp", l.Addr().String()); cd != first {
+		t.Error(cd)
+	}
+}
+
+func TestDialerPoolHealthCheck(t *testing.T) {
+	l := makeAcceptListener(t)
+	cds, counters := makeCountingDialers(2)
+	counters[0].fail = map[string]bool{l.Addr().String(): true}
+	pool := &DialerPool{Dialers: cds, HealthCheckAddress: l.Addr().String(), HealthCheckInterval: 10 * time.Millisecond}
+	defer pool.Close()
+	_, _ = pool.SelectDialers("", "tcp", "example.com:443")
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cds, err := pool.SelectDialers("", "tcp", "example.com:443")
+		maybeFatal(t, err)
+		if len(cds) == 1 {
+			if cds[0].(*poolMember).ContextDialer != counters[1] {
+				t.Error(cds)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("member not marked unhealthy")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	maybeFatal(t, pool.Close())
+	if cds, err := pool.SelectDialers("", "tcp", "example.com:443"); err != nil || len(cds) != 2 {
+		t.Error(cds, err)
+	}
+}
+
+func TestDialerPoolServer(t *testing.T) {
+	destsrv := makeHTTPDestSrv(t)
+	defer destsrv.Close()
+	cds, counters := makeCountingDialers(2)
+	counters[0].fail = map[string]bool{"*": true}
+	rur := newRecordingUsageReporter()
+	proxysrv := httptest.NewServer(&Server{
+		DialerSelector: &DialerPool{Dialers: cds},
+		UsageReporter:  rur,
+	})
+	defer proxysrv.Close()
+	client := makeClient(t, proxysrv.URL)
+	for range 4 {
+		resp, err := client.Get(destsrv.URL)
+		maybeFatal(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Error(resp.StatusCode)
+		}
+		if u := rur.next(t); u.Dialer != "gw1" {
+			t.Errorf("%#v", u)
+		}
+	}
+}
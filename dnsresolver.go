@@ -0,0 +1,358 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+var ErrDNSResponse = errors.New("invalid DNS response")
+
+// DefaultDNSTimeout is the default time a DNSResolver waits for a response.
+var DefaultDNSTimeout = 5 * time.Second
+
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeSOA   = 6
+	dnsTypeAAAA  = 28
+	dnsTypeOPT   = 41
+	dnsClassINET = 1
+
+	dnsRcodeNXDomain = 3
+	dnsUDPSize       = 1232
+)
+
+// DNSResolver is a TTLResolver sending queries for A and AAAA records
+// directly to a DNS server, bypassing the system resolver.
+//
+// Queries are sent over UDP and retried over TCP if the response is truncated.
+// For the "ip" network, IPv4 addresses are returned before IPv6 addresses.
+type DNSResolver struct {
+	Server        string        // DNS server address, port defaults to 53
+	Timeout       time.Duration // optional time to wait for a response, defaults to DefaultDNSTimeout
+	ContextDialer ContextDialer // optional dialer used to reach the server, otherwise uses a net.Dialer
+}
+
+var _ TTLResolver = (*DNSResolver)(nil)
+
+func (dr *DNSResolver) String() string {
+	return "dns://" + dr.server()
+}
+
+func (dr *DNSResolver) server() string {
+	if _, _, err := net.SplitHostPort(dr.Server); err != nil {
+		return net.JoinHostPort(strings.Trim(dr.Server, "[]"), "53")
+	}
+	return dr.Server
+}
+
+// LookupNetIP implements Resolver.
+func (dr *DNSResolver) LookupNetIP(ctx context.Context, network, host string) (addrs []netip.Addr, err error) {
+	addrs, _, err = dr.LookupNetIPTTL(ctx, network, host)
+	return
+}
+
+// LookupNetIPTTL implements TTLResolver. The TTL is the lowest of the records used,
+// or for names without addresses, the negative caching TTL from the SOA record if present.
+func (dr *DNSResolver) LookupNetIPTTL(ctx context.Context, network, host string) (addrs []netip.Addr, ttl time.Duration, err error) {
+	if addr, perr := netip.ParseAddr(host); perr == nil {
+		return []netip.Addr{addr}, 0, nil
+	}
+	timeout := dr.Timeout
+	if timeout <= 0 {
+		timeout = DefaultDNSTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var qtypes []uint16
+	switch lookupNetwork(network) {
+	case "ip4":
+		qtypes = []uint16{dnsTypeA}
+	case "ip6":
+		qtypes = []uint16{dnsTypeAAAA}
+	default:
+		qtypes = []uint16{dnsTypeA, dnsTypeAAAA}
+	}
+	type result struct {
+		addrs []netip.Addr
+		ttl   uint32
+		err   error
+	}
+	results := make([]chan result, len(qtypes))
+	for i, qtype := range qtypes {
+		results[i] = make(chan result, 1)
+		go func() {
+			var res result
+			res.addrs, res.ttl, res.err = dr.query(ctx, host, qtype)
+			results[i] <- res
+		}()
+	}
+	minTTL := ^uint32(0)
+	var notFound error
+	for _, ch := range results {
+		res := <-ch
+		var dnsErr *net.DNSError
+		switch {
+		case res.err == nil:
+			addrs = append(addrs, res.addrs...)
+			minTTL = min(minTTL, res.ttl)
+		case errors.As(res.err, &dnsErr) && dnsErr.IsNotFound:
+			notFound = res.err
+			if res.ttl > 0 {
+				minTTL = min(minTTL, res.ttl)
+			}
+		default:
+			err = res.err
+		}
+	}
+	if len(addrs) > 0 {
+		err = nil
+	} else if err == nil {
+		err = notFound
+	}
+	if (err == nil || err == notFound) && minTTL != ^uint32(0) {
+		ttl = time.Duration(minTTL) * time.Second
+	}
+	return
+}
+
+// dnsError returns a *net.DNSError for host.
+func (dr *DNSResolver) dnsError(host, msg string, err error) *net.DNSError {
+	dnsErr := &net.DNSError{Err: msg, Name: host, Server: dr.server(), UnwrapErr: err}
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() || errors.Is(err, context.DeadlineExceeded) {
+		dnsErr.IsTimeout = true
+	}
+	return dnsErr
+}
+
+// query asks the server for records of type qtype for host and returns the addresses
+// found following any CNAME records, along with the lowest TTL.
+func (dr *DNSResolver) query(ctx context.Context, host string, qtype uint16) (addrs []netip.Addr, ttl uint32, err error) {
+	name := strings.TrimSuffix(host, ".") + "."
+	msg, ok := dnsQuery(uint16(rand.Uint32()), name, qtype)
+	if !ok {
+		dnsErr := dr.dnsError(host, "no such host", nil)
+		dnsErr.IsNotFound = true
+		return nil, 0, dnsErr
+	}
+	var resp []byte
+	if resp, err = dr.exchange(ctx, "udp", msg); err == nil && resp[2]&0x02 != 0 {
+		resp, err = dr.exchange(ctx, "tcp", msg)
+	}
+	if err != nil {
+		return nil, 0, dr.dnsError(host, err.Error(), err)
+	}
+	var rcode int
+	if addrs, ttl, rcode, err = dnsParseResponse(resp, name, qtype); err == nil {
+		switch {
+		case rcode == dnsRcodeNXDomain || (rcode == 0 && len(addrs) == 0):
+			dnsErr := dr.dnsError(host, "no such host", nil)
+			dnsErr.IsNotFound = true
+			addrs, err = nil, dnsErr
+		case rcode != 0:
+			dnsErr := dr.dnsError(host, "server misbehaving", nil)
+			dnsErr.IsTemporary = true
+			addrs, ttl, err = nil, 0, dnsErr
+		}
+	} else {
+		err = dr.dnsError(host, err.Error(), err)
+	}
+	return
+}
+
+// exchange sends msg to the server over network and returns the response with the same ID.
+func (dr *DNSResolver) exchange(ctx context.Context, network string, msg []byte) (resp []byte, err error) {
+	var cd ContextDialer = &net.Dialer{}
+	if dr.ContextDialer != nil {
+		cd = dr.ContextDialer
+	}
+	var conn net.Conn
+	if conn, err = cd.DialContext(ctx, network, dr.server()); err == nil {
+		defer conn.Close()
+		stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Now()) })
+		defer stop()
+		if network == "tcp" {
+			resp, err = dnsExchangeStream(conn, msg)
+		} else {
+			resp, err = dnsExchangePacket(conn, msg)
+		}
+		if err != nil && ctx.Err() != nil {
+			err = ctx.Err()
+		}
+	}
+	return
+}
+
+func dnsExchangePacket(conn net.Conn, msg []byte) (resp []byte, err error) {
+	if _, err = conn.Write(msg); err == nil {
+		buf := make([]byte, dnsUDPSize)
+		for err == nil {
+			var n int
+			if n, err = conn.Read(buf); err == nil && n >= 12 && buf[0] == msg[0] && buf[1] == msg[1] {
+				return buf[:n], nil
+			}
+		}
+	}
+	return
+}
+
+func dnsExchangeStream(conn net.Conn, msg []byte) (resp []byte, err error) {
+	if _, err = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)); err == nil {
+		var hdr [2]byte
+		if _, err = io.ReadFull(conn, hdr[:]); err == nil {
+			resp = make([]byte, binary.BigEndian.Uint16(hdr[:]))
+			if _, err = io.ReadFull(conn, resp); err == nil {
+				if len(resp) < 12 || resp[0] != msg[0] || resp[1] != msg[1] {
+					err = ErrDNSResponse
+				}
+			}
+		}
+	}
+	return
+}
+
+// dnsQuery returns a recursive query message for records of type qtype for name.
+// It returns false if name is not a valid domain name.
+func dnsQuery(id uint16, name string, qtype uint16) (msg []byte, ok bool) {
+	msg = binary.BigEndian.AppendUint16(msg, id)
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 1)
+	if msg, ok = dnsAppendName(msg, name); ok {
+		msg = binary.BigEndian.AppendUint16(msg, qtype)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassINET)
+		// EDNS(0) OPT record advertising our UDP payload size
+		msg = append(msg, 0)
+		msg = binary.BigEndian.AppendUint16(msg, dnsTypeOPT)
+		msg = binary.BigEndian.AppendUint16(msg, dnsUDPSize)
+		msg = append(msg, 0, 0, 0, 0, 0, 0)
+	}
+	return
+}
+
+// dnsAppendName appends the fully qualified name in wire format to msg.
+func dnsAppendName(msg []byte, name string) ([]byte, bool) {
+	if name == "." || len(name) > 254 {
+		return nil, false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label == "" || len(label) > 63 {
+			return nil, false
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0), true
+}
+
+// dnsReadName returns the possibly compressed name at off in msg and the offset following it.
+func dnsReadName(msg []byte, off int) (name string, next int, err error) {
+	var sb strings.Builder
+	next = -1
+	for jumps := 0; err == nil; {
+		if off >= len(msg) {
+			return "", 0, ErrDNSResponse
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			if sb.Len() == 0 {
+				sb.WriteByte('.')
+			}
+			return sb.String(), next, nil
+		case n&0xC0 == 0xC0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, ErrDNSResponse
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3FFF)
+			jumps++
+		case n&0xC0 != 0 || off+1+n > len(msg):
+			err = ErrDNSResponse
+		default:
+			sb.Write(msg[off+1 : off+1+n])
+			sb.WriteByte('.')
+			off += 1 + n
+		}
+	}
+	return "", 0, err
+}
+
+// dnsParseResponse returns the addresses of type qtype for name in the response msg,
+// following CNAME records, along with the lowest TTL of the records used and the response code.
+// If there are no addresses, the TTL is taken from the SOA record in the authority section.
+func dnsParseResponse(msg []byte, name string, qtype uint16) (addrs []netip.Addr, ttl uint32, rcode int, err error) {
+	if len(msg) < 12 || msg[2]&0x80 == 0 {
+		return nil, 0, 0, ErrDNSResponse
+	}
+	rcode = int(msg[3] & 0x0F)
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	ancount := int(binary.BigEndian.Uint16(msg[6:]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:]))
+	off := 12
+	for range qdcount {
+		if _, off, err = dnsReadName(msg, off); err != nil {
+			return
+		}
+		if off += 4; off > len(msg) {
+			return nil, 0, 0, ErrDNSResponse
+		}
+	}
+	target := name
+	ttl = ^uint32(0)
+	var soaTTL uint32
+	for i := range ancount + nscount {
+		var rrname string
+		if rrname, off, err = dnsReadName(msg, off); err != nil {
+			return
+		}
+		if off+10 > len(msg) {
+			return nil, 0, 0, ErrDNSResponse
+		}
+		rrtype := binary.BigEndian.Uint16(msg[off:])
+		rrclass := binary.BigEndian.Uint16(msg[off+2:])
+		rrttl := binary.BigEndian.Uint32(msg[off+4:])
+		rdata := int(binary.BigEndian.Uint16(msg[off+8:]))
+		if off += 10; off+rdata > len(msg) {
+			return nil, 0, 0, ErrDNSResponse
+		}
+		data := msg[off : off+rdata]
+		if rrclass == dnsClassINET {
+			if i < ancount {
+				if strings.EqualFold(rrname, target) {
+					switch rrtype {
+					case dnsTypeCNAME:
+						if target, _, err = dnsReadName(msg, off); err != nil {
+							return
+						}
+						ttl = min(ttl, rrttl)
+					case qtype:
+						if addr, ok := netip.AddrFromSlice(data); ok {
+							addrs = append(addrs, addr)
+							ttl = min(ttl, rrttl)
+						}
+					}
+				}
+			} else if rrtype == dnsTypeSOA && len(data) >= 4 {
+				soaTTL = min(rrttl, binary.BigEndian.Uint32(data[len(data)-4:]))
+			}
+		}
+		off += rdata
+	}
+	if len(addrs) == 0 {
+		ttl = soaTTL
+	}
+	return
+}
@@ -0,0 +1,236 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type dnsTestRecord struct {
+	name  string // fully qualified
+	rtype uint16
+	ttl   uint32
+	data  []byte // for CNAME, the target name in wire format
+}
+
+func dnsTestName(t *testing.T, name string) []byte {
+	t.Helper()
+	b, ok := dnsAppendName(nil, name)
+	if !ok {
+		t.Fatal(name)
+	}
+	return b
+}
+
+// dnsTestResponse answers the query msg from records. Names without records get NXDOMAIN,
+// names starting with "fail." get SERVFAIL, and unanswered queries an SOA record with a minimum of 60.
+func dnsTestResponse(t *testing.T, records []dnsTestRecord, msg []byte, truncate bool) []byte {
+	name, off, err := dnsReadName(msg, 12)
+	maybeFatal(t, err)
+	qtype := binary.BigEndian.Uint16(msg[off:])
+	resp := append([]byte(nil), msg[:off+4]...)
+	resp[2], resp[3] = 0x81, 0x80
+	clear(resp[6:12])
+	if truncate {
+		resp[2] |= 0x02
+		return resp
+	}
+	if strings.HasPrefix(name, "fail.") {
+		resp[3] |= 2
+		return resp
+	}
+	var ancount uint16
+	exists := false
+	for target := name; target != ""; {
+		next := ""
+		for _, rec := range records {
+			if strings.EqualFold(rec.name, target) {
+				exists = true
+				if rec.rtype == qtype || rec.rtype == dnsTypeCNAME {
+					if target == name {
+						resp = append(resp, 0xC0, 12)
+					} else {
+						resp = append(resp, dnsTestName(t, target)...)
+					}
+					resp = binary.BigEndian.AppendUint16(resp, rec.rtype)
+					resp = binary.BigEndian.AppendUint16(resp, dnsClassINET)
+					resp = binary.BigEndian.AppendUint32(resp, rec.ttl)
+					resp = binary.BigEndian.AppendUint16(resp, uint16(len(rec.data)))
+					resp = append(resp, rec.data...)
+					ancount++
+					if rec.rtype == dnsTypeCNAME {
+						next, _, _ = dnsReadName(rec.data, 0)
+					}
+				}
+			}
+		}
+		target = next
+	}
+	binary.BigEndian.PutUint16(resp[6:], ancount)
+	if ancount == 0 {
+		if !exists {
+			resp[3] |= dnsRcodeNXDomain
+		}
+		soa := append(dnsTestName(t, "ns.example."), dnsTestName(t, "admin.example.")...)
+		soa = append(soa, 0, 0, 0, 1, 0, 0, 0, 2, 0, 0, 0, 3, 0, 0, 0, 4, 0, 0, 0, 60)
+		resp = append(resp, dnsTestName(t, "example.")...)
+		resp = binary.BigEndian.AppendUint16(resp, dnsTypeSOA)
+		resp = binary.BigEndian.AppendUint16(resp, dnsClassINET)
+		resp = binary.BigEndian.AppendUint32(resp, 300)
+		resp = binary.BigEndian.AppendUint16(resp, uint16(len(soa)))
+		resp = append(resp, soa...)
+		binary.BigEndian.PutUint16(resp[8:], 1)
+	}
+	return resp
+}
+
+// makeDNSServer serves records over UDP and TCP, returning the address and a counter of UDP queries.
+// If truncate is set, UDP responses are truncated so clients must retry over TCP.
+func makeDNSServer(t *testing.T, records []dnsTestRecord, truncate bool) (string, *atomic.Int32) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	maybeFatal(t, err)
+	t.Cleanup(func() { _ = pc.Close() })
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+	var queries atomic.Int32
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			queries.Add(1)
+			_, _ = pc.WriteTo(dnsTestResponse(t, records, buf[:n], truncate), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				var hdr [2]byte
+				if _, err := io.ReadFull(conn, hdr[:]); err == nil {
+					msg := make([]byte, binary.BigEndian.Uint16(hdr[:]))
+					if _, err = io.ReadFull(conn, msg); err == nil {
+						resp := dnsTestResponse(t, records, msg, false)
+						_, _ = conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(resp))), resp...))
+					}
+				}
+			}()
+		}
+	}()
+	return pc.LocalAddr().String(), &queries
+}
+
+func testDNSRecords(t *testing.T) []dnsTestRecord {
+	return []dnsTestRecord{
+		{name: "www.example.com.", rtype: dnsTypeCNAME, ttl: 600, data: dnsTestName(t, "web.example.com.")},
+		{name: "web.example.com.", rtype: dnsTypeA, ttl: 300, data: []byte{192, 0, 2, 1}},
+		{name: "web.example.com.", rtype: dnsTypeAAAA, ttl: 120, data: netip.MustParseAddr("2001:db8::1").AsSlice()},
+		{name: "v4only.example.com.", rtype: dnsTypeA, ttl: 200, data: []byte{192, 0, 2, 2}},
+		{name: "other.example.com.", rtype: dnsTypeA, ttl: 200, data: []byte{192, 0, 2, 3}},
+	}
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func TestDNSResolver(t *testing.T) {
+	server, _ := makeDNSServer(t, testDNSRecords(t), false)
+	dr := &DNSResolver{Server: server}
+	ctx := context.Background()
+	tests := []struct {
+		network, host string
+		want          []string
+		ttl           time.Duration
+	}{
+		{"ip", "www.example.com", []string{"192.0.2.1", "2001:db8::1"}, 120 * time.Second},
+		{"ip4", "WWW.example.com.", []string{"192.0.2.1"}, 300 * time.Second},
+		{"tcp6", "www.example.com", []string{"2001:db8::1"}, 120 * time.Second},
+		{"ip", "v4only.example.com", []string{"192.0.2.2"}, 60 * time.Second},
+		{"ip", "192.0.2.9", []string{"192.0.2.9"}, 0},
+	}
+	for _, tt := range tests {
+		addrs, ttl, err := dr.LookupNetIPTTL(ctx, tt.network, tt.host)
+		maybeFatal(t, err)
+		var got []string
+		for _, addr := range addrs {
+			got = append(got, addr.String())
+		}
+		if !slices.Equal(got, tt.want) || ttl != tt.ttl {
+			t.Errorf("%s %s: got %v %v, want %v %v", tt.network, tt.host, got, ttl, tt.want, tt.ttl)
+		}
+	}
+
+	for _, host := range []string{"missing.example.com", "bad..name"} {
+		if addrs, err := dr.LookupNetIP(ctx, "ip", host); !isNotFound(err) || addrs != nil {
+			t.Error(host, addrs, err)
+		}
+	}
+	if _, ttl, err := dr.LookupNetIPTTL(ctx, "ip6", "v4only.example.com"); !isNotFound(err) || ttl != 60*time.Second {
+		t.Error(ttl, err)
+	}
+	var dnsErr *net.DNSError
+	if _, err := dr.LookupNetIP(ctx, "ip4", "fail.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsTemporary || dnsErr.IsNotFound {
+		t.Error(err)
+	}
+	if s := (&DNSResolver{Server: "127.0.0.1"}).String(); s != "dns://127.0.0.1:53" {
+		t.Error(s)
+	}
+}
+
+func TestDNSResolverTCP(t *testing.T) {
+	server, queries := makeDNSServer(t, testDNSRecords(t), true)
+	dr := &DNSResolver{Server: server}
+	addrs, err := dr.LookupNetIP(context.Background(), "ip4", "other.example.com")
+	maybeFatal(t, err)
+	if len(addrs) != 1 || addrs[0] != netip.MustParseAddr("192.0.2.3") || queries.Load() != 1 {
+		t.Error(addrs, queries.Load())
+	}
+}
+
+func TestDNSResolverTimeout(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	maybeFatal(t, err)
+	defer pc.Close()
+	dr := &DNSResolver{Server: pc.LocalAddr().String(), Timeout: 50 * time.Millisecond}
+	var dnsErr *net.DNSError
+	if _, err := dr.LookupNetIP(context.Background(), "ip", "www.example.com"); !errors.As(err, &dnsErr) || !dnsErr.IsTimeout {
+		t.Error(err)
+	}
+}
+
+func TestDNSParseResponse(t *testing.T) {
+	msg, _ := dnsQuery(1, "www.example.com.", dnsTypeA)
+	if _, _, _, err := dnsParseResponse(msg, "www.example.com.", dnsTypeA); !errors.Is(err, ErrDNSResponse) {
+		t.Error(err)
+	}
+	resp := dnsTestResponse(t, testDNSRecords(t), msg, false)
+	for i := 12; i < len(resp); i++ {
+		if _, _, _, err := dnsParseResponse(resp[:i], "www.example.com.", dnsTypeA); !errors.Is(err, ErrDNSResponse) {
+			t.Error(i, err)
+		}
+	}
+	loop := []byte{0, 1, 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12}
+	if _, _, _, err := dnsParseResponse(loop, "www.example.com.", dnsTypeA); !errors.Is(err, ErrDNSResponse) {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,62 @@
+package httpproxy
+
+import "strings"
+
+type domainFlags uint8
+
+const (
+	blockExact domainFlags = 1 << iota
+	blockSubdomains
+	allowExact
+	allowSubdomains
+)
+
+// domainTrie is a suffix trie of domain name labels.
+type domainTrie struct {
+	children map[string]*domainTrie
+	flags    domainFlags
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func (dt *domainTrie) add(domain string, flags domainFlags) {
+	labels := strings.Split(normalizeHost(domain), ".")
+	node := dt
+	for i := len(labels) - 1; i >= 0; i-- {
+		child := node.children[labels[i]]
+		if child == nil {
+			if node.children == nil {
+				node.children = make(map[string]*domainTrie)
+			}
+			child = &domainTrie{}
+			node.children[labels[i]] = child
+		}
+		node = child
+	}
+	node.flags |= flags
+}
+
+// match returns the union of flags that apply to host,
+// with subdomain flags translated to their exact counterparts.
+func (dt *domainTrie) match(host string) (flags domainFlags) {
+	labels := strings.Split(normalizeHost(host), ".")
+	node := dt
+	for i := len(labels) - 1; i >= 0 && node != nil; i-- {
+		if node = node.children[labels[i]]; node != nil {
+			if i == 0 {
+				flags |= node.flags & (blockExact | allowExact)
+			} else {
+				flags |= (node.flags & (blockSubdomains | allowSubdomains)) >> 1
+			}
+		}
+	}
+	return
+}
+
+// blocked returns true if host matches a block rule and no allow rule.
+func (dt *domainTrie) blocked(host string) bool {
+	flags := dt.match(host)
+	return flags&blockExact != 0 && flags&allowExact == 0
+}
@@ -0,0 +1,71 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// Classes of errors as returned by errorClass.
+const (
+	errClassUnauthorized = "unauthorized"
+	errClassForbidden    = "forbidden"
+	errClassLimit        = "limit"
+	errClassClosed       = "closed"
+	errClassCanceled     = "canceled"
+	errClassDNS          = "dns"
+	errClassRefused      = "refused"
+	errClassUnreachable  = "unreachable"
+	errClassTerminated   = "terminated"
+	errClassTimeout      = "timeout"
+	errClassTLS          = "tls"
+	errClassOther        = "other"
+)
+
+// errorClass returns a short, stable description of the kind of error err is.
+func errorClass(err error) (class string) {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	switch {
+	case err == nil:
+	case errors.Is(err, ErrUnauthorized):
+		class = errClassUnauthorized
+	case errors.Is(err, ErrForbidden):
+		class = errClassForbidden
+	case errors.Is(err, ErrTooManyTunnels), errors.Is(err, ErrTooManyRequests):
+		class = errClassLimit
+	case errors.Is(err, ErrServerClosed):
+		class = errClassClosed
+	case errors.Is(err, context.Canceled):
+		class = errClassCanceled
+	case errors.As(err, &dnsErr):
+		class = errClassDNS
+		if dnsErr.IsTimeout {
+			class = errClassTimeout
+		}
+	case errors.Is(err, syscall.ECONNREFUSED):
+		class = errClassRefused
+	case errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		class = errClassUnreachable
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE),
+		errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		class = errClassTerminated
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		class = errClassTimeout
+	case errors.As(err, &recordErr), errors.As(err, &alertErr), errors.As(err, &certErr),
+		errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr):
+		class = errClassTLS
+	default:
+		class = errClassOther
+	}
+	return
+}
@@ -0,0 +1,206 @@
+package httpproxy
+
+import (
+	"bytes"
+	htmltemplate "html/template"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+)
+
+// DefaultErrorPageHTML is the HTML template used by ErrorPages if none is set.
+var DefaultErrorPageHTML = htmltemplate.Must(htmltemplate.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.StatusCode}} {{.Status}}</title>
+</head>
+<body>
+<h1>{{.Status}}</h1>
+<p>{{.Reason}}</p>
+<dl>
+{{- if .Host}}
+<dt>Host</dt><dd>{{.Host}}</dd>
+{{- end}}
+{{- if .RequestID}}
+<dt>Request ID</dt><dd>{{.RequestID}}</dd>
+{{- end}}
+<dt>Time</dt><dd>{{.Time.Format "2006-01-02 15:04:05 MST"}}</dd>
+</dl>
+{{- if .Contact}}
+<p>If you need assistance, contact {{.Contact}}.</p>
+{{- end}}
+</body>
+</html>
+`))
+
+// DefaultErrorPageText is the plain text template used by ErrorPages if none is set.
+var DefaultErrorPageText = texttemplate.Must(texttemplate.New("error").Parse(`{{.StatusCode}} {{.Status}}
+
+{{.Reason}}
+{{if .Host}}
+Host: {{.Host}}{{end}}{{if .RequestID}}
+Request ID: {{.RequestID}}{{end}}
+Time: {{.Time.Format "2006-01-02 15:04:05 MST"}}
+{{if .Contact}}
+If you need assistance, contact {{.Contact}}.
+{{end}}`))
+
+// ErrorPageData is the data ErrorPages templates are executed with.
+type ErrorPageData struct {
+	StatusCode int       // HTTP status code
+	Status     string    // HTTP status text
+	Reason     string    // explanation of the error suitable for end users
+	ErrorType  string    // RFC 9209 Proxy-Status error type, if any
+	Host       string    // target host name
+	RequestID  string    // ID of the request, as in ConnInfo, empty if none
+	Contact    string    // support contact from ErrorPages
+	Time       time.Time // when the error occurred
+}
+
+// ErrorPages renders the bodies of responses for authorization failures,
+// blocked requests and upstream errors, as HTML or plain text depending
+// on the request's Accept header.
+type ErrorPages struct {
+	HTML    *htmltemplate.Template // optional HTML template, defaults to DefaultErrorPageHTML
+	Text    *texttemplate.Template // optional plain text template, defaults to DefaultErrorPageText
+	Contact string                 // optional support contact shown on pages, such as an email address
+}
+
+// errorReasons maps Proxy-Status error types to explanations for end users.
+var errorReasons = map[string]string{
+	"http_request_denied":       "Access to this destination is not allowed by policy.",
+	"dns_error":                 "The host name could not be resolved.",
+	"dns_timeout":               "Resolving the host name timed out.",
+	"connection_refused":        "The server refused the connection.",
+	"connection_timeout":        "The server did not respond in time.",
+	"destination_ip_unroutable": "The server is unreachable.",
+	"destination_unavailable":   "The server could not be reached.",
+	"connection_terminated":     "The connection to the server was closed unexpectedly.",
+	"tls_alert_received":        "A secure connection to the server could not be established.",
+	"tls_certificate_error":     "The server's certificate could not be verified.",
+	"tls_protocol_error":        "A secure connection to the server could not be established.",
+	"http_protocol_error":       "The server sent an invalid response.",
+	"proxy_internal_error":      "The proxy encountered an internal error.",
+}
+
+func errorReason(err error, code int, errorType string) (reason string) {
+	switch errorClass(err) {
+	case errClassUnauthorized:
+		reason = "Proxy authentication is required."
+	case errClassLimit:
+		reason = "Too many requests, please try again later."
+	case errClassClosed:
+		reason = "The proxy is shutting down, please try again later."
+	case errClassCanceled:
+		reason = "The request was cancelled."
+	default:
+		if reason = errorReasons[errorType]; reason == "" {
+			reason = http.StatusText(code)
+		}
+	}
+	return
+}
+
+// prefersHTML returns true if the Accept header value accept
+// ranks text/html at least as high as text/plain.
+func prefersHTML(accept string) bool {
+	var qHTML, qText float64
+	var explicitHTML bool
+	for _, mr := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mr))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "text/html":
+			qHTML, explicitHTML = q, true
+		case "text/plain":
+			qText = q
+		case "text/*", "*/*":
+			if !explicitHTML {
+				qHTML = max(qHTML, q)
+			}
+			qText = max(qText, q)
+		}
+	}
+	return explicitHTML && qHTML > 0 && qHTML >= qText
+}
+
+// render returns the Content-Type and body of the error page for err.
+func (ep *ErrorPages) render(r *http.Request, id uint64, err error, code int) (contentType, body string, execErr error) {
+	_, errorType, _ := classifyError(err, code)
+	data := ErrorPageData{
+		StatusCode: code,
+		Status:     http.StatusText(code),
+		Reason:     errorReason(err, code, errorType),
+		ErrorType:  errorType,
+		Host:       r.URL.Hostname(),
+		Contact:    ep.Contact,
+		Time:       time.Now(),
+	}
+	if id != 0 {
+		data.RequestID = strconv.FormatUint(id, 10)
+	}
+	var buf bytes.Buffer
+	if prefersHTML(r.Header.Get("Accept")) {
+		tmpl := ep.HTML
+		if tmpl == nil {
+			tmpl = DefaultErrorPageHTML
+		}
+		contentType = "text/html; charset=utf-8"
+		execErr = tmpl.Execute(&buf, data)
+	} else {
+		tmpl := ep.Text
+		if tmpl == nil {
+			tmpl = DefaultErrorPageText
+		}
+		contentType = "text/plain; charset=utf-8"
+		execErr = tmpl.Execute(&buf, data)
+	}
+	body = buf.String()
+	return
+}
+
+func (srv *Server) renderErrorPage(r *http.Request, id uint64, err error, code int) (contentType, body string, ok bool) {
+	if srv.ErrorPages != nil {
+		var execErr error
+		if contentType, body, execErr = srv.ErrorPages.render(r, id, err, code); execErr == nil {
+			ok = true
+		} else if srv.Logger != nil {
+			srv.Logger.Error("errorpage", "error", execErr)
+		}
+	}
+	return
+}
+
+// writeErrorResponse writes the response for err to w, using the ErrorPages if set.
+func (srv *Server) writeErrorResponse(w http.ResponseWriter, r *http.Request, id uint64, err error) {
+	frt := fakeRoundTripper{err}
+	code := frt.StatusCode(http.StatusInternalServerError)
+	if contentType, body, ok := srv.renderErrorPage(r, id, err, code); ok {
+		writeResponse(w, code, frt.Header(), contentType, body)
+	} else {
+		frt.WriteResponse(w)
+	}
+}
+
+// writeConnectError writes the response to the CONNECT request r for err to w, using the ErrorPages if set.
+func (srv *Server) writeConnectError(w io.Writer, r *http.Request, id uint64, err error) error {
+	frt := fakeRoundTripper{err}
+	code := frt.StatusCode(http.StatusInternalServerError)
+	if contentType, body, ok := srv.renderErrorPage(r, id, err, code); ok {
+		return writeConnectResponse(w, code, frt.Header(), contentType, body)
+	}
+	return frt.WriteConnectResponse(w)
+}
@@ -0,0 +1,81 @@
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	texttemplate "text/template"
+)
+
+func TestPrefersHTML(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":          false,
+		"*/*":       false,
+		"text/html": true,
+		"text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8": true,
+		"text/plain, text/html;q=0.5":                                     false,
+		"text/html;q=0.5, */*":                                            false,
+		"text/html;q=0":                                                   false,
+		"text/plain, text/html":                                           true,
+		"bogus;;, text/html":                                              true,
+	} {
+		if got := prefersHTML(accept); got != want {
+			t.Errorf("%q: got %v", accept, got)
+		}
+	}
+}
+
+func TestErrorPages(t *testing.T) {
+	srv := &Server{
+		HostFilter:        testHostFilter{"blocked.example": true},
+		ConnectPortPolicy: AnyConnectPort{},
+		ErrorPages:        &ErrorPages{Contact: "help@example.com"},
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+	client := makeClient(t, proxysrv.URL)
+
+	get := func(url, accept string) (resp *http.Response, body string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Accept", accept)
+		resp, err := client.Do(req)
+		maybeFatal(t, err)
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return resp, string(b)
+	}
+
+	resp, body := get("http://blocked.example/", "text/html")
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Error(resp.Status, resp.Header)
+	}
+	for _, s := range []string{"<h1>Forbidden</h1>", "not allowed by policy", "<dd>blocked.example</dd>", "help@example.com", "Request ID"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("missing %q in %q", s, body)
+		}
+	}
+
+	target := closedAddr(t)
+	resp, body = get("http://"+target+"/", "*/*")
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("Content-Type") != "text/plain; charset=utf-8" || resp.Header.Get("Proxy-Status") == "" {
+		t.Error(resp.Status, resp.Header)
+	}
+	if !strings.HasPrefix(body, "502 Bad Gateway\n\nThe server refused the connection.\n") || strings.Contains(body, "dial") {
+		t.Errorf("%q", body)
+	}
+
+	resp, body = rawConnect(t, proxysrv.Listener.Addr().String(), target, "")
+	if resp.StatusCode != http.StatusBadGateway || !strings.Contains(body, "The server refused the connection.") {
+		t.Error(resp.Status, body)
+	}
+
+	srv.CredentialsValidator = StaticCredentials{"foo": "secret"}
+	srv.ErrorPages.Text = texttemplate.Must(texttemplate.New("custom").Parse("{{.StatusCode}}: {{.Reason}}"))
+	resp, body = get("http://"+target+"/", "")
+	if resp.StatusCode != http.StatusUnauthorized || body != "401: Proxy authentication is required." {
+		t.Error(resp.Status, body)
+	}
+}
@@ -0,0 +1,177 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
+)
+
+var ErrNoDialer = errors.New("no dialer selected")
+
+// A DialerListSelector returns the ContextDialers to try in order.
+//
+// If the Server's DialerSelector implements DialerListSelector, it is used
+// instead of SelectDialer, and failed CONNECT dials and requests are retried
+// using the next ContextDialer as allowed by the Server's RetryPolicy.
+type DialerListSelector interface {
+	// SelectDialers returns the ContextDialers to try, most preferred first.
+	SelectDialers(username, network, address string) (cds []ContextDialer, err error)
+}
+
+// FailoverDialers is a DialerSelector returning the same ContextDialers for all requests,
+// failing over to the next one if dialing fails.
+type FailoverDialers []ContextDialer
+
+var _ DialerSelector = FailoverDialers(nil)
+var _ DialerListSelector = FailoverDialers(nil)
+
+func (fd FailoverDialers) SelectDialer(username, network, address string) (cd ContextDialer, err error) {
+	err = ErrNoDialer
+	if len(fd) > 0 {
+		cd, err = fd[0], nil
+	}
+	return
+}
+
+func (fd FailoverDialers) SelectDialers(username, network, address string) (cds []ContextDialer, err error) {
+	return fd, nil
+}
+
+// RetryPolicy controls retries of failed CONNECT dials and requests.
+//
+// A request is retried if it failed before it was sent, or if it has no body
+// and is idempotent as described in RFC 9110 section 9.2.2 or has an Idempotency-Key header.
+type RetryPolicy struct {
+	Attempts   int           // optional maximum number of attempts, defaults to the number of ContextDialers selected
+	Backoff    time.Duration // optional delay before the second attempt, doubled for each following attempt
+	MaxBackoff time.Duration // optional maximum delay between attempts
+}
+
+func (rp *RetryPolicy) attempts(candidates int) int {
+	if rp != nil && rp.Attempts > 0 {
+		return rp.Attempts
+	}
+	return candidates
+}
+
+// wait sleeps before retry number n, starting at 1.
+func (rp *RetryPolicy) wait(ctx context.Context, n int) (err error) {
+	if rp != nil && rp.Backoff > 0 {
+		d := rp.Backoff << min(n-1, 30)
+		if rp.MaxBackoff > 0 && (d > rp.MaxBackoff || d <= 0) {
+			d = rp.MaxBackoff
+		}
+		tmr := time.NewTimer(d)
+		defer tmr.Stop()
+		select {
+		case <-tmr.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	return
+}
+
+// retryableError returns false if retrying err with another ContextDialer can't succeed.
+func retryableError(ctx context.Context, err error) bool {
+	switch errorClass(err) {
+	case errClassUnauthorized, errClassForbidden, errClassLimit, errClassClosed, errClassCanceled:
+		return false
+	}
+	return ctx.Err() == nil
+}
+
+func idempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return r.Header.Get("Idempotency-Key") != "" || r.Header.Get("X-Idempotency-Key") != ""
+}
+
+// retry calls attempt with the ContextDialers in cds in turn, as allowed by the Server's RetryPolicy,
+// until it succeeds or returns false for retry. The ContextDialer last used is recorded in the session.
+func (srv *Server) retry(sess *session, cds []ContextDialer, attempt func(cd ContextDialer) (retry bool, err error)) (err error) {
+	err = ErrNoDialer
+	if len(cds) > 0 {
+		failover := len(cds) > 1 || srv.RetryPolicy != nil
+		n := srv.RetryPolicy.attempts(len(cds))
+		for i := 0; i < n; i++ {
+			if i > 0 {
+				if waitErr := srv.RetryPolicy.wait(sess.ctx, i); waitErr != nil {
+					break
+				}
+				srv.Metrics.retried()
+			}
+			cd := cds[i%len(cds)]
+			sess.setDialer(cd)
+			if failover {
+				sess.setAttempts(i + 1)
+			}
+			var retry bool
+			if retry, err = attempt(cd); err == nil || !retry {
+				break
+			}
+			if srv.Logger != nil {
+				srv.Logger.Warn("retry", "id", sess.id, "dialer", dialerName(cd), "attempt", i+1, "error", err)
+			}
+		}
+	}
+	return
+}
+
+// dial connects to address for the CONNECT session, failing over between the ContextDialers in cds.
+func (srv *Server) dial(sess *session, cds []ContextDialer, address string) (conn net.Conn, err error) {
+	err = srv.retry(sess, cds, func(cd ContextDialer) (bool, error) {
+		start := time.Now()
+		var err error
+		conn, err = cd.DialContext(sess.ctx, "tcp", address)
+		sess.trace.add("dial", start, err, "server.address", address, "dialer", dialerName(cd))
+		if err == nil {
+			srv.Metrics.dialed(time.Since(start))
+		}
+		return retryableError(sess.ctx, err), err
+	})
+	return
+}
+
+// failoverRoundTripper forwards requests using the RoundTripper for each of its ContextDialers in turn.
+type failoverRoundTripper struct {
+	srv  *Server
+	sess *session
+	cds  []ContextDialer
+}
+
+func (frt failoverRoundTripper) RoundTrip(r *http.Request) (resp *http.Response, err error) {
+	// a failed RoundTrip consumes and closes the body, so it must be rewound to retry
+	hasBody := r.Body != nil && r.Body != http.NoBody
+	rewindable := !hasBody || r.GetBody != nil
+	attempts := 0
+	err = frt.srv.retry(frt.sess, frt.cds, func(cd ContextDialer) (bool, error) {
+		req := r
+		if attempts++; attempts > 1 && hasBody {
+			body, err := r.GetBody()
+			if err != nil {
+				return false, err
+			}
+			req = r.Clone(r.Context())
+			req.Body = body
+		}
+		var sent atomic.Bool
+		ctx := httptrace.WithClientTrace(req.Context(), &httptrace.ClientTrace{
+			WroteHeaders: func() { sent.Store(true) },
+		})
+		var err error
+		resp, err = frt.srv.ensureTripper(cd).RoundTrip(req.WithContext(ctx))
+		retry := rewindable && retryableError(r.Context(), err)
+		if sent.Load() {
+			retry = retry && idempotent(r) && !hasBody
+		}
+		return retry, err
+	})
+	return
+}
@@ -0,0 +1,197 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var errTestDial = errors.New("test dial failure")
+
+type failingDialer string
+
+func (fd failingDialer) String() string { return string(fd) }
+
+func (failingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return nil, errTestDial
+}
+
+// hangupDialer connects to a server that reads the request headers and closes the connection.
+type hangupDialer struct{ addr string }
+
+func (hd hangupDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return DefaultContextDialer.DialContext(ctx, network, hd.addr)
+}
+
+func makeHangupListener(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	maybeFatal(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = http.ReadRequest(bufio.NewReader(conn))
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func TestFailoverConnect(t *testing.T) {
+	destsrv := makeHTTPSDestSrv(t)
+	defer destsrv.Close()
+	rur := newRecordingUsageReporter()
+	metrics := &Metrics{}
+	proxysrv := httptest.NewServer(&Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		DialerSelector:    FailoverDialers{failingDialer("first"), DefaultContextDialer},
+		UsageReporter:     rur,
+		Metrics:           metrics,
+	})
+	defer proxysrv.Close()
+
+	client := makeClient(t, proxysrv.URL)
+	resp, err := client.Get(destsrv.URL)
+	maybeFatal(t, err)
+	body, err := io.ReadAll(resp.Body)
+	maybeFatal(t, err)
+	maybeFatal(t, resp.Body.Close())
+	if !bytes.Equal(body, testBody) {
+		t.Error(string(body))
+	}
+	client.CloseIdleConnections()
+	if u := rur.next(t); u.Dialer != "direct" || u.Attempts != 2 || u.StatusCode != http.StatusOK {
+		t.Errorf("%#v", u)
+	}
+	var sb strings.Builder
+	_, _ = metrics.WriteTo(&sb)
+	if !strings.Contains(sb.String(), "httpproxy_retries_total 1\n") {
+		t.Error(sb.String())
+	}
+}
+
+func TestFailoverRequest(t *testing.T) {
+	destsrv := makeHTTPDestSrv(t)
+	defer destsrv.Close()
+	hangup := makeHangupListener(t)
+	defer hangup.Close()
+	rur := newRecordingUsageReporter()
+	proxysrv := httptest.NewServer(&Server{
+		DialerSelector: FailoverDialers{hangupDialer{hangup.Addr().String()}, DefaultContextDialer},
+		UsageReporter:  rur,
+	})
+	defer proxysrv.Close()
+	client := makeClient(t, proxysrv.URL)
+
+	resp, err := client.Get(destsrv.URL)
+	maybeFatal(t, err)
+	body, err := io.ReadAll(resp.Body)
+	maybeFatal(t, err)
+	maybeFatal(t, resp.Body.Close())
+	if !bytes.Equal(body, testBody) {
+		t.Error(string(body))
+	}
+	if u := rur.next(t); u.Dialer != "direct" || u.Attempts != 2 {
+		t.Errorf("%#v", u)
+	}
+
+	// a request with a body that was sent is not retried
+	resp, err = client.Post(destsrv.URL, "text/plain", strings.NewReader("data"))
+	maybeFatal(t, err)
+	maybeFatal(t, resp.Body.Close())
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error(resp.StatusCode)
+	}
+	if u := rur.next(t); u.Attempts != 1 {
+		t.Errorf("%#v", u)
+	}
+}
+
+func TestFailoverRequestBody(t *testing.T) {
+	bodies := make(chan string, 2)
+	destsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	defer destsrv.Close()
+	rur := newRecordingUsageReporter()
+	srv := &Server{
+		DialerSelector: FailoverDialers{failingDialer("first"), DefaultContextDialer},
+		UsageReporter:  rur,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	// the body of a proxied request can't be rewound, so it is not retried even if it wasn't sent
+	resp, err := makeClient(t, proxysrv.URL).Post(destsrv.URL, "text/plain", strings.NewReader("data"))
+	maybeFatal(t, err)
+	maybeFatal(t, resp.Body.Close())
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Error(resp.StatusCode)
+	}
+	if u := rur.next(t); u.Attempts != 1 {
+		t.Errorf("%#v", u)
+	}
+
+	// a body that can be rewound is sent again in full
+	req, err := http.NewRequest(http.MethodPost, destsrv.URL, strings.NewReader("data"))
+	maybeFatal(t, err)
+	sess, err := srv.addSession(req, ConnKindRequest)
+	maybeFatal(t, err)
+	frt := failoverRoundTripper{srv: srv, sess: sess, cds: []ContextDialer{failingDialer("first"), DefaultContextDialer}}
+	resp, err = frt.RoundTrip(req)
+	maybeFatal(t, err)
+	maybeFatal(t, resp.Body.Close())
+	srv.removeSession(sess)
+	_ = rur.next(t)
+	if body := <-bodies; body != "data" {
+		t.Error(body)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	rur := newRecordingUsageReporter()
+	proxysrv := httptest.NewServer(&Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		DialerSelector:    FailoverDialers{failingDialer("a"), failingDialer("b")},
+		RetryPolicy:       &RetryPolicy{Attempts: 3, Backoff: 20 * time.Millisecond, MaxBackoff: 30 * time.Millisecond},
+		UsageReporter:     rur,
+	})
+	defer proxysrv.Close()
+
+	start := time.Now()
+	_, err := makeClient(t, proxysrv.URL).Get("https://127.0.0.1:1/")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+	if d := time.Since(start); d < 50*time.Millisecond {
+		t.Error(d)
+	}
+	if u := rur.next(t); u.Dialer != "a" || u.Attempts != 3 || u.StatusCode != http.StatusBadGateway {
+		t.Errorf("%#v", u)
+	}
+}
+
+func TestFailoverDialers(t *testing.T) {
+	if _, err := (FailoverDialers{}).SelectDialer("", "tcp", "x:1"); err != ErrNoDialer {
+		t.Error(err)
+	}
+	srv := &Server{DialerSelector: FailoverDialers{}}
+	req := httptest.NewRequest(http.MethodGet, "http://x/", nil)
+	if _, _, _, err := srv.getDialer(req); err != ErrNoDialer {
+		t.Error(err)
+	}
+}
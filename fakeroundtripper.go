@@ -2,9 +2,12 @@ package httpproxy
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
+	"strings"
 )
 
 type fakeRoundTripper struct {
@@ -18,33 +21,62 @@ var fakeRoundTripperHeader = http.Header{
 
 var fakeRoundTripperFprintf = fmt.Fprintf
 
+// Header returns the header fields describing the error, if any.
+func (f fakeRoundTripper) Header() (hdr http.Header) {
+	hdr = http.Header{}
+	var le *LimitError
+	if errors.As(f.err, &le) {
+		hdr.Set("Retry-After", le.retryAfter())
+	}
+	if _, errorType, params := classifyError(f.err, 0); errorType != "" {
+		hdr.Set("Proxy-Status", proxyStatus(errorType, params))
+	}
+	return
+}
+
 func (f fakeRoundTripper) WriteConnectResponse(w io.Writer) (err error) {
 	code := f.StatusCode(http.StatusInternalServerError)
-	_, err = fakeRoundTripperFprintf(w, "HTTP/1.0 %03d %s\r\n\r\n", code, http.StatusText(code))
+	return writeConnectResponse(w, code, f.Header(), fakeRoundTripperHeader.Get("Content-Type"), errorBody(f.err, code))
+}
+
+// writeConnectResponse writes a response to a CONNECT request to w,
+// adding the Content-Type and Content-Length to hdr if body is not empty.
+func writeConnectResponse(w io.Writer, code int, hdr http.Header, contentType, body string) (err error) {
+	if body != "" {
+		hdr.Set("Content-Type", contentType)
+		hdr.Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	var sb strings.Builder
+	_ = hdr.Write(&sb)
+	_, err = fakeRoundTripperFprintf(w, "HTTP/1.0 %03d %s\r\n%s\r\n%s", code, http.StatusText(code), sb.String(), body)
 	return
 }
 
 func (f fakeRoundTripper) WriteResponse(w http.ResponseWriter) {
-	hdr := w.Header()
-	clear(hdr)
+	code := f.StatusCode(http.StatusInternalServerError)
+	writeResponse(w, code, f.Header(), fakeRoundTripperHeader.Get("Content-Type"), errorBody(f.err, code))
+}
+
+// writeResponse replaces the headers in w with hdr and the given Content-Type and writes the response.
+func writeResponse(w http.ResponseWriter, code int, hdr http.Header, contentType, body string) {
+	wh := w.Header()
+	clear(wh)
 	for k, vv := range fakeRoundTripperHeader {
-		hdr[k] = append([]string{}, vv...)
+		wh[k] = append([]string{}, vv...)
 	}
-	code := f.StatusCode(http.StatusInternalServerError)
+	for k, vv := range hdr {
+		wh[k] = vv
+	}
+	wh.Set("Content-Type", contentType)
 	w.WriteHeader(code)
-	if code == http.StatusInternalServerError && f.err != nil {
-		_, _ = w.Write([]byte(f.err.Error()))
+	if body != "" {
+		_, _ = io.WriteString(w, body)
 	}
 }
 
+// StatusCode returns the HTTP status code for the error, or defaultcode if it can't be classified.
 func (f fakeRoundTripper) StatusCode(defaultcode int) (code int) {
-	code = defaultcode
-	switch f.err {
-	case nil:
-		code = http.StatusOK
-	case ErrUnauthorized:
-		code = http.StatusUnauthorized
-	}
+	code, _, _ = classifyError(f.err, defaultcode)
 	return
 }
 
@@ -54,7 +86,7 @@ func (f fakeRoundTripper) RoundTrip(req *http.Request) (resp *http.Response, err
 	if code != 0 {
 		err = nil
 		var body io.Reader = bytes.NewReader(nil)
-		var hdr http.Header
+		hdr := f.Header()
 		/*if code == http.StatusInternalServerError && f.err != nil {
 			hdr = fakeRoundTripperHeader
 			body = strings.NewReader(f.err.Error())
@@ -1,17 +1,54 @@
 package httpproxy
 
 import (
+	"bufio"
+	"bytes"
 	"errors"
+	"io"
 	"net"
 	"net/http"
 )
 
 var ErrHijackingNotSupported = errors.New("http.ResponseWriter does not support http.Hijacker")
 
+// hijackedConn is a hijacked net.Conn that first returns the data
+// the http.Server had buffered from the client before the hijack.
+type hijackedConn struct {
+	net.Conn
+	buffered []byte
+}
+
+func (hc *hijackedConn) Read(p []byte) (n int, err error) {
+	if len(hc.buffered) > 0 {
+		n = copy(p, hc.buffered)
+		hc.buffered = hc.buffered[n:]
+		return
+	}
+	return hc.Conn.Read(p)
+}
+
 func hijack(w http.ResponseWriter) (conn net.Conn, err error) {
 	err = ErrHijackingNotSupported
 	if hj, ok := w.(http.Hijacker); ok {
-		conn, _, err = hj.Hijack()
+		var brw *bufio.ReadWriter
+		if conn, brw, err = hj.Hijack(); err == nil {
+			if n := brw.Reader.Buffered(); n > 0 {
+				buf, _ := brw.Reader.Peek(n)
+				conn = &hijackedConn{Conn: conn, buffered: bytes.Clone(buf)}
+			}
+		}
 	}
 	return
 }
+
+// unwrapHijacked writes any data still buffered in conn to w
+// and returns the underlying net.Conn.
+func unwrapHijacked(conn net.Conn, w io.Writer) (net.Conn, error) {
+	if hc, ok := conn.(*hijackedConn); ok {
+		buffered := hc.buffered
+		hc.buffered = nil
+		_, err := w.Write(buffered)
+		return hc.Conn, err
+	}
+	return conn, nil
+}
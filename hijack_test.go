@@ -0,0 +1,107 @@
+package httpproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// makeEchoListener returns a listener that echoes data back. If upgrade is true,
+// it first reads a HTTP request and responds with a WebSocket upgrade.
+func makeEchoListener(t *testing.T, upgrade bool) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	maybeFatal(t, err)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				var r io.Reader = c
+				if upgrade {
+					br := bufio.NewReader(c)
+					if _, err := http.ReadRequest(br); err != nil {
+						return
+					}
+					if _, err := io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"); err != nil {
+						return
+					}
+					r = br
+				}
+				_, _ = io.Copy(c, r)
+			}()
+		}
+	}()
+	return l
+}
+
+func readEchoed(t *testing.T, br *bufio.Reader, want string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(br, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+func TestConnectPipelinedPayload(t *testing.T) {
+	const payload = "pipelined payload"
+	l := makeEchoListener(t, false)
+	defer l.Close()
+
+	for _, si := range []*SNIInspector{nil, {Timeout: time.Second}} {
+		proxysrv := httptest.NewServer(&Server{ConnectPortPolicy: AnyConnectPort{}, SNIInspector: si})
+		conn, err := net.Dial("tcp", proxysrv.Listener.Addr().String())
+		maybeFatal(t, err)
+		_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+		target := l.Addr().String()
+		_, err = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"+payload)
+		maybeFatal(t, err)
+		br := bufio.NewReader(conn)
+		resp, err := http.ReadResponse(br, nil)
+		maybeFatal(t, err)
+		if resp.StatusCode != http.StatusOK {
+			t.Fatal(resp.Status)
+		}
+		readEchoed(t, br, payload)
+		_, err = io.WriteString(conn, "more")
+		maybeFatal(t, err)
+		readEchoed(t, br, "more")
+		conn.Close()
+		proxysrv.Close()
+	}
+}
+
+func TestWebSocketPipelinedPayload(t *testing.T) {
+	const payload = "early frames"
+	l := makeEchoListener(t, true)
+	defer l.Close()
+
+	proxysrv := httptest.NewServer(&Server{})
+	defer proxysrv.Close()
+
+	conn, err := net.Dial("tcp", proxysrv.Listener.Addr().String())
+	maybeFatal(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	target := l.Addr().String()
+	_, err = io.WriteString(conn, "GET http://"+target+"/ HTTP/1.1\r\nHost: "+target+
+		"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n"+payload)
+	maybeFatal(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	maybeFatal(t, err)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal(resp.Status)
+	}
+	readEchoed(t, br, payload)
+}
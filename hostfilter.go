@@ -0,0 +1,13 @@
+package httpproxy
+
+import "fmt"
+
+var ErrBlocked = fmt.Errorf("%w: blocked", ErrForbidden)
+
+// A HostFilter decides if requests to a host should be blocked.
+type HostFilter interface {
+	// BlockHost returns true if username may not access host.
+	//
+	// If username is the empty string no authorization has taken place (anonymous usage).
+	BlockHost(username, host string) bool
+}
@@ -0,0 +1,87 @@
+package httpproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// HTTPProxyDialer is a ContextDialer that connects through an upstream
+// HTTP proxy using the CONNECT method.
+//
+// If the proxy responds 403 Forbidden, the error wraps ErrForbidden,
+// otherwise failures wrap ErrUpstreamProxy.
+type HTTPProxyDialer struct {
+	Address       string        // host:port of the upstream proxy
+	TLSConfig     *tls.Config   // optional, if set the upstream proxy is connected to using TLS
+	Username      string        // optional username for Proxy-Authorization
+	Password      string        // optional password for Proxy-Authorization
+	ContextDialer ContextDialer // optional dialer used to reach the proxy, otherwise uses DefaultContextDialer
+}
+
+var _ ContextDialer = (*HTTPProxyDialer)(nil)
+
+func (hpd *HTTPProxyDialer) String() string {
+	scheme := "http"
+	if hpd.TLSConfig != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + hpd.Address
+}
+
+func (hpd *HTTPProxyDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	if conn, err = dialProxy(ctx, hpd.ContextDialer, hpd.Address); err == nil {
+		if hpd.TLSConfig != nil {
+			cfg := hpd.TLSConfig.Clone()
+			if cfg.ServerName == "" {
+				cfg.ServerName, _, _ = net.SplitHostPort(hpd.Address)
+			}
+			conn = tls.Client(conn, cfg)
+		}
+		err = proxyHandshake(ctx, conn, func() (err error) {
+			conn, err = hpd.connect(conn, address)
+			return
+		})
+	}
+	if err != nil {
+		conn = nil
+	}
+	return
+}
+
+func (hpd *HTTPProxyDialer) connect(conn net.Conn, address string) (tunnel net.Conn, err error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if hpd.Username != "" {
+		SetBasicAuth(req.Header, hpd.Username, hpd.Password)
+	}
+	tunnel = conn
+	if err = req.Write(conn); err == nil {
+		br := bufio.NewReader(conn)
+		var resp *http.Response
+		if resp, err = http.ReadResponse(br, req); err == nil {
+			_ = resp.Body.Close()
+			switch resp.StatusCode {
+			case http.StatusOK:
+				if n := br.Buffered(); n > 0 {
+					buf, _ := br.Peek(n)
+					tunnel = &hijackedConn{Conn: conn, buffered: bytes.Clone(buf)}
+				}
+			case http.StatusForbidden:
+				err = fmt.Errorf("%w: %s: %s", ErrForbidden, hpd.Address, resp.Status)
+			default:
+				err = fmt.Errorf("%w: %s: %s", ErrUpstreamProxy, hpd.Address, resp.Status)
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,88 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func checkEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	_, err := conn.Write([]byte("ping"))
+	maybeFatal(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	maybeFatal(t, err)
+	if string(buf) != "ping" {
+		t.Error(string(buf))
+	}
+}
+
+func TestHTTPProxyDialer(t *testing.T) {
+	echo := makeEchoListener(t, false)
+	defer echo.Close()
+	auths := make(chan string, 1)
+	srv := &Server{ConnectPortPolicy: AnyConnectPort{}}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auths <- r.Header.Get(proxyAuthorizationHeader)
+		srv.ServeHTTP(w, r)
+	}))
+	defer upstream.Close()
+
+	hpd := &HTTPProxyDialer{Address: upstream.Listener.Addr().String(), Username: "user", Password: "pass"}
+	conn, err := hpd.DialContext(context.Background(), "tcp", echo.Addr().String())
+	maybeFatal(t, err)
+	checkEcho(t, conn)
+	if user, pass, _ := GetBasicAuth(http.Header{proxyAuthorizationHeader: {<-auths}}); user != "user" || pass != "pass" {
+		t.Error(user, pass)
+	}
+	if s := hpd.String(); s != "http://"+hpd.Address {
+		t.Error(s)
+	}
+}
+
+func TestHTTPProxyDialerTLS(t *testing.T) {
+	echo := makeEchoListener(t, false)
+	defer echo.Close()
+	upstream := httptest.NewTLSServer(&Server{ConnectPortPolicy: AnyConnectPort{}})
+	defer upstream.Close()
+	hpd := &HTTPProxyDialer{
+		Address:   upstream.Listener.Addr().String(),
+		TLSConfig: upstream.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+	conn, err := hpd.DialContext(context.Background(), "tcp", echo.Addr().String())
+	maybeFatal(t, err)
+	checkEcho(t, conn)
+}
+
+func TestHTTPProxyDialerErrors(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "forbidden.example.com:443" {
+			w.WriteHeader(http.StatusForbidden)
+		} else {
+			w.WriteHeader(http.StatusProxyAuthRequired)
+		}
+	}))
+	defer upstream.Close()
+	hpd := &HTTPProxyDialer{Address: upstream.Listener.Addr().String()}
+	if _, err := hpd.DialContext(context.Background(), "tcp", "forbidden.example.com:443"); !errors.Is(err, ErrForbidden) {
+		t.Error(err)
+	}
+	if _, err := hpd.DialContext(context.Background(), "tcp", "www.example.com:443"); !errors.Is(err, ErrUpstreamProxy) {
+		t.Error(err)
+	}
+
+	silent := makeAcceptListener(t)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	hpd = &HTTPProxyDialer{Address: silent.Addr().String()}
+	if _, err := hpd.DialContext(ctx, "tcp", "www.example.com:443"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error(err)
+	}
+}
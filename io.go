@@ -1,10 +1,12 @@
 package httpproxy
 
 import (
+	"bytes"
 	"errors"
 	"io"
 	"net"
 	"sync"
+	"sync/atomic"
 )
 
 type halfClosable interface {
@@ -15,24 +17,56 @@ type halfClosable interface {
 
 var _ halfClosable = (*net.TCPConn)(nil)
 
-func copyAndClose(dst, src halfClosable, wg *sync.WaitGroup) {
+// countingReader adds the number of bytes read to n.
+type countingReader struct {
+	io.Reader
+	n *atomic.Int64
+}
+
+func (cr countingReader) Read(p []byte) (n int, err error) {
+	n, err = cr.Reader.Read(p)
+	cr.n.Add(int64(n))
+	return
+}
+
+// sentWriter writes data already read from the client, counting, limiting
+// and throttling it like data read using the session reader.
+type sentWriter struct {
+	io.Writer
+	sess *session
+}
+
+func (sw sentWriter) Write(p []byte) (n int, err error) {
+	var written int64
+	written, err = io.Copy(sw.Writer, sw.sess.reader(bytes.NewReader(p), true))
+	return int(written), err
+}
+
+func ignoreClosed(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		err = nil
+	}
+	return err
+}
+
+// copyAndClose copies from src to dst, accounting for it in sess
+// as sent by the client if sent is true, otherwise as received by it.
+func copyAndClose(sess *session, dst, src halfClosable, sent bool, wg *sync.WaitGroup) {
 	defer wg.Done()
-	_, _ = io.Copy(dst, src)
+	_, err := io.Copy(dst, sess.reader(src, sent))
+	sess.setErr(ignoreClosed(err))
 	_ = dst.CloseWrite()
 	_ = src.CloseRead()
 }
 
 func copyUntilClosed(ch chan<- error, dst io.Writer, src io.Reader) {
 	_, err := io.Copy(dst, src)
-	if errors.Is(err, net.ErrClosed) {
-		err = nil
-	}
-	ch <- err
+	ch <- ignoreClosed(err)
 }
 
-func proxyUntilClosed(targetConn io.ReadWriter, clientConn io.ReadWriter) error {
+func proxyUntilClosed(sess *session, targetConn io.ReadWriter, clientConn io.ReadWriter) error {
 	ch := make(chan error, 2)
-	go copyUntilClosed(ch, targetConn, clientConn)
-	go copyUntilClosed(ch, clientConn, targetConn)
+	go copyUntilClosed(ch, targetConn, sess.reader(clientConn, true))
+	go copyUntilClosed(ch, clientConn, sess.reader(targetConn, false))
 	return <-ch
 }
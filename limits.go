@@ -0,0 +1,178 @@
+package httpproxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var ErrTooManyTunnels = errors.New("too many tunnels")
+var ErrTooManyRequests = errors.New("too many requests")
+
+// LimitError is returned when a Limits limit is exceeded.
+type LimitError struct {
+	Err        error         // ErrTooManyTunnels or ErrTooManyRequests
+	Key        string        // the username or client IP that exceeded the limit
+	RetryAfter time.Duration // suggested time to wait before retrying
+}
+
+func (le *LimitError) Error() string {
+	return fmt.Sprintf("%v: %s", le.Err, le.Key)
+}
+
+func (le *LimitError) Unwrap() error {
+	return le.Err
+}
+
+// retryAfter returns the value for the Retry-After header.
+func (le *LimitError) retryAfter() string {
+	return strconv.Itoa(max(1, int(math.Ceil(le.RetryAfter.Seconds()))))
+}
+
+// Limits caps the number of concurrent CONNECT tunnels per user and per client IP,
+// and the rate of proxied requests per user. Anonymous clients count as a user per client IP.
+//
+// A zero limit means unlimited. The limits may be changed at any time.
+// Exceeding a tunnel limit results in 503 Service Unavailable, exceeding
+// the request rate in 429 Too Many Requests, both with a Retry-After header.
+type Limits struct {
+	Logger         Logger        // optional logger for limit changes and limits being exceeded
+	RetryAfter     time.Duration // Retry-After suggested when a tunnel limit is exceeded, defaults to one second
+	mu             sync.Mutex    // protects following
+	tunnelsPerUser int
+	tunnelsPerIP   int
+	requestRate    Bandwidth // requests per second and burst
+	userTunnels    map[string]int
+	ipTunnels      map[string]int
+	requestBuckets map[string]*tokenBucket
+}
+
+func (l *Limits) logInfo(msg string, keyValuePairs ...any) {
+	if l.Logger != nil {
+		l.Logger.Info(msg, keyValuePairs...)
+	}
+}
+
+// SetTunnelsPerUser sets the maximum number of concurrent CONNECT tunnels
+// per username (or client IP for anonymous usage).
+func (l *Limits) SetTunnelsPerUser(n int) {
+	l.mu.Lock()
+	l.tunnelsPerUser = n
+	l.mu.Unlock()
+	l.logInfo("limits", "tunnels_per_user", n)
+}
+
+// SetTunnelsPerIP sets the maximum number of concurrent CONNECT tunnels per client IP address.
+func (l *Limits) SetTunnelsPerIP(n int) {
+	l.mu.Lock()
+	l.tunnelsPerIP = n
+	l.mu.Unlock()
+	l.logInfo("limits", "tunnels_per_ip", n)
+}
+
+// SetRequestRate sets the maximum number of proxied requests per second
+// and the burst size, per username (or client IP for anonymous usage).
+func (l *Limits) SetRequestRate(perSecond, burst int64) {
+	l.mu.Lock()
+	l.requestRate = Bandwidth{Rate: perSecond, Burst: burst}
+	l.requestBuckets = nil
+	l.mu.Unlock()
+	l.logInfo("limits", "request_rate", perSecond, "request_burst", burst)
+}
+
+// Get returns the current limits.
+func (l *Limits) Get() (tunnelsPerUser, tunnelsPerIP int, requestsPerSecond, requestBurst int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tunnelsPerUser, l.tunnelsPerIP, l.requestRate.Rate, l.requestRate.Burst
+}
+
+func (l *Limits) exceeded(err error, key string, retryAfter time.Duration) error {
+	le := &LimitError{Err: err, Key: key, RetryAfter: retryAfter}
+	if l.Logger != nil {
+		l.Logger.Warn("limits", "error", le)
+	}
+	return le
+}
+
+func clientIP(remoteAddr string) string {
+	if host, _, err := net.SplitHostPort(remoteAddr); err == nil {
+		return host
+	}
+	return remoteAddr
+}
+
+// acquireTunnel reserves a tunnel for username and remoteAddr.
+// If it returns a nil error, release must be called when the tunnel closes.
+func (l *Limits) acquireTunnel(username, remoteAddr string) (release func(), err error) {
+	ip := clientIP(remoteAddr)
+	user := username
+	if user == "" {
+		// anonymous clients aren't all the same user
+		user = ip
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	retryAfter := l.RetryAfter
+	if retryAfter <= 0 {
+		retryAfter = time.Second
+	}
+	if l.tunnelsPerUser > 0 && l.userTunnels[user] >= l.tunnelsPerUser {
+		return nil, l.exceeded(ErrTooManyTunnels, user, retryAfter)
+	}
+	if l.tunnelsPerIP > 0 && l.ipTunnels[ip] >= l.tunnelsPerIP {
+		return nil, l.exceeded(ErrTooManyTunnels, ip, retryAfter)
+	}
+	if l.userTunnels == nil {
+		l.userTunnels = make(map[string]int)
+		l.ipTunnels = make(map[string]int)
+	}
+	l.userTunnels[user]++
+	l.ipTunnels[ip]++
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.userTunnels[user]--; l.userTunnels[user] <= 0 {
+				delete(l.userTunnels, user)
+			}
+			if l.ipTunnels[ip]--; l.ipTunnels[ip] <= 0 {
+				delete(l.ipTunnels, ip)
+			}
+		})
+	}
+	return
+}
+
+// allowRequest returns a non-nil error if the request rate for username
+// (or remoteAddr's IP if username is empty) is exceeded.
+func (l *Limits) allowRequest(username, remoteAddr string) (err error) {
+	key := username
+	if key == "" {
+		key = clientIP(remoteAddr)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.requestBuckets == nil {
+		l.requestBuckets = make(map[string]*tokenBucket)
+	}
+	if tb := getTokenBucket(l.requestBuckets, key, l.requestRate); tb != nil {
+		if ok, retryAfter := tb.take(1); !ok {
+			err = l.exceeded(ErrTooManyRequests, key, retryAfter)
+		}
+	}
+	return
+}
+
+// releaser calls a function when closed.
+type releaser func()
+
+func (r releaser) Close() error {
+	r()
+	return nil
+}
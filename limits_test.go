@@ -0,0 +1,137 @@
+package httpproxy
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func TestLimitsTunnels(t *testing.T) {
+	l := makeEchoListener(t, false)
+	defer l.Close()
+	var logbuf syncBuffer
+	limits := &Limits{Logger: slog.New(slog.NewTextHandler(&logbuf, nil))}
+	limits.SetTunnelsPerUser(1)
+	srv := &Server{
+		ConnectPortPolicy:    AnyConnectPort{},
+		CredentialsValidator: StaticCredentials{"foo": "secret", "bar": "secret"},
+		Limits:               limits,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+	proxyaddr := proxysrv.Listener.Addr().String()
+
+	conn1, _, resp := openTunnelAuth(t, proxyaddr, l.Addr().String(), "foo")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	_, _, resp = openTunnelAuth(t, proxyaddr, l.Addr().String(), "foo")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "1" {
+		t.Error(resp.Status, resp.Header)
+	}
+	conn2, _, resp := openTunnelAuth(t, proxyaddr, l.Addr().String(), "bar")
+	defer conn2.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error(resp.Status)
+	}
+
+	limits.SetTunnelsPerIP(2)
+	_, _, resp = openTunnelAuth(t, proxyaddr, l.Addr().String(), "baz")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error(resp.Status)
+	}
+	limits.SetTunnelsPerUser(2)
+	_, _, resp = openTunnelAuth(t, proxyaddr, l.Addr().String(), "foo")
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error(resp.Status)
+	}
+
+	conn1.Close()
+	waitForConns(t, srv, 1)
+	conn3, _, resp := openTunnelAuth(t, proxyaddr, l.Addr().String(), "foo")
+	defer conn3.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error(resp.Status)
+	}
+
+	if tpu, tpi, _, _ := limits.Get(); tpu != 2 || tpi != 2 {
+		t.Error(tpu, tpi)
+	}
+	logs := logbuf.String()
+	if !strings.Contains(logs, "tunnels_per_user=2") || !strings.Contains(logs, ErrTooManyTunnels.Error()) {
+		t.Error(logs)
+	}
+}
+
+func TestLimitsRequestRate(t *testing.T) {
+	destsrv := makeHTTPDestSrv(t)
+	defer destsrv.Close()
+	limits := &Limits{}
+	limits.SetRequestRate(1, 2)
+	proxysrv := httptest.NewServer(&Server{Limits: limits})
+	defer proxysrv.Close()
+	client := makeClient(t, proxysrv.URL)
+
+	for i, want := range []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests} {
+		resp, err := client.Get(destsrv.URL)
+		maybeFatal(t, err)
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Error(i, resp.Status)
+		}
+		if want == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "1" {
+			t.Error(resp.Header)
+		}
+	}
+
+	limits.SetRequestRate(0, 0)
+	resp, err := client.Get(destsrv.URL)
+	maybeFatal(t, err)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error(resp.Status)
+	}
+}
+
+func TestLimitsTunnelsAnonymous(t *testing.T) {
+	limits := &Limits{}
+	limits.SetTunnelsPerUser(1)
+	release1, err := limits.acquireTunnel("", "192.0.2.1:1234")
+	maybeFatal(t, err)
+	release2, err := limits.acquireTunnel("", "192.0.2.2:1234")
+	maybeFatal(t, err)
+	if _, err = limits.acquireTunnel("", "192.0.2.1:5678"); !errors.Is(err, ErrTooManyTunnels) {
+		t.Error(err)
+	}
+	release1()
+	release2()
+	limits.mu.Lock()
+	defer limits.mu.Unlock()
+	if len(limits.userTunnels) != 0 || len(limits.ipTunnels) != 0 {
+		t.Error(limits.userTunnels, limits.ipTunnels)
+	}
+}
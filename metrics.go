@@ -0,0 +1,244 @@
+package httpproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the dial latency histogram buckets.
+var DefaultLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	count  uint64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(h.bounds))
+	}
+	if i, _ := slices.BinarySearch(h.bounds, v); i < len(h.bounds) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+// Metrics collects Server metrics and serves them as
+// a http.Handler using the Prometheus text exposition format.
+//
+// Byte counters are updated when tunnels and requests complete.
+type Metrics struct {
+	LatencyBuckets []float64 // optional dial latency histogram buckets, defaults to DefaultLatencyBuckets
+	mu             sync.Mutex
+	requests       map[[2]string]uint64 // method, status code
+	connects       uint64
+	connectFails   map[string]uint64 // error class
+	activeTunnels  map[string]int64  // kind
+	bytes          map[[2]string]uint64
+	dialLatency    *histogram
+	authFailures   uint64
+	retries        uint64
+	cacheSize      int
+	cacheHits      uint64
+	cacheMisses    uint64
+	cacheEvictions uint64
+}
+
+var _ http.Handler = (*Metrics)(nil)
+
+func incMap[K comparable, V int64 | uint64](m *map[K]V, k K, n V) {
+	if *m == nil {
+		*m = make(map[K]V)
+	}
+	(*m)[k] += n
+}
+
+func (m *Metrics) tunnelOpened(kind string) {
+	if m != nil {
+		m.mu.Lock()
+		incMap(&m.activeTunnels, kind, 1)
+		m.mu.Unlock()
+	}
+}
+
+func (m *Metrics) connectAttempt() {
+	if m != nil {
+		m.mu.Lock()
+		m.connects++
+		m.mu.Unlock()
+	}
+}
+
+func (m *Metrics) authFailure() {
+	if m != nil {
+		m.mu.Lock()
+		m.authFailures++
+		m.mu.Unlock()
+	}
+}
+
+func (m *Metrics) retried() {
+	if m != nil {
+		m.mu.Lock()
+		m.retries++
+		m.mu.Unlock()
+	}
+}
+
+func (m *Metrics) dialed(d time.Duration) {
+	if m != nil {
+		m.mu.Lock()
+		if m.dialLatency == nil {
+			bounds := m.LatencyBuckets
+			if bounds == nil {
+				bounds = DefaultLatencyBuckets
+			}
+			m.dialLatency = &histogram{bounds: bounds}
+		}
+		m.dialLatency.observe(d.Seconds())
+		m.mu.Unlock()
+	}
+}
+
+func (m *Metrics) tripperCache(size int, hit bool, evicted int) {
+	if m != nil {
+		m.mu.Lock()
+		m.cacheSize = size
+		if hit {
+			m.cacheHits++
+		} else {
+			m.cacheMisses++
+		}
+		m.cacheEvictions += uint64(evicted)
+		m.mu.Unlock()
+	}
+}
+
+// metricsMethod returns method if it is a standard one, otherwise "OTHER",
+// so that clients can't create any number of time series.
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace, "PURGE":
+		return method
+	}
+	return "OTHER"
+}
+
+// connectFailed records a CONNECT request that failed before proxying started,
+// including after the 200 response was sent.
+func (m *Metrics) connectFailed(err error) {
+	// clients going away aren't failures to connect
+	if class := errorClass(err); m != nil && class != errClassCanceled {
+		m.mu.Lock()
+		incMap(&m.connectFails, class, 1)
+		m.mu.Unlock()
+	}
+}
+
+// completed records the usage of a completed session.
+func (m *Metrics) completed(u Usage) {
+	if m != nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		switch u.Kind {
+		case ConnKindRequest:
+			incMap(&m.requests, [2]string{metricsMethod(u.Method), strconv.Itoa(u.StatusCode)}, 1)
+		default:
+			incMap(&m.activeTunnels, u.Kind, -1)
+		}
+		incMap(&m.bytes, [2]string{u.Kind, "sent"}, uint64(max(0, u.BytesSent)))
+		incMap(&m.bytes, [2]string{u.Kind, "received"}, uint64(max(0, u.BytesReceived)))
+	}
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func formatLabels(names []string, values []string) string {
+	var sb strings.Builder
+	for i, name := range names {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, "%s=\"%s\"", name, metricsLabelEscaper.Replace(values[i]))
+	}
+	return sb.String()
+}
+
+func writeMetricMap[K comparable, V int64 | uint64](w io.Writer, name string, m map[K]V, labels []string, values func(K) []string) {
+	lines := make([]string, 0, len(m))
+	for k, v := range m {
+		lines = append(lines, fmt.Sprintf("%s{%s} %d\n", name, formatLabels(labels, values(k)), v))
+	}
+	slices.Sort(lines)
+	for _, line := range lines {
+		_, _ = io.WriteString(w, line)
+	}
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// WriteTo writes the metrics to w in the Prometheus text exposition format.
+func (m *Metrics) WriteTo(w io.Writer) (n int64, err error) {
+	var sb strings.Builder
+	m.mu.Lock()
+	writeMetricHeader(&sb, "httpproxy_requests_total", "counter", "Proxied HTTP requests by method and status code.")
+	writeMetricMap(&sb, "httpproxy_requests_total", m.requests, []string{"method", "code"}, func(k [2]string) []string { return k[:] })
+	writeMetricHeader(&sb, "httpproxy_connect_total", "counter", "CONNECT requests received.")
+	fmt.Fprintf(&sb, "httpproxy_connect_total %d\n", m.connects)
+	writeMetricHeader(&sb, "httpproxy_connect_failures_total", "counter", "CONNECT requests that failed, by error class.")
+	writeMetricMap(&sb, "httpproxy_connect_failures_total", m.connectFails, []string{"class"}, func(k string) []string { return []string{k} })
+	writeMetricHeader(&sb, "httpproxy_active_tunnels", "gauge", "Active CONNECT tunnels and WebSocket relays.")
+	writeMetricMap(&sb, "httpproxy_active_tunnels", m.activeTunnels, []string{"kind"}, func(k string) []string { return []string{k} })
+	writeMetricHeader(&sb, "httpproxy_bytes_total", "counter", "Bytes transferred by completed tunnels and requests, by kind and direction relative to the client.")
+	writeMetricMap(&sb, "httpproxy_bytes_total", m.bytes, []string{"kind", "direction"}, func(k [2]string) []string { return k[:] })
+	writeMetricHeader(&sb, "httpproxy_dial_duration_seconds", "histogram", "Time taken to connect to targets.")
+	if h := m.dialLatency; h != nil {
+		var cumulative uint64
+		for i, bound := range h.bounds {
+			if h.counts != nil {
+				cumulative += h.counts[i]
+			}
+			fmt.Fprintf(&sb, "httpproxy_dial_duration_seconds_bucket{le=\"%s\"} %d\n", formatFloat(bound), cumulative)
+		}
+		fmt.Fprintf(&sb, "httpproxy_dial_duration_seconds_bucket{le=\"+Inf\"} %d\n", h.count)
+		fmt.Fprintf(&sb, "httpproxy_dial_duration_seconds_sum %s\n", formatFloat(h.sum))
+		fmt.Fprintf(&sb, "httpproxy_dial_duration_seconds_count %d\n", h.count)
+	}
+	writeMetricHeader(&sb, "httpproxy_auth_failures_total", "counter", "Requests that failed authentication.")
+	fmt.Fprintf(&sb, "httpproxy_auth_failures_total %d\n", m.authFailures)
+	writeMetricHeader(&sb, "httpproxy_retries_total", "counter", "CONNECT dials and requests retried after failing.")
+	fmt.Fprintf(&sb, "httpproxy_retries_total %d\n", m.retries)
+	writeMetricHeader(&sb, "httpproxy_roundtripper_cache_size", "gauge", "RoundTrippers in the cache.")
+	fmt.Fprintf(&sb, "httpproxy_roundtripper_cache_size %d\n", m.cacheSize)
+	writeMetricHeader(&sb, "httpproxy_roundtripper_cache_hits_total", "counter", "RoundTripper cache hits.")
+	fmt.Fprintf(&sb, "httpproxy_roundtripper_cache_hits_total %d\n", m.cacheHits)
+	writeMetricHeader(&sb, "httpproxy_roundtripper_cache_misses_total", "counter", "RoundTripper cache misses.")
+	fmt.Fprintf(&sb, "httpproxy_roundtripper_cache_misses_total %d\n", m.cacheMisses)
+	writeMetricHeader(&sb, "httpproxy_roundtripper_cache_evictions_total", "counter", "RoundTrippers evicted from the cache.")
+	fmt.Fprintf(&sb, "httpproxy_roundtripper_cache_evictions_total %d\n", m.cacheEvictions)
+	m.mu.Unlock()
+	var written int
+	written, err = io.WriteString(w, sb.String())
+	return int64(written), err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
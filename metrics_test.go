@@ -0,0 +1,151 @@
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	destsrv := makeHTTPDestSrv(t)
+	defer destsrv.Close()
+	l := makeEchoListener(t, false)
+	defer l.Close()
+
+	metrics := &Metrics{}
+	srv := &Server{
+		ConnectPortPolicy:    AnyConnectPort{},
+		CredentialsValidator: StaticCredentials{"foo": "secret"},
+		Metrics:              metrics,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+	metricssrv := httptest.NewServer(metrics)
+	defer metricssrv.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, destsrv.URL, nil)
+	SetBasicAuth(req.Header, "foo", "secret")
+	resp, err := makeClient(t, proxysrv.URL).Do(req)
+	maybeFatal(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	conn, br, resp := openTunnelAuth(t, proxysrv.Listener.Addr().String(), l.Addr().String(), "foo")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	_, err = io.WriteString(conn, "hello")
+	maybeFatal(t, err)
+	readEchoed(t, br, "hello")
+	conn.Close()
+	waitForConns(t, srv, 0)
+
+	_, _, resp = openTunnelAuth(t, proxysrv.Listener.Addr().String(), l.Addr().String(), "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error(resp.Status)
+	}
+	waitForConns(t, srv, 0)
+
+	resp, err = http.Get(metricssrv.URL)
+	maybeFatal(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Error(ct)
+	}
+	text := string(body)
+	for _, want := range []string{
+		"# TYPE httpproxy_requests_total counter\n",
+		`httpproxy_requests_total{method="GET",code="200"} 1` + "\n",
+		"httpproxy_connect_total 2\n",
+		`httpproxy_connect_failures_total{class="unauthorized"} 1` + "\n",
+		`httpproxy_active_tunnels{kind="connect"} 0` + "\n",
+		`httpproxy_bytes_total{kind="connect",direction="sent"} 5` + "\n",
+		`httpproxy_bytes_total{kind="request",direction="received"} 12` + "\n",
+		`httpproxy_dial_duration_seconds_bucket{le="+Inf"} 2` + "\n",
+		"httpproxy_dial_duration_seconds_count 2\n",
+		"httpproxy_auth_failures_total 1\n",
+		"httpproxy_roundtripper_cache_size 1\n",
+		"httpproxy_roundtripper_cache_misses_total 1\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in\n%s", want, text)
+		}
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	for err, want := range map[error]string{
+		nil:                                  "",
+		ErrUnauthorized:                      errClassUnauthorized,
+		ErrBlocked:                           errClassForbidden,
+		ErrServerClosed:                      errClassClosed,
+		context.Canceled:                     errClassCanceled,
+		&LimitError{Err: ErrTooManyRequests}: errClassLimit,
+		io.EOF:                               errClassTerminated,
+		ErrBodyNotReadWriter:                 errClassOther,
+	} {
+		if got := errorClass(err); got != want {
+			t.Errorf("%v: got %q want %q", err, got, want)
+		}
+	}
+}
+
+func TestMetricsCanceled(t *testing.T) {
+	metrics := &Metrics{}
+	metrics.connectFailed(context.Canceled)
+	metrics.connectFailed(io.EOF)
+	var sb strings.Builder
+	_, err := metrics.WriteTo(&sb)
+	maybeFatal(t, err)
+	if text := sb.String(); strings.Contains(text, errClassCanceled) || !strings.Contains(text, `httpproxy_connect_failures_total{class="terminated"} 1`) {
+		t.Error(text)
+	}
+}
+
+func TestMetricsTunnelRejected(t *testing.T) {
+	destsrv := makeHTTPDestSrv(t)
+	defer destsrv.Close()
+	metrics := &Metrics{}
+	srv := &Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		SNIInspector:      &SNIInspector{Timeout: time.Second, RequireTLS: true},
+		Metrics:           metrics,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	if body, err := connectPlain(t, proxysrv.Listener.Addr().String(), destsrv.Listener.Addr().String()); err == nil {
+		t.Errorf("expected error, got %q", body)
+	}
+	waitForConns(t, srv, 0)
+	var sb strings.Builder
+	_, err := metrics.WriteTo(&sb)
+	maybeFatal(t, err)
+	if text := sb.String(); !strings.Contains(text, `httpproxy_connect_failures_total{class="forbidden"} 1`) {
+		t.Error(text)
+	}
+}
+
+func TestMetricsMethod(t *testing.T) {
+	metrics := &Metrics{}
+	for _, method := range []string{http.MethodGet, "get", "X-RANDOM-1", "X-RANDOM-2"} {
+		metrics.completed(Usage{ConnInfo: ConnInfo{Kind: ConnKindRequest, Method: method}, StatusCode: http.StatusOK})
+	}
+	var sb strings.Builder
+	_, err := metrics.WriteTo(&sb)
+	maybeFatal(t, err)
+	text := sb.String()
+	for _, want := range []string{
+		`httpproxy_requests_total{method="GET",code="200"} 1` + "\n",
+		`httpproxy_requests_total{method="OTHER",code="200"} 3` + "\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("missing %q in\n%s", want, text)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package httpproxy
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+)
+
+var ErrOTLPExport = errors.New("OTLP export failed")
+
+// OTLPExporter is a SpanExporter sending spans to an OpenTelemetry collector
+// using OTLP JSON over HTTP.
+type OTLPExporter struct {
+	URL         string       // collector traces endpoint, e.g. "http://localhost:4318/v1/traces"
+	Client      *http.Client // optional HTTP client, defaults to http.DefaultClient
+	Header      http.Header  // optional extra request headers, e.g. for authorization
+	ServiceName string       // optional service.name resource attribute, defaults to "httpproxy"
+}
+
+var _ SpanExporter = (*OTLPExporter)(nil)
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64 is encoded as a string in OTLP JSON
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            *otlpStatus    `json:"status,omitempty"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// OTLP span kinds and status codes.
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpStatusError      = 2
+)
+
+func otlpValue(v any) (av otlpAnyValue) {
+	switch v := v.(type) {
+	case string:
+		av.StringValue = &v
+	case bool:
+		av.BoolValue = &v
+	case int:
+		s := strconv.FormatInt(int64(v), 10)
+		av.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		av.IntValue = &s
+	case uint64:
+		s := strconv.FormatUint(v, 10)
+		av.IntValue = &s
+	case float64:
+		av.DoubleValue = &v
+	default:
+		s := fmt.Sprint(v)
+		av.StringValue = &s
+	}
+	return
+}
+
+func otlpAttributes(m map[string]any) (kvs []otlpKeyValue) {
+	for k, v := range m {
+		kvs = append(kvs, otlpKeyValue{Key: k, Value: otlpValue(v)})
+	}
+	slices.SortFunc(kvs, func(a, b otlpKeyValue) int { return cmp.Compare(a.Key, b.Key) })
+	return
+}
+
+func (e *OTLPExporter) marshal(spans []Span) ([]byte, error) {
+	serviceName := e.ServiceName
+	if serviceName == "" {
+		serviceName = "httpproxy"
+	}
+	var ss otlpScopeSpans
+	ss.Scope.Name = "github.com/linkdata/httpproxy"
+	local := make(map[SpanID]bool, len(spans))
+	for _, span := range spans {
+		local[span.SpanID] = true
+	}
+	for _, span := range spans {
+		o := otlpSpan{
+			TraceID:           span.TraceID.String(),
+			SpanID:            span.SpanID.String(),
+			TraceState:        span.TraceState,
+			Name:              span.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+		}
+		if span.ParentID.IsValid() {
+			o.ParentSpanID = span.ParentID.String()
+		}
+		if !local[span.ParentID] {
+			// the proxy's own span for the tunnel or request
+			o.Kind = otlpSpanKindServer
+		}
+		if span.Err != nil {
+			o.Status = &otlpStatus{Code: otlpStatusError, Message: span.Err.Error()}
+		}
+		ss.Spans = append(ss.Spans, o)
+	}
+	var rs otlpResourceSpans
+	rs.Resource.Attributes = otlpAttributes(map[string]any{"service.name": serviceName})
+	rs.ScopeSpans = []otlpScopeSpans{ss}
+	return json.Marshal(otlpTraces{ResourceSpans: []otlpResourceSpans{rs}})
+}
+
+// ExportSpans posts spans to the collector at URL.
+func (e *OTLPExporter) ExportSpans(ctx context.Context, spans []Span) (err error) {
+	var body []byte
+	if body, err = e.marshal(spans); err == nil {
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, e.URL, bytes.NewReader(body)); err == nil {
+			for k, vv := range e.Header {
+				req.Header[k] = append([]string{}, vv...)
+			}
+			req.Header.Set("Content-Type", "application/json")
+			client := e.Client
+			if client == nil {
+				client = http.DefaultClient
+			}
+			var resp *http.Response
+			if resp, err = client.Do(req); err == nil {
+				_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64*1024))
+				_ = resp.Body.Close()
+				if resp.StatusCode < 200 || resp.StatusCode > 299 {
+					err = fmt.Errorf("%w: %s", ErrOTLPExport, resp.Status)
+				}
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,70 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	received := make(chan otlpTraces, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer x" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		var traces otlpTraces
+		if err := json.NewDecoder(r.Body).Decode(&traces); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- traces
+	}))
+	defer collector.Close()
+
+	exp := &OTLPExporter{URL: collector.URL + "/v1/traces", Header: http.Header{"Authorization": {"Bearer x"}}}
+	start := time.Unix(1700000000, 0)
+	root := Span{
+		TraceID:    newTraceID(),
+		SpanID:     newSpanID(),
+		Name:       "GET",
+		Start:      start,
+		End:        start.Add(time.Second),
+		Attributes: map[string]any{"b": int64(42), "a": "x", "c": true},
+		Err:        errors.New("boom"),
+	}
+	child := Span{TraceID: root.TraceID, SpanID: newSpanID(), ParentID: root.SpanID, Name: "dial", Start: start, End: start}
+	maybeFatal(t, exp.ExportSpans(context.Background(), []Span{root, child}))
+
+	traces := <-received
+	rs := traces.ResourceSpans[0]
+	if *rs.Resource.Attributes[0].Value.StringValue != "httpproxy" {
+		t.Error(rs.Resource.Attributes)
+	}
+	spans := rs.ScopeSpans[0].Spans
+	if len(spans) != 2 {
+		t.Fatal(spans)
+	}
+	got := spans[0]
+	if got.TraceID != root.TraceID.String() || got.ParentSpanID != "" || got.Kind != otlpSpanKindServer || got.StartTimeUnixNano != "1700000000000000000" {
+		t.Errorf("%#v", got)
+	}
+	if got.Status == nil || got.Status.Code != otlpStatusError || got.Status.Message != "boom" {
+		t.Errorf("%#v", got.Status)
+	}
+	if len(got.Attributes) != 3 || got.Attributes[0].Key != "a" || *got.Attributes[1].Value.IntValue != "42" || !*got.Attributes[2].Value.BoolValue {
+		t.Errorf("%#v", got.Attributes)
+	}
+	if spans[1].ParentSpanID != root.SpanID.String() || spans[1].Kind != otlpSpanKindInternal || spans[1].Status != nil {
+		t.Errorf("%#v", spans[1])
+	}
+
+	exp.Header = nil
+	if err := exp.ExportSpans(context.Background(), []Span{root}); !errors.Is(err, ErrOTLPExport) {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,458 @@
+package httpproxy
+
+import (
+	"math"
+	"math/rand/v2"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func pacNative(name string, fn func(in *pacInterp, args []any) (any, error)) *pacNativeFunc {
+	return &pacNativeFunc{name: name, fn: fn}
+}
+
+// pacSliceRange resolves JavaScript slice arguments against length n.
+func pacSliceRange(args []any, n int) (start, end int) {
+	clamp := func(v any, def int) int {
+		if v == (pacUndefined{}) {
+			return def
+		}
+		f := math.Trunc(pacToNumber(v))
+		switch {
+		case math.IsNaN(f):
+			return 0
+		case f < 0:
+			return max(0, n+int(max(f, -float64(n))))
+		}
+		return int(min(f, float64(n)))
+	}
+	start, end = clamp(pacArg(args, 0), 0), clamp(pacArg(args, 1), n)
+	return start, max(start, end)
+}
+
+// pacClampIndex clamps v to [0, n], with NaN and undefined as def.
+func pacClampIndex(v any, n, def int) int {
+	if v == (pacUndefined{}) {
+		return def
+	}
+	f := math.Trunc(pacToNumber(v))
+	if math.IsNaN(f) {
+		return 0
+	}
+	return int(max(0, min(f, float64(n))))
+}
+
+func pacMatch(re *pacRegExp, s string, all bool) any {
+	if all {
+		matches := re.re.FindAllString(s, -1)
+		if matches == nil {
+			return nil
+		}
+		a := &pacArray{}
+		for _, m := range matches {
+			a.elems = append(a.elems, m)
+		}
+		return a
+	}
+	m := re.re.FindStringSubmatchIndex(s)
+	if m == nil {
+		return nil
+	}
+	a := &pacArray{}
+	for i := 0; i < len(m); i += 2 {
+		if m[i] < 0 {
+			a.elems = append(a.elems, pacUndefined{})
+		} else {
+			a.elems = append(a.elems, s[m[i]:m[i+1]])
+		}
+	}
+	return a
+}
+
+// pacReplacement expands $& and $1..$9 in repl for the submatch indexes m of s.
+func pacReplacement(repl, s string, m []int) string {
+	var sb strings.Builder
+	for i := 0; i < len(repl) && sb.Len() <= pacMaxStringLength; i++ {
+		if repl[i] == '$' && i+1 < len(repl) {
+			switch c := repl[i+1]; {
+			case c == '$':
+				sb.WriteByte('$')
+				i++
+				continue
+			case c == '&':
+				sb.WriteString(s[m[0]:m[1]])
+				i++
+				continue
+			case c >= '1' && c <= '9' && int(c-'0')*2+1 < len(m):
+				if g := int(c-'0') * 2; m[g] >= 0 {
+					sb.WriteString(s[m[g]:m[g+1]])
+				}
+				i++
+				continue
+			}
+		}
+		sb.WriteByte(repl[i])
+	}
+	return sb.String()
+}
+
+func pacReplace(s string, pattern, repl any) string {
+	rs := pacToString(repl)
+	if re, ok := pattern.(*pacRegExp); ok {
+		var sb strings.Builder
+		last := 0
+		for _, m := range re.re.FindAllStringSubmatchIndex(s, -1) {
+			if sb.Len() > pacMaxStringLength {
+				break
+			}
+			sb.WriteString(s[last:m[0]])
+			sb.WriteString(pacReplacement(rs, s, m))
+			last = m[1]
+			if !re.global {
+				break
+			}
+		}
+		sb.WriteString(s[last:])
+		return sb.String()
+	}
+	ps := pacToString(pattern)
+	if i := strings.Index(s, ps); i >= 0 {
+		return s[:i] + pacReplacement(rs, s, []int{i, i + len(ps)}) + s[i+len(ps):]
+	}
+	return s
+}
+
+func pacStringMethod(s, name string) *pacNativeFunc {
+	var fn func(args []any) any
+	switch name {
+	case "charAt":
+		fn = func(args []any) any {
+			if i, ok := pacIndex(pacArg(args, 0)); ok && i < len(s) {
+				return s[i : i+1]
+			} else if pacArg(args, 0) == (pacUndefined{}) && s != "" {
+				return s[:1]
+			}
+			return ""
+		}
+	case "charCodeAt":
+		fn = func(args []any) any {
+			i, ok := pacIndex(pacArg(args, 0))
+			if pacArg(args, 0) == (pacUndefined{}) {
+				i, ok = 0, true
+			}
+			if ok && i < len(s) {
+				return float64(s[i])
+			}
+			return math.NaN()
+		}
+	case "indexOf":
+		fn = func(args []any) any {
+			from := pacClampIndex(pacArg(args, 1), len(s), 0)
+			if i := strings.Index(s[from:], pacToString(pacArg(args, 0))); i >= 0 {
+				return float64(from + i)
+			}
+			return -1.0
+		}
+	case "lastIndexOf":
+		fn = func(args []any) any {
+			return float64(strings.LastIndex(s, pacToString(pacArg(args, 0))))
+		}
+	case "includes":
+		fn = func(args []any) any { return strings.Contains(s, pacToString(pacArg(args, 0))) }
+	case "startsWith":
+		fn = func(args []any) any { return strings.HasPrefix(s, pacToString(pacArg(args, 0))) }
+	case "endsWith":
+		fn = func(args []any) any { return strings.HasSuffix(s, pacToString(pacArg(args, 0))) }
+	case "substring":
+		fn = func(args []any) any {
+			start := pacClampIndex(pacArg(args, 0), len(s), 0)
+			end := pacClampIndex(pacArg(args, 1), len(s), len(s))
+			return s[min(start, end):max(start, end)]
+		}
+	case "substr":
+		fn = func(args []any) any {
+			start, _ := pacSliceRange(args[:min(len(args), 1)], len(s))
+			n := pacClampIndex(pacArg(args, 1), len(s)-start, len(s)-start)
+			return s[start : start+n]
+		}
+	case "slice":
+		fn = func(args []any) any {
+			start, end := pacSliceRange(args, len(s))
+			return s[start:end]
+		}
+	case "toLowerCase", "toLocaleLowerCase":
+		fn = func(args []any) any { return strings.ToLower(s) }
+	case "toUpperCase", "toLocaleUpperCase":
+		fn = func(args []any) any { return strings.ToUpper(s) }
+	case "trim":
+		fn = func(args []any) any { return strings.TrimSpace(s) }
+	case "toString", "valueOf":
+		fn = func(args []any) any { return s }
+	case "concat":
+		fn = func(args []any) any {
+			for _, arg := range args {
+				if len(s) > pacMaxStringLength {
+					break
+				}
+				s += pacToString(arg)
+			}
+			return s
+		}
+	case "split":
+		fn = func(args []any) any {
+			a := &pacArray{}
+			sep := pacArg(args, 0)
+			var parts []string
+			switch sep := sep.(type) {
+			case pacUndefined:
+				parts = []string{s}
+			case *pacRegExp:
+				parts = sep.re.Split(s, -1)
+			default:
+				parts = strings.Split(s, pacToString(sep))
+				if s == "" && pacToString(sep) == "" {
+					parts = nil
+				}
+			}
+			for _, part := range parts {
+				a.elems = append(a.elems, part)
+			}
+			return a
+		}
+	case "replace":
+		fn = func(args []any) any { return pacReplace(s, pacArg(args, 0), pacArg(args, 1)) }
+	case "match":
+		fn = func(args []any) any {
+			re, ok := pacArg(args, 0).(*pacRegExp)
+			if !ok {
+				compiled, err := pacCompileRegExp(pacToString(pacArg(args, 0)), "")
+				if err != nil {
+					return nil
+				}
+				re = &pacRegExp{re: compiled}
+			}
+			return pacMatch(re, s, re.global)
+		}
+	case "search":
+		fn = func(args []any) any {
+			if re, ok := pacArg(args, 0).(*pacRegExp); ok {
+				if m := re.re.FindStringIndex(s); m != nil {
+					return float64(m[0])
+				}
+			}
+			return -1.0
+		}
+	default:
+		return nil
+	}
+	return pacNative(name, func(in *pacInterp, args []any) (any, error) { return fn(args), nil })
+}
+
+func pacArrayMethod(a *pacArray, name string) *pacNativeFunc {
+	var fn func(args []any) any
+	switch name {
+	case "indexOf":
+		fn = func(args []any) any {
+			for i, elem := range a.elems {
+				if pacStrictEquals(elem, pacArg(args, 0)) {
+					return float64(i)
+				}
+			}
+			return -1.0
+		}
+	case "includes":
+		fn = func(args []any) any {
+			for _, elem := range a.elems {
+				if pacStrictEquals(elem, pacArg(args, 0)) {
+					return true
+				}
+			}
+			return false
+		}
+	case "join":
+		fn = func(args []any) any {
+			sep := ","
+			if pacArg(args, 0) != (pacUndefined{}) {
+				sep = pacToString(args[0])
+			}
+			return pacJoin(a, sep, nil)
+		}
+	case "push":
+		fn = func(args []any) any {
+			a.elems = append(a.elems, args...)
+			return float64(len(a.elems))
+		}
+	case "pop":
+		fn = func(args []any) any {
+			if len(a.elems) == 0 {
+				return pacUndefined{}
+			}
+			v := a.elems[len(a.elems)-1]
+			a.elems = a.elems[:len(a.elems)-1]
+			return v
+		}
+	case "shift":
+		fn = func(args []any) any {
+			if len(a.elems) == 0 {
+				return pacUndefined{}
+			}
+			v := a.elems[0]
+			a.elems = a.elems[1:]
+			return v
+		}
+	case "slice":
+		fn = func(args []any) any {
+			start, end := pacSliceRange(args, len(a.elems))
+			return &pacArray{elems: append([]any(nil), a.elems[start:end]...)}
+		}
+	case "concat":
+		fn = func(args []any) any {
+			res := &pacArray{elems: append([]any(nil), a.elems...)}
+			for _, arg := range args {
+				if other, ok := arg.(*pacArray); ok {
+					res.elems = append(res.elems, other.elems...)
+				} else {
+					res.elems = append(res.elems, arg)
+				}
+			}
+			return res
+		}
+	case "reverse":
+		fn = func(args []any) any {
+			for i, j := 0, len(a.elems)-1; i < j; i, j = i+1, j-1 {
+				a.elems[i], a.elems[j] = a.elems[j], a.elems[i]
+			}
+			return a
+		}
+	case "toString":
+		fn = func(args []any) any { return pacToString(a) }
+	default:
+		return nil
+	}
+	// push and concat grow arrays, so check a as well as the result
+	return pacNative(name, func(in *pacInterp, args []any) (any, error) { return fn(args), in.checkSize(a) })
+}
+
+func pacParseInt(s string, radix int) float64 {
+	s = strings.TrimSpace(s)
+	neg := false
+	if rest, ok := strings.CutPrefix(s, "-"); ok {
+		s, neg = rest, true
+	} else {
+		s = strings.TrimPrefix(s, "+")
+	}
+	if radix == 0 || radix == 16 {
+		if rest, ok := strings.CutPrefix(strings.ToLower(s), "0x"); ok {
+			s, radix = rest, 16
+		}
+	}
+	if radix == 0 {
+		radix = 10
+	}
+	if radix < 2 || radix > 36 {
+		return math.NaN()
+	}
+	end := 0
+	for end < len(s) {
+		if d := strings.IndexByte("0123456789abcdefghijklmnopqrstuvwxyz", s[end]|0x20); d < 0 || d >= radix {
+			break
+		}
+		end++
+	}
+	if end == 0 {
+		return math.NaN()
+	}
+	n, err := strconv.ParseUint(s[:end], radix, 64)
+	f := float64(n)
+	if err != nil {
+		f = math.Inf(1)
+	}
+	if neg {
+		f = -f
+	}
+	return f
+}
+
+func pacMathObject() *pacObject {
+	m := newPACObject()
+	unary := func(name string, fn func(float64) float64) {
+		m.set(name, pacNative(name, func(in *pacInterp, args []any) (any, error) {
+			return fn(pacToNumber(pacArg(args, 0))), nil
+		}))
+	}
+	unary("abs", math.Abs)
+	unary("ceil", math.Ceil)
+	unary("floor", math.Floor)
+	unary("round", func(f float64) float64 { return math.Floor(f + 0.5) })
+	unary("sqrt", math.Sqrt)
+	m.set("min", pacNative("min", func(in *pacInterp, args []any) (any, error) {
+		v := math.Inf(1)
+		for _, arg := range args {
+			v = math.Min(v, pacToNumber(arg))
+		}
+		return v, nil
+	}))
+	m.set("max", pacNative("max", func(in *pacInterp, args []any) (any, error) {
+		v := math.Inf(-1)
+		for _, arg := range args {
+			v = math.Max(v, pacToNumber(arg))
+		}
+		return v, nil
+	}))
+	m.set("random", pacNative("random", func(in *pacInterp, args []any) (any, error) {
+		return rand.Float64(), nil
+	}))
+	m.set("PI", math.Pi)
+	return m
+}
+
+// pacGlobals are the JavaScript functions and objects available to scripts.
+func pacGlobals(sc *pacScope) {
+	sc.vars["NaN"] = math.NaN()
+	sc.vars["Infinity"] = math.Inf(1)
+	sc.vars["Math"] = pacMathObject()
+	sc.vars["parseInt"] = pacNative("parseInt", func(in *pacInterp, args []any) (any, error) {
+		radix := 0
+		if pacArg(args, 1) != (pacUndefined{}) {
+			radix = int(pacToInt32(args[1]))
+		}
+		return pacParseInt(pacToString(pacArg(args, 0)), radix), nil
+	})
+	sc.vars["parseFloat"] = pacNative("parseFloat", func(in *pacInterp, args []any) (any, error) {
+		s := strings.TrimSpace(pacToString(pacArg(args, 0)))
+		for end := len(s); end > 0; end-- {
+			if f, err := strconv.ParseFloat(s[:end], 64); err == nil && !strings.ContainsAny(s[:end], "iInNxX_") {
+				return f, nil
+			}
+		}
+		return math.NaN(), nil
+	})
+	sc.vars["isNaN"] = pacNative("isNaN", func(in *pacInterp, args []any) (any, error) {
+		return math.IsNaN(pacToNumber(pacArg(args, 0))), nil
+	})
+	sc.vars["String"] = pacNative("String", func(in *pacInterp, args []any) (any, error) {
+		if len(args) == 0 {
+			return "", nil
+		}
+		return pacToString(args[0]), nil
+	})
+	sc.vars["Number"] = pacNative("Number", func(in *pacInterp, args []any) (any, error) {
+		if len(args) == 0 {
+			return 0.0, nil
+		}
+		return pacToNumber(args[0]), nil
+	})
+	sc.vars["Boolean"] = pacNative("Boolean", func(in *pacInterp, args []any) (any, error) {
+		return pacTruthy(pacArg(args, 0)), nil
+	})
+	sc.vars["encodeURIComponent"] = pacNative("encodeURIComponent", func(in *pacInterp, args []any) (any, error) {
+		return strings.ReplaceAll(url.QueryEscape(pacToString(pacArg(args, 0))), "+", "%20"), nil
+	})
+	sc.vars["decodeURIComponent"] = pacNative("decodeURIComponent", func(in *pacInterp, args []any) (v any, err error) {
+		if v, err = url.PathUnescape(pacToString(pacArg(args, 0))); err != nil {
+			err = in.errorf("malformed URI")
+		}
+		return
+	})
+}
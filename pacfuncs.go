@@ -0,0 +1,328 @@
+package httpproxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// pacEnv is the environment a PAC script is evaluated in.
+type pacEnv struct {
+	ctx      context.Context
+	resolver Resolver
+	now      time.Time
+	myIP     func() []netip.Addr
+	logger   Logger
+	resolved map[string][]netip.Addr // lookups made during the evaluation
+}
+
+// lookup resolves host, returning nil if it can't be resolved.
+func (env *pacEnv) lookup(host string) (addrs []netip.Addr) {
+	if addr, err := netip.ParseAddr(strings.Trim(host, "[]")); err == nil {
+		return []netip.Addr{addr.Unmap()}
+	}
+	var ok bool
+	if addrs, ok = env.resolved[host]; !ok {
+		resolver := env.resolver
+		if resolver == nil {
+			resolver = DefaultResolver
+		}
+		if found, err := resolver.LookupNetIP(env.ctx, "ip", host); err == nil {
+			for _, addr := range found {
+				addrs = append(addrs, addr.Unmap())
+			}
+		}
+		if env.resolved == nil {
+			env.resolved = make(map[string][]netip.Addr)
+		}
+		env.resolved[host] = addrs
+	}
+	return
+}
+
+func firstIPv4(addrs []netip.Addr) (addr netip.Addr) {
+	for _, a := range addrs {
+		if a.Is4() {
+			return a
+		}
+	}
+	return
+}
+
+// localAddrs returns the addresses of the up, non-loopback network interfaces,
+// or the loopback address if there are none.
+func localAddrs() (addrs []netip.Addr) {
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp != 0 && iface.Flags&net.FlagLoopback == 0 {
+			ifaddrs, _ := iface.Addrs()
+			for _, ifaddr := range ifaddrs {
+				if pfx, err := netip.ParsePrefix(ifaddr.String()); err == nil && !pfx.Addr().IsLinkLocalUnicast() {
+					addrs = append(addrs, pfx.Addr().Unmap())
+				}
+			}
+		}
+	}
+	if len(addrs) == 0 {
+		addrs = []netip.Addr{netip.AddrFrom4([4]byte{127, 0, 0, 1})}
+	}
+	return
+}
+
+// pacShExp converts a shell expression using * and ? into a regular expression.
+func pacShExp(shexp string) (*regexp.Regexp, error) {
+	var sb strings.Builder
+	sb.WriteString("^(?s:")
+	for _, r := range shexp {
+		switch r {
+		case '*':
+			sb.WriteString(".*")
+		case '?':
+			sb.WriteString(".")
+		default:
+			sb.WriteString(regexp.QuoteMeta(string(r)))
+		}
+	}
+	sb.WriteString(")$")
+	return regexp.Compile(sb.String())
+}
+
+var pacWeekdays = []string{"SUN", "MON", "TUE", "WED", "THU", "FRI", "SAT"}
+
+var pacMonths = []string{"JAN", "FEB", "MAR", "APR", "MAY", "JUN", "JUL", "AUG", "SEP", "OCT", "NOV", "DEC"}
+
+// pacTimeArgs removes a trailing "GMT" argument, returning the current time in the requested zone.
+func (env *pacEnv) pacTimeArgs(args []any) ([]any, time.Time) {
+	if n := len(args); n > 0 && pacToString(args[n-1]) == "GMT" {
+		return args[:n-1], env.now.UTC()
+	}
+	return args, env.now.Local()
+}
+
+// pacInRange returns true if lo <= v <= hi, wrapping around if lo > hi.
+func pacInRange(v, lo, hi int) bool {
+	if lo <= hi {
+		return lo <= v && v <= hi
+	}
+	return v >= lo || v <= hi
+}
+
+func (env *pacEnv) weekdayRange(args []any) bool {
+	args, now := env.pacTimeArgs(args)
+	if len(args) == 0 {
+		return false
+	}
+	wd1 := slices.Index(pacWeekdays, pacToString(args[0]))
+	wd2 := wd1
+	if len(args) > 1 {
+		wd2 = slices.Index(pacWeekdays, pacToString(args[1]))
+	}
+	return wd1 >= 0 && wd2 >= 0 && pacInRange(int(now.Weekday()), wd1, wd2)
+}
+
+// dateRange supports the forms (day), (month), (year), and the ranges
+// (d1, d2), (m1, m2), (y1, y2), (d1, m1, d2, m2), (m1, y1, m2, y2) and (d1, m1, y1, d2, m2, y2).
+func (env *pacEnv) dateRange(args []any) bool {
+	args, now := env.pacTimeArgs(args)
+	if n := len(args); n == 0 || n > 6 || (n > 2 && n%2 != 0) {
+		return false
+	}
+	half := max(1, len(args)/2)
+	bounds := [2]int{}
+	var fields [2]string
+	for b := range 2 {
+		start := min(b*half, len(args)-half)
+		for _, arg := range args[start : start+half] {
+			var field string
+			var v int
+			if s, ok := arg.(string); ok {
+				if v = slices.Index(pacMonths, s); v < 0 {
+					return false
+				}
+				field, v = "m", v+1
+			} else if f := pacToNumber(arg); f >= 1 && f <= 31 {
+				field, v = "d", int(f)
+			} else if f > 31 {
+				field, v = "y", int(f)
+			} else {
+				return false
+			}
+			switch field {
+			case "y":
+				bounds[b] += v * 10000
+			case "m":
+				bounds[b] += v * 100
+			default:
+				bounds[b] += v
+			}
+			fields[b] += field
+		}
+	}
+	if fields[0] != fields[1] {
+		return false
+	}
+	cur := 0
+	if strings.Contains(fields[0], "y") {
+		cur += now.Year() * 10000
+	}
+	if strings.Contains(fields[0], "m") {
+		cur += int(now.Month()) * 100
+	}
+	if strings.Contains(fields[0], "d") {
+		cur += now.Day()
+	}
+	if strings.Contains(fields[0], "y") {
+		return bounds[0] <= cur && cur <= bounds[1]
+	}
+	return pacInRange(cur, bounds[0], bounds[1])
+}
+
+// timeRange supports the forms (hour), (h1, h2), (h1, m1, h2, m2) and (h1, m1, s1, h2, m2, s2).
+func (env *pacEnv) timeRange(args []any) bool {
+	args, now := env.pacTimeArgs(args)
+	nums := make([]int, len(args))
+	for i, arg := range args {
+		nums[i] = int(pacToNumber(arg))
+	}
+	hour := now.Hour()
+	cur := hour*3600 + now.Minute()*60 + now.Second()
+	switch len(nums) {
+	case 1:
+		return hour == nums[0]
+	case 2:
+		return pacInRange(hour, nums[0], nums[1])
+	case 4:
+		return pacInRange(cur, nums[0]*3600+nums[1]*60, nums[2]*3600+nums[3]*60+59)
+	case 6:
+		return pacInRange(cur, nums[0]*3600+nums[1]*60+nums[2], nums[3]*3600+nums[4]*60+nums[5])
+	}
+	return false
+}
+
+func pacAddrsString(addrs []netip.Addr) string {
+	parts := make([]string, len(addrs))
+	for i, addr := range addrs {
+		parts[i] = addr.String()
+	}
+	return strings.Join(parts, ";")
+}
+
+// pacFunctions defines the PAC helper functions, including the IPv6 extensions.
+func pacFunctions(sc *pacScope, env *pacEnv) {
+	str := func(args []any, i int) string { return pacToString(pacArg(args, i)) }
+	define := func(name string, fn func(args []any) any) {
+		sc.vars[name] = pacNative(name, func(in *pacInterp, args []any) (any, error) { return fn(args), nil })
+	}
+	define("isPlainHostName", func(args []any) any {
+		return !strings.ContainsAny(str(args, 0), ".:")
+	})
+	define("dnsDomainIs", func(args []any) any {
+		host, domain := strings.ToLower(str(args, 0)), strings.ToLower(str(args, 1))
+		return strings.HasSuffix(host, domain)
+	})
+	define("localHostOrDomainIs", func(args []any) any {
+		host, hostdom := strings.ToLower(str(args, 0)), strings.ToLower(str(args, 1))
+		return host == hostdom || (!strings.Contains(host, ".") && strings.HasPrefix(hostdom, host+"."))
+	})
+	define("isResolvable", func(args []any) any {
+		return firstIPv4(env.lookup(str(args, 0))).IsValid()
+	})
+	define("isResolvableEx", func(args []any) any {
+		return len(env.lookup(str(args, 0))) > 0
+	})
+	define("dnsResolve", func(args []any) any {
+		if addr := firstIPv4(env.lookup(str(args, 0))); addr.IsValid() {
+			return addr.String()
+		}
+		return nil
+	})
+	define("dnsResolveEx", func(args []any) any {
+		return pacAddrsString(env.lookup(str(args, 0)))
+	})
+	define("myIpAddress", func(args []any) any {
+		if addr := firstIPv4(env.myIP()); addr.IsValid() {
+			return addr.String()
+		}
+		return "127.0.0.1"
+	})
+	define("myIpAddressEx", func(args []any) any {
+		return pacAddrsString(env.myIP())
+	})
+	define("isInNet", func(args []any) any {
+		addr := firstIPv4(env.lookup(str(args, 0)))
+		pattern, err1 := netip.ParseAddr(str(args, 1))
+		mask, err2 := netip.ParseAddr(str(args, 2))
+		if !addr.IsValid() || err1 != nil || err2 != nil || !pattern.Is4() || !mask.Is4() {
+			return false
+		}
+		a, p, m := addr.As4(), pattern.As4(), mask.As4()
+		for i := range a {
+			if a[i]&m[i] != p[i]&m[i] {
+				return false
+			}
+		}
+		return true
+	})
+	define("isInNetEx", func(args []any) any {
+		pfx, err := netip.ParsePrefix(str(args, 1))
+		if err != nil {
+			return false
+		}
+		for _, addr := range env.lookup(str(args, 0)) {
+			if pfx.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	})
+	define("convert_addr", func(args []any) any {
+		if addr, err := netip.ParseAddr(str(args, 0)); err == nil && addr.Is4() {
+			a := addr.As4()
+			return float64(uint32(a[0])<<24 | uint32(a[1])<<16 | uint32(a[2])<<8 | uint32(a[3]))
+		}
+		return 0.0
+	})
+	define("sortIpAddressList", func(args []any) any {
+		var addrs []netip.Addr
+		for s := range strings.SplitSeq(str(args, 0), ";") {
+			addr, err := netip.ParseAddr(strings.TrimSpace(s))
+			if err != nil {
+				return false
+			}
+			addrs = append(addrs, addr)
+		}
+		slices.SortStableFunc(addrs, func(a, b netip.Addr) int {
+			if a.Is6() != b.Is6() {
+				if a.Is6() {
+					return -1
+				}
+				return 1
+			}
+			return a.Compare(b)
+		})
+		return pacAddrsString(addrs)
+	})
+	define("getClientVersion", func(args []any) any {
+		return "1.0"
+	})
+	define("dnsDomainLevels", func(args []any) any {
+		return float64(strings.Count(str(args, 0), "."))
+	})
+	define("shExpMatch", func(args []any) any {
+		re, err := pacShExp(str(args, 1))
+		return err == nil && re.MatchString(str(args, 0))
+	})
+	define("weekdayRange", func(args []any) any { return env.weekdayRange(args) })
+	define("dateRange", func(args []any) any { return env.dateRange(args) })
+	define("timeRange", func(args []any) any { return env.timeRange(args) })
+	define("alert", func(args []any) any {
+		if env.logger != nil {
+			env.logger.Info("pac", "alert", str(args, 0))
+		}
+		return pacUndefined{}
+	})
+}
@@ -0,0 +1,100 @@
+package httpproxy
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestPACFunctions(t *testing.T) {
+	tests := []struct{ expr, want string }{
+		{`isPlainHostName("www")`, "true"},
+		{`isPlainHostName("www.example.com")`, "false"},
+		{`isPlainHostName("::1")`, "false"},
+		{`dnsDomainIs("www.example.com", ".example.com")`, "true"},
+		{`dnsDomainIs("www.Example.COM", ".example.com")`, "true"},
+		{`dnsDomainIs("www", ".example.com")`, "false"},
+		{`localHostOrDomainIs("www.example.com", "www.example.com")`, "true"},
+		{`localHostOrDomainIs("www", "www.example.com")`, "true"},
+		{`localHostOrDomainIs("www.other.com", "www.example.com")`, "false"},
+		{`localHostOrDomainIs("home.example.com", "www.example.com")`, "false"},
+		{`isResolvable("intranet.example.com")`, "true"},
+		{`isResolvable("nonexistent.example.com")`, "false"},
+		{`dnsResolve("intranet.example.com")`, "10.1.2.3"},
+		{`dnsResolve("dual.example.com")`, "192.0.2.7"},
+		{`dnsResolve("nonexistent.example.com")`, "null"},
+		{`dnsResolveEx("dual.example.com")`, "2001:db8::1;192.0.2.7"},
+		{`isResolvableEx("dual.example.com")`, "true"},
+		{`myIpAddress()`, "192.168.1.20"},
+		{`isInNet("intranet.example.com", "10.0.0.0", "255.0.0.0")`, "true"},
+		{`isInNet("10.1.2.3", "10.1.0.0", "255.255.0.0")`, "true"},
+		{`isInNet("10.2.2.3", "10.1.0.0", "255.255.0.0")`, "false"},
+		{`isInNet("nonexistent.example.com", "0.0.0.0", "0.0.0.0")`, "false"},
+		{`isInNet(myIpAddress(), "192.168.1.0", "255.255.255.0")`, "true"},
+		{`isInNetEx("dual.example.com", "2001:db8::/32")`, "true"},
+		{`isInNetEx("intranet.example.com", "192.168.0.0/16")`, "false"},
+		{`convert_addr("10.0.0.1")`, "167772161"},
+		{`convert_addr("10.1.2.3") & convert_addr("255.255.0.0")`, "167837696"},
+		{`sortIpAddressList("10.0.0.2;2001:db8::1;10.0.0.1")`, "2001:db8::1;10.0.0.1;10.0.0.2"},
+		{`dnsDomainLevels("www")`, "0"},
+		{`dnsDomainLevels("www.example.com")`, "2"},
+		{`shExpMatch("http://home.example.com/a/b", "*/a/*")`, "true"},
+		{`shExpMatch("www.example.com", "*.example.com")`, "true"},
+		{`shExpMatch("example.com", "*.example.com")`, "false"},
+		{`shExpMatch("www1.example.com", "www?.example.com")`, "true"},
+		{`shExpMatch("www12.example.com", "www?.example.com")`, "false"},
+		{`shExpMatch("a(b)c", "a(b)*")`, "true"},
+	}
+	for _, tt := range tests {
+		got, err := pacExprResult(t, tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+		} else if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestPACTimeFunctions(t *testing.T) {
+	// Wednesday 2025-06-18 14:30:15 UTC
+	now := time.Date(2025, 6, 18, 14, 30, 15, 0, time.UTC)
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{`weekdayRange("WED", "GMT")`, true},
+		{`weekdayRange("MON", "FRI", "GMT")`, true},
+		{`weekdayRange("SAT", "GMT")`, false},
+		{`weekdayRange("FRI", "MON", "GMT")`, false},
+		{`weekdayRange("SAT", "WED", "GMT")`, true},
+		{`weekdayRange("XYZ", "GMT")`, false},
+		{`dateRange(18, "GMT")`, true},
+		{`dateRange(1, 15, "GMT")`, false},
+		{`dateRange("JUN", "GMT")`, true},
+		{`dateRange("JAN", "MAR", "GMT")`, false},
+		{`dateRange("NOV", "JUL", "GMT")`, true},
+		{`dateRange(2025, "GMT")`, true},
+		{`dateRange(2020, 2024, "GMT")`, false},
+		{`dateRange(1, "JUN", 30, "AUG", "GMT")`, true},
+		{`dateRange(19, "JUN", 30, "AUG", "GMT")`, false},
+		{`dateRange("JUN", 2025, "DEC", 2025, "GMT")`, true},
+		{`dateRange(1, "JAN", 2025, 18, "JUN", 2025, "GMT")`, true},
+		{`dateRange(1, "JAN", 2025, 17, "JUN", 2025, "GMT")`, false},
+		{`timeRange(14, "GMT")`, true},
+		{`timeRange(9, 17, "GMT")`, true},
+		{`timeRange(22, 6, "GMT")`, false},
+		{`timeRange(14, 0, 14, 30, "GMT")`, true},
+		{`timeRange(14, 31, 15, 0, "GMT")`, false},
+		{`timeRange(14, 30, 0, 14, 30, 10, "GMT")`, false},
+		{`timeRange(14, 30, 0, 14, 30, 15, "GMT")`, true},
+		{`timeRange(1, 2, 3, "GMT")`, false},
+	}
+	for _, tt := range tests {
+		got, err := evalPACAt(t, now, "function FindProxyForURL(url, host) { return String("+tt.expr+"); }", "http://x/", "x")
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+		} else if want := strconv.FormatBool(tt.want); got != want {
+			t.Errorf("%s: got %q, want %q", tt.expr, got, want)
+		}
+	}
+}
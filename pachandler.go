@@ -0,0 +1,160 @@
+package httpproxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PACContentType is the MIME type of proxy auto-config files.
+const PACContentType = "application/x-ns-proxy-autoconfig"
+
+// DefaultPACMaxAge is the default time clients may cache a PAC file served by a PACHandler.
+var DefaultPACMaxAge = time.Hour
+
+// PACHandler is an http.Handler serving a proxy auto-config file at
+// /proxy.pac and /wpad.dat that sends all traffic to the proxy, except for
+// destinations matching Bypass which are connected to directly.
+//
+// It can be used as the Server's Handler, in which case the proxy address
+// defaults to the host and port the request for the PAC file was received on.
+//
+// Bypass entries may be "<local>" for plain host names, an IP address,
+// an address range in CIDR notation, "example.com" for a domain and its subdomains,
+// ".example.com" or "*.example.com" for subdomains only, or a shell expression
+// using * and ? matched against the host name. Addresses and address ranges only
+// match destinations given as IP addresses, so clients need not resolve host names.
+type PACHandler struct {
+	Address        string        // optional host:port clients should use, defaults to the address the request was received on
+	Bypass         []string      // optional destinations connected to directly
+	FallbackDirect bool          // optional, let clients connect directly if the proxy can't be reached
+	MaxAge         time.Duration // optional time clients may cache the file, defaults to DefaultPACMaxAge
+	Handler        http.Handler  // optional handler for requests for other paths, otherwise responds 404 Not Found
+}
+
+var _ http.Handler = (*PACHandler)(nil)
+
+// pacQuote returns s as a JavaScript string literal.
+func pacQuote(s string) string {
+	b, _ := json.Marshal(s)
+	return string(b)
+}
+
+// pacBypassCondition returns the JavaScript condition matching the bypass entry.
+func pacBypassCondition(entry string) string {
+	entry = strings.ToLower(strings.TrimSpace(entry))
+	if entry == "<local>" {
+		return "isPlainHostName(host)"
+	}
+	if pfx, err := netip.ParsePrefix(entry); err == nil {
+		pfx = pfx.Masked()
+		if pfx.Addr().Is4() {
+			mask := net.IP(net.CIDRMask(pfx.Bits(), 32)).String()
+			return "(isIPv4(host) && isInNet(host, " + pacQuote(pfx.Addr().String()) + ", " + pacQuote(mask) + "))"
+		}
+		return "(isIPv6(host) && typeof isInNetEx == \"function\" && isInNetEx(host, " + pacQuote(pfx.String()) + "))"
+	}
+	if addr, err := netip.ParseAddr(strings.Trim(entry, "[]")); err == nil {
+		return "host == " + pacQuote(addr.String())
+	}
+	if domain, ok := strings.CutPrefix(entry, "*."); ok && !strings.ContainsAny(domain, "*?") {
+		return "dnsDomainIs(host, " + pacQuote("."+domain) + ")"
+	}
+	if strings.HasPrefix(entry, ".") && !strings.ContainsAny(entry, "*?") {
+		return "dnsDomainIs(host, " + pacQuote(entry) + ")"
+	}
+	if strings.ContainsAny(entry, "*?") {
+		return "shExpMatch(host, " + pacQuote(entry) + ")"
+	}
+	return "(host == " + pacQuote(entry) + " || dnsDomainIs(host, " + pacQuote("."+entry) + "))"
+}
+
+// proxyAddress returns the host:port clients should use to reach the proxy.
+func (ph *PACHandler) proxyAddress(r *http.Request) string {
+	if ph.Address != "" {
+		return ph.Address
+	}
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	if laddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if lhost, lport, err := net.SplitHostPort(laddr.String()); err == nil {
+			if host == "" {
+				host = lhost
+			}
+			if port == "" {
+				port = lport
+			}
+		}
+	}
+	if port == "" {
+		port = "80"
+		if r.TLS != nil {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// Script returns the PAC file for clients reaching the proxy at address.
+func (ph *PACHandler) Script(address string, secure bool) string {
+	var sb strings.Builder
+	sb.WriteString("function isIPv4(host) {\n\treturn /^\\d+\\.\\d+\\.\\d+\\.\\d+$/.test(host);\n}\n\n")
+	sb.WriteString("function isIPv6(host) {\n\treturn host.indexOf(\":\") >= 0;\n}\n\n")
+	sb.WriteString("function FindProxyForURL(url, host) {\n")
+	sb.WriteString("\thost = host.toLowerCase();\n")
+	var conds []string
+	for _, entry := range ph.Bypass {
+		if strings.TrimSpace(entry) != "" {
+			conds = append(conds, pacBypassCondition(entry))
+		}
+	}
+	if len(conds) > 0 {
+		sb.WriteString("\tif (" + strings.Join(conds, " ||\n\t\t") + ")\n")
+		sb.WriteString("\t\treturn \"DIRECT\";\n")
+	}
+	result := "PROXY " + address
+	if secure {
+		result = "HTTPS " + address
+	}
+	if ph.FallbackDirect {
+		result += "; DIRECT"
+	}
+	sb.WriteString("\treturn " + pacQuote(result) + ";\n}\n")
+	return sb.String()
+}
+
+func (ph *PACHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/proxy.pac" && r.URL.Path != "/wpad.dat" {
+		if ph.Handler != nil {
+			ph.Handler.ServeHTTP(w, r)
+		} else {
+			http.NotFound(w, r)
+		}
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	script := ph.Script(ph.proxyAddress(r), r.TLS != nil)
+	sum := sha256.Sum256([]byte(script))
+	maxAge := ph.MaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultPACMaxAge
+	}
+	hdr := w.Header()
+	hdr.Set("Content-Type", PACContentType)
+	hdr.Set("Cache-Control", "max-age="+strconv.Itoa(int(maxAge.Seconds())))
+	hdr.Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte(script)))
+}
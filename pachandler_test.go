@@ -0,0 +1,100 @@
+package httpproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPACHandlerScript(t *testing.T) {
+	ph := &PACHandler{
+		Bypass:         []string{"<local>", "example.com", "*.corp.example.net", ".lab.example.org", "build-??.example.io", "10.0.0.0/8", "192.168.1.5", "fc00::/7", " "},
+		FallbackDirect: true,
+	}
+	script := ph.Script("proxy.example.com:8080", false)
+	tests := []struct{ host, want string }{
+		{"intranet", "DIRECT"},
+		{"example.com", "DIRECT"},
+		{"WWW.Example.com", "DIRECT"},
+		{"notexample.com", "PROXY proxy.example.com:8080; DIRECT"},
+		{"a.corp.example.net", "DIRECT"},
+		{"corp.example.net", "PROXY proxy.example.com:8080; DIRECT"},
+		{"x.lab.example.org", "DIRECT"},
+		{"build-01.example.io", "DIRECT"},
+		{"build-001.example.io", "PROXY proxy.example.com:8080; DIRECT"},
+		{"10.20.30.40", "DIRECT"},
+		{"11.20.30.40", "PROXY proxy.example.com:8080; DIRECT"},
+		{"192.168.1.5", "DIRECT"},
+		{"fd00::1", "DIRECT"},
+		{"2001:db8::1", "PROXY proxy.example.com:8080; DIRECT"},
+	}
+	for _, tt := range tests {
+		got, err := evalPACAt(t, time.Now(), script, "http://"+tt.host+"/", tt.host)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.host, got, err, tt.want)
+		}
+	}
+
+	if got, err := evalPACAt(t, time.Now(), (&PACHandler{}).Script("proxy:443", true), "http://x/", "x"); err != nil || got != "HTTPS proxy:443" {
+		t.Error(got, err)
+	}
+}
+
+func TestPACHandler(t *testing.T) {
+	proxysrv := httptest.NewServer(&Server{Handler: &PACHandler{
+		Bypass: []string{"<local>"},
+		MaxAge: time.Minute,
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "other")
+		}),
+	}})
+	defer proxysrv.Close()
+
+	resp, err := http.Get(proxysrv.URL + "/wpad.dat")
+	maybeFatal(t, err)
+	body := readBody(t, resp)
+	if resp.StatusCode != http.StatusOK ||
+		resp.Header.Get("Content-Type") != PACContentType ||
+		resp.Header.Get("Cache-Control") != "max-age=60" ||
+		!strings.Contains(body, `"PROXY `+proxysrv.Listener.Addr().String()+`"`) {
+		t.Error(resp.StatusCode, resp.Header, body)
+	}
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		t.Fatal(resp.Header)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, proxysrv.URL+"/proxy.pac", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	maybeFatal(t, err)
+	if _ = readBody(t, resp); resp.StatusCode != http.StatusNotModified {
+		t.Error(resp.StatusCode)
+	}
+
+	resp, err = http.Post(proxysrv.URL+"/proxy.pac", "text/plain", nil)
+	maybeFatal(t, err)
+	if _ = readBody(t, resp); resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Error(resp.StatusCode, resp.Header)
+	}
+
+	resp, err = http.Get(proxysrv.URL + "/")
+	maybeFatal(t, err)
+	if body := readBody(t, resp); body != "other" {
+		t.Error(body)
+	}
+
+	rec := httptest.NewRecorder()
+	(&PACHandler{Address: "proxy.example.com:3128"}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/elsewhere", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Error(rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	(&PACHandler{Address: "proxy.example.com:3128"}).ServeHTTP(rec, httptest.NewRequest(http.MethodHead, "/proxy.pac", nil))
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 || rec.Header().Get("Cache-Control") != "max-age=3600" {
+		t.Error(rec.Code, rec.Header(), rec.Body.String())
+	}
+}
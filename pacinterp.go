@@ -0,0 +1,960 @@
+package httpproxy
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var ErrPACEval = errors.New("PAC evaluation error")
+
+// pacMaxSteps limits the statements and calls executed in one evaluation.
+const pacMaxSteps = 1_000_000
+
+// pacCheckInterval is how many steps are executed between checks that the evaluation hasn't timed out.
+const pacCheckInterval = 1024
+
+// pacMaxDepth limits the nesting of function calls.
+const pacMaxDepth = 200
+
+// pacMaxStringLength limits the length of strings created by a script.
+const pacMaxStringLength = 1 << 20
+
+// pacMaxArrayLength limits the length of arrays created by a script.
+const pacMaxArrayLength = 1 << 20
+
+// pacCheckSize is how many bytes or array elements may be created between checks that the evaluation hasn't timed out.
+const pacCheckSize = 1 << 20
+
+// PAC script values are float64, string, bool, nil (null), pacUndefined
+// and the reference types below.
+type (
+	pacUndefined struct{}
+	pacArray     struct{ elems []any }
+	pacObject    struct {
+		keys  []string // in insertion order
+		props map[string]any
+	}
+	pacFunc struct {
+		decl  *pacFuncDecl
+		scope *pacScope
+	}
+	pacNativeFunc struct {
+		name string
+		fn   func(in *pacInterp, args []any) (v any, err error)
+	}
+	pacRegExp struct {
+		re     *regexp.Regexp
+		source string
+		global bool
+	}
+)
+
+type pacCtrl int
+
+const (
+	pacNormal pacCtrl = iota
+	pacDoBreak
+	pacDoContinue
+	pacDoReturn
+)
+
+type pacScope struct {
+	vars   map[string]any
+	parent *pacScope
+}
+
+func newPACScope(parent *pacScope) *pacScope {
+	return &pacScope{vars: make(map[string]any), parent: parent}
+}
+
+func (sc *pacScope) lookup(name string) (v any, ok bool) {
+	for ; sc != nil; sc = sc.parent {
+		if v, ok = sc.vars[name]; ok {
+			return
+		}
+	}
+	return
+}
+
+// set assigns to the innermost variable name, or creates a global variable.
+func (sc *pacScope) set(name string, v any) {
+	for s := sc; s != nil; s = s.parent {
+		if _, ok := s.vars[name]; ok || s.parent == nil {
+			s.vars[name] = v
+			return
+		}
+	}
+}
+
+// pacInterp holds the state of one evaluation.
+type pacInterp struct {
+	env   *pacEnv
+	steps int
+	depth int
+	size  int // bytes and array elements created since the last timeout check
+}
+
+func (in *pacInterp) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s", ErrPACEval, fmt.Sprintf(format, args...))
+}
+
+func (in *pacInterp) step() (err error) {
+	if in.steps++; in.steps > pacMaxSteps {
+		err = in.errorf("script too long running")
+	} else if in.steps%pacCheckInterval == 0 {
+		err = in.checkTimeout()
+	}
+	return
+}
+
+func (in *pacInterp) checkTimeout() (err error) {
+	if in.env.ctx != nil && in.env.ctx.Err() != nil {
+		err = fmt.Errorf("%w: script timed out: %w", ErrPACEval, in.env.ctx.Err())
+	}
+	return
+}
+
+// checkSize fails if v is a string or array longer than allowed.
+// Since creating large values takes time, it also checks that the
+// evaluation hasn't timed out in proportion to their size.
+func (in *pacInterp) checkSize(v any) (err error) {
+	var n int
+	switch v := v.(type) {
+	case string:
+		if n = len(v); n > pacMaxStringLength {
+			err = in.errorf("string too long")
+		}
+	case *pacArray:
+		if n = len(v.elems); n > pacMaxArrayLength {
+			err = in.errorf("array too long")
+		}
+	}
+	if in.size += n; err == nil && in.size >= pacCheckSize {
+		in.size = 0
+		err = in.checkTimeout()
+	}
+	return
+}
+
+func newPACObject() *pacObject {
+	return &pacObject{props: make(map[string]any)}
+}
+
+func (o *pacObject) get(key string) (v any) {
+	var ok bool
+	if v, ok = o.props[key]; !ok {
+		v = pacUndefined{}
+	}
+	return
+}
+
+func (o *pacObject) set(key string, v any) {
+	if _, ok := o.props[key]; !ok {
+		o.keys = append(o.keys, key)
+	}
+	o.props[key] = v
+}
+
+func (o *pacObject) delete(key string) {
+	if _, ok := o.props[key]; ok {
+		delete(o.props, key)
+		o.keys = slices.DeleteFunc(o.keys, func(k string) bool { return k == key })
+	}
+}
+
+func pacNumberToString(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case math.IsInf(f, 1):
+		return "Infinity"
+	case math.IsInf(f, -1):
+		return "-Infinity"
+	case f == 0:
+		return "0"
+	case math.Abs(f) >= 1e21 || math.Abs(f) < 1e-6:
+		return strings.Replace(strconv.FormatFloat(f, 'g', -1, 64), "e+0", "e+", 1)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func pacToString(v any) string {
+	switch v := v.(type) {
+	case pacUndefined:
+		return "undefined"
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return pacNumberToString(v)
+	case string:
+		return v
+	case *pacArray:
+		return pacJoin(v, ",", nil)
+	case *pacRegExp:
+		return "/" + v.source + "/"
+	case *pacFunc, *pacNativeFunc:
+		return "function"
+	}
+	return "[object Object]"
+}
+
+// pacJoin converts the elements of a to strings and joins them with sep.
+// Arrays in seen are already being converted, and like in JavaScript
+// they are converted to the empty string rather than recursing forever.
+// Arrays nested deeper than pacMaxDepth are also converted to the empty string.
+// The result is cut short once it is longer than pacMaxStringLength.
+func pacJoin(a *pacArray, sep string, seen []*pacArray) string {
+	if slices.Contains(seen, a) || len(seen) >= pacMaxDepth {
+		return ""
+	}
+	seen = append(seen, a)
+	var sb strings.Builder
+	for i, elem := range a.elems {
+		if sb.Len() > pacMaxStringLength {
+			break
+		}
+		if i > 0 {
+			sb.WriteString(sep)
+		}
+		switch elem := elem.(type) {
+		case nil, pacUndefined:
+		case *pacArray:
+			sb.WriteString(pacJoin(elem, ",", seen))
+		default:
+			sb.WriteString(pacToString(elem))
+		}
+	}
+	return sb.String()
+}
+
+func pacToNumber(v any) float64 {
+	switch v := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case float64:
+		return v
+	case string:
+		s := strings.TrimSpace(v)
+		if s == "" {
+			return 0
+		}
+		if hex, ok := strings.CutPrefix(strings.ToLower(s), "0x"); ok {
+			if n, err := strconv.ParseUint(hex, 16, 64); err == nil {
+				return float64(n)
+			}
+			return math.NaN()
+		}
+		switch s {
+		case "Infinity", "+Infinity":
+			return math.Inf(1)
+		case "-Infinity":
+			return math.Inf(-1)
+		}
+		if f, err := strconv.ParseFloat(s, 64); err == nil && !strings.ContainsAny(s, "iInN_") {
+			return f
+		}
+	case *pacArray:
+		return pacToNumber(pacToString(v))
+	}
+	return math.NaN()
+}
+
+func pacTruthy(v any) bool {
+	switch v := v.(type) {
+	case pacUndefined, nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	}
+	return true
+}
+
+func pacToInt32(v any) int32 {
+	f := pacToNumber(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return int32(uint32(int64(math.Mod(math.Trunc(f), 1<<32))))
+}
+
+func pacTypeOf(v any) string {
+	switch v.(type) {
+	case pacUndefined:
+		return "undefined"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case *pacFunc, *pacNativeFunc:
+		return "function"
+	}
+	return "object"
+}
+
+// pacPrimitive converts arrays and objects to strings.
+func pacPrimitive(v any) any {
+	switch v.(type) {
+	case *pacArray, *pacObject, *pacRegExp, *pacFunc, *pacNativeFunc:
+		return pacToString(v)
+	}
+	return v
+}
+
+func pacStrictEquals(a, b any) bool {
+	if fa, ok := a.(float64); ok {
+		fb, ok := b.(float64)
+		return ok && fa == fb
+	}
+	return a == b
+}
+
+func pacLooseEquals(a, b any) bool {
+	if pacTypeOf(a) == pacTypeOf(b) && (a == nil) == (b == nil) {
+		return pacStrictEquals(a, b)
+	}
+	switch {
+	case (a == nil || a == pacUndefined{}) && (b == nil || b == pacUndefined{}):
+		return true
+	case a == nil || a == pacUndefined{} || b == nil || b == pacUndefined{}:
+		return false
+	}
+	_, aref := pacPrimitive(a).(string)
+	_, bref := pacPrimitive(b).(string)
+	if aref && bref {
+		return pacToString(a) == pacToString(b)
+	}
+	return pacToNumber(pacPrimitive(a)) == pacToNumber(pacPrimitive(b))
+}
+
+func pacBinaryOp(op string, l, r any) (v any, err error) {
+	switch op {
+	case "+":
+		l, r = pacPrimitive(l), pacPrimitive(r)
+		_, ls := l.(string)
+		_, rs := r.(string)
+		if ls || rs {
+			return pacToString(l) + pacToString(r), nil
+		}
+		return pacToNumber(l) + pacToNumber(r), nil
+	case "-":
+		return pacToNumber(l) - pacToNumber(r), nil
+	case "*":
+		return pacToNumber(l) * pacToNumber(r), nil
+	case "/":
+		return pacToNumber(l) / pacToNumber(r), nil
+	case "%":
+		return math.Mod(pacToNumber(l), pacToNumber(r)), nil
+	case "==":
+		return pacLooseEquals(l, r), nil
+	case "!=":
+		return !pacLooseEquals(l, r), nil
+	case "===":
+		return pacStrictEquals(l, r), nil
+	case "!==":
+		return !pacStrictEquals(l, r), nil
+	case "<", ">", "<=", ">=":
+		l, r = pacPrimitive(l), pacPrimitive(r)
+		ls, lok := l.(string)
+		rs, rok := r.(string)
+		var c int
+		if lok && rok {
+			c = strings.Compare(ls, rs)
+		} else {
+			lf, rf := pacToNumber(l), pacToNumber(r)
+			if math.IsNaN(lf) || math.IsNaN(rf) {
+				return false, nil
+			}
+			c = cmpFloat(lf, rf)
+		}
+		switch op {
+		case "<":
+			return c < 0, nil
+		case ">":
+			return c > 0, nil
+		case "<=":
+			return c <= 0, nil
+		}
+		return c >= 0, nil
+	case "&":
+		return float64(pacToInt32(l) & pacToInt32(r)), nil
+	case "|":
+		return float64(pacToInt32(l) | pacToInt32(r)), nil
+	case "^":
+		return float64(pacToInt32(l) ^ pacToInt32(r)), nil
+	case "<<":
+		return float64(pacToInt32(l) << (uint32(pacToInt32(r)) & 31)), nil
+	case ">>":
+		return float64(pacToInt32(l) >> (uint32(pacToInt32(r)) & 31)), nil
+	case ">>>":
+		return float64(uint32(pacToInt32(l)) >> (uint32(pacToInt32(r)) & 31)), nil
+	case "in":
+		key := pacToString(r)
+		switch obj := r.(type) {
+		case *pacObject:
+			_, ok := obj.props[pacToString(l)]
+			return ok, nil
+		case *pacArray:
+			i, ok := pacIndex(l)
+			return ok && i < len(obj.elems), nil
+		}
+		return nil, fmt.Errorf("%w: cannot use 'in' operator on %s", ErrPACEval, key)
+	}
+	return nil, fmt.Errorf("%w: unsupported operator %q", ErrPACEval, op)
+}
+
+func cmpFloat(a, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// pacIndex returns v as an array index.
+func pacIndex(v any) (i int, ok bool) {
+	f := pacToNumber(v)
+	if f >= 0 && f == math.Trunc(f) && f < math.MaxInt32 {
+		return int(f), true
+	}
+	return
+}
+
+func (x *pacLiteral) eval(in *pacInterp, sc *pacScope) (any, error) {
+	return x.v, nil
+}
+
+func (x *pacIdentExpr) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	var ok bool
+	if v, ok = sc.lookup(x.name); !ok {
+		err = in.errorf("%s is not defined", x.name)
+	}
+	return
+}
+
+func (x *pacRegExpLit) eval(in *pacInterp, sc *pacScope) (any, error) {
+	return &pacRegExp{re: x.re, source: x.source, global: strings.Contains(x.flags, "g")}, nil
+}
+
+func (x *pacArrayLit) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	a := &pacArray{elems: make([]any, len(x.elems))}
+	for i, elem := range x.elems {
+		if a.elems[i], err = elem.eval(in, sc); err != nil {
+			return
+		}
+	}
+	return a, nil
+}
+
+func (x *pacObjectLit) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	o := newPACObject()
+	for i, key := range x.keys {
+		var val any
+		if val, err = x.vals[i].eval(in, sc); err != nil {
+			return
+		}
+		o.set(key, val)
+	}
+	return o, nil
+}
+
+func (x *pacFuncExpr) eval(in *pacInterp, sc *pacScope) (any, error) {
+	return &pacFunc{decl: x.decl, scope: sc}, nil
+}
+
+func (x *pacMember) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	var obj, key any
+	if obj, err = x.obj.eval(in, sc); err == nil {
+		if key, err = x.key.eval(in, sc); err == nil {
+			v, err = in.getMember(obj, key)
+		}
+	}
+	return
+}
+
+func (in *pacInterp) getMember(obj, key any) (v any, err error) {
+	name := pacToString(key)
+	v = pacUndefined{}
+	switch obj := obj.(type) {
+	case pacUndefined, nil:
+		err = in.errorf("cannot read property %q of %s", name, pacToString(obj))
+	case string:
+		if name == "length" {
+			v = float64(len(obj))
+		} else if i, ok := pacIndex(key); ok {
+			if i < len(obj) {
+				v = obj[i : i+1]
+			}
+		} else if fn := pacStringMethod(obj, name); fn != nil {
+			v = fn
+		}
+	case *pacArray:
+		if name == "length" {
+			v = float64(len(obj.elems))
+		} else if i, ok := pacIndex(key); ok {
+			if i < len(obj.elems) {
+				v = obj.elems[i]
+			}
+		} else if fn := pacArrayMethod(obj, name); fn != nil {
+			v = fn
+		}
+	case *pacObject:
+		if val, ok := obj.props[name]; ok {
+			v = val
+		} else if name == "hasOwnProperty" {
+			v = &pacNativeFunc{name: name, fn: func(in *pacInterp, args []any) (any, error) {
+				_, ok := obj.props[pacToString(pacArg(args, 0))]
+				return ok, nil
+			}}
+		}
+	case *pacRegExp:
+		switch name {
+		case "source":
+			v = obj.source
+		case "global":
+			v = obj.global
+		case "test":
+			v = &pacNativeFunc{name: name, fn: func(in *pacInterp, args []any) (any, error) {
+				return obj.re.MatchString(pacToString(pacArg(args, 0))), nil
+			}}
+		case "exec":
+			v = &pacNativeFunc{name: name, fn: func(in *pacInterp, args []any) (any, error) {
+				return pacMatch(obj, pacToString(pacArg(args, 0)), false), nil
+			}}
+		}
+	}
+	return
+}
+
+func (in *pacInterp) setMember(obj, key, v any) (err error) {
+	switch obj := obj.(type) {
+	case *pacObject:
+		obj.set(pacToString(key), v)
+	case *pacArray:
+		i, ok := pacIndex(key)
+		switch {
+		case ok && i < len(obj.elems)+pacMaxArrayGrowth && i < pacMaxArrayLength:
+			for len(obj.elems) <= i {
+				obj.elems = append(obj.elems, pacUndefined{})
+			}
+			obj.elems[i] = v
+		case pacToString(key) == "length":
+			if n, ok := pacIndex(v); ok && n <= len(obj.elems) {
+				obj.elems = obj.elems[:n]
+			}
+		default:
+			err = in.errorf("invalid array index %s", pacToString(key))
+		}
+	default:
+		err = in.errorf("cannot set property %q of %s", pacToString(key), pacToString(obj))
+	}
+	return
+}
+
+// pacMaxArrayGrowth limits how far past its end an array may be assigned to.
+const pacMaxArrayGrowth = 1024
+
+func pacArg(args []any, i int) any {
+	if i < len(args) {
+		return args[i]
+	}
+	return pacUndefined{}
+}
+
+func (x *pacCall) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	var fn any
+	if fn, err = x.callee.eval(in, sc); err == nil {
+		args := make([]any, len(x.args))
+		for i, arg := range x.args {
+			if args[i], err = arg.eval(in, sc); err != nil {
+				return
+			}
+		}
+		v, err = in.call(fn, args)
+	}
+	return
+}
+
+func (in *pacInterp) call(fn any, args []any) (v any, err error) {
+	if err = in.step(); err == nil {
+		switch fn := fn.(type) {
+		case *pacNativeFunc:
+			if v, err = fn.fn(in, args); err == nil {
+				err = in.checkSize(v)
+			}
+		case *pacFunc:
+			if in.depth >= pacMaxDepth {
+				return nil, in.errorf("too much recursion")
+			}
+			in.depth++
+			defer func() { in.depth-- }()
+			sc := newPACScope(fn.scope)
+			for i, name := range fn.decl.params {
+				sc.vars[name] = pacArg(args, i)
+			}
+			var ctrl pacCtrl
+			if ctrl, v, err = in.execBody(fn.decl.body, sc); err == nil && ctrl != pacDoReturn {
+				v = pacUndefined{}
+			}
+		default:
+			err = in.errorf("%s is not a function", pacToString(fn))
+		}
+	}
+	return
+}
+
+// execBody hoists the function declarations in body and executes it.
+func (in *pacInterp) execBody(body []pacStmt, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	for _, stmt := range body {
+		if decl, ok := stmt.(*pacFuncDecl); ok {
+			sc.vars[decl.name] = &pacFunc{decl: decl, scope: sc}
+		}
+	}
+	return in.execList(body, sc)
+}
+
+func (in *pacInterp) execList(body []pacStmt, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	for _, stmt := range body {
+		if ctrl, v, err = stmt.exec(in, sc); err != nil || ctrl != pacNormal {
+			return
+		}
+	}
+	return
+}
+
+func (x *pacUnary) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	if x.op == "typeof" {
+		if id, ok := x.x.(*pacIdentExpr); ok {
+			if v, ok = sc.lookup(id.name); !ok {
+				return "undefined", nil
+			}
+			return pacTypeOf(v), nil
+		}
+	}
+	if x.op == "delete" {
+		if m, ok := x.x.(*pacMember); ok {
+			var obj, key any
+			if obj, err = m.obj.eval(in, sc); err == nil {
+				if key, err = m.key.eval(in, sc); err == nil {
+					if o, ok := obj.(*pacObject); ok {
+						o.delete(pacToString(key))
+					}
+				}
+			}
+			return true, err
+		}
+		return true, nil
+	}
+	if v, err = x.x.eval(in, sc); err == nil {
+		switch x.op {
+		case "!":
+			v = !pacTruthy(v)
+		case "-":
+			v = -pacToNumber(v)
+		case "+":
+			v = pacToNumber(v)
+		case "~":
+			v = float64(^pacToInt32(v))
+		case "typeof":
+			v = pacTypeOf(v)
+		case "void":
+			v = pacUndefined{}
+		}
+	}
+	return
+}
+
+// assign stores v in the variable or property target.
+func (in *pacInterp) assign(target pacExpr, sc *pacScope, v any) (err error) {
+	switch t := target.(type) {
+	case *pacIdentExpr:
+		sc.set(t.name, v)
+	case *pacMember:
+		var obj, key any
+		if obj, err = t.obj.eval(in, sc); err == nil {
+			if key, err = t.key.eval(in, sc); err == nil {
+				err = in.setMember(obj, key, v)
+			}
+		}
+	}
+	return
+}
+
+func (x *pacUpdate) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	var old any
+	if old, err = x.target.eval(in, sc); err == nil {
+		n := pacToNumber(old)
+		nv := n + 1
+		if x.op == "--" {
+			nv = n - 1
+		}
+		if err = in.assign(x.target, sc, nv); err == nil {
+			v = n
+			if x.prefix {
+				v = nv
+			}
+		}
+	}
+	return
+}
+
+func (x *pacBinary) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	if v, err = x.l.eval(in, sc); err == nil {
+		switch x.op {
+		case "&&":
+			if pacTruthy(v) {
+				v, err = x.r.eval(in, sc)
+			}
+		case "||":
+			if !pacTruthy(v) {
+				v, err = x.r.eval(in, sc)
+			}
+		default:
+			var r any
+			if r, err = x.r.eval(in, sc); err == nil {
+				if v, err = pacBinaryOp(x.op, v, r); err == nil {
+					err = in.checkSize(v)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (x *pacCond) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	if v, err = x.test.eval(in, sc); err == nil {
+		if pacTruthy(v) {
+			v, err = x.a.eval(in, sc)
+		} else {
+			v, err = x.b.eval(in, sc)
+		}
+	}
+	return
+}
+
+func (x *pacAssign) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	if v, err = x.value.eval(in, sc); err == nil {
+		if x.op != "=" {
+			var old any
+			if old, err = x.target.eval(in, sc); err != nil {
+				return
+			}
+			if v, err = pacBinaryOp(strings.TrimSuffix(x.op, "="), old, v); err == nil {
+				err = in.checkSize(v)
+			}
+			if err != nil {
+				return
+			}
+		}
+		err = in.assign(x.target, sc, v)
+	}
+	return
+}
+
+func (x *pacComma) eval(in *pacInterp, sc *pacScope) (v any, err error) {
+	for _, e := range x.exprs {
+		if v, err = e.eval(in, sc); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (s *pacExprStmt) exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	if err = in.step(); err == nil {
+		_, err = s.x.eval(in, sc)
+	}
+	return
+}
+
+func (s *pacVarStmt) exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	for i, name := range s.names {
+		if _, ok := sc.vars[name]; !ok {
+			sc.vars[name] = pacUndefined{}
+		}
+		if s.inits[i] != nil {
+			if v, err = s.inits[i].eval(in, sc); err != nil {
+				return
+			}
+			sc.vars[name] = v
+		}
+	}
+	return pacNormal, nil, nil
+}
+
+func (s *pacFuncDecl) exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	if _, ok := sc.vars[s.name]; !ok {
+		sc.vars[s.name] = &pacFunc{decl: s, scope: sc}
+	}
+	return
+}
+
+func (s *pacIfStmt) exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	if err = in.step(); err == nil {
+		if v, err = s.test.eval(in, sc); err == nil {
+			if pacTruthy(v) {
+				return s.then.exec(in, sc)
+			} else if s.els != nil {
+				return s.els.exec(in, sc)
+			}
+		}
+	}
+	return pacNormal, nil, err
+}
+
+func (s *pacBlock) exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	return in.execList(s.body, sc)
+}
+
+func (s *pacReturn) exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	v = pacUndefined{}
+	if s.x != nil {
+		v, err = s.x.eval(in, sc)
+	}
+	return pacDoReturn, v, err
+}
+
+// loop executes body, returning true if the loop should end.
+func (in *pacInterp) loop(body pacStmt, sc *pacScope) (done bool, ctrl pacCtrl, v any, err error) {
+	if err = in.step(); err == nil {
+		if ctrl, v, err = body.exec(in, sc); err == nil {
+			switch ctrl {
+			case pacDoBreak:
+				return true, pacNormal, nil, nil
+			case pacDoContinue:
+				return false, pacNormal, nil, nil
+			}
+		}
+	}
+	return err != nil || ctrl == pacDoReturn, ctrl, v, err
+}
+
+func (s *pacWhileStmt) exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	for first := true; ; first = false {
+		if !first || !s.doWhile {
+			if v, err = s.test.eval(in, sc); err != nil || !pacTruthy(v) {
+				return pacNormal, nil, err
+			}
+		}
+		var done bool
+		if done, ctrl, v, err = in.loop(s.body, sc); done {
+			return
+		}
+	}
+}
+
+func (s *pacForStmt) exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	if s.init != nil {
+		if _, _, err = s.init.exec(in, sc); err != nil {
+			return
+		}
+	}
+	for {
+		if s.test != nil {
+			if v, err = s.test.eval(in, sc); err != nil || !pacTruthy(v) {
+				return pacNormal, nil, err
+			}
+		}
+		var done bool
+		if done, ctrl, v, err = in.loop(s.body, sc); done {
+			return
+		}
+		if s.update != nil {
+			if _, err = s.update.eval(in, sc); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *pacForInStmt) exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	var obj any
+	if obj, err = s.obj.eval(in, sc); err == nil {
+		var keys []string
+		switch obj := obj.(type) {
+		case *pacObject:
+			keys = slices.Clone(obj.keys)
+		case *pacArray:
+			for i := range obj.elems {
+				keys = append(keys, strconv.Itoa(i))
+			}
+		case string:
+			for i := range len(obj) {
+				keys = append(keys, strconv.Itoa(i))
+			}
+		}
+		for _, key := range keys {
+			sc.set(s.name, key)
+			var done bool
+			if done, ctrl, v, err = in.loop(s.body, sc); done {
+				return
+			}
+		}
+	}
+	return pacNormal, nil, err
+}
+
+func (s *pacSwitchStmt) exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error) {
+	var disc any
+	if disc, err = s.disc.eval(in, sc); err == nil {
+		start := -1
+		for i, c := range s.cases {
+			if c.test == nil {
+				continue
+			}
+			var cv any
+			if cv, err = c.test.eval(in, sc); err != nil {
+				return
+			}
+			if pacStrictEquals(disc, cv) {
+				start = i
+				break
+			}
+		}
+		if start < 0 {
+			start = slices.IndexFunc(s.cases, func(c pacCase) bool { return c.test == nil })
+		}
+		if start >= 0 {
+			for _, c := range s.cases[start:] {
+				if ctrl, v, err = in.execList(c.body, sc); err != nil || ctrl != pacNormal {
+					if ctrl == pacDoBreak {
+						ctrl = pacNormal
+					}
+					return
+				}
+			}
+		}
+	}
+	return pacNormal, nil, err
+}
+
+func (pacBreak) exec(in *pacInterp, sc *pacScope) (pacCtrl, any, error) {
+	return pacDoBreak, nil, nil
+}
+
+func (pacContinue) exec(in *pacInterp, sc *pacScope) (pacCtrl, any, error) {
+	return pacDoContinue, nil, nil
+}
+
+func (pacEmpty) exec(in *pacInterp, sc *pacScope) (pacCtrl, any, error) {
+	return pacNormal, nil, nil
+}
@@ -0,0 +1,309 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+)
+
+// mapResolver resolves host names using a map.
+type mapResolver map[string][]netip.Addr
+
+func (mr mapResolver) LookupNetIP(ctx context.Context, network, host string) ([]netip.Addr, error) {
+	if addrs, ok := mr[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func evalPACAt(t *testing.T, now time.Time, script, rawURL, host string) (string, error) {
+	t.Helper()
+	prog, err := parsePAC(script)
+	if err != nil {
+		return "", err
+	}
+	env := &pacEnv{
+		ctx: context.Background(),
+		resolver: mapResolver{
+			"intranet.example.com": {netip.MustParseAddr("10.1.2.3")},
+			"dual.example.com":     {netip.MustParseAddr("2001:db8::1"), netip.MustParseAddr("192.0.2.7")},
+		},
+		now:  now,
+		myIP: func() []netip.Addr { return []netip.Addr{netip.MustParseAddr("192.168.1.20")} },
+	}
+	return env.run(prog, rawURL, host)
+}
+
+// pacExprResult evaluates expr in a FindProxyForURL function, returning its string value.
+func pacExprResult(t *testing.T, expr string) (string, error) {
+	t.Helper()
+	return evalPACAt(t, time.Now(), "function FindProxyForURL(url, host) { return String("+expr+"); }", "http://www.example.com/", "www.example.com")
+}
+
+func TestPACExpressions(t *testing.T) {
+	tests := []struct{ expr, want string }{
+		{`1 + 2 * 3`, "7"},
+		{`(1 + 2) * 3`, "9"},
+		{`"a" + 1 + 2`, "a12"},
+		{`1 + 2 + "a"`, "3a"},
+		{`10 / 4`, "2.5"},
+		{`7 % 3`, "1"},
+		{`-"3" + 1`, "-2"},
+		{`"5" * "2"`, "10"},
+		{`1 / 0`, "Infinity"},
+		{`0 / 0`, "NaN"},
+		{`0x10`, "16"},
+		{`1e3`, "1000"},
+		{`0.1 + 0.2 > 0.3`, "true"},
+		{`"10" == 10`, "true"},
+		{`"10" === 10`, "false"},
+		{`null == undefined`, "true"},
+		{`null === undefined`, "false"},
+		{`null == 0`, "false"},
+		{`true == 1`, "true"},
+		{`"b" > "a"`, "true"},
+		{`"10" < "9"`, "true"},
+		{`10 < 9`, "false"},
+		{`!""`, "true"},
+		{`!!"x"`, "true"},
+		{`0 || "def"`, "def"},
+		{`1 && "yes"`, "yes"},
+		{`null && x`, "null"},
+		{`true ? "a" : "b"`, "a"},
+		{`0 ? "a" : 1 ? "b" : "c"`, "b"},
+		{`typeof 1`, "number"},
+		{`typeof "s"`, "string"},
+		{`typeof nothing`, "undefined"},
+		{`typeof null`, "object"},
+		{`typeof isInNet`, "function"},
+		{`0xff & 0x0f`, "15"},
+		{`1 << 4 | 1`, "17"},
+		{`-1 >>> 28`, "15"},
+		{`~5`, "-6"},
+		{`[1, 2, 3].length`, "3"},
+		{`[1, 2, 3][1]`, "2"},
+		{`[1, 2, 3].join("-")`, "1-2-3"},
+		{`[1, 2, 3].indexOf(3)`, "2"},
+		{`[1, [2, 3]]`, "1,2,3"},
+		{`({a: 1, "b-c": 2})["b-c"]`, "2"},
+		{`({a: 1}).b`, "undefined"},
+		{`"a" in {a: 1}`, "true"},
+		{`"Hello".length`, "5"},
+		{`"Hello".toLowerCase()`, "hello"},
+		{`"Hello".toUpperCase()`, "HELLO"},
+		{`"Hello".indexOf("l")`, "2"},
+		{`"Hello".lastIndexOf("l")`, "3"},
+		{`"Hello".indexOf("x")`, "-1"},
+		{`"Hello".substring(1, 3)`, "el"},
+		{`"Hello".substring(3, 1)`, "el"},
+		{`"Hello".substr(-3, 2)`, "ll"},
+		{`"Hello".slice(-3)`, "llo"},
+		{`"Hello".charAt(1)`, "e"},
+		{`"Hello".charCodeAt(0)`, "72"},
+		{`"a.b.c".split(".").length`, "3"},
+		{`"a.b.c".replace(".", "-")`, "a-b.c"},
+		{`"a.b.c".replace(/\./g, "-")`, "a-b-c"},
+		{`"www.example.com".replace(/^(\w+)\.(.*)$/, "$2/$1")`, "example.com/www"},
+		{`/^www\./.test("www.example.com")`, "true"},
+		{`/EXAMPLE/i.test("www.example.com")`, "true"},
+		{`"www.example.com".match(/(\w+)\.com$/)[1]`, "example"},
+		{`"abc".match(/x/)`, "null"},
+		{`" x ".trim()`, "x"},
+		{`"abc".startsWith("ab") && "abc".endsWith("bc")`, "true"},
+		{`parseInt("42px")`, "42"},
+		{`parseInt("ff", 16)`, "255"},
+		{`parseInt("x")`, "NaN"},
+		{`parseFloat("3.5kg")`, "3.5"},
+		{`isNaN("x")`, "true"},
+		{`Math.max(1, 5, 3)`, "5"},
+		{`Math.floor(2.7)`, "2"},
+		{`Math.random() < 1`, "true"},
+		{`encodeURIComponent("a b&c")`, "a%20b%26c"},
+		{`(function(a, b) { return a + b; })(1, 2)`, "3"},
+		{`(function(a, b) { return b; })(1)`, "undefined"},
+	}
+	for _, tt := range tests {
+		got, err := pacExprResult(t, tt.expr)
+		if err != nil {
+			t.Errorf("%s: %v", tt.expr, err)
+		} else if got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestPACStatements(t *testing.T) {
+	script := `
+/* a typical PAC file, without semicolons in places */
+var proxy = "PROXY proxy.example.com:3128"
+var bypass = ["localhost", "*.internal.example.com", "10.*"]
+
+function inBypass(host) {
+	for (var i = 0; i < bypass.length; i++) {
+		if (shExpMatch(host, bypass[i]))
+			return true
+	}
+	return false
+}
+
+function countDots(host) {
+	var n = 0, i = -1
+	while ((i = host.indexOf(".", i + 1)) >= 0) n++
+	return n
+}
+
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	if (inBypass(host)) return "DIRECT";
+	switch (countDots(host)) {
+	case 0:
+		return "DIRECT";
+	case 1:
+	case 2:
+		break;
+	default:
+		return proxy + "; DIRECT";
+	}
+	var total = 0;
+	for (var k in {a: 1, b: 2, c: 3}) {
+		if (k == "b") continue;
+		total += 1;
+	}
+	do { total++; } while (total < 5);
+	if (url.substring(0, 6) == "https:") {
+		return "SOCKS socks.example.com:1080";
+	} else if (total != 5) {
+		return "error " + total;
+	}
+	return proxy;
+}
+`
+	tests := []struct{ url, host, want string }{
+		{"http://localhost/", "localhost", "DIRECT"},
+		{"http://a.internal.example.com/", "A.Internal.Example.com", "DIRECT"},
+		{"http://10.1.2.3/", "10.1.2.3", "DIRECT"},
+		{"http://intranet/", "intranet", "DIRECT"},
+		{"http://a.b.c.example.com/", "a.b.c.example.com", "PROXY proxy.example.com:3128; DIRECT"},
+		{"https://www.example.com/", "www.example.com", "SOCKS socks.example.com:1080"},
+		{"http://www.example.com/", "www.example.com", "PROXY proxy.example.com:3128"},
+	}
+	for _, tt := range tests {
+		got, err := evalPACAt(t, time.Now(), script, tt.url, tt.host)
+		if err != nil || got != tt.want {
+			t.Errorf("%s: got %q, %v, want %q", tt.host, got, err, tt.want)
+		}
+	}
+}
+
+func TestPACErrors(t *testing.T) {
+	tests := []struct {
+		script string
+		want   error
+	}{
+		{`function FindProxyForURL(url, host) { return "DIRECT" `, ErrPACSyntax},
+		{`function FindProxyForURL(url, host) { return 'DIRECT; }`, ErrPACSyntax},
+		{`function FindProxyForURL(url, host) { return "DIRECT" "x"; }`, ErrPACSyntax},
+		{`function FindProxyForURL(url, host) { 1 = 2; }`, ErrPACSyntax},
+		{`function FindProxyForURL(url, host) { return /(?<!x)/.test(host); }`, ErrPACSyntax},
+		{`function FindProxyForURL(url, host) { return undefinedFunction(host); }`, ErrPACEval},
+		{`function FindProxyForURL(url, host) { return host.nope(); }`, ErrPACEval},
+		{`function FindProxyForURL(url, host) { var x; return x.y; }`, ErrPACEval},
+		{`function FindProxyForURL(url, host) { while (true) {} }`, ErrPACEval},
+		{`function f() { return f(); } function FindProxyForURL(url, host) { return f(); }`, ErrPACEval},
+		{`function FindProxyForURL(url, host) { return 1; }`, ErrPACEval},
+		{`function FindProxyForURL(url, host) { }`, ErrPACEval},
+		{`var x = 1;`, ErrPACEval},
+	}
+	for _, tt := range tests {
+		if _, err := evalPACAt(t, time.Now(), tt.script, "http://x/", "x"); !errors.Is(err, tt.want) {
+			t.Errorf("%s: %v", tt.script, err)
+		}
+	}
+}
+
+func TestPACNesting(t *testing.T) {
+	const n = 10000
+	for _, script := range []string{
+		"var x = " + strings.Repeat("(", n) + "1" + strings.Repeat(")", n) + ";",
+		"var x = " + strings.Repeat("!", n) + "1;",
+		"var x = " + strings.Repeat("[", n) + strings.Repeat("]", n) + ";",
+		strings.Repeat("{", n) + strings.Repeat("}", n),
+		strings.Repeat("if (1) ", n) + ";",
+	} {
+		if _, err := parsePAC(script); !errors.Is(err, ErrPACEval) {
+			t.Errorf("%.20s: %v", script, err)
+		}
+	}
+	nested := "function FindProxyForURL(url, host) { return " + strings.Repeat("(", pacMaxNesting/4) + `"DIRECT"` + strings.Repeat(")", pacMaxNesting/4) + "; }"
+	if result, err := evalPACAt(t, time.Now(), nested, "http://x/", "x"); err != nil || result != "DIRECT" {
+		t.Error(result, err)
+	}
+}
+
+func TestPACTimeout(t *testing.T) {
+	prog, err := parsePAC(`function FindProxyForURL(url, host) { while (true) {} }`)
+	maybeFatal(t, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	start := time.Now()
+	if _, err = (&pacEnv{ctx: ctx}).run(prog, "http://x/", "x"); !errors.Is(err, ErrPACEval) || !errors.Is(err, context.Canceled) {
+		t.Error(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Error(d)
+	}
+}
+
+func TestPACCyclicArray(t *testing.T) {
+	for expr, want := range map[string]string{
+		`String(a)`:                   "1,",
+		`a.join("-")`:                 "1-",
+		`a + "x"`:                     "1,x",
+		`a == "1,"`:                   "true",
+		`[a, [a]].toString()`:         "1,,1,",
+		`(b.push(b, [b]), String(b))`: ",",
+	} {
+		script := "function FindProxyForURL(url, host) { var a = [1]; a.push(a); var b = []; return String(" + expr + "); }"
+		if got, err := evalPACAt(t, time.Now(), script, "http://x/", "x"); err != nil || got != want {
+			t.Errorf("%s: got %q %v, want %q", expr, got, err, want)
+		}
+	}
+}
+
+func TestPACSizeLimits(t *testing.T) {
+	for _, body := range []string{
+		`var s = "x"; for (var i = 0; i < 40; i++) s = s + s;`,
+		`var s = "x"; for (var i = 0; i < 40; i++) s += s;`,
+		`var s = "x"; for (var i = 0; i < 40; i++) s = s.concat(s);`,
+		`var s = "x"; for (var i = 0; i < 40; i++) s = s.replace("x", s + s);`,
+		`var a = [1]; for (var i = 0; i < 40; i++) a = a.concat(a);`,
+		`var a = [1]; for (var i = 0; i < 40; i++) a.push(a.join());`,
+		`var a = []; for (var i = 0; ; i += 1000) a[i] = 1;`,
+	} {
+		script := "function FindProxyForURL(url, host) { " + body + ` return "DIRECT"; }`
+		if _, err := evalPACAt(t, time.Now(), script, "http://x/", "x"); !errors.Is(err, ErrPACEval) {
+			t.Errorf("%s: %v", body, err)
+		}
+	}
+}
+
+func TestPACSizeTimeout(t *testing.T) {
+	prog, err := parsePAC(`function FindProxyForURL(url, host) {
+		var s = "x"; while (s.length < 500000) s += s;
+		while (true) s = s.slice(1) + "y";
+	}`)
+	maybeFatal(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err = (&pacEnv{ctx: ctx}).run(prog, "http://x/", "x"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error(err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Error(d)
+	}
+}
@@ -0,0 +1,297 @@
+package httpproxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var ErrPACSyntax = errors.New("PAC syntax error")
+
+type pacTokenKind int
+
+const (
+	pacTokEOF pacTokenKind = iota
+	pacTokIdent
+	pacTokKeyword
+	pacTokNumber
+	pacTokString
+	pacTokRegExp
+	pacTokPunct
+)
+
+type pacToken struct {
+	kind    pacTokenKind
+	text    string  // identifier, keyword, punctuator or regexp pattern
+	str     string  // string value, or regexp flags
+	num     float64 // number value
+	line    int
+	newline bool // true if a line terminator precedes the token
+}
+
+var pacKeywords = map[string]bool{
+	"break": true, "case": true, "continue": true, "default": true, "do": true, "else": true,
+	"false": true, "for": true, "function": true, "if": true, "in": true, "new": true, "null": true,
+	"return": true, "switch": true, "this": true, "true": true, "typeof": true, "undefined": true,
+	"var": true, "let": true, "const": true, "void": true, "while": true, "delete": true,
+}
+
+// pacPunctuators are sorted longest first so the longest match wins.
+var pacPunctuators = []string{
+	">>>=", "===", "!==", ">>>", "<<=", ">>=",
+	"==", "!=", "<=", ">=", "&&", "||", "++", "--", "+=", "-=", "*=", "/=", "%=", "&=", "|=", "^=", "<<", ">>",
+	"{", "}", "(", ")", "[", "]", ";", ",", "<", ">", "+", "-", "*", "/", "%", "&", "|", "^", "!", "~", "?", ":", "=", ".",
+}
+
+type pacLexer struct {
+	src  string
+	pos  int
+	line int
+	prev pacToken // previous token, to tell a regexp from a division
+}
+
+func (lx *pacLexer) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: line %d: %s", ErrPACSyntax, lx.line, fmt.Sprintf(format, args...))
+}
+
+// skipSpace skips white space and comments, returning true if a line terminator was skipped.
+func (lx *pacLexer) skipSpace() (newline bool, err error) {
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		switch {
+		case c == '\n':
+			newline = true
+			lx.line++
+			lx.pos++
+		case c == ' ' || c == '\t' || c == '\r' || c == '\f' || c == '\v':
+			lx.pos++
+		case strings.HasPrefix(lx.src[lx.pos:], "//"):
+			for lx.pos < len(lx.src) && lx.src[lx.pos] != '\n' {
+				lx.pos++
+			}
+		case strings.HasPrefix(lx.src[lx.pos:], "/*"):
+			end := strings.Index(lx.src[lx.pos+2:], "*/")
+			if end < 0 {
+				return newline, lx.errorf("unterminated comment")
+			}
+			comment := lx.src[lx.pos : lx.pos+2+end+2]
+			if n := strings.Count(comment, "\n"); n > 0 {
+				newline = true
+				lx.line += n
+			}
+			lx.pos += len(comment)
+		case strings.HasPrefix(lx.src[lx.pos:], "\u00a0"), strings.HasPrefix(lx.src[lx.pos:], "\ufeff"):
+			_, size := utf8.DecodeRuneInString(lx.src[lx.pos:])
+			lx.pos += size
+		default:
+			return
+		}
+	}
+	return
+}
+
+func isPACIdentStart(c byte) bool {
+	return c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isPACDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// regexpAllowed returns true if a '/' at the current position starts a regular expression literal.
+func (lx *pacLexer) regexpAllowed() bool {
+	switch lx.prev.kind {
+	case pacTokIdent, pacTokNumber, pacTokString, pacTokRegExp:
+		return false
+	case pacTokKeyword:
+		switch lx.prev.text {
+		case "this", "true", "false", "null", "undefined":
+			return false
+		}
+	case pacTokPunct:
+		switch lx.prev.text {
+		case ")", "]", "}", "++", "--":
+			return false
+		}
+	}
+	return true
+}
+
+func (lx *pacLexer) next() (tok pacToken, err error) {
+	tok.newline, err = lx.skipSpace()
+	tok.line = lx.line
+	if err == nil {
+		if lx.pos >= len(lx.src) {
+			tok.kind = pacTokEOF
+		} else {
+			c := lx.src[lx.pos]
+			switch {
+			case isPACIdentStart(c):
+				start := lx.pos
+				for lx.pos < len(lx.src) && (isPACIdentStart(lx.src[lx.pos]) || isPACDigit(lx.src[lx.pos])) {
+					lx.pos++
+				}
+				tok.text = lx.src[start:lx.pos]
+				tok.kind = pacTokIdent
+				if pacKeywords[tok.text] {
+					tok.kind = pacTokKeyword
+				}
+			case isPACDigit(c) || (c == '.' && lx.pos+1 < len(lx.src) && isPACDigit(lx.src[lx.pos+1])):
+				tok.kind = pacTokNumber
+				tok.num, err = lx.number()
+			case c == '"' || c == '\'':
+				tok.kind = pacTokString
+				tok.str, err = lx.string(c)
+			case c == '/' && lx.regexpAllowed():
+				tok.kind = pacTokRegExp
+				tok.text, tok.str, err = lx.regexp()
+			default:
+				tok.kind = pacTokPunct
+				for _, p := range pacPunctuators {
+					if strings.HasPrefix(lx.src[lx.pos:], p) {
+						tok.text = p
+						break
+					}
+				}
+				if tok.text == "" {
+					err = lx.errorf("unexpected character %q", c)
+				}
+				lx.pos += len(tok.text)
+			}
+		}
+	}
+	lx.prev = tok
+	return
+}
+
+func (lx *pacLexer) number() (f float64, err error) {
+	start := lx.pos
+	if strings.HasPrefix(lx.src[lx.pos:], "0x") || strings.HasPrefix(lx.src[lx.pos:], "0X") {
+		lx.pos += 2
+		for lx.pos < len(lx.src) && strings.IndexByte("0123456789abcdefABCDEF", lx.src[lx.pos]) >= 0 {
+			lx.pos++
+		}
+		var n uint64
+		if n, err = strconv.ParseUint(lx.src[start+2:lx.pos], 16, 64); err != nil {
+			err = lx.errorf("invalid number %q", lx.src[start:lx.pos])
+		}
+		return float64(n), err
+	}
+	for lx.pos < len(lx.src) && (isPACDigit(lx.src[lx.pos]) || lx.src[lx.pos] == '.') {
+		lx.pos++
+	}
+	if lx.pos < len(lx.src) && (lx.src[lx.pos] == 'e' || lx.src[lx.pos] == 'E') {
+		lx.pos++
+		if lx.pos < len(lx.src) && (lx.src[lx.pos] == '+' || lx.src[lx.pos] == '-') {
+			lx.pos++
+		}
+		for lx.pos < len(lx.src) && isPACDigit(lx.src[lx.pos]) {
+			lx.pos++
+		}
+	}
+	if f, err = strconv.ParseFloat(lx.src[start:lx.pos], 64); err != nil {
+		err = lx.errorf("invalid number %q", lx.src[start:lx.pos])
+	}
+	return
+}
+
+func (lx *pacLexer) string(quote byte) (s string, err error) {
+	var sb strings.Builder
+	lx.pos++
+	for lx.pos < len(lx.src) {
+		c := lx.src[lx.pos]
+		lx.pos++
+		switch c {
+		case quote:
+			return sb.String(), nil
+		case '\n':
+			return "", lx.errorf("unterminated string")
+		case '\\':
+			if lx.pos >= len(lx.src) {
+				return "", lx.errorf("unterminated string")
+			}
+			c = lx.src[lx.pos]
+			lx.pos++
+			switch c {
+			case 'n':
+				sb.WriteByte('\n')
+			case 't':
+				sb.WriteByte('\t')
+			case 'r':
+				sb.WriteByte('\r')
+			case 'b':
+				sb.WriteByte('\b')
+			case 'f':
+				sb.WriteByte('\f')
+			case 'v':
+				sb.WriteByte('\v')
+			case '0':
+				sb.WriteByte(0)
+			case 'x', 'u':
+				n := 2
+				if c == 'u' {
+					n = 4
+				}
+				if lx.pos+n > len(lx.src) {
+					return "", lx.errorf("invalid escape")
+				}
+				v, perr := strconv.ParseUint(lx.src[lx.pos:lx.pos+n], 16, 32)
+				if perr != nil {
+					return "", lx.errorf("invalid escape")
+				}
+				sb.WriteRune(rune(v))
+				lx.pos += n
+			case '\n':
+				lx.line++
+			default:
+				sb.WriteByte(c)
+			}
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", lx.errorf("unterminated string")
+}
+
+func (lx *pacLexer) regexp() (pattern, flags string, err error) {
+	start := lx.pos + 1
+	inClass := false
+	for lx.pos++; lx.pos < len(lx.src); lx.pos++ {
+		switch c := lx.src[lx.pos]; {
+		case c == '\\':
+			lx.pos++
+		case c == '[':
+			inClass = true
+		case c == ']':
+			inClass = false
+		case c == '\n':
+			return "", "", lx.errorf("unterminated regular expression")
+		case c == '/' && !inClass:
+			pattern = lx.src[start:lx.pos]
+			lx.pos++
+			fstart := lx.pos
+			for lx.pos < len(lx.src) && isPACIdentStart(lx.src[lx.pos]) {
+				lx.pos++
+			}
+			return pattern, lx.src[fstart:lx.pos], nil
+		}
+	}
+	return "", "", lx.errorf("unterminated regular expression")
+}
+
+// pacTokenize splits src into tokens.
+func pacTokenize(src string) (toks []pacToken, err error) {
+	lx := &pacLexer{src: src, line: 1}
+	for {
+		var tok pacToken
+		if tok, err = lx.next(); err != nil {
+			return
+		}
+		toks = append(toks, tok)
+		if tok.kind == pacTokEOF {
+			return
+		}
+	}
+}
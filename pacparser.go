@@ -0,0 +1,765 @@
+package httpproxy
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// The PAC script interpreter supports the subset of JavaScript used by proxy
+// auto-config files: functions, var/let/const, if, for, for-in, while, do-while,
+// switch, the usual operators, array and object literals, regular expressions
+// and the common String and Array methods.
+
+type pacExpr interface {
+	eval(in *pacInterp, sc *pacScope) (v any, err error)
+}
+
+type pacStmt interface {
+	exec(in *pacInterp, sc *pacScope) (ctrl pacCtrl, v any, err error)
+}
+
+type (
+	pacLiteral   struct{ v any }
+	pacIdentExpr struct{ name string }
+	pacRegExpLit struct {
+		re     *regexp.Regexp
+		source string
+		flags  string
+	}
+	pacArrayLit  struct{ elems []pacExpr }
+	pacObjectLit struct {
+		keys []string
+		vals []pacExpr
+	}
+	pacFuncExpr struct{ decl *pacFuncDecl }
+	pacMember   struct{ obj, key pacExpr }
+	pacCall     struct {
+		callee pacExpr
+		args   []pacExpr
+	}
+	pacUnary struct {
+		op string
+		x  pacExpr
+	}
+	pacUpdate struct {
+		op     string
+		prefix bool
+		target pacExpr
+	}
+	pacBinary struct {
+		op   string
+		l, r pacExpr
+	}
+	pacCond   struct{ test, a, b pacExpr }
+	pacAssign struct {
+		op     string
+		target pacExpr
+		value  pacExpr
+	}
+	pacComma struct{ exprs []pacExpr }
+)
+
+type (
+	pacExprStmt struct{ x pacExpr }
+	pacVarStmt  struct {
+		names []string
+		inits []pacExpr
+	}
+	pacFuncDecl struct {
+		name   string
+		params []string
+		body   []pacStmt
+	}
+	pacIfStmt struct {
+		test      pacExpr
+		then, els pacStmt
+	}
+	pacBlock     struct{ body []pacStmt }
+	pacReturn    struct{ x pacExpr }
+	pacWhileStmt struct {
+		test    pacExpr
+		body    pacStmt
+		doWhile bool
+	}
+	pacForStmt struct {
+		init   pacStmt
+		test   pacExpr
+		update pacExpr
+		body   pacStmt
+	}
+	pacForInStmt struct {
+		name string
+		obj  pacExpr
+		body pacStmt
+	}
+	pacSwitchStmt struct {
+		disc  pacExpr
+		cases []pacCase
+	}
+	pacCase struct {
+		test pacExpr // nil for default
+		body []pacStmt
+	}
+	pacBreak    struct{}
+	pacContinue struct{}
+	pacEmpty    struct{}
+)
+
+var pacBinaryPrec = map[string]int{
+	"||": 1, "&&": 2, "|": 3, "^": 4, "&": 5,
+	"==": 6, "!=": 6, "===": 6, "!==": 6,
+	"<": 7, ">": 7, "<=": 7, ">=": 7, "in": 7,
+	"<<": 8, ">>": 8, ">>>": 8,
+	"+": 9, "-": 9,
+	"*": 10, "/": 10, "%": 10,
+}
+
+var pacAssignOps = map[string]bool{
+	"=": true, "+=": true, "-=": true, "*=": true, "/=": true, "%=": true,
+	"<<=": true, ">>=": true, ">>>=": true, "&=": true, "|=": true, "^=": true,
+}
+
+// pacMaxNesting limits the nesting of statements and expressions in a PAC script.
+const pacMaxNesting = 500
+
+type pacParser struct {
+	toks  []pacToken
+	pos   int
+	noIn  bool // true while parsing a for statement initializer
+	depth int  // nesting of statements and expressions being parsed
+}
+
+// enter increments the nesting depth, failing if the script is nested too deeply.
+// If it succeeds, the caller must call leave when done.
+func (p *pacParser) enter() (err error) {
+	if p.depth >= pacMaxNesting {
+		return fmt.Errorf("%w: line %d: nesting too deep", ErrPACEval, p.peek().line)
+	}
+	p.depth++
+	return
+}
+
+func (p *pacParser) leave() {
+	p.depth--
+}
+
+func (p *pacParser) peek() pacToken {
+	return p.toks[p.pos]
+}
+
+func (p *pacParser) next() (tok pacToken) {
+	tok = p.toks[p.pos]
+	if tok.kind != pacTokEOF {
+		p.pos++
+	}
+	return
+}
+
+// back undoes reading tok.
+func (p *pacParser) back(tok pacToken) {
+	if tok.kind != pacTokEOF {
+		p.pos--
+	}
+}
+
+// is returns true if the next token is the punctuator or keyword text.
+func (p *pacParser) is(text string) bool {
+	tok := p.peek()
+	return (tok.kind == pacTokPunct || tok.kind == pacTokKeyword) && tok.text == text
+}
+
+func (p *pacParser) accept(text string) (ok bool) {
+	if ok = p.is(text); ok {
+		p.next()
+	}
+	return
+}
+
+func (p *pacParser) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: line %d: %s", ErrPACSyntax, p.peek().line, fmt.Sprintf(format, args...))
+}
+
+func (p *pacParser) unexpected() error {
+	tok := p.peek()
+	switch tok.kind {
+	case pacTokEOF:
+		return p.errorf("unexpected end of script")
+	case pacTokString:
+		return p.errorf("unexpected string %q", tok.str)
+	case pacTokNumber:
+		return p.errorf("unexpected number %v", tok.num)
+	}
+	return p.errorf("unexpected %q", tok.text)
+}
+
+func (p *pacParser) expect(text string) (err error) {
+	if !p.accept(text) {
+		err = p.unexpected()
+	}
+	return
+}
+
+func (p *pacParser) ident() (name string, err error) {
+	if tok := p.peek(); tok.kind == pacTokIdent {
+		p.next()
+		return tok.text, nil
+	}
+	return "", p.unexpected()
+}
+
+// semicolon consumes a statement terminator, allowing it to be omitted as JavaScript does.
+func (p *pacParser) semicolon() (err error) {
+	if !p.accept(";") && !p.is("}") && p.peek().kind != pacTokEOF && !p.peek().newline {
+		err = p.unexpected()
+	}
+	return
+}
+
+// parsePAC parses a PAC script.
+func parsePAC(src string) (prog []pacStmt, err error) {
+	var toks []pacToken
+	if toks, err = pacTokenize(src); err == nil {
+		p := &pacParser{toks: toks}
+		for err == nil && p.peek().kind != pacTokEOF {
+			var stmt pacStmt
+			if stmt, err = p.statement(); err == nil {
+				prog = append(prog, stmt)
+			}
+		}
+	}
+	return
+}
+
+func (p *pacParser) block() (body []pacStmt, err error) {
+	if err = p.expect("{"); err == nil {
+		for err == nil && !p.accept("}") {
+			if p.peek().kind == pacTokEOF {
+				return nil, p.unexpected()
+			}
+			var stmt pacStmt
+			if stmt, err = p.statement(); err == nil {
+				body = append(body, stmt)
+			}
+		}
+	}
+	return
+}
+
+func (p *pacParser) statement() (stmt pacStmt, err error) {
+	if err = p.enter(); err != nil {
+		return
+	}
+	defer p.leave()
+	tok := p.peek()
+	if tok.kind == pacTokKeyword || tok.kind == pacTokPunct {
+		switch tok.text {
+		case "{":
+			var body []pacStmt
+			body, err = p.block()
+			return &pacBlock{body: body}, err
+		case ";":
+			p.next()
+			return pacEmpty{}, nil
+		case "var", "let", "const":
+			if stmt, err = p.varDecl(); err == nil {
+				err = p.semicolon()
+			}
+			return
+		case "function":
+			p.next()
+			var decl *pacFuncDecl
+			if decl, err = p.function(true); err == nil {
+				stmt = decl
+			}
+			return
+		case "if":
+			return p.ifStmt()
+		case "while", "do":
+			return p.whileStmt()
+		case "for":
+			return p.forStmt()
+		case "switch":
+			return p.switchStmt()
+		case "return":
+			p.next()
+			ret := &pacReturn{}
+			if !p.is(";") && !p.is("}") && p.peek().kind != pacTokEOF && !p.peek().newline {
+				if ret.x, err = p.expression(); err != nil {
+					return
+				}
+			}
+			return ret, p.semicolon()
+		case "break":
+			p.next()
+			return pacBreak{}, p.semicolon()
+		case "continue":
+			p.next()
+			return pacContinue{}, p.semicolon()
+		}
+	}
+	var x pacExpr
+	if x, err = p.expression(); err == nil {
+		stmt, err = &pacExprStmt{x: x}, p.semicolon()
+	}
+	return
+}
+
+func (p *pacParser) varDecl() (stmt *pacVarStmt, err error) {
+	p.next()
+	stmt = &pacVarStmt{}
+	for {
+		var name string
+		if name, err = p.ident(); err != nil {
+			return
+		}
+		var init pacExpr
+		if p.accept("=") {
+			if init, err = p.assignment(); err != nil {
+				return
+			}
+		}
+		stmt.names = append(stmt.names, name)
+		stmt.inits = append(stmt.inits, init)
+		if !p.accept(",") {
+			return
+		}
+	}
+}
+
+// function parses a function's optional name, parameters and body.
+func (p *pacParser) function(named bool) (decl *pacFuncDecl, err error) {
+	decl = &pacFuncDecl{}
+	if named || p.peek().kind == pacTokIdent {
+		if decl.name, err = p.ident(); err != nil {
+			return
+		}
+	}
+	if err = p.expect("("); err == nil {
+		for err == nil && !p.accept(")") {
+			if len(decl.params) > 0 {
+				if err = p.expect(","); err != nil {
+					return
+				}
+			}
+			var name string
+			if name, err = p.ident(); err == nil {
+				decl.params = append(decl.params, name)
+			}
+		}
+		if err == nil {
+			noIn := p.noIn
+			p.noIn = false
+			decl.body, err = p.block()
+			p.noIn = noIn
+		}
+	}
+	return
+}
+
+func (p *pacParser) paren() (x pacExpr, err error) {
+	if err = p.expect("("); err == nil {
+		if x, err = p.expression(); err == nil {
+			err = p.expect(")")
+		}
+	}
+	return
+}
+
+func (p *pacParser) ifStmt() (stmt pacStmt, err error) {
+	p.next()
+	s := &pacIfStmt{}
+	if s.test, err = p.paren(); err == nil {
+		if s.then, err = p.statement(); err == nil && p.accept("else") {
+			s.els, err = p.statement()
+		}
+	}
+	return s, err
+}
+
+func (p *pacParser) whileStmt() (stmt pacStmt, err error) {
+	s := &pacWhileStmt{doWhile: p.next().text == "do"}
+	if s.doWhile {
+		if s.body, err = p.statement(); err == nil {
+			if err = p.expect("while"); err == nil {
+				if s.test, err = p.paren(); err == nil {
+					p.accept(";")
+				}
+			}
+		}
+	} else if s.test, err = p.paren(); err == nil {
+		s.body, err = p.statement()
+	}
+	return s, err
+}
+
+func (p *pacParser) forStmt() (stmt pacStmt, err error) {
+	p.next()
+	if err = p.expect("("); err != nil {
+		return
+	}
+	s := &pacForStmt{}
+	p.noIn = true
+	if p.is("var") || p.is("let") || p.is("const") {
+		var decl *pacVarStmt
+		if decl, err = p.varDecl(); err == nil {
+			s.init = decl
+			if len(decl.names) == 1 && decl.inits[0] == nil && p.is("in") {
+				p.noIn = false
+				return p.forIn(decl.names[0])
+			}
+		}
+	} else if !p.is(";") {
+		var x pacExpr
+		if x, err = p.expression(); err == nil {
+			s.init = &pacExprStmt{x: x}
+			if id, ok := x.(*pacIdentExpr); ok && p.is("in") {
+				p.noIn = false
+				return p.forIn(id.name)
+			}
+		}
+	}
+	p.noIn = false
+	if err == nil {
+		err = p.expect(";")
+	}
+	if err == nil && !p.is(";") {
+		s.test, err = p.expression()
+	}
+	if err == nil {
+		err = p.expect(";")
+	}
+	if err == nil && !p.is(")") {
+		s.update, err = p.expression()
+	}
+	if err == nil {
+		err = p.expect(")")
+	}
+	if err == nil {
+		s.body, err = p.statement()
+	}
+	return s, err
+}
+
+func (p *pacParser) forIn(name string) (stmt pacStmt, err error) {
+	p.next()
+	s := &pacForInStmt{name: name}
+	if s.obj, err = p.expression(); err == nil {
+		if err = p.expect(")"); err == nil {
+			s.body, err = p.statement()
+		}
+	}
+	return s, err
+}
+
+func (p *pacParser) switchStmt() (stmt pacStmt, err error) {
+	p.next()
+	s := &pacSwitchStmt{}
+	if s.disc, err = p.paren(); err == nil {
+		err = p.expect("{")
+	}
+	for err == nil && !p.accept("}") {
+		var c pacCase
+		if p.accept("case") {
+			c.test, err = p.expression()
+		} else if !p.accept("default") {
+			err = p.unexpected()
+		}
+		if err == nil {
+			err = p.expect(":")
+		}
+		for err == nil && !p.is("case") && !p.is("default") && !p.is("}") {
+			if p.peek().kind == pacTokEOF {
+				return nil, p.unexpected()
+			}
+			var body pacStmt
+			if body, err = p.statement(); err == nil {
+				c.body = append(c.body, body)
+			}
+		}
+		s.cases = append(s.cases, c)
+	}
+	return s, err
+}
+
+func (p *pacParser) expression() (x pacExpr, err error) {
+	if x, err = p.assignment(); err == nil && p.is(",") {
+		comma := &pacComma{exprs: []pacExpr{x}}
+		for err == nil && p.accept(",") {
+			if x, err = p.assignment(); err == nil {
+				comma.exprs = append(comma.exprs, x)
+			}
+		}
+		x = comma
+	}
+	return
+}
+
+func (p *pacParser) assignment() (x pacExpr, err error) {
+	if err = p.enter(); err != nil {
+		return
+	}
+	defer p.leave()
+	if x, err = p.conditional(); err == nil {
+		if tok := p.peek(); tok.kind == pacTokPunct && pacAssignOps[tok.text] {
+			switch x.(type) {
+			case *pacIdentExpr, *pacMember:
+			default:
+				return nil, p.errorf("invalid assignment target")
+			}
+			p.next()
+			a := &pacAssign{op: tok.text, target: x}
+			a.value, err = p.assignment()
+			x = a
+		}
+	}
+	return
+}
+
+func (p *pacParser) conditional() (x pacExpr, err error) {
+	if x, err = p.binary(0); err == nil && p.accept("?") {
+		c := &pacCond{test: x}
+		noIn := p.noIn
+		p.noIn = false
+		c.a, err = p.assignment()
+		p.noIn = noIn
+		if err == nil {
+			if err = p.expect(":"); err == nil {
+				c.b, err = p.assignment()
+			}
+		}
+		x = c
+	}
+	return
+}
+
+func (p *pacParser) binary(minPrec int) (x pacExpr, err error) {
+	if x, err = p.unary(); err == nil {
+		for {
+			tok := p.peek()
+			if tok.kind != pacTokPunct && !(tok.kind == pacTokKeyword && tok.text == "in" && !p.noIn) {
+				return
+			}
+			prec := pacBinaryPrec[tok.text]
+			if prec <= minPrec {
+				return
+			}
+			p.next()
+			var r pacExpr
+			if r, err = p.binary(prec); err != nil {
+				return
+			}
+			x = &pacBinary{op: tok.text, l: x, r: r}
+		}
+	}
+	return
+}
+
+func (p *pacParser) unary() (x pacExpr, err error) {
+	if err = p.enter(); err != nil {
+		return
+	}
+	defer p.leave()
+	tok := p.peek()
+	if tok.kind == pacTokPunct || tok.kind == pacTokKeyword {
+		switch tok.text {
+		case "!", "-", "+", "~", "typeof", "void", "delete":
+			p.next()
+			u := &pacUnary{op: tok.text}
+			u.x, err = p.unary()
+			return u, err
+		case "++", "--":
+			p.next()
+			u := &pacUpdate{op: tok.text, prefix: true}
+			if u.target, err = p.unary(); err == nil {
+				err = p.checkTarget(u.target)
+			}
+			return u, err
+		}
+	}
+	if x, err = p.callMember(); err == nil {
+		if tok := p.peek(); (p.is("++") || p.is("--")) && !tok.newline {
+			if err = p.checkTarget(x); err == nil {
+				p.next()
+				x = &pacUpdate{op: tok.text, target: x}
+			}
+		}
+	}
+	return
+}
+
+func (p *pacParser) checkTarget(x pacExpr) (err error) {
+	switch x.(type) {
+	case *pacIdentExpr, *pacMember:
+	default:
+		err = p.errorf("invalid update target")
+	}
+	return
+}
+
+func (p *pacParser) callMember() (x pacExpr, err error) {
+	if x, err = p.primary(); err == nil {
+		for err == nil {
+			switch {
+			case p.accept("."):
+				tok := p.next()
+				if tok.kind != pacTokIdent && tok.kind != pacTokKeyword {
+					p.back(tok)
+					return nil, p.unexpected()
+				}
+				x = &pacMember{obj: x, key: &pacLiteral{v: tok.text}}
+			case p.accept("["):
+				m := &pacMember{obj: x}
+				noIn := p.noIn
+				p.noIn = false
+				if m.key, err = p.expression(); err == nil {
+					err = p.expect("]")
+				}
+				p.noIn = noIn
+				x = m
+			case p.is("("):
+				c := &pacCall{callee: x}
+				c.args, err = p.arguments()
+				x = c
+			default:
+				return
+			}
+		}
+	}
+	return
+}
+
+func (p *pacParser) arguments() (args []pacExpr, err error) {
+	p.next()
+	noIn := p.noIn
+	p.noIn = false
+	defer func() { p.noIn = noIn }()
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err = p.expect(","); err != nil {
+				return
+			}
+		}
+		var x pacExpr
+		if x, err = p.assignment(); err != nil {
+			return
+		}
+		args = append(args, x)
+	}
+	return
+}
+
+// pacCompileRegExp compiles a JavaScript regular expression using the regexp package syntax.
+func pacCompileRegExp(source, flags string) (re *regexp.Regexp, err error) {
+	prefix := ""
+	for _, f := range flags {
+		switch f {
+		case 'i', 'm', 's':
+			prefix += string(f)
+		case 'g':
+		default:
+			return nil, fmt.Errorf("%w: invalid regular expression flag %q", ErrPACSyntax, f)
+		}
+	}
+	if prefix != "" {
+		source = "(?" + prefix + ")" + source
+	}
+	if re, err = regexp.Compile(source); err != nil {
+		err = fmt.Errorf("%w: %v", ErrPACSyntax, err)
+	}
+	return
+}
+
+func (p *pacParser) primary() (x pacExpr, err error) {
+	tok := p.next()
+	switch tok.kind {
+	case pacTokNumber:
+		return &pacLiteral{v: tok.num}, nil
+	case pacTokString:
+		return &pacLiteral{v: tok.str}, nil
+	case pacTokIdent:
+		return &pacIdentExpr{name: tok.text}, nil
+	case pacTokRegExp:
+		var re *regexp.Regexp
+		if re, err = pacCompileRegExp(tok.text, tok.str); err == nil {
+			x = &pacRegExpLit{re: re, source: tok.text, flags: tok.str}
+		}
+		return
+	case pacTokKeyword:
+		switch tok.text {
+		case "true":
+			return &pacLiteral{v: true}, nil
+		case "false":
+			return &pacLiteral{v: false}, nil
+		case "null":
+			return &pacLiteral{v: nil}, nil
+		case "undefined", "this":
+			return &pacLiteral{v: pacUndefined{}}, nil
+		case "function":
+			var decl *pacFuncDecl
+			if decl, err = p.function(false); err == nil {
+				x = &pacFuncExpr{decl: decl}
+			}
+			return
+		}
+	case pacTokPunct:
+		switch tok.text {
+		case "(":
+			noIn := p.noIn
+			p.noIn = false
+			if x, err = p.expression(); err == nil {
+				err = p.expect(")")
+			}
+			p.noIn = noIn
+			return
+		case "[":
+			return p.arrayLit()
+		case "{":
+			return p.objectLit()
+		}
+	}
+	p.back(tok)
+	return nil, p.unexpected()
+}
+
+func (p *pacParser) arrayLit() (x pacExpr, err error) {
+	a := &pacArrayLit{}
+	for err == nil && !p.accept("]") {
+		var elem pacExpr
+		if elem, err = p.assignment(); err == nil {
+			a.elems = append(a.elems, elem)
+			if !p.is("]") {
+				err = p.expect(",")
+			}
+		}
+	}
+	return a, err
+}
+
+func (p *pacParser) objectLit() (x pacExpr, err error) {
+	o := &pacObjectLit{}
+	for err == nil && !p.accept("}") {
+		var key string
+		switch tok := p.next(); tok.kind {
+		case pacTokIdent, pacTokKeyword:
+			key = tok.text
+		case pacTokString:
+			key = tok.str
+		case pacTokNumber:
+			key = pacNumberToString(tok.num)
+		default:
+			p.back(tok)
+			return nil, p.unexpected()
+		}
+		if err = p.expect(":"); err == nil {
+			var val pacExpr
+			if val, err = p.assignment(); err == nil {
+				o.keys = append(o.keys, key)
+				o.vals = append(o.vals, val)
+				if !p.is("}") {
+					err = p.expect(",")
+				}
+			}
+		}
+	}
+	return o, err
+}
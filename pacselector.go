@@ -0,0 +1,340 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPACTimeout is the default time allowed for evaluating a PAC script, including its DNS lookups.
+var DefaultPACTimeout = 5 * time.Second
+
+// PACFetchTimeout is the time allowed to fetch a PAC file from a URL.
+var PACFetchTimeout = 30 * time.Second
+
+// PACMaxSize is the largest PAC file that will be loaded.
+var PACMaxSize int64 = 10 << 20
+
+// PACSelector is a DialerSelector that evaluates FindProxyForURL in a proxy
+// auto-config (PAC) file to choose how to reach each destination.
+//
+// The script is run by a built-in interpreter supporting the JavaScript commonly
+// used in PAC files and the standard helper functions (isPlainHostName, dnsDomainIs,
+// localHostOrDomainIs, isResolvable, isInNet, dnsResolve, myIpAddress, dnsDomainLevels,
+// shExpMatch, weekdayRange, dateRange, timeRange and the IPv6 "Ex" extensions).
+//
+// FindProxyForURL is called with a URL containing only the scheme and host,
+// using https for port 443, as browsers do for https URLs.
+//
+// Each DIRECT, PROXY, HTTP, HTTPS, SOCKS or SOCKS5 entry in the result maps to a
+// ContextDialer. As a DialerListSelector all of them are returned in order, so the
+// Server fails over to the next one if one fails. If the script fails or returns
+// nothing usable, the Fallback result is used.
+type PACSelector struct {
+	File          string                                            // PAC file name, or http or https URL to fetch it from
+	Script        string                                            // optional PAC script, used if File is empty
+	Fallback      string                                            // optional result used if the script fails, defaults to "DIRECT"
+	ContextDialer ContextDialer                                     // optional dialer used for DIRECT and to reach proxies, otherwise uses DefaultContextDialer
+	ProxyDialer   func(kind, address string) (ContextDialer, error) // optional, returns the ContextDialer for a PROXY, HTTP, HTTPS, SOCKS or SOCKS5 entry
+	Resolver      Resolver                                          // optional resolver used by the script, otherwise uses DefaultResolver
+	Timeout       time.Duration                                     // optional time allowed per evaluation including DNS lookups, defaults to DefaultPACTimeout
+	Logger        Logger                                            // optional logger for errors
+	mu            sync.RWMutex                                      // protects following
+	prog          []pacStmt                                         // loaded script, nil if not loaded
+	source        string                                            // text of the loaded script
+	mtime         time.Time                                         // modification time of File when loaded
+	tried         bool                                              // Load has been called
+	dialers       map[string]ContextDialer                          // by PAC entry
+	myIPOnce      sync.Once
+	myIP          []netip.Addr
+}
+
+var _ DialerSelector = (*PACSelector)(nil)
+var _ DialerListSelector = (*PACSelector)(nil)
+
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// fetch returns the PAC script text, or changed false if File has not been modified since last loaded.
+func (ps *PACSelector) fetch(mtime time.Time) (text string, newMtime time.Time, changed bool, err error) {
+	switch {
+	case ps.File == "":
+		return ps.Script, mtime, true, nil
+	case isURL(ps.File):
+		client := &http.Client{Timeout: PACFetchTimeout}
+		var resp *http.Response
+		if resp, err = client.Get(ps.File); err == nil {
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				return "", mtime, false, fmt.Errorf("%s: %s", ps.File, resp.Status)
+			}
+			var b []byte
+			if b, err = io.ReadAll(io.LimitReader(resp.Body, PACMaxSize+1)); err == nil {
+				if int64(len(b)) > PACMaxSize {
+					return "", mtime, false, fmt.Errorf("%s: larger than %d bytes", ps.File, PACMaxSize)
+				}
+				text, changed = string(b), true
+			}
+		}
+		return text, mtime, changed, err
+	}
+	var fi os.FileInfo
+	if fi, err = os.Stat(ps.File); err == nil {
+		newMtime = fi.ModTime()
+		if fi.Size() > PACMaxSize {
+			return "", mtime, false, fmt.Errorf("%s: larger than %d bytes", ps.File, PACMaxSize)
+		}
+		if !newMtime.Equal(mtime) {
+			var b []byte
+			if b, err = os.ReadFile(ps.File); err == nil {
+				text, changed = string(b), true
+			}
+		}
+	}
+	return
+}
+
+// Load (re)loads the PAC script from File, or Script if File is empty.
+// If an error occurs, the previously loaded script remains in effect.
+func (ps *PACSelector) Load() (err error) {
+	ps.mu.Lock()
+	ps.tried = true
+	prog, source, mtime := ps.prog, ps.source, ps.mtime
+	ps.mu.Unlock()
+	var text string
+	var changed bool
+	if text, mtime, changed, err = ps.fetch(mtime); err == nil && changed {
+		if text != source || prog == nil {
+			prog, err = parsePAC(text)
+		}
+		if err == nil {
+			ps.mu.Lock()
+			ps.prog, ps.source, ps.mtime = prog, text, mtime
+			ps.mu.Unlock()
+		}
+	}
+	return
+}
+
+// Watch calls Load every interval until ctx is done.
+func (ps *PACSelector) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ps.Load(); err != nil && ps.Logger != nil {
+				ps.Logger.Error("pac", "error", err)
+			}
+		}
+	}
+}
+
+// program returns the loaded script, loading it on first use if Load hasn't been called.
+func (ps *PACSelector) program() (prog []pacStmt, err error) {
+	ps.mu.RLock()
+	prog, tried := ps.prog, ps.tried
+	ps.mu.RUnlock()
+	if !tried {
+		err = ps.Load()
+		ps.mu.RLock()
+		prog = ps.prog
+		ps.mu.RUnlock()
+	}
+	if prog == nil && err == nil {
+		err = fmt.Errorf("%w: no script loaded", ErrPACEval)
+	}
+	return
+}
+
+func (ps *PACSelector) localAddrs() []netip.Addr {
+	ps.myIPOnce.Do(func() { ps.myIP = localAddrs() })
+	return ps.myIP
+}
+
+// FindProxyForURL evaluates the PAC script's FindProxyForURL function.
+func (ps *PACSelector) FindProxyForURL(rawURL, host string) (result string, err error) {
+	var prog []pacStmt
+	if prog, err = ps.program(); err == nil {
+		timeout := ps.Timeout
+		if timeout <= 0 {
+			timeout = DefaultPACTimeout
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		env := &pacEnv{ctx: ctx, resolver: ps.Resolver, now: time.Now(), myIP: ps.localAddrs, logger: ps.Logger}
+		result, err = env.run(prog, rawURL, host)
+	}
+	return
+}
+
+// run executes prog and calls its FindProxyForURL function.
+func (env *pacEnv) run(prog []pacStmt, rawURL, host string) (result string, err error) {
+	in := &pacInterp{env: env}
+	sc := newPACScope(nil)
+	pacGlobals(sc)
+	pacFunctions(sc, env)
+	if _, _, err = in.execBody(prog, sc); err == nil {
+		fn, ok := sc.vars["FindProxyForURLEx"]
+		if !ok {
+			fn, ok = sc.vars["FindProxyForURL"]
+		}
+		if !ok {
+			return "", fmt.Errorf("%w: FindProxyForURL is not defined", ErrPACEval)
+		}
+		var v any
+		if v, err = in.call(fn, []any{rawURL, host}); err == nil {
+			var isString bool
+			if result, isString = v.(string); !isString {
+				err = fmt.Errorf("%w: FindProxyForURL returned %s", ErrPACEval, pacToString(v))
+			}
+		}
+	}
+	return
+}
+
+// pacURL returns the URL passed to FindProxyForURL for a connection to address.
+func pacURL(host, port string) string {
+	hostport := host
+	if strings.Contains(host, ":") {
+		hostport = "[" + host + "]"
+	}
+	switch port {
+	case "443":
+		return "https://" + hostport + "/"
+	case "80", "":
+		return "http://" + hostport + "/"
+	}
+	return "http://" + net.JoinHostPort(host, port) + "/"
+}
+
+// defaultProxyDialer returns the ContextDialer for a PAC entry of the given kind.
+func (ps *PACSelector) defaultProxyDialer(kind, address string) (cd ContextDialer, err error) {
+	switch kind {
+	case "PROXY", "HTTP":
+		cd = &HTTPProxyDialer{Address: address, ContextDialer: ps.ContextDialer}
+	case "HTTPS":
+		cd = &HTTPProxyDialer{Address: address, TLSConfig: &tls.Config{}, ContextDialer: ps.ContextDialer}
+	case "SOCKS", "SOCKS5":
+		cd = &SOCKS5Dialer{Address: address, ContextDialer: ps.ContextDialer}
+	default:
+		err = fmt.Errorf("%w: unsupported proxy type %q", ErrPACEval, kind)
+	}
+	return
+}
+
+var pacDefaultPorts = map[string]string{"PROXY": "80", "HTTP": "80", "HTTPS": "443", "SOCKS": "1080", "SOCKS4": "1080", "SOCKS5": "1080"}
+
+// dialer returns the ContextDialer for a single PAC result entry such as "PROXY host:port".
+func (ps *PACSelector) dialer(entry string) (cd ContextDialer, err error) {
+	fields := strings.Fields(entry)
+	if len(fields) == 0 || len(fields) > 2 {
+		return nil, fmt.Errorf("%w: invalid result %q", ErrPACEval, entry)
+	}
+	kind := strings.ToUpper(fields[0])
+	if kind == "DIRECT" {
+		if cd = ps.ContextDialer; cd == nil {
+			cd = DefaultContextDialer
+		}
+		return
+	}
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("%w: invalid result %q", ErrPACEval, entry)
+	}
+	address := fields[1]
+	if _, _, serr := net.SplitHostPort(address); serr != nil {
+		address = net.JoinHostPort(strings.Trim(address, "[]"), pacDefaultPorts[kind])
+	}
+	key := kind + " " + address
+	ps.mu.RLock()
+	cd = ps.dialers[key]
+	ps.mu.RUnlock()
+	if cd == nil {
+		newDialer := ps.ProxyDialer
+		if newDialer == nil {
+			newDialer = ps.defaultProxyDialer
+		}
+		if cd, err = newDialer(kind, address); err == nil {
+			ps.mu.Lock()
+			if prev := ps.dialers[key]; prev != nil {
+				cd = prev
+			} else {
+				if ps.dialers == nil {
+					ps.dialers = make(map[string]ContextDialer)
+				}
+				ps.dialers[key] = cd
+			}
+			ps.mu.Unlock()
+		}
+	}
+	return
+}
+
+// dialersFor returns the ContextDialers for the entries in a PAC result.
+func (ps *PACSelector) dialersFor(result string) (cds []ContextDialer, err error) {
+	for entry := range strings.SplitSeq(result, ";") {
+		if entry = strings.TrimSpace(entry); entry != "" {
+			if cd, entryErr := ps.dialer(entry); entryErr == nil {
+				cds = append(cds, cd)
+			} else {
+				err = errors.Join(err, entryErr)
+			}
+		}
+	}
+	return
+}
+
+func (ps *PACSelector) logError(msg, address string, err error) {
+	if ps.Logger != nil {
+		ps.Logger.Warn(msg, "address", address, "error", err)
+	}
+}
+
+func (ps *PACSelector) SelectDialers(username, network, address string) (cds []ContextDialer, err error) {
+	host, port, serr := net.SplitHostPort(address)
+	if serr != nil {
+		host = address
+	}
+	result, err := ps.FindProxyForURL(pacURL(host, port), host)
+	if err == nil {
+		cds, err = ps.dialersFor(result)
+	}
+	if len(cds) == 0 {
+		if err == nil {
+			err = fmt.Errorf("%w: no usable entry in result %q", ErrPACEval, result)
+		}
+		ps.logError("pac", address, err)
+		fallback := ps.Fallback
+		if fallback == "" {
+			fallback = "DIRECT"
+		}
+		cds, err = ps.dialersFor(fallback)
+	} else if err != nil {
+		ps.logError("pac", address, err)
+	}
+	err = nil
+	if len(cds) == 0 {
+		err = ErrNoDialer
+	}
+	return
+}
+
+func (ps *PACSelector) SelectDialer(username, network, address string) (cd ContextDialer, err error) {
+	var cds []ContextDialer
+	if cds, err = ps.SelectDialers(username, network, address); err == nil {
+		cd = cds[0]
+	}
+	return
+}
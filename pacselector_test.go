@@ -0,0 +1,182 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testPACScript = `
+function FindProxyForURL(url, host) {
+	if (isPlainHostName(host) || dnsDomainIs(host, ".local"))
+		return "DIRECT";
+	if (shExpMatch(url, "https:*"))
+		return "HTTPS secure.example.com:8443; DIRECT";
+	if (dnsDomainIs(host, ".socks.example.com"))
+		return "SOCKS4 old.example.com:1080; SOCKS socks.example.com";
+	if (host == "broken.example.com")
+		return nothing();
+	if (host == "empty.example.com")
+		return "";
+	return "PROXY proxy1.example.com:3128; PROXY proxy2.example.com:3128; DIRECT";
+}
+`
+
+func dialerNames(cds []ContextDialer) (names []string) {
+	for _, cd := range cds {
+		names = append(names, dialerName(cd))
+	}
+	return
+}
+
+func TestPACSelector(t *testing.T) {
+	direct := &countingDialer{name: "direct"}
+	ps := &PACSelector{Script: testPACScript, ContextDialer: direct, Fallback: "PROXY fallback.example.com:3128"}
+	tests := []struct {
+		address string
+		want    []string
+	}{
+		{"intranet:80", []string{"direct"}},
+		{"printer.local:631", []string{"direct"}},
+		{"www.example.com:443", []string{"https://secure.example.com:8443", "direct"}},
+		{"a.socks.example.com:22", []string{"socks5://socks.example.com:1080"}},
+		{"www.example.com:80", []string{"http://proxy1.example.com:3128", "http://proxy2.example.com:3128", "direct"}},
+		{"[2001:db8::1]:8080", []string{"http://proxy1.example.com:3128", "http://proxy2.example.com:3128", "direct"}},
+		{"broken.example.com:80", []string{"http://fallback.example.com:3128"}},
+		{"empty.example.com:80", []string{"http://fallback.example.com:3128"}},
+	}
+	for _, tt := range tests {
+		cds, err := ps.SelectDialers("", "tcp", tt.address)
+		maybeFatal(t, err)
+		if got := dialerNames(cds); len(got) != len(tt.want) || (len(got) > 0 && got[0] != tt.want[0]) || (len(got) > 1 && got[1] != tt.want[1]) {
+			t.Errorf("%s: got %v, want %v", tt.address, got, tt.want)
+		}
+	}
+
+	cd1, err := ps.SelectDialer("", "tcp", "www.example.com:80")
+	maybeFatal(t, err)
+	cd2, err := ps.SelectDialer("", "tcp", "other.example.com:80")
+	maybeFatal(t, err)
+	if cd1 != cd2 {
+		t.Error("dialers not reused", cd1, cd2)
+	}
+	if hpd, ok := cd1.(*HTTPProxyDialer); !ok || hpd.ContextDialer != direct {
+		t.Errorf("%#v", cd1)
+	}
+
+	if result, err := ps.FindProxyForURL("http://intranet/", "intranet"); err != nil || result != "DIRECT" {
+		t.Error(result, err)
+	}
+}
+
+func TestPACSelectorFallback(t *testing.T) {
+	ps := &PACSelector{Script: "function FindProxyForURL(url, host) {"}
+	cds, err := ps.SelectDialers("", "tcp", "www.example.com:80")
+	maybeFatal(t, err)
+	if len(cds) != 1 || cds[0] != DefaultContextDialer {
+		t.Error(cds)
+	}
+	if _, err := ps.FindProxyForURL("http://www.example.com/", "www.example.com"); !errors.Is(err, ErrPACEval) {
+		t.Error(err)
+	}
+
+	ps = &PACSelector{Script: `function FindProxyForURL(url, host) { return "SOCKS4 a:1"; }`, Fallback: "SOCKS4 b:1"}
+	if _, err := ps.SelectDialers("", "tcp", "www.example.com:80"); !errors.Is(err, ErrNoDialer) {
+		t.Error(err)
+	}
+}
+
+func TestPACSelectorLoad(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "proxy.pac")
+	write := func(script string, mtime time.Time) {
+		maybeFatal(t, os.WriteFile(fn, []byte(script), 0o644))
+		maybeFatal(t, os.Chtimes(fn, mtime, mtime))
+	}
+	now := time.Now()
+	write(`function FindProxyForURL(url, host) { return "PROXY one:1"; }`, now.Add(-time.Hour))
+	ps := &PACSelector{File: fn}
+	maybeFatal(t, ps.Load())
+	if result, err := ps.FindProxyForURL("http://x/", "x"); err != nil || result != "PROXY one:1" {
+		t.Error(result, err)
+	}
+
+	write(`function FindProxyForURL(url, host) { return "PROXY two:2" `, now.Add(-time.Minute))
+	if err := ps.Load(); !errors.Is(err, ErrPACSyntax) {
+		t.Error(err)
+	}
+	if result, _ := ps.FindProxyForURL("http://x/", "x"); result != "PROXY one:1" {
+		t.Error(result)
+	}
+
+	write(`function FindProxyForURL(url, host) { return "PROXY two:2"; }`, now)
+	maybeFatal(t, ps.Load())
+	if result, _ := ps.FindProxyForURL("http://x/", "x"); result != "PROXY two:2" {
+		t.Error(result)
+	}
+
+	if err := (&PACSelector{File: fn + ".missing"}).Load(); !errors.Is(err, os.ErrNotExist) {
+		t.Error(err)
+	}
+}
+
+func TestPACSelectorURL(t *testing.T) {
+	pacsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/proxy.pac" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+		_, _ = io.WriteString(w, `function FindProxyForURL(url, host) { return "PROXY remote:3128"; }`)
+		if r.URL.Query().Has("huge") {
+			_, _ = io.WriteString(w, strings.Repeat(" ", int(PACMaxSize)))
+		}
+	}))
+	defer pacsrv.Close()
+	ps := &PACSelector{File: pacsrv.URL + "/proxy.pac"}
+	if result, err := ps.FindProxyForURL("http://x/", "x"); err != nil || result != "PROXY remote:3128" {
+		t.Error(result, err)
+	}
+	if err := (&PACSelector{File: pacsrv.URL + "/missing.pac"}).Load(); err == nil {
+		t.Error("expected error")
+	}
+	if err := (&PACSelector{File: pacsrv.URL + "/proxy.pac?huge"}).Load(); err == nil || !strings.Contains(err.Error(), "larger than") {
+		t.Error(err)
+	}
+}
+
+func TestPACSelectorServer(t *testing.T) {
+	destsrv := makeHTTPDestSrv(t)
+	defer destsrv.Close()
+	upstream := httptest.NewServer(&Server{ConnectPortPolicy: AnyConnectPort{}})
+	defer upstream.Close()
+	dead := makeHangupListener(t)
+	defer dead.Close()
+
+	rur := newRecordingUsageReporter()
+	proxysrv := httptest.NewServer(&Server{
+		DialerSelector: &PACSelector{
+			Script: `function FindProxyForURL(url, host) {
+				return "PROXY ` + dead.Addr().String() + `; PROXY ` + upstream.Listener.Addr().String() + `";
+			}`,
+		},
+		UsageReporter: rur,
+	})
+	defer proxysrv.Close()
+	client := makeClient(t, proxysrv.URL)
+	resp, err := client.Get(destsrv.URL)
+	maybeFatal(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Error(resp.StatusCode)
+	}
+	if u := rur.next(t); u.Dialer != "http://"+upstream.Listener.Addr().String() || u.Attempts != 2 {
+		t.Errorf("%#v", u)
+	}
+}
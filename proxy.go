@@ -1,18 +1,90 @@
 package httpproxy
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
+	"sync/atomic"
+	"time"
 )
 
 var ErrBodyNotReadWriter = errors.New("response body not an io.ReadWriter")
 
 func (srv *Server) proxy(w http.ResponseWriter, r *http.Request) {
-	rt := srv.getRoundTripper(r)
+	sess, _ := srv.addSession(r, ConnKindRequest)
+	defer srv.removeSession(sess)
+	ctx := sess.ctx
+	var roundTripStart atomic.Int64
+	if srv.Metrics != nil || sess.trace != nil {
+		var connectStart, tlsStart atomic.Int64
+		ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+			ConnectStart: func(network, addr string) { connectStart.Store(time.Now().UnixNano()) },
+			ConnectDone: func(network, addr string, err error) {
+				start := time.Unix(0, connectStart.Load())
+				sess.trace.add("dial", start, err, "server.address", addr)
+				if err == nil {
+					srv.Metrics.dialed(time.Since(start))
+				}
+			},
+			TLSHandshakeStart: func() { tlsStart.Store(time.Now().UnixNano()) },
+			TLSHandshakeDone: func(state tls.ConnectionState, err error) {
+				sess.trace.add("tls", time.Unix(0, tlsStart.Load()), err, "tls.server_name", state.ServerName)
+			},
+			GotFirstResponseByte: func() {
+				sess.trace.add("first_byte", time.Unix(0, roundTripStart.Load()), nil)
+			},
+		})
+	}
+	r = r.WithContext(ctx)
+	rt := srv.getRoundTripper(sess, r)
+	if _, ok := rt.(fakeRoundTripper); !ok && srv.Limits != nil {
+		if err := srv.Limits.allowRequest(sess.getUsername(), r.RemoteAddr); err != nil {
+			rt = fakeRoundTripper{err}
+		}
+	}
+	if frt, ok := rt.(fakeRoundTripper); ok && frt.err != nil {
+		sess.setErr(frt.err)
+		sess.setStatus(frt.StatusCode(http.StatusInternalServerError))
+		if srv.BlockHandler != nil && errors.Is(frt.err, ErrBlocked) {
+			srv.BlockHandler.ServeHTTP(w, r)
+		} else {
+			srv.writeErrorResponse(w, r, sess.id, frt.err)
+		}
+		return
+	}
+	if r.Method == "PURGE" && srv.Cache != nil {
+		sess.setStatus(srv.Cache.purge(w, r, sess.getUsername()))
+		return
+	}
 	RemoveRequestHeaders(r)
-	resp, err := rt.RoundTrip(r)
+	sess.trace.inject(r.Header)
+	if r.Body != nil && r.Body != http.NoBody {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{sess.reader(r.Body, true), r.Body}
+	}
+	roundTripStart.Store(time.Now().UnixNano())
+	var resp *http.Response
+	var err error
+	if srv.Cache != nil {
+		resp, err = srv.Cache.roundTrip(rt, r)
+	} else {
+		resp, err = rt.RoundTrip(r)
+	}
+	if err != nil {
+		err = upstreamError{err, "http_protocol_error"}
+	}
+	var isWebSocket bool
+	if err == nil && resp != nil {
+		if isWebSocket = isWebSocketHandshake(resp.Header); isWebSocket {
+			sess.add(resp.Body)
+			err = srv.upgradeSession(sess)
+		}
+	}
 	if err == nil && resp != nil {
 		// replace headers and write them out
 		hdr := w.Header()
@@ -24,24 +96,31 @@ func (srv *Server) proxy(w http.ResponseWriter, r *http.Request) {
 			hdr["Transfer-Encoding"] = resp.TransferEncoding
 		}
 		w.WriteHeader(resp.StatusCode)
+		sess.setStatus(resp.StatusCode)
 
 		// proxy the body data
-		if isWebSocketHandshake(resp.Header) {
+		start := time.Now()
+		if isWebSocket {
 			var clientConn net.Conn
 			if clientConn, err = hijack(w); err == nil {
+				sess.add(clientConn)
+				srv.watchTunnel(sess, clientConn)
 				err = ErrBodyNotReadWriter
 				if wsConn, ok := resp.Body.(io.ReadWriter); ok {
-					err = proxyUntilClosed(wsConn, clientConn)
+					err = proxyUntilClosed(sess, wsConn, clientConn)
 				}
 			}
 		} else {
-			_, err = io.Copy(maybeMakeFlushWriter(hdr, w), resp.Body)
+			_, err = io.Copy(maybeMakeFlushWriter(hdr, w), sess.reader(resp.Body, false))
 			err = errors.Join(err, resp.Body.Close())
 		}
+		sess.trace.add("transfer", start, err)
 	} else {
-		(fakeRoundTripper{err}).WriteResponse(w)
+		srv.writeErrorResponse(w, r, sess.id, err)
+		sess.setStatus(fakeRoundTripper{err}.StatusCode(http.StatusInternalServerError))
 	}
 
+	sess.setErr(err)
 	if err != nil && srv.Logger != nil {
 		srv.Logger.Error("proxy", "error", err)
 	}
@@ -0,0 +1,116 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// ProxyStatusName identifies this proxy in the RFC 9209 Proxy-Status header fields it sends.
+var ProxyStatusName = "httpproxy"
+
+// statusClientClosedRequest is the non-standard status code nginx uses for requests the client abandoned.
+const statusClientClosedRequest = 499
+
+// upstreamError marks an error encountered while dialing or talking to the next hop.
+type upstreamError struct {
+	error
+	errorType string // Proxy-Status error type used if err can't be classified further
+}
+
+func (e upstreamError) Unwrap() error {
+	return e.error
+}
+
+// classifyError returns the HTTP status code and RFC 9209 Proxy-Status
+// error type and parameters to respond with for err.
+// If err can't be classified, code is defaultcode.
+func classifyError(err error, defaultcode int) (code int, errorType, params string) {
+	code = http.StatusBadGateway
+	var dnsErr *net.DNSError
+	switch errorClass(err) {
+	case "":
+		code = http.StatusOK
+	case errClassUnauthorized:
+		code = http.StatusUnauthorized
+	case errClassForbidden:
+		code, errorType = http.StatusForbidden, "http_request_denied"
+	case errClassLimit:
+		code, errorType = http.StatusServiceUnavailable, "proxy_internal_response"
+		if errors.Is(err, ErrTooManyRequests) {
+			code = http.StatusTooManyRequests
+		}
+	case errClassClosed:
+		code, errorType = http.StatusServiceUnavailable, "proxy_internal_response"
+	case errClassCanceled:
+		code = statusClientClosedRequest
+	case errClassDNS:
+		errorType = "dns_error"
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			params = `; rcode="NXDOMAIN"`
+		}
+	case errClassTimeout:
+		code, errorType = http.StatusGatewayTimeout, "connection_timeout"
+		if errors.As(err, &dnsErr) {
+			errorType = "dns_timeout"
+		}
+	case errClassRefused:
+		errorType = "connection_refused"
+	case errClassUnreachable:
+		errorType = "destination_ip_unroutable"
+	case errClassTerminated:
+		errorType = "connection_terminated"
+	case errClassTLS:
+		errorType = tlsErrorType(err)
+	default:
+		var ue upstreamError
+		if errors.As(err, &ue) {
+			errorType = ue.errorType
+		} else {
+			code, errorType = defaultcode, "proxy_internal_error"
+		}
+	}
+	return
+}
+
+func tlsErrorType(err error) string {
+	var alertErr tls.AlertError
+	var certErr *tls.CertificateVerificationError
+	var unknownAuthErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	switch {
+	case errors.As(err, &alertErr):
+		return "tls_alert_received"
+	case errors.As(err, &certErr), errors.As(err, &unknownAuthErr), errors.As(err, &hostnameErr):
+		return "tls_certificate_error"
+	}
+	return "tls_protocol_error"
+}
+
+// proxyStatus returns the Proxy-Status header field value for the given error type and parameters.
+func proxyStatus(errorType, params string) string {
+	var sb strings.Builder
+	sb.WriteString(ProxyStatusName)
+	if errorType != "" {
+		sb.WriteString("; error=")
+		sb.WriteString(errorType)
+		sb.WriteString(params)
+	}
+	return sb.String()
+}
+
+// errorBody returns the response body text for err, which only
+// includes the error message for errors the proxy itself decided on.
+func errorBody(err error, code int) (body string) {
+	switch errorClass(err) {
+	case "", errClassUnauthorized:
+	case errClassForbidden, errClassLimit, errClassClosed:
+		body = err.Error()
+	default:
+		body = http.StatusText(code)
+	}
+	return
+}
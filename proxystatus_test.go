@@ -0,0 +1,112 @@
+package httpproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+func TestClassifyError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	for _, tc := range []struct {
+		err       error
+		code      int
+		errorType string
+		params    string
+	}{
+		{nil, http.StatusOK, "", ""},
+		{ErrUnauthorized, http.StatusUnauthorized, "", ""},
+		{ErrBlocked, http.StatusForbidden, "http_request_denied", ""},
+		{&LimitError{Err: ErrTooManyRequests}, http.StatusTooManyRequests, "proxy_internal_response", ""},
+		{&LimitError{Err: ErrTooManyTunnels}, http.StatusServiceUnavailable, "proxy_internal_response", ""},
+		{ErrServerClosed, http.StatusServiceUnavailable, "proxy_internal_response", ""},
+		{&net.DNSError{Err: "no such host", Name: "x.invalid", IsNotFound: true}, http.StatusBadGateway, "dns_error", `; rcode="NXDOMAIN"`},
+		{&net.DNSError{Err: "timeout", Name: "x.invalid", IsTimeout: true}, http.StatusGatewayTimeout, "dns_timeout", ""},
+		{refused, http.StatusBadGateway, "connection_refused", ""},
+		{upstreamError{refused, "destination_unavailable"}, http.StatusBadGateway, "connection_refused", ""},
+		{syscall.EHOSTUNREACH, http.StatusBadGateway, "destination_ip_unroutable", ""},
+		{io.ErrUnexpectedEOF, http.StatusBadGateway, "connection_terminated", ""},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout, "connection_timeout", ""},
+		{upstreamError{context.Canceled, "http_protocol_error"}, statusClientClosedRequest, "", ""},
+		{tls.AlertError(40), http.StatusBadGateway, "tls_alert_received", ""},
+		{x509.UnknownAuthorityError{}, http.StatusBadGateway, "tls_certificate_error", ""},
+		{tls.RecordHeaderError{}, http.StatusBadGateway, "tls_protocol_error", ""},
+		{upstreamError{errors.New("bad"), "http_protocol_error"}, http.StatusBadGateway, "http_protocol_error", ""},
+		{errors.New("bad"), http.StatusInternalServerError, "proxy_internal_error", ""},
+	} {
+		code, errorType, params := classifyError(tc.err, http.StatusInternalServerError)
+		if code != tc.code || errorType != tc.errorType || params != tc.params {
+			t.Errorf("%v: got %v %q %q", tc.err, code, errorType, params)
+		}
+	}
+}
+
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	maybeFatal(t, err)
+	addr := l.Addr().String()
+	maybeFatal(t, l.Close())
+	return addr
+}
+
+func TestProxyStatusResponses(t *testing.T) {
+	srv := &Server{ConnectPortPolicy: AnyConnectPort{}}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+	target := closedAddr(t)
+
+	resp, err := makeClient(t, proxysrv.URL).Get("http://" + target + "/")
+	maybeFatal(t, err)
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("Proxy-Status") != "httpproxy; error=connection_refused" {
+		t.Error(resp.Status, resp.Header)
+	}
+	if string(body) != http.StatusText(http.StatusBadGateway) || strings.Contains(string(body), "dial") {
+		t.Errorf("%q", body)
+	}
+
+	resp, cbody := rawConnect(t, proxysrv.Listener.Addr().String(), target, "")
+	if resp.StatusCode != http.StatusBadGateway || resp.Header.Get("Proxy-Status") != "httpproxy; error=connection_refused" {
+		t.Error(resp.Status, resp.Header)
+	}
+	if cbody != http.StatusText(http.StatusBadGateway) {
+		t.Errorf("%q", cbody)
+	}
+}
+
+func TestProxyStatusCanceled(t *testing.T) {
+	started := make(chan struct{})
+	destsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+	defer destsrv.Close()
+	rur := newRecordingUsageReporter()
+	srv := &Server{UsageReporter: rur}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, destsrv.URL, nil)
+	go func() {
+		<-started
+		cancel()
+	}()
+	if _, err := makeClient(t, proxysrv.URL).Do(req); !errors.Is(err, context.Canceled) {
+		t.Error(err)
+	}
+	if u := rur.next(t); u.StatusCode != statusClientClosedRequest || errorClass(u.Err) != errClassCanceled {
+		t.Error(u.StatusCode, u.Err)
+	}
+}
@@ -0,0 +1,117 @@
+package httpproxy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var ErrQuotaExceeded = fmt.Errorf("%w: quota exceeded", ErrForbidden)
+
+// QuotaPeriod is the period a Quota applies to.
+type QuotaPeriod int
+
+const (
+	QuotaDaily QuotaPeriod = iota
+	QuotaMonthly
+)
+
+func (qp QuotaPeriod) String() string {
+	if qp == QuotaMonthly {
+		return "monthly"
+	}
+	return "daily"
+}
+
+// current returns the name of the period t falls within.
+func (qp QuotaPeriod) current(t time.Time) string {
+	if qp == QuotaMonthly {
+		return t.Format("2006-01")
+	}
+	return t.Format("2006-01-02")
+}
+
+// Quota limits the number of bytes transferred per period.
+type Quota struct {
+	Period QuotaPeriod
+	Limit  int64 // bytes sent and received allowed per period
+}
+
+// A QuotaStore keeps track of the bytes used per quota key and period.
+type QuotaStore interface {
+	// AddQuotaUsage adds n bytes to the usage of key during period and returns the new total.
+	// If the last period recorded for key differs from period, its usage is reset first.
+	AddQuotaUsage(key, period string, n int64) (used int64, err error)
+}
+
+// Quotas enforces data quotas per user or group of users.
+//
+// New requests are rejected with ErrQuotaExceeded once a quota is exhausted,
+// and running tunnels and requests are cut off when they exhaust it.
+type Quotas struct {
+	Store    QuotaStore         // where usage is kept
+	Limits   map[string][]Quota // quotas per user or group name, anonymous usage uses the empty string
+	Groups   map[string]string  // optional group per username, users in a group share its quotas
+	Default  []Quota            // quotas for users and groups not in Limits
+	Location *time.Location     // optional location deciding when days and months start, defaults to time.Local
+}
+
+func (q *Quotas) lookup(username string) (name string, quotas []Quota) {
+	name = username
+	if group, ok := q.Groups[username]; ok {
+		name = group
+	}
+	var ok bool
+	if quotas, ok = q.Limits[name]; !ok {
+		quotas = q.Default
+	}
+	return
+}
+
+// Add adds n bytes to all the quotas of username, returning ErrQuotaExceeded
+// if any of them are exhausted afterwards, along with any errors from the Store.
+func (q *Quotas) Add(username string, n int64) error {
+	name, quotas := q.lookup(username)
+	loc := q.Location
+	if loc == nil {
+		loc = time.Local
+	}
+	now := time.Now().In(loc)
+	var exceeded error
+	var storeErrs []error
+	for _, quota := range quotas {
+		used, err := q.Store.AddQuotaUsage(name+"/"+quota.Period.String(), quota.Period.current(now), n)
+		if err != nil {
+			storeErrs = append(storeErrs, err)
+		} else if used >= quota.Limit && exceeded == nil {
+			exceeded = fmt.Errorf("%w: %s %q", ErrQuotaExceeded, quota.Period, name)
+		}
+	}
+	return errors.Join(append([]error{exceeded}, storeErrs...)...)
+}
+
+// Check returns ErrQuotaExceeded if any of username's quotas are exhausted.
+func (q *Quotas) Check(username string) error {
+	return q.Add(username, 0)
+}
+
+// quotaReader accounts for the data read from it in the session user's quotas,
+// closing the session once a quota is exhausted. Errors from the QuotaStore are logged.
+type quotaReader struct {
+	io.Reader
+	sess *session
+	q    *Quotas
+}
+
+func (qr quotaReader) Read(p []byte) (n int, err error) {
+	if n, err = qr.Reader.Read(p); n > 0 {
+		if qerr := qr.q.Add(qr.sess.getUsername(), int64(n)); errors.Is(qerr, ErrQuotaExceeded) {
+			qr.sess.close(qerr)
+			err = qerr
+		} else if qerr != nil && qr.sess.srv.Logger != nil {
+			qr.sess.srv.Logger.Error("quotas", "id", qr.sess.id, "error", qerr)
+		}
+	}
+	return
+}
@@ -0,0 +1,178 @@
+package httpproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuotas(t *testing.T) {
+	q := &Quotas{
+		Store: &MemoryQuotaStore{},
+		Limits: map[string][]Quota{
+			"team":  {{Period: QuotaDaily, Limit: 100}},
+			"admin": nil,
+		},
+		Groups:  map[string]string{"alice": "team", "bob": "team"},
+		Default: []Quota{{Period: QuotaDaily, Limit: 1000}, {Period: QuotaMonthly, Limit: 1500}},
+	}
+	maybeFatal(t, q.Add("alice", 60))
+	if err := q.Add("bob", 40); !errors.Is(err, ErrQuotaExceeded) {
+		t.Error(err)
+	}
+	if err := q.Check("alice"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Error(err)
+	}
+	maybeFatal(t, q.Add("admin", 1<<40))
+	maybeFatal(t, q.Add("carol", 999))
+	maybeFatal(t, q.Check("carol"))
+	if err := q.Add("carol", 1); !errors.Is(err, ErrQuotaExceeded) {
+		t.Error(err)
+	}
+	maybeFatal(t, q.Check("dave"))
+
+	// usage keeps counting towards the monthly quota after the daily one is exhausted
+	if err := q.Add("carol", 100); !errors.Is(err, ErrQuotaExceeded) {
+		t.Error(err)
+	}
+	if used, _ := q.Store.AddQuotaUsage("carol/monthly", QuotaMonthly.current(time.Now()), 0); used != 1100 {
+		t.Error(used)
+	}
+
+	mqs := &MemoryQuotaStore{}
+	if used, _ := mqs.AddQuotaUsage("k", "2026-01-01", 10); used != 10 {
+		t.Error(used)
+	}
+	if used, _ := mqs.AddQuotaUsage("k", "2026-01-01", 5); used != 15 {
+		t.Error(used)
+	}
+	if used, _ := mqs.AddQuotaUsage("k", "2026-01-02", 1); used != 1 {
+		t.Error(used)
+	}
+}
+
+// failingQuotaStore fails to record usage for keys starting with fail.
+type failingQuotaStore struct{ MemoryQuotaStore }
+
+var errQuotaStore = errors.New("disk full")
+
+func (fqs *failingQuotaStore) AddQuotaUsage(key, period string, n int64) (int64, error) {
+	used, err := fqs.MemoryQuotaStore.AddQuotaUsage(key, period, n)
+	if strings.HasPrefix(key, "fail") {
+		err = errQuotaStore
+	}
+	return used, err
+}
+
+func TestQuotasStoreError(t *testing.T) {
+	q := &Quotas{
+		Store:   &failingQuotaStore{},
+		Groups:  map[string]string{"failing": "fail"},
+		Default: []Quota{{Period: QuotaDaily, Limit: 10}, {Period: QuotaMonthly, Limit: 100}},
+	}
+	if err := q.Add("failing", 5); !errors.Is(err, errQuotaStore) || errors.Is(err, ErrQuotaExceeded) {
+		t.Error(err)
+	}
+	maybeFatal(t, q.Add("ok", 5))
+	if err := q.Add("ok", 5); errors.Is(err, errQuotaStore) || !errors.Is(err, ErrQuotaExceeded) {
+		t.Error(err)
+	}
+
+	sess := &session{srv: &Server{}}
+	sess.username = "failing"
+	qr := quotaReader{Reader: strings.NewReader("abc"), sess: sess, q: &Quotas{Store: q.Store, Default: []Quota{{Period: QuotaDaily, Limit: 1000}}}}
+	if n, err := qr.Read(make([]byte, 10)); n != 3 || err != nil || sess.closed {
+		t.Error(n, err, sess.closed)
+	}
+}
+
+func TestFileQuotaStore(t *testing.T) {
+	fn := filepath.Join(t.TempDir(), "quotas.json")
+	fqs, err := NewFileQuotaStore(fn)
+	maybeFatal(t, err)
+	fqs.SaveInterval = time.Hour
+	_, err = fqs.AddQuotaUsage("alice/daily", "2026-10-19", 123)
+	maybeFatal(t, err)
+	maybeFatal(t, fqs.Save())
+
+	fqs, err = NewFileQuotaStore(fn)
+	maybeFatal(t, err)
+	if used, _ := fqs.AddQuotaUsage("alice/daily", "2026-10-19", 0); used != 123 {
+		t.Error(used)
+	}
+}
+
+func TestQuotasServer(t *testing.T) {
+	l := makeEchoListener(t, false)
+	defer l.Close()
+	srv := &Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		Quotas: &Quotas{
+			Store:   &MemoryQuotaStore{},
+			Default: []Quota{{Period: QuotaDaily, Limit: 100}},
+		},
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	conn, br, resp := openTunnel(t, proxysrv.Listener.Addr().String(), l.Addr().String())
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	_, err := io.WriteString(conn, "0123456789")
+	maybeFatal(t, err)
+	readEchoed(t, br, "0123456789")
+
+	_, err = io.WriteString(conn, strings.Repeat("x", 100))
+	maybeFatal(t, err)
+	if _, err = io.ReadAll(br); err != nil {
+		t.Error(err)
+	}
+
+	_, _, resp = openTunnel(t, proxysrv.Listener.Addr().String(), l.Addr().String())
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error(resp.Status)
+	}
+}
+
+func TestQuotasPipelined(t *testing.T) {
+	l := makeEchoListener(t, false)
+	defer l.Close()
+	q := &Quotas{
+		Store:   &MemoryQuotaStore{},
+		Default: []Quota{{Period: QuotaDaily, Limit: 1000}},
+	}
+	srv := &Server{ConnectPortPolicy: AnyConnectPort{}, Quotas: q}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	// data sent along with the CONNECT request is buffered by the HTTP server
+	conn, err := net.Dial("tcp", proxysrv.Listener.Addr().String())
+	maybeFatal(t, err)
+	defer conn.Close()
+	target := l.Addr().String()
+	payload := strings.Repeat("x", 50)
+	_, err = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n"+payload)
+	maybeFatal(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	maybeFatal(t, err)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	readEchoed(t, br, payload)
+	conn.Close()
+	waitForConns(t, srv, 0)
+
+	if used, _ := q.Store.AddQuotaUsage("/daily", QuotaDaily.current(time.Now()), 0); used != 100 {
+		t.Error(used)
+	}
+}
@@ -0,0 +1,109 @@
+package httpproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var DefaultQuotaSaveInterval = 10 * time.Second
+
+type quotaUsage struct {
+	Period string `json:"period"`
+	Used   int64  `json:"used"`
+}
+
+// MemoryQuotaStore is a QuotaStore that keeps usage in memory.
+type MemoryQuotaStore struct {
+	mu    sync.Mutex
+	usage map[string]quotaUsage
+}
+
+var _ QuotaStore = (*MemoryQuotaStore)(nil)
+
+func (mqs *MemoryQuotaStore) AddQuotaUsage(key, period string, n int64) (used int64, err error) {
+	mqs.mu.Lock()
+	defer mqs.mu.Unlock()
+	if mqs.usage == nil {
+		mqs.usage = make(map[string]quotaUsage)
+	}
+	qu := mqs.usage[key]
+	if qu.Period != period {
+		qu = quotaUsage{Period: period}
+	}
+	qu.Used += n
+	mqs.usage[key] = qu
+	return qu.Used, nil
+}
+
+// FileQuotaStore is a QuotaStore that keeps usage in memory and persists
+// it as JSON to a file at most every SaveInterval, and when Save is called.
+type FileQuotaStore struct {
+	Path         string        // file to load from and save to
+	SaveInterval time.Duration // minimum time between automatic saves, defaults to DefaultQuotaSaveInterval
+	MemoryQuotaStore
+	saveMu   sync.Mutex // serializes Save
+	lastSave time.Time  // protected by MemoryQuotaStore.mu
+}
+
+var _ QuotaStore = (*FileQuotaStore)(nil)
+
+// NewFileQuotaStore returns a FileQuotaStore with usage loaded from path, if it exists.
+func NewFileQuotaStore(path string) (fqs *FileQuotaStore, err error) {
+	fqs = &FileQuotaStore{Path: path}
+	var b []byte
+	if b, err = os.ReadFile(path); err == nil {
+		err = json.Unmarshal(b, &fqs.usage)
+	} else if errors.Is(err, fs.ErrNotExist) {
+		err = nil
+	}
+	fqs.lastSave = time.Now()
+	return
+}
+
+func (fqs *FileQuotaStore) AddQuotaUsage(key, period string, n int64) (used int64, err error) {
+	if used, err = fqs.MemoryQuotaStore.AddQuotaUsage(key, period, n); err == nil && n != 0 {
+		interval := fqs.SaveInterval
+		if interval <= 0 {
+			interval = DefaultQuotaSaveInterval
+		}
+		fqs.mu.Lock()
+		due := time.Since(fqs.lastSave) >= interval
+		if due {
+			fqs.lastSave = time.Now()
+		}
+		fqs.mu.Unlock()
+		if due {
+			err = fqs.Save()
+		}
+	}
+	return
+}
+
+// Save writes the current usage to Path.
+func (fqs *FileQuotaStore) Save() (err error) {
+	fqs.saveMu.Lock()
+	defer fqs.saveMu.Unlock()
+	fqs.mu.Lock()
+	b, err := json.Marshal(fqs.usage)
+	fqs.lastSave = time.Now()
+	fqs.mu.Unlock()
+	if err == nil {
+		var f *os.File
+		if f, err = os.CreateTemp(filepath.Dir(fqs.Path), filepath.Base(fqs.Path)+".*"); err == nil {
+			_, err = f.Write(b)
+			err = errors.Join(err, f.Close())
+			if err == nil {
+				err = os.Rename(f.Name(), fqs.Path)
+			}
+			if err != nil {
+				_ = os.Remove(f.Name())
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,34 @@
+package httpproxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"time"
+)
+
+// A Resolver looks up the IP addresses of a host name.
+//
+// It matches the LookupNetIP method of *net.Resolver.
+type Resolver interface {
+	LookupNetIP(ctx context.Context, network, host string) (addrs []netip.Addr, err error)
+}
+
+var DefaultResolver Resolver = net.DefaultResolver
+
+// A TTLResolver is a Resolver that also returns how long the result may be cached.
+type TTLResolver interface {
+	Resolver
+	LookupNetIPTTL(ctx context.Context, network, host string) (addrs []netip.Addr, ttl time.Duration, err error)
+}
+
+// lookupNetwork returns the "ip", "ip4" or "ip6" network to resolve for network.
+func lookupNetwork(network string) string {
+	if strings.HasSuffix(network, "4") {
+		return "ip4"
+	} else if strings.HasSuffix(network, "6") {
+		return "ip6"
+	}
+	return "ip"
+}
@@ -0,0 +1,55 @@
+package httpproxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+)
+
+// ResolvingDialer is a ContextDialer that resolves host names using a Resolver
+// and connects to the resolved addresses in turn until one accepts the connection.
+//
+// Setting DefaultContextDialer to a ResolvingDialer makes the built-in dialers
+// resolve names using DefaultResolver, such as a CachingResolver.
+type ResolvingDialer struct {
+	Resolver      Resolver      // optional resolver to use, otherwise uses DefaultResolver
+	ContextDialer ContextDialer // optional dialer connecting to the addresses, otherwise uses a net.Dialer
+}
+
+var _ ContextDialer = (*ResolvingDialer)(nil)
+
+// DialContext resolves the host part of address and connects to the first
+// address that accepts the connection, returning the first error if none do.
+func (rd *ResolvingDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	var cd ContextDialer = &net.Dialer{}
+	if rd.ContextDialer != nil {
+		cd = rd.ContextDialer
+	}
+	var host, port string
+	if host, port, err = net.SplitHostPort(address); err == nil {
+		r := DefaultResolver
+		if rd.Resolver != nil {
+			r = rd.Resolver
+		}
+		var addrs []netip.Addr
+		if addrs, err = r.LookupNetIP(ctx, lookupNetwork(network), host); err == nil {
+			err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			var firstErr error
+			for _, addr := range addrs {
+				if conn, err = cd.DialContext(ctx, network, net.JoinHostPort(addr.Unmap().String(), port)); err == nil {
+					return
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+				if ctx.Err() != nil {
+					break
+				}
+			}
+			if firstErr != nil {
+				err = firstErr
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,68 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// refusingDialer refuses connections to addresses starting with prefix and dials the rest.
+type refusingDialer struct{ prefix string }
+
+func (rd refusingDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if strings.HasPrefix(address, rd.prefix) {
+		return nil, errors.New("refused " + address)
+	}
+	return (&net.Dialer{}).DialContext(ctx, network, address)
+}
+
+func TestResolvingDialer(t *testing.T) {
+	echo := makeEchoListener(t, false)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	rd := &ResolvingDialer{
+		Resolver: &CachingResolver{Hosts: map[string][]netip.Addr{
+			"echo.test": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("127.0.0.1")},
+			"down.test": {netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")},
+		}},
+		ContextDialer: refusingDialer{prefix: "192.0.2."},
+	}
+	conn, err := rd.DialContext(context.Background(), "tcp", net.JoinHostPort("echo.test", port))
+	maybeFatal(t, err)
+	checkEcho(t, conn)
+
+	if _, err = rd.DialContext(context.Background(), "tcp", "down.test:80"); err == nil || err.Error() != "refused 192.0.2.1:80" {
+		t.Error(err)
+	}
+	if _, err = rd.DialContext(context.Background(), "tcp6", "echo.test:80"); !isNotFound(err) {
+		t.Error(err)
+	}
+}
+
+func TestResolvingDialerDNS(t *testing.T) {
+	echo := makeEchoListener(t, false)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+	server, queries := makeDNSServer(t, []dnsTestRecord{
+		{name: "echo.example.com.", rtype: dnsTypeA, ttl: 60, data: []byte{127, 0, 0, 1}},
+	}, false)
+
+	// an upstream proxy reached by name through the DNS server
+	upstream := makeSOCKS5Server(t, "", "", 0)
+	_, upstreamPort, _ := net.SplitHostPort(upstream.Addr().String())
+	rd := &ResolvingDialer{Resolver: &CachingResolver{Resolver: &DNSResolver{Server: server}}}
+	sd := &SOCKS5Dialer{Address: net.JoinHostPort("echo.example.com", upstreamPort), ContextDialer: rd}
+	for range 2 {
+		conn, err := sd.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port))
+		maybeFatal(t, err)
+		checkEcho(t, conn)
+	}
+	// one query each for A and AAAA records
+	if n := queries.Load(); n != 2 {
+		t.Error(n)
+	}
+}
@@ -0,0 +1,101 @@
+package httpproxy
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// RotatingFile is an io.WriteCloser appending to the file at Path, rotating it
+// to Path.1, Path.2 and so on when a write would make it exceed MaxSize bytes.
+//
+// Each Write is kept whole in a single file, so rotation happens on line
+// boundaries when every Write is a line.
+type RotatingFile struct {
+	Path       string     // file to write to
+	MaxSize    int64      // optional maximum size in bytes before rotating, zero disables rotation
+	MaxBackups int        // number of rotated files to keep, zero keeps none
+	mu         sync.Mutex // protects following
+	f          *os.File
+	size       int64
+}
+
+func (rf *RotatingFile) openLocked() (err error) {
+	if rf.f == nil {
+		var f *os.File
+		if f, err = os.OpenFile(rf.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644); err == nil {
+			var fi os.FileInfo
+			if fi, err = f.Stat(); err == nil {
+				rf.f = f
+				rf.size = fi.Size()
+			} else {
+				_ = f.Close()
+			}
+		}
+	}
+	return
+}
+
+func (rf *RotatingFile) closeLocked() (err error) {
+	if rf.f != nil {
+		err = rf.f.Close()
+		rf.f = nil
+		rf.size = 0
+	}
+	return
+}
+
+func (rf *RotatingFile) rotateLocked() (err error) {
+	if err = rf.closeLocked(); err == nil {
+		for i := rf.MaxBackups - 1; i > 0 && err == nil; i-- {
+			if err = os.Rename(fmt.Sprintf("%s.%d", rf.Path, i), fmt.Sprintf("%s.%d", rf.Path, i+1)); errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		}
+		if err == nil {
+			if rf.MaxBackups > 0 {
+				err = os.Rename(rf.Path, rf.Path+".1")
+			} else {
+				err = os.Remove(rf.Path)
+			}
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+		}
+	}
+	return
+}
+
+// Write appends p to the file, rotating it first if needed.
+func (rf *RotatingFile) Write(p []byte) (n int, err error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if err = rf.openLocked(); err == nil {
+		if rf.MaxSize > 0 && rf.size > 0 && rf.size+int64(len(p)) > rf.MaxSize {
+			if err = rf.rotateLocked(); err == nil {
+				err = rf.openLocked()
+			}
+		}
+		if err == nil {
+			n, err = rf.f.Write(p)
+			rf.size += int64(n)
+		}
+	}
+	return
+}
+
+// Rotate rotates the file now, regardless of its size.
+func (rf *RotatingFile) Rotate() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.rotateLocked()
+}
+
+// Close closes the file. A later Write reopens it.
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	return rf.closeLocked()
+}
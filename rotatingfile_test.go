@@ -0,0 +1,41 @@
+package httpproxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "access.log")
+	rf := &RotatingFile{Path: path, MaxSize: 10, MaxBackups: 2}
+	defer rf.Close()
+
+	for _, line := range []string{"aaaaaa\n", "bbbbbb\n", "cccccc\n", "dddddd\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{
+		path:        "dddddd\n",
+		path + ".1": "cccccc\n",
+		path + ".2": "bbbbbb\n",
+	} {
+		b, err := os.ReadFile(name)
+		maybeFatal(t, err)
+		if string(b) != want {
+			t.Errorf("%s: %q != %q", name, b, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+
+	maybeFatal(t, rf.Rotate())
+	if _, err := rf.Write([]byte("e\n")); err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := os.ReadFile(path + ".1"); string(b) != "dddddd\n" {
+		t.Errorf("%q", b)
+	}
+}
@@ -0,0 +1,138 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+)
+
+var ErrForbidden = errors.New("forbidden")
+
+// DefaultDeniedPrefixes are the address ranges a SafeDialer refuses to connect to
+// if its Denied member is nil. It covers loopback, private, link-local,
+// shared, multicast and otherwise reserved ranges, along with the Teredo and 6to4
+// ranges which embed IPv4 addresses.
+var DefaultDeniedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("2001::/32"),
+	netip.MustParsePrefix("2002::/16"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// SafeDialer is a ContextDialer that resolves host names itself and refuses
+// to connect to denied addresses, returning an error wrapping ErrForbidden.
+//
+// Connections are made to the resolved IP addresses rather than the host name,
+// so DNS rebinding can't be used to reach a denied address. If ContextDialer connects
+// directly, the remote address of the resulting connection is checked again. Otherwise
+// only the destination is checked, so ContextDialer may connect through an upstream
+// proxy on a private network.
+type SafeDialer struct {
+	ContextDialer ContextDialer  // optional dialer to use, otherwise uses DefaultContextDialer
+	Resolver      Resolver       // optional resolver to use, otherwise uses DefaultResolver
+	Denied        []netip.Prefix // denied address ranges, if nil uses DefaultDeniedPrefixes
+	Allowed       []netip.Prefix // address ranges allowed even if they are in Denied
+}
+
+var _ ContextDialer = (*SafeDialer)(nil)
+
+// AllowedAddr returns true if addr may be connected to.
+func (sd *SafeDialer) AllowedAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, pfx := range sd.Allowed {
+		if pfx.Contains(addr) {
+			return true
+		}
+	}
+	denied := sd.Denied
+	if denied == nil {
+		denied = DefaultDeniedPrefixes
+	}
+	for _, pfx := range denied {
+		if pfx.Contains(addr) {
+			return false
+		}
+	}
+	return addr.IsValid()
+}
+
+func (sd *SafeDialer) lookup(ctx context.Context, network, host string) (addrs []netip.Addr, err error) {
+	if addr, perr := netip.ParseAddr(host); perr == nil {
+		return []netip.Addr{addr}, nil
+	}
+	r := DefaultResolver
+	if sd.Resolver != nil {
+		r = sd.Resolver
+	}
+	return r.LookupNetIP(ctx, lookupNetwork(network), host)
+}
+
+// connectsDirectly returns true if cd connects to the addresses it is given
+// rather than through a proxy.
+func connectsDirectly(cd ContextDialer) bool {
+	switch cd := cd.(type) {
+	case *net.Dialer:
+		return true
+	case *ResolvingDialer:
+		return cd.ContextDialer == nil || connectsDirectly(cd.ContextDialer)
+	}
+	return false
+}
+
+func (sd *SafeDialer) checkConn(conn net.Conn) (err error) {
+	if ap, perr := netip.ParseAddrPort(conn.RemoteAddr().String()); perr == nil {
+		if !sd.AllowedAddr(ap.Addr()) {
+			err = fmt.Errorf("%w: connected to %v", ErrForbidden, ap.Addr())
+		}
+	}
+	return
+}
+
+// DialContext resolves the host part of address and connects to the first
+// allowed address that accepts the connection.
+func (sd *SafeDialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	var host, port string
+	if host, port, err = net.SplitHostPort(address); err == nil {
+		var addrs []netip.Addr
+		if addrs, err = sd.lookup(ctx, network, host); err == nil {
+			cd := DefaultContextDialer
+			if sd.ContextDialer != nil {
+				cd = sd.ContextDialer
+			}
+			direct := connectsDirectly(cd)
+			err = fmt.Errorf("%w: %s", ErrForbidden, host)
+			for _, addr := range addrs {
+				if sd.AllowedAddr(addr) {
+					if conn, err = cd.DialContext(ctx, network, net.JoinHostPort(addr.Unmap().String(), port)); err == nil {
+						if !direct {
+							return
+						}
+						if err = sd.checkConn(conn); err == nil {
+							return
+						}
+						_ = conn.Close()
+						conn = nil
+					}
+				}
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,137 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+type staticDialerSelector struct {
+	ContextDialer
+}
+
+func (s staticDialerSelector) SelectDialer(username, network, address string) (cd ContextDialer, err error) {
+	return s.ContextDialer, nil
+}
+
+type staticResolver map[string][]netip.Addr
+
+func (s staticResolver) LookupNetIP(ctx context.Context, network, host string) (addrs []netip.Addr, err error) {
+	if addrs = s[host]; addrs == nil {
+		err = &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return
+}
+
+func TestSafeDialerAllowedAddr(t *testing.T) {
+	sd := &SafeDialer{}
+	for _, s := range []string{"127.0.0.1", "10.1.2.3", "169.254.169.254", "192.168.0.1", "172.16.5.4", "::1", "fe80::1", "::ffff:127.0.0.1", "0.0.0.0", "2002:7f00:1::1", "2001:0:4136:e378:8000:63bf:80ff:fffe"} {
+		if sd.AllowedAddr(netip.MustParseAddr(s)) {
+			t.Error(s)
+		}
+	}
+	for _, s := range []string{"1.1.1.1", "8.8.8.8", "2606:4700:4700::1111"} {
+		if !sd.AllowedAddr(netip.MustParseAddr(s)) {
+			t.Error(s)
+		}
+	}
+	sd.Allowed = []netip.Prefix{netip.MustParsePrefix("127.0.0.0/8")}
+	if !sd.AllowedAddr(netip.MustParseAddr("127.0.0.1")) {
+		t.Error("127.0.0.1 should be allowed")
+	}
+	sd.Denied = []netip.Prefix{}
+	if !sd.AllowedAddr(netip.MustParseAddr("10.1.2.3")) {
+		t.Error("10.1.2.3 should be allowed")
+	}
+}
+
+func TestSafeDialerDialContext(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	maybeFatal(t, err)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	sd := &SafeDialer{Resolver: staticResolver{
+		"rebind.example": {netip.MustParseAddr("127.0.0.1")},
+	}}
+	if _, err = sd.DialContext(t.Context(), "tcp", l.Addr().String()); !errors.Is(err, ErrForbidden) {
+		t.Error(err)
+	}
+	if _, err = sd.DialContext(t.Context(), "tcp", net.JoinHostPort("rebind.example", port)); !errors.Is(err, ErrForbidden) {
+		t.Error(err)
+	}
+	if _, err = sd.DialContext(t.Context(), "tcp", net.JoinHostPort("missing.example", port)); err == nil || errors.Is(err, ErrForbidden) {
+		t.Error(err)
+	}
+
+	sd.Allowed = []netip.Prefix{netip.MustParsePrefix("127.0.0.1/32")}
+	conn, err := sd.DialContext(t.Context(), "tcp", net.JoinHostPort("rebind.example", port))
+	maybeFatal(t, err)
+	maybeFatal(t, conn.Close())
+
+	// the destination is checked, not the address of an upstream proxy on a private network
+	sd = &SafeDialer{
+		ContextDialer: hangupDialer{l.Addr().String()},
+		Resolver:      staticResolver{"public.example": {netip.MustParseAddr("1.1.1.1")}},
+	}
+	conn, err = sd.DialContext(t.Context(), "tcp", "public.example:443")
+	maybeFatal(t, err)
+	maybeFatal(t, conn.Close())
+
+	// the remote address of direct connections is checked again
+	conn, err = net.Dial("tcp", l.Addr().String())
+	maybeFatal(t, err)
+	defer conn.Close()
+	if err = (&SafeDialer{}).checkConn(conn); !errors.Is(err, ErrForbidden) {
+		t.Error(err)
+	}
+	for cd, want := range map[ContextDialer]bool{
+		&net.Dialer{}:      true,
+		&ResolvingDialer{}: true,
+		&ResolvingDialer{ContextDialer: &net.Dialer{}}:  true,
+		&ResolvingDialer{ContextDialer: hangupDialer{}}: false,
+		hangupDialer{}:  false,
+		&SOCKS5Dialer{}: false,
+	} {
+		if got := connectsDirectly(cd); got != want {
+			t.Errorf("%T: got %v", cd, got)
+		}
+	}
+}
+
+func TestSafeDialerForbiddenResponse(t *testing.T) {
+	destsrv := makeHTTPDestSrv(t)
+	defer destsrv.Close()
+
+	proxysrv := httptest.NewServer(&Server{
+		DialerSelector:    staticDialerSelector{&SafeDialer{}},
+		ConnectPortPolicy: AnyConnectPort{},
+	})
+	defer proxysrv.Close()
+
+	resp, err := makeClient(t, proxysrv.URL).Get(destsrv.URL)
+	maybeFatal(t, err)
+	body, err := io.ReadAll(resp.Body)
+	maybeFatal(t, err)
+	maybeFatal(t, resp.Body.Close())
+	if resp.StatusCode != http.StatusForbidden {
+		t.Error(resp.StatusCode)
+	}
+	if !strings.Contains(string(body), ErrForbidden.Error()) {
+		t.Error(string(body))
+	}
+
+	resp, err = makeClient(t, proxysrv.URL).Get(strings.ReplaceAll(destsrv.URL, "http:", "https:"))
+	if resp != nil {
+		resp.Body.Close()
+	}
+	if err == nil || !strings.Contains(err.Error(), http.StatusText(http.StatusForbidden)) {
+		t.Error(err)
+	}
+}
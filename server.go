@@ -1,12 +1,16 @@
 package httpproxy
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
 	"net/url"
 	"slices"
+	"strconv"
 	"sync"
+	"time"
 )
 
 var MaxCachedRoundTrippers = 100
@@ -17,11 +21,32 @@ type Server struct {
 	Logger               Logger                               // optional logger to use
 	Handler              http.Handler                         // optional handler for requests that aren't proxy requests
 	DialerSelector       DialerSelector                       // optional handler to select ContextDialer per proxy request, otherwise uses DefaultContextDialer
+	RetryPolicy          *RetryPolicy                         // optional retries of failed CONNECT dials and requests, defaults to one attempt per ContextDialer selected
 	CredentialsValidator CredentialsValidator                 // optional credentials validator
 	RoundTripperMaker    RoundTripperMaker                    // optional RoundTripperMaker, defaults to DefaultMakeRoundTripper
+	ConnectPortPolicy    ConnectPortPolicy                    // optional CONNECT port policy, defaults to DefaultConnectPortPolicy allowing only 443, 563 and 8443 (earlier versions allowed any port, use AnyConnectPort{} for that)
+	HostFilter           HostFilter                           // optional filter blocking requests by destination host
+	BlockHandler         http.Handler                         // optional handler writing the response for blocked proxy requests
+	SNIInspector         *SNIInspector                        // optional TLS ClientHello inspection for CONNECT tunnels
+	UsageReporter        UsageReporter                        // optional receiver of usage for completed tunnels and requests
+	Quotas               *Quotas                              // optional data quotas per user or group
+	Throttle             *Throttle                            // optional bandwidth limits
+	Limits               *Limits                              // optional concurrent tunnel and request rate limits
+	TunnelIdleTimeout    time.Duration                        // optional time without data in either direction after which tunnels are closed
+	TunnelMaxDuration    time.Duration                        // optional maximum lifetime of tunnels
+	TunnelKeepAlive      time.Duration                        // optional TCP keep-alive period for both legs of tunnels, negative disables keep-alives
+	Metrics              *Metrics                             // optional metrics collector
+	AccessLog            *AccessLog                           // optional access log with one line per completed tunnel or request
+	Tracer               *Tracer                              // optional W3C trace context propagation and span export
+	ErrorPages           *ErrorPages                          // optional templates for error and block pages
+	Cache                *Cache                               // optional shared HTTP cache for proxied GET requests
 	mu                   sync.Mutex                           // protects following
 	counter              int64                                // counts ensureTripper calls
 	trippers             map[ContextDialer]*roundTripperCache // LRU cache mapping CD -> RT
+	sessions             map[uint64]*session                  // active tunnels and requests
+	lastSessionID        uint64                               // last session ID assigned
+	closed               bool                                 // true if Shutdown or Close has been called
+	wg                   sync.WaitGroup                       // counts active sessions
 }
 
 func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -36,6 +61,55 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Shutdown stops the Server from accepting new CONNECT tunnels and WebSocket relays
+// and waits for the active ones and any proxied requests to finish. If ctx is done before they have,
+// the remaining ones are closed and the context error is returned.
+// Idle connections of all cached RoundTrippers are closed.
+//
+// Shutdown does not affect the http.Server the Server is used with,
+// so call its Shutdown method as well.
+func (srv *Server) Shutdown(ctx context.Context) (err error) {
+	srv.mu.Lock()
+	srv.closed = true
+	srv.mu.Unlock()
+	done := make(chan struct{})
+	go func() {
+		srv.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		srv.closeSessions()
+		<-done
+	}
+	srv.closeIdleConnections()
+	return
+}
+
+// Close stops the Server from accepting new CONNECT tunnels and WebSocket relays,
+// closes the active ones, cancels proxied requests and closes idle connections of all cached RoundTrippers.
+func (srv *Server) Close() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_ = srv.Shutdown(ctx)
+	return nil
+}
+
+func (srv *Server) closeIdleConnections() {
+	type closeIdler interface {
+		CloseIdleConnections()
+	}
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	for _, rtc := range srv.trippers {
+		if ci, ok := rtc.RoundTripper.(closeIdler); ok {
+			ci.CloseIdleConnections()
+		}
+	}
+}
+
 // DefaultMakeRoundTripper clones http.DefaultTransport, sets
 // it's DialContext member and returns it.
 func DefaultMakeRoundTripper(cd ContextDialer) http.RoundTripper {
@@ -44,7 +118,7 @@ func DefaultMakeRoundTripper(cd ContextDialer) http.RoundTripper {
 	return tp
 }
 
-func (srv *Server) cleanTripperCacheLocked() {
+func (srv *Server) cleanTripperCacheLocked() (evicted int) {
 	type roundTripperCacheList struct {
 		ContextDialer
 		*roundTripperCache
@@ -57,20 +131,25 @@ func (srv *Server) cleanTripperCacheLocked() {
 	for i, rtcl := range trippers {
 		if i >= MaxCachedRoundTrippers/2 {
 			delete(srv.trippers, rtcl.ContextDialer)
+			evicted++
 		}
 	}
+	return
 }
 
 func (srv *Server) ensureTripper(cd ContextDialer) (rt http.RoundTripper) {
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 	var rtc *roundTripperCache
+	var evicted int
+	hit := true
 	if rtc = srv.trippers[cd]; rtc == nil {
+		hit = false
 		if srv.trippers == nil {
 			srv.trippers = make(map[ContextDialer]*roundTripperCache)
 		}
 		if len(srv.trippers) >= MaxCachedRoundTrippers {
-			srv.cleanTripperCacheLocked()
+			evicted = srv.cleanTripperCacheLocked()
 		}
 		rtm := DefaultMakeRoundTripper
 		if srv.RoundTripperMaker != nil {
@@ -82,9 +161,21 @@ func (srv *Server) ensureTripper(cd ContextDialer) (rt http.RoundTripper) {
 	}
 	srv.counter++
 	rtc.counter = srv.counter
+	srv.Metrics.tripperCache(len(srv.trippers), hit, evicted)
 	return rtc.RoundTripper
 }
 
+// dialerName returns a name for cd suitable for logging.
+func dialerName(cd ContextDialer) string {
+	if cd == DefaultContextDialer {
+		return "direct"
+	}
+	if s, ok := cd.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%T", cd)
+}
+
 func getAddress(u *url.URL) (address string) {
 	address = u.Host
 	if u.Port() == "" {
@@ -98,8 +189,7 @@ func getAddress(u *url.URL) (address string) {
 	return
 }
 
-func (srv *Server) getDialer(r *http.Request) (cd ContextDialer, address string, err error) {
-	var username string
+func (srv *Server) getDialer(r *http.Request) (cds []ContextDialer, address, username string, err error) {
 	address = getAddress(r.URL)
 	if srv.CredentialsValidator != nil {
 		var password string
@@ -109,20 +199,73 @@ func (srv *Server) getDialer(r *http.Request) (cd ContextDialer, address string,
 			}
 		}
 	}
+	if errors.Is(err, ErrUnauthorized) {
+		srv.Metrics.authFailure()
+	}
+	if err == nil && srv.Quotas != nil {
+		err = srv.Quotas.Check(username)
+	}
+	if err == nil && srv.HostFilter != nil && srv.HostFilter.BlockHost(username, r.URL.Hostname()) {
+		err = fmt.Errorf("%w: %s", ErrBlocked, r.URL.Hostname())
+	}
 	if err == nil {
-		cd = DefaultContextDialer
+		cds = []ContextDialer{DefaultContextDialer}
 		if srv.DialerSelector != nil {
-			cd, err = srv.DialerSelector.SelectDialer(username, "tcp", address)
+			if dls, ok := srv.DialerSelector.(DialerListSelector); ok {
+				if cds, err = dls.SelectDialers(username, "tcp", address); err == nil && len(cds) == 0 {
+					err = ErrNoDialer
+				}
+			} else {
+				var cd ContextDialer
+				cd, err = srv.DialerSelector.SelectDialer(username, "tcp", address)
+				cds = []ContextDialer{cd}
+			}
+			if errors.Is(err, ErrUnauthorized) {
+				srv.Metrics.authFailure()
+			}
 		}
 	}
 	return
 }
 
-func (srv *Server) getRoundTripper(r *http.Request) (rt http.RoundTripper) {
-	if cd, _, err := srv.getDialer(r); err == nil {
-		rt = srv.ensureTripper(cd)
+func (srv *Server) getRoundTripper(sess *session, r *http.Request) (rt http.RoundTripper) {
+	start := time.Now()
+	cds, _, username, err := srv.getDialer(r)
+	sess.trace.add("auth", start, err)
+	sess.setUsername(username)
+	if err == nil {
+		if len(cds) == 1 && srv.RetryPolicy == nil {
+			sess.setDialer(cds[0])
+			rt = srv.ensureTripper(cds[0])
+		} else {
+			rt = failoverRoundTripper{srv: srv, sess: sess, cds: cds}
+		}
 	} else {
 		rt = fakeRoundTripper{err: err}
 	}
 	return
 }
+
+func (srv *Server) getConnectPortPolicy() (cpp ConnectPortPolicy) {
+	if cpp = srv.ConnectPortPolicy; cpp == nil {
+		var ok bool
+		if cpp, ok = srv.DialerSelector.(ConnectPortPolicy); !ok {
+			if cpp, ok = srv.CredentialsValidator.(ConnectPortPolicy); !ok {
+				cpp = DefaultConnectPortPolicy
+			}
+		}
+	}
+	return
+}
+
+func (srv *Server) checkConnectPort(username, address string) (err error) {
+	var port string
+	if _, port, err = net.SplitHostPort(address); err != nil {
+		return fmt.Errorf("%w: CONNECT to %q without a port not allowed", ErrForbidden, address)
+	}
+	portnum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil || !srv.getConnectPortPolicy().AllowConnectPort(username, uint16(portnum)) {
+		err = fmt.Errorf("%w: CONNECT to port %q not allowed", ErrForbidden, port)
+	}
+	return
+}
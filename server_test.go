@@ -45,9 +45,12 @@ func TestMakeRoundTripper(t *testing.T) {
 		t.Error("ContentLength", resp.ContentLength, "len(body)", len(body))
 	}
 
-	if string(body) != "failMakeRoundTripper" {
+	if string(body) != http.StatusText(http.StatusInternalServerError) {
 		t.Error(string(body))
 	}
+	if ps := resp.Header.Get("Proxy-Status"); ps != "httpproxy; error=proxy_internal_error" {
+		t.Error(ps)
+	}
 }
 
 type failSelectDialer struct{}
@@ -81,9 +84,12 @@ func TestSelectDialer(t *testing.T) {
 		t.Error("ContentLength", resp.ContentLength, "len(body)", len(body))
 	}
 
-	if string(body) != "failSelectDialer" {
+	if string(body) != http.StatusText(http.StatusInternalServerError) {
 		t.Error(string(body))
 	}
+	if ps := resp.Header.Get("Proxy-Status"); ps != "httpproxy; error=proxy_internal_error" {
+		t.Error(ps)
+	}
 }
 
 type testContextDialer string
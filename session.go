@@ -0,0 +1,289 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrServerClosed = errors.New("server closed")
+
+// Kinds of connections reported in ConnInfo.
+const (
+	ConnKindConnect   = "connect"   // CONNECT tunnel
+	ConnKindWebSocket = "websocket" // WebSocket relay
+	ConnKindRequest   = "request"   // proxied HTTP request
+)
+
+// ConnInfo describes an active CONNECT tunnel, WebSocket relay or proxied request.
+type ConnInfo struct {
+	ID            uint64    `json:"id"`
+	Kind          string    `json:"kind"`                 // ConnKindConnect, ConnKindWebSocket or ConnKindRequest
+	Method        string    `json:"method"`               // HTTP method of the request
+	Username      string    `json:"username,omitempty"`   // empty if no authorization has taken place
+	Client        string    `json:"client"`               // client network address
+	Target        string    `json:"target"`               // target host and port
+	URL           string    `json:"url"`                  // request URL, or host and port for CONNECT
+	Proto         string    `json:"proto"`                // protocol version of the request
+	Referer       string    `json:"referer,omitempty"`    // Referer header of the request
+	UserAgent     string    `json:"user_agent,omitempty"` // User-Agent header of the request
+	Dialer        string    `json:"dialer,omitempty"`     // name of the ContextDialer used, empty if none
+	Attempts      int       `json:"attempts,omitempty"`   // number of dials or upstream requests attempted if failover was possible
+	Start         time.Time `json:"start"`
+	BytesSent     int64     `json:"bytes_sent"`     // bytes sent from the client to the target
+	BytesReceived int64     `json:"bytes_received"` // bytes received from the target by the client
+}
+
+// session is an active CONNECT tunnel, WebSocket relay or proxied request.
+type session struct {
+	srv          *Server
+	ctx          context.Context
+	cancel       context.CancelFunc
+	id           uint64
+	method       string
+	client       string
+	target       string
+	url          string
+	proto        string
+	referer      string
+	userAgent    string
+	start        time.Time
+	sent         atomic.Int64 // bytes sent from client to target
+	received     atomic.Int64 // bytes received from target by client
+	lastActivity atomic.Int64 // UnixNano of last data read in either direction
+	trace        *trace       // nil unless the Server has a Tracer
+	waited       bool         // true if Shutdown waits for the session
+	mu           sync.Mutex   // protects following
+	kind         string
+	username     string
+	dialer       string
+	attempts     int
+	closers      []io.Closer // closed when the session is closed
+	closed       bool        // true if close has been called
+	status       int         // HTTP status code sent to the client
+	err          error       // first error encountered
+}
+
+func (sess *session) setUsername(username string) {
+	sess.mu.Lock()
+	sess.username = username
+	sess.mu.Unlock()
+}
+
+// setDialer records the name of the ContextDialer used to reach the target.
+func (sess *session) setDialer(cd ContextDialer) {
+	name := dialerName(cd)
+	sess.mu.Lock()
+	sess.dialer = name
+	sess.mu.Unlock()
+}
+
+func (sess *session) setAttempts(n int) {
+	sess.mu.Lock()
+	sess.attempts = n
+	sess.mu.Unlock()
+}
+
+func (sess *session) getUsername() string {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return sess.username
+}
+
+// setStatus records the HTTP status code sent to the client, unless one is already recorded.
+func (sess *session) setStatus(code int) {
+	sess.mu.Lock()
+	if sess.status == 0 {
+		sess.status = code
+	}
+	sess.mu.Unlock()
+}
+
+// setErr records err as the outcome of the session, unless an error is already recorded.
+func (sess *session) setErr(err error) {
+	if err != nil {
+		sess.mu.Lock()
+		if sess.err == nil {
+			sess.err = err
+		}
+		sess.mu.Unlock()
+	}
+}
+
+func (sess *session) usage() (u Usage) {
+	u.ConnInfo = sess.info()
+	u.Duration = time.Since(sess.start)
+	sess.mu.Lock()
+	u.StatusCode = sess.status
+	u.Err = sess.err
+	sess.mu.Unlock()
+	return
+}
+
+func (sess *session) info() ConnInfo {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+	return ConnInfo{
+		ID:            sess.id,
+		Kind:          sess.kind,
+		Method:        sess.method,
+		Username:      sess.username,
+		Client:        sess.client,
+		Target:        sess.target,
+		URL:           sess.url,
+		Proto:         sess.proto,
+		Referer:       sess.referer,
+		UserAgent:     sess.userAgent,
+		Dialer:        sess.dialer,
+		Attempts:      sess.attempts,
+		Start:         sess.start,
+		BytesSent:     sess.sent.Load(),
+		BytesReceived: sess.received.Load(),
+	}
+}
+
+// reader returns src wrapped to account for data sent
+// from the client if sent is true, or received by it otherwise.
+func (sess *session) reader(src io.Reader, sent bool) (r io.Reader) {
+	n := &sess.received
+	if sent {
+		n = &sess.sent
+	}
+	r = countingReader{Reader: src, n: n}
+	if q := sess.srv.Quotas; q != nil {
+		r = quotaReader{Reader: r, sess: sess, q: q}
+	}
+	if th := sess.srv.Throttle; th != nil {
+		r = th.reader(sess, r)
+	}
+	if sess.srv.TunnelIdleTimeout > 0 {
+		r = idleReader{Reader: r, last: &sess.lastActivity}
+	}
+	return
+}
+
+// add registers c to be closed when the session is closed.
+func (sess *session) add(c io.Closer) {
+	sess.mu.Lock()
+	closed := sess.closed
+	if !closed {
+		sess.closers = append(sess.closers, c)
+	}
+	sess.mu.Unlock()
+	if closed {
+		_ = c.Close()
+	}
+}
+
+// close records cause as the session outcome if it is not nil,
+// cancels the session context and closes everything added to it.
+func (sess *session) close(cause error) {
+	sess.setErr(cause)
+	sess.cancel()
+	sess.mu.Lock()
+	closers := sess.closers
+	sess.closers = nil
+	sess.closed = true
+	sess.mu.Unlock()
+	for _, c := range closers {
+		_ = c.Close()
+	}
+}
+
+// addSession registers a new session for r. If kind is ConnKindRequest the
+// session context is canceled if r's is, otherwise the session is a tunnel
+// and it is refused with ErrServerClosed if the Server is shutting down.
+// Request sessions added while shutting down are not waited for by Shutdown.
+func (srv *Server) addSession(r *http.Request, kind string) (sess *session, err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if kind != ConnKindRequest && srv.closed {
+		return nil, ErrServerClosed
+	}
+	srv.lastSessionID++
+	sess = &session{
+		srv:       srv,
+		id:        srv.lastSessionID,
+		kind:      kind,
+		method:    r.Method,
+		client:    r.RemoteAddr,
+		target:    getAddress(r.URL),
+		url:       r.URL.String(),
+		proto:     r.Proto,
+		referer:   r.Referer(),
+		userAgent: r.UserAgent(),
+		start:     time.Now(),
+	}
+	if r.Method == http.MethodConnect {
+		sess.url = r.Host
+	}
+	sess.trace = srv.Tracer.start(r)
+	ctx := r.Context()
+	if kind != ConnKindRequest {
+		ctx = context.WithoutCancel(ctx)
+	}
+	sess.ctx, sess.cancel = context.WithCancel(ctx)
+	if srv.sessions == nil {
+		srv.sessions = make(map[uint64]*session)
+	}
+	srv.sessions[sess.id] = sess
+	if !srv.closed {
+		// Shutdown waits only after setting closed, so this can't race with it
+		sess.waited = true
+		srv.wg.Add(1)
+	}
+	if kind == ConnKindConnect {
+		srv.Metrics.connectAttempt()
+		srv.Metrics.tunnelOpened(kind)
+	}
+	return
+}
+
+// upgradeSession turns a request session into a WebSocket relay,
+// unless the Server is shutting down.
+func (srv *Server) upgradeSession(sess *session) (err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if err = ErrServerClosed; !srv.closed {
+		err = nil
+		sess.mu.Lock()
+		sess.kind = ConnKindWebSocket
+		sess.mu.Unlock()
+		srv.Metrics.tunnelOpened(ConnKindWebSocket)
+	}
+	return
+}
+
+// removeSession closes the session, reports its usage and unregisters it.
+func (srv *Server) removeSession(sess *session) {
+	sess.close(nil)
+	u := sess.usage()
+	srv.Metrics.completed(u)
+	srv.AccessLog.log(u)
+	srv.Tracer.finish(sess.trace, u)
+	if srv.UsageReporter != nil {
+		srv.UsageReporter.ReportUsage(u)
+	}
+	srv.mu.Lock()
+	delete(srv.sessions, sess.id)
+	srv.mu.Unlock()
+	if sess.waited {
+		srv.wg.Done()
+	}
+}
+
+func (srv *Server) closeSessions() {
+	srv.mu.Lock()
+	sessions := make([]*session, 0, len(srv.sessions))
+	for _, sess := range srv.sessions {
+		sessions = append(sessions, sess)
+	}
+	srv.mu.Unlock()
+	for _, sess := range sessions {
+		sess.close(ErrServerClosed)
+	}
+}
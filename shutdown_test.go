@@ -0,0 +1,145 @@
+package httpproxy
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// openTunnelAuth opens a CONNECT tunnel to target through proxyaddr,
+// authenticating as username with password "secret" if username is not empty.
+func openTunnelAuth(t *testing.T, proxyaddr, target, username string) (conn net.Conn, br *bufio.Reader, resp *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyaddr)
+	maybeFatal(t, err)
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req, err := http.NewRequest(http.MethodConnect, "", nil)
+	maybeFatal(t, err)
+	req.Host = target
+	if username != "" {
+		SetBasicAuth(req.Header, username, "secret")
+	}
+	maybeFatal(t, req.Write(conn))
+	br = bufio.NewReader(conn)
+	resp, err = http.ReadResponse(br, nil)
+	maybeFatal(t, err)
+	return
+}
+
+// openTunnel opens an anonymous CONNECT tunnel to target through proxyaddr.
+func openTunnel(t *testing.T, proxyaddr, target string) (conn net.Conn, br *bufio.Reader, resp *http.Response) {
+	t.Helper()
+	return openTunnelAuth(t, proxyaddr, target, "")
+}
+
+func TestShutdownWaitsForTunnels(t *testing.T) {
+	l := makeEchoListener(t, false)
+	defer l.Close()
+	srv := &Server{ConnectPortPolicy: AnyConnectPort{}}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	conn, _, resp := openTunnel(t, proxysrv.Listener.Addr().String(), l.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	time.AfterFunc(50*time.Millisecond, func() { conn.Close() })
+
+	ctx, cancel := context.WithTimeout(t.Context(), 10*time.Second)
+	defer cancel()
+	maybeFatal(t, srv.Shutdown(ctx))
+
+	_, _, resp = openTunnel(t, proxysrv.Listener.Addr().String(), l.Addr().String())
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Error(resp.Status)
+	}
+}
+
+func TestShutdownClosesTunnels(t *testing.T) {
+	l := makeEchoListener(t, false)
+	defer l.Close()
+	srv := &Server{ConnectPortPolicy: AnyConnectPort{}}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	conn, br, resp := openTunnel(t, proxysrv.Listener.Addr().String(), l.Addr().String())
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+
+	ctx, cancel := context.WithTimeout(t.Context(), 50*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Error(err)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Error(err)
+	}
+}
+
+func TestCloseWebSocketRelay(t *testing.T) {
+	l := makeEchoListener(t, true)
+	defer l.Close()
+	srv := &Server{}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	conn, err := net.Dial("tcp", proxysrv.Listener.Addr().String())
+	maybeFatal(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	target := l.Addr().String()
+	_, err = io.WriteString(conn, "GET http://"+target+"/ HTTP/1.1\r\nHost: "+target+
+		"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	maybeFatal(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	maybeFatal(t, err)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal(resp.Status)
+	}
+
+	maybeFatal(t, srv.Close())
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Error(err)
+	}
+}
+
+func TestShutdownRequestSessions(t *testing.T) {
+	srv := &Server{}
+	r := httptest.NewRequest(http.MethodGet, "http://www.example.com/", nil)
+	tunnel, err := srv.addSession(r, ConnKindConnect)
+	maybeFatal(t, err)
+	done := make(chan error)
+	go func() { done <- srv.Shutdown(context.Background()) }()
+	closed := func() bool {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return srv.closed
+	}
+	for !closed() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// requests keep being served while shutting down, without being waited for
+	if _, err = srv.addSession(r, ConnKindConnect); !errors.Is(err, ErrServerClosed) {
+		t.Error(err)
+	}
+	for range 100 {
+		sess, err := srv.addSession(r, ConnKindRequest)
+		maybeFatal(t, err)
+		srv.removeSession(sess)
+	}
+	sess, err := srv.addSession(r, ConnKindRequest)
+	maybeFatal(t, err)
+	srv.removeSession(tunnel)
+	maybeFatal(t, <-done)
+	srv.removeSession(sess)
+}
@@ -0,0 +1,129 @@
+package httpproxy
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+var ErrSNIMismatch = fmt.Errorf("%w: TLS server name does not match CONNECT host", ErrForbidden)
+var ErrNotTLS = fmt.Errorf("%w: tunnel did not start with a TLS ClientHello", ErrForbidden)
+
+var DefaultSNITimeout = 5 * time.Second
+
+var errClientHelloPeeked = errors.New("client hello peeked")
+
+// ClientHello holds the information peeked from a TLS ClientHello.
+type ClientHello struct {
+	ServerName string   // server name from the SNI extension, if any
+	ALPN       []string // application protocols offered by the client, if any
+}
+
+// A ClientHelloValidator may reject CONNECT tunnels based on the TLS ClientHello.
+type ClientHelloValidator interface {
+	// ValidateClientHello returns a non-nil error to close the tunnel.
+	// The tunnel is recorded as forbidden, with the error wrapped in ErrForbidden if needed.
+	//
+	// The hello is nil if the client didn't start with a TLS ClientHello.
+	ValidateClientHello(username, address string, hello *ClientHello) error
+}
+
+// SNIInspector peeks at the TLS ClientHello clients send after a successful
+// CONNECT, without decrypting anything. The peeked data is forwarded unaltered.
+//
+// If the Server has a HostFilter, it is also applied to the SNI server name.
+//
+// Relaying only starts once the ClientHello has been read, or Timeout has passed.
+// Tunnels for protocols where the server speaks first, such as SMTP, SSH or FTP,
+// are therefore delayed by Timeout. The DefaultConnectPortPolicy only allows
+// TLS ports, but if the ConnectPortPolicy allows such protocols, consider a shorter Timeout.
+type SNIInspector struct {
+	Timeout        time.Duration        // how long to wait for the ClientHello, defaults to DefaultSNITimeout
+	RejectMismatch bool                 // close tunnels where the SNI server name differs from the CONNECT host name
+	RequireTLS     bool                 // close tunnels that don't start with a TLS ClientHello
+	Validator      ClientHelloValidator // optional ClientHelloValidator
+}
+
+// peekConn makes a tls.Conn read from r and discards anything it writes.
+type peekConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (pc peekConn) Read(p []byte) (int, error) {
+	return pc.r.Read(p)
+}
+
+func (pc peekConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (pc peekConn) Close() error {
+	return nil
+}
+
+// peekClientHello reads a TLS ClientHello from conn, returning it (if any)
+// along with all data read from conn.
+func peekClientHello(conn net.Conn, timeout time.Duration) (hello *ClientHello, peeked []byte) {
+	var buf bytes.Buffer
+	_ = conn.SetReadDeadline(time.Now().Add(timeout))
+	defer conn.SetReadDeadline(time.Time{})
+	tlsconn := tls.Server(peekConn{Conn: conn, r: io.TeeReader(conn, &buf)}, &tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = &ClientHello{ServerName: chi.ServerName, ALPN: slices.Clone(chi.SupportedProtos)}
+			return nil, errClientHelloPeeked
+		},
+	})
+	_ = tlsconn.Handshake()
+	return hello, buf.Bytes()
+}
+
+func sniMismatch(hello *ClientHello, address string) bool {
+	if hello != nil && hello.ServerName != "" {
+		if host, _, err := net.SplitHostPort(address); err == nil {
+			if _, err = netip.ParseAddr(host); err != nil {
+				return normalizeHost(host) != normalizeHost(hello.ServerName)
+			}
+		}
+	}
+	return false
+}
+
+func (si *SNIInspector) check(srv *Server, username, address string, hello *ClientHello) (err error) {
+	switch {
+	case hello == nil && si.RequireTLS:
+		err = ErrNotTLS
+	case si.RejectMismatch && sniMismatch(hello, address):
+		err = fmt.Errorf("%w: %q != %q", ErrSNIMismatch, hello.ServerName, address)
+	case hello != nil && hello.ServerName != "" && srv.HostFilter != nil && srv.HostFilter.BlockHost(username, hello.ServerName):
+		err = fmt.Errorf("%w: %s", ErrBlocked, hello.ServerName)
+	case si.Validator != nil:
+		if err = si.Validator.ValidateClientHello(username, address, hello); err != nil && !errors.Is(err, ErrForbidden) {
+			err = fmt.Errorf("%w: %w", ErrForbidden, err)
+		}
+	}
+	return
+}
+
+// inspect peeks at the ClientHello from clientConn, checks it and
+// forwards the peeked data to target.
+func (si *SNIInspector) inspect(srv *Server, clientConn net.Conn, target io.Writer, username, address string) (err error) {
+	timeout := si.Timeout
+	if timeout <= 0 {
+		timeout = DefaultSNITimeout
+	}
+	hello, peeked := peekClientHello(clientConn, timeout)
+	if hello != nil && srv.Logger != nil {
+		srv.Logger.Debug("connect", "address", address, "sni", hello.ServerName, "alpn", hello.ALPN)
+	}
+	if err = si.check(srv, username, address, hello); err == nil {
+		_, err = target.Write(peeked)
+	}
+	return
+}
@@ -0,0 +1,205 @@
+package httpproxy
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testHostFilter map[string]bool
+
+func (thf testHostFilter) BlockHost(username, host string) bool {
+	return thf[host]
+}
+
+type recordingHelloValidator struct {
+	mu     sync.Mutex
+	hellos []*ClientHello
+}
+
+func (rhv *recordingHelloValidator) ValidateClientHello(username, address string, hello *ClientHello) error {
+	rhv.mu.Lock()
+	defer rhv.mu.Unlock()
+	rhv.hellos = append(rhv.hellos, hello)
+	if hello != nil && hello.ServerName == "denied.example" {
+		return errors.New("denied by validator")
+	}
+	return nil
+}
+
+func (rhv *recordingHelloValidator) last() *ClientHello {
+	rhv.mu.Lock()
+	defer rhv.mu.Unlock()
+	return rhv.hellos[len(rhv.hellos)-1]
+}
+
+// connectTLS opens a CONNECT tunnel to target through proxyaddr and
+// performs a TLS handshake using servername, then sends a HTTP GET.
+func connectTLS(t *testing.T, proxyaddr, target, servername string) (body string, err error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyaddr)
+	maybeFatal(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	maybeFatal(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	maybeFatal(t, err)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	tlsconn := tls.Client(conn, &tls.Config{
+		ServerName:         servername,
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"http/1.1"},
+	})
+	if err = tlsconn.Handshake(); err == nil {
+		req, _ := http.NewRequest(http.MethodGet, "https://"+target+"/", nil)
+		if err = req.Write(tlsconn); err == nil {
+			if resp, err = http.ReadResponse(bufio.NewReader(tlsconn), req); err == nil {
+				var b []byte
+				b, err = io.ReadAll(resp.Body)
+				body = string(b)
+			}
+		}
+	}
+	return
+}
+
+func TestSNIInspector(t *testing.T) {
+	destsrv := makeHTTPSDestSrv(t)
+	defer destsrv.Close()
+	_, port, _ := net.SplitHostPort(destsrv.Listener.Addr().String())
+
+	rhv := &recordingHelloValidator{}
+	srv := &Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		HostFilter:        testHostFilter{"blocked.example": true},
+		SNIInspector: &SNIInspector{
+			RejectMismatch: true,
+			Validator:      rhv,
+		},
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+	proxyaddr := proxysrv.Listener.Addr().String()
+
+	body, err := connectTLS(t, proxyaddr, destsrv.Listener.Addr().String(), "anything.example")
+	maybeFatal(t, err)
+	if body != string(testBody) {
+		t.Errorf("%q", body)
+	}
+	if hello := rhv.last(); hello == nil || hello.ServerName != "anything.example" || len(hello.ALPN) != 1 || hello.ALPN[0] != "http/1.1" {
+		t.Errorf("%#v", hello)
+	}
+
+	if body, err = connectTLS(t, proxyaddr, net.JoinHostPort("localhost", port), "localhost"); err != nil || body != string(testBody) {
+		t.Error(body, err)
+	}
+	if _, err = connectTLS(t, proxyaddr, net.JoinHostPort("localhost", port), "fronted.example"); err == nil {
+		t.Error("expected SNI mismatch to fail")
+	}
+	if _, err = connectTLS(t, proxyaddr, destsrv.Listener.Addr().String(), "blocked.example"); err == nil {
+		t.Error("expected blocked SNI to fail")
+	}
+	if _, err = connectTLS(t, proxyaddr, destsrv.Listener.Addr().String(), "denied.example"); err == nil {
+		t.Error("expected validator to deny")
+	}
+}
+
+// connectPlain opens a CONNECT tunnel to target through proxyaddr and sends a plain HTTP GET.
+func connectPlain(t *testing.T, proxyaddr, target string) (body string, err error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyaddr)
+	maybeFatal(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.WriteString(conn, "CONNECT "+target+" HTTP/1.1\r\nHost: "+target+"\r\n\r\n")
+	maybeFatal(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	maybeFatal(t, err)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	req, _ := http.NewRequest(http.MethodGet, "http://"+target+"/", nil)
+	if err = req.Write(conn); err == nil {
+		if resp, err = http.ReadResponse(br, req); err == nil {
+			var b []byte
+			b, err = io.ReadAll(resp.Body)
+			body = string(b)
+		}
+	}
+	return
+}
+
+func TestSNIInspectorRequireTLS(t *testing.T) {
+	destsrv := makeHTTPDestSrv(t)
+	defer destsrv.Close()
+
+	si := &SNIInspector{Timeout: time.Second}
+	srv := &Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		SNIInspector:      si,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+	proxyaddr := proxysrv.Listener.Addr().String()
+	target := destsrv.Listener.Addr().String()
+
+	body, err := connectPlain(t, proxyaddr, target)
+	maybeFatal(t, err)
+	if body != string(testBody) {
+		t.Errorf("%q", body)
+	}
+
+	si.RequireTLS = true
+	if body, err = connectPlain(t, proxyaddr, target); err == nil {
+		t.Errorf("expected error, got %q", body)
+	}
+}
+
+func TestSNIInspectorUsage(t *testing.T) {
+	destsrv := makeHTTPSDestSrv(t)
+	defer destsrv.Close()
+	_, port, _ := net.SplitHostPort(destsrv.Listener.Addr().String())
+
+	rur := newRecordingUsageReporter()
+	srv := &Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		HostFilter:        testHostFilter{"blocked.example": true},
+		SNIInspector: &SNIInspector{
+			RejectMismatch: true,
+			Validator:      &recordingHelloValidator{},
+		},
+		UsageReporter: rur,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+	proxyaddr := proxysrv.Listener.Addr().String()
+
+	for _, tt := range []struct {
+		target, servername string
+		want               error
+	}{
+		{net.JoinHostPort("localhost", port), "fronted.example", ErrSNIMismatch},
+		{destsrv.Listener.Addr().String(), "blocked.example", ErrBlocked},
+		{destsrv.Listener.Addr().String(), "denied.example", ErrForbidden},
+	} {
+		if _, err := connectTLS(t, proxyaddr, tt.target, tt.servername); err == nil {
+			t.Errorf("%s: expected error", tt.servername)
+		}
+		// the client got the 200 response before the tunnel was rejected
+		if u := rur.next(t); u.StatusCode != http.StatusOK || !errors.Is(u.Err, tt.want) || errorClass(u.Err) != errClassForbidden {
+			t.Errorf("%s: %v %v", tt.servername, u.StatusCode, u.Err)
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"syscall"
+)
+
+// SOCKS5Dialer is a ContextDialer that connects through an upstream SOCKS5 proxy (RFC 1928),
+// optionally authenticating with a username and password (RFC 1929).
+//
+// Host names are resolved by the proxy. Failures wrap ErrUpstreamProxy, and if the
+// proxy reports it, ErrForbidden, syscall.ENETUNREACH, syscall.EHOSTUNREACH or syscall.ECONNREFUSED.
+type SOCKS5Dialer struct {
+	Address       string        // host:port of the upstream proxy
+	Username      string        // optional username
+	Password      string        // optional password
+	ContextDialer ContextDialer // optional dialer used to reach the proxy, otherwise uses DefaultContextDialer
+}
+
+var _ ContextDialer = (*SOCKS5Dialer)(nil)
+
+const (
+	socks5Version        = 5
+	socks5NoAuth         = 0
+	socks5UserPass       = 2
+	socks5Connect        = 1
+	socks5AddrIPv4       = 1
+	socks5AddrDomain     = 3
+	socks5AddrIPv6       = 4
+	socks5UserPassVer    = 1
+	socks5ReplySucceeded = 0
+)
+
+var socks5Replies = []struct {
+	msg string
+	err error
+}{
+	1: {"general SOCKS server failure", nil},
+	2: {"connection not allowed by ruleset", ErrForbidden},
+	3: {"network unreachable", syscall.ENETUNREACH},
+	4: {"host unreachable", syscall.EHOSTUNREACH},
+	5: {"connection refused", syscall.ECONNREFUSED},
+	6: {"TTL expired", nil},
+	7: {"command not supported", nil},
+	8: {"address type not supported", nil},
+}
+
+func (sd *SOCKS5Dialer) String() string {
+	return "socks5://" + sd.Address
+}
+
+func (sd *SOCKS5Dialer) errorf(format string, args ...any) error {
+	return fmt.Errorf("%w: %s: %s", ErrUpstreamProxy, sd.Address, fmt.Sprintf(format, args...))
+}
+
+func (sd *SOCKS5Dialer) DialContext(ctx context.Context, network, address string) (conn net.Conn, err error) {
+	if conn, err = dialProxy(ctx, sd.ContextDialer, sd.Address); err == nil {
+		if err = proxyHandshake(ctx, conn, func() error { return sd.connect(conn, address) }); err != nil {
+			conn = nil
+		}
+	}
+	return
+}
+
+func (sd *SOCKS5Dialer) authenticate(conn net.Conn) (err error) {
+	methods := []byte{socks5Version, 1, socks5NoAuth}
+	if sd.Username != "" {
+		methods = []byte{socks5Version, 2, socks5NoAuth, socks5UserPass}
+	}
+	if _, err = conn.Write(methods); err == nil {
+		var reply [2]byte
+		if _, err = io.ReadFull(conn, reply[:]); err == nil {
+			switch {
+			case reply[0] != socks5Version:
+				err = sd.errorf("unexpected SOCKS version %d", reply[0])
+			case reply[1] == socks5NoAuth:
+			case reply[1] == socks5UserPass && sd.Username != "":
+				if len(sd.Username) > 255 || len(sd.Password) > 255 {
+					return sd.errorf("username or password too long")
+				}
+				req := append([]byte{socks5UserPassVer, byte(len(sd.Username))}, sd.Username...)
+				req = append(append(req, byte(len(sd.Password))), sd.Password...)
+				if _, err = conn.Write(req); err == nil {
+					if _, err = io.ReadFull(conn, reply[:]); err == nil && reply[1] != 0 {
+						err = sd.errorf("authentication failed")
+					}
+				}
+			default:
+				err = sd.errorf("no acceptable authentication method")
+			}
+		}
+	}
+	return
+}
+
+func (sd *SOCKS5Dialer) connect(conn net.Conn, address string) (err error) {
+	var host, portstr string
+	var port uint64
+	if host, portstr, err = net.SplitHostPort(address); err == nil {
+		if port, err = strconv.ParseUint(portstr, 10, 16); err == nil {
+			req := []byte{socks5Version, socks5Connect, 0}
+			if addr, perr := netip.ParseAddr(host); perr == nil {
+				if addr = addr.Unmap(); addr.Is4() {
+					req = append(req, socks5AddrIPv4)
+				} else {
+					req = append(req, socks5AddrIPv6)
+				}
+				req = append(req, addr.AsSlice()...)
+			} else if len(host) > 255 {
+				return sd.errorf("host name too long")
+			} else {
+				req = append(append(req, socks5AddrDomain, byte(len(host))), host...)
+			}
+			req = binary.BigEndian.AppendUint16(req, uint16(port))
+			if err = sd.authenticate(conn); err == nil {
+				if _, err = conn.Write(req); err == nil {
+					err = sd.readReply(conn)
+				}
+			}
+		}
+	}
+	return
+}
+
+func (sd *SOCKS5Dialer) readReply(conn net.Conn) (err error) {
+	var hdr [4]byte
+	if _, err = io.ReadFull(conn, hdr[:]); err == nil {
+		if hdr[0] != socks5Version {
+			return sd.errorf("unexpected SOCKS version %d", hdr[0])
+		}
+		if code := int(hdr[1]); code != socks5ReplySucceeded {
+			if code < len(socks5Replies) {
+				if reply := socks5Replies[code]; reply.err != nil {
+					return fmt.Errorf("%w: %s: %s: %w", ErrUpstreamProxy, sd.Address, reply.msg, reply.err)
+				}
+				return sd.errorf("%s", socks5Replies[code].msg)
+			}
+			return sd.errorf("unknown reply %d", code)
+		}
+		var n int
+		switch hdr[3] {
+		case socks5AddrIPv4:
+			n = 4
+		case socks5AddrIPv6:
+			n = 16
+		case socks5AddrDomain:
+			var l [1]byte
+			if _, err = io.ReadFull(conn, l[:]); err != nil {
+				return
+			}
+			n = int(l[0])
+		default:
+			return sd.errorf("unknown address type %d", hdr[3])
+		}
+		_, err = io.ReadFull(conn, make([]byte, n+2))
+	}
+	return
+}
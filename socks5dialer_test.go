@@ -0,0 +1,143 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// makeSOCKS5Server returns a minimal SOCKS5 server requiring the given credentials if username is set,
+// replying with reply to CONNECT requests for other than the zero reply.
+func makeSOCKS5Server(t *testing.T, username, password string, reply byte) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	maybeFatal(t, err)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				hdr := make([]byte, 2)
+				if _, err := io.ReadFull(conn, hdr); err != nil {
+					return
+				}
+				methods := make([]byte, hdr[1])
+				if _, err := io.ReadFull(conn, methods); err != nil {
+					return
+				}
+				if username == "" {
+					_, _ = conn.Write([]byte{5, 0})
+				} else {
+					_, _ = conn.Write([]byte{5, 2})
+					b := make([]byte, 2)
+					_, _ = io.ReadFull(conn, b)
+					user := make([]byte, b[1])
+					_, _ = io.ReadFull(conn, user)
+					_, _ = io.ReadFull(conn, b[:1])
+					pass := make([]byte, b[0])
+					_, _ = io.ReadFull(conn, pass)
+					if string(user) != username || string(pass) != password {
+						_, _ = conn.Write([]byte{1, 1})
+						return
+					}
+					_, _ = conn.Write([]byte{1, 0})
+				}
+				req := make([]byte, 4)
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				var host string
+				switch req[3] {
+				case 1, 4:
+					addr := make([]byte, 4+12*int(req[3]/4))
+					_, _ = io.ReadFull(conn, addr)
+					host = net.IP(addr).String()
+				case 3:
+					n := make([]byte, 1)
+					_, _ = io.ReadFull(conn, n)
+					name := make([]byte, n[0])
+					_, _ = io.ReadFull(conn, name)
+					host = string(name)
+				}
+				port := make([]byte, 2)
+				_, _ = io.ReadFull(conn, port)
+				if reply != 0 {
+					_, _ = conn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port)))))
+				if err != nil {
+					_, _ = conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				_, _ = conn.Write([]byte{5, 0, 0, 3, 4, 't', 'e', 's', 't', 0, 0})
+				go func() { _, _ = io.Copy(target, conn) }()
+				_, _ = io.Copy(conn, target)
+			}()
+		}
+	}()
+	t.Cleanup(func() { _ = l.Close() })
+	return l
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	echo := makeEchoListener(t, false)
+	defer echo.Close()
+	_, port, _ := net.SplitHostPort(echo.Addr().String())
+
+	socks := makeSOCKS5Server(t, "", "", 0)
+	sd := &SOCKS5Dialer{Address: socks.Addr().String()}
+	conn, err := sd.DialContext(context.Background(), "tcp", echo.Addr().String())
+	maybeFatal(t, err)
+	checkEcho(t, conn)
+	conn, err = sd.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	maybeFatal(t, err)
+	checkEcho(t, conn)
+
+	socks = makeSOCKS5Server(t, "user", "pass", 0)
+	sd = &SOCKS5Dialer{Address: socks.Addr().String(), Username: "user", Password: "pass"}
+	conn, err = sd.DialContext(context.Background(), "tcp", echo.Addr().String())
+	maybeFatal(t, err)
+	checkEcho(t, conn)
+	sd.Password = "wrong"
+	if _, err = sd.DialContext(context.Background(), "tcp", echo.Addr().String()); !errors.Is(err, ErrUpstreamProxy) {
+		t.Error(err)
+	}
+	sd.Username = ""
+	if _, err = sd.DialContext(context.Background(), "tcp", echo.Addr().String()); !errors.Is(err, ErrUpstreamProxy) {
+		t.Error(err)
+	}
+	if s := sd.String(); s != "socks5://"+sd.Address {
+		t.Error(s)
+	}
+}
+
+func TestSOCKS5DialerReplies(t *testing.T) {
+	tests := []struct {
+		reply byte
+		want  error
+	}{
+		{1, ErrUpstreamProxy},
+		{2, ErrForbidden},
+		{3, syscall.ENETUNREACH},
+		{4, syscall.EHOSTUNREACH},
+		{5, syscall.ECONNREFUSED},
+		{42, ErrUpstreamProxy},
+	}
+	for _, tt := range tests {
+		socks := makeSOCKS5Server(t, "", "", tt.reply)
+		sd := &SOCKS5Dialer{Address: socks.Addr().String()}
+		if _, err := sd.DialContext(context.Background(), "tcp", "www.example.com:443"); !errors.Is(err, tt.want) || !errors.Is(err, ErrUpstreamProxy) {
+			t.Error(tt.reply, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// maxThrottleChunk is the largest read a throttled reader makes at once,
+// so that concurrent connections sharing a limit take turns.
+const maxThrottleChunk = 16 * 1024
+
+// maxThrottleBuckets is the number of per-user or per-host buckets kept
+// before full (idle) buckets are discarded.
+const maxThrottleBuckets = 1000
+
+// Bandwidth is a rate limit in bytes per second.
+type Bandwidth struct {
+	Rate  int64 // bytes per second, zero means unlimited
+	Burst int64 // maximum burst in bytes, defaults to Rate
+}
+
+// tokenBucket hands out tokens in order of request, so waiters are served fairly.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bw Bandwidth) *tokenBucket {
+	burst := bw.Burst
+	if burst <= 0 {
+		burst = bw.Rate
+	}
+	return &tokenBucket{rate: float64(bw.Rate), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (tb *tokenBucket) refillLocked(now time.Time) {
+	tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+}
+
+// full returns true if the bucket has been idle long enough to be refilled.
+func (tb *tokenBucket) full() bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refillLocked(time.Now())
+	return tb.tokens >= tb.burst
+}
+
+// reserve takes n tokens and returns how long to wait before using them.
+func (tb *tokenBucket) reserve(n int) (delay time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refillLocked(time.Now())
+	tb.tokens -= float64(n)
+	if tb.tokens < 0 {
+		delay = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	return
+}
+
+// take takes n tokens if they are available, otherwise it returns
+// false and how long it would take until they are.
+func (tb *tokenBucket) take(n int) (ok bool, retryAfter time.Duration) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.refillLocked(time.Now())
+	if ok = tb.tokens >= float64(n); ok {
+		tb.tokens -= float64(n)
+	} else {
+		retryAfter = time.Duration((float64(n) - tb.tokens) / tb.rate * float64(time.Second))
+	}
+	return
+}
+
+// Throttle limits the bandwidth used by CONNECT tunnels, WebSocket relays and
+// proxied request and response bodies. Data in both directions counts towards the limits.
+//
+// Connections sharing a limit are served in turn, so concurrent connections
+// of a user get a fair share of that user's bandwidth.
+type Throttle struct {
+	Global  Bandwidth            // limit shared by all connections
+	PerUser Bandwidth            // limit per username (anonymous usage shares one)
+	Users   map[string]Bandwidth // optional limits for specific users, overriding PerUser
+	PerHost Bandwidth            // limit per destination host
+	Hosts   map[string]Bandwidth // optional limits for specific destination hosts, overriding PerHost
+	mu      sync.Mutex           // protects following
+	global  *tokenBucket
+	users   map[string]*tokenBucket
+	hosts   map[string]*tokenBucket
+}
+
+func getTokenBucket(m map[string]*tokenBucket, key string, bw Bandwidth) (tb *tokenBucket) {
+	if tb = m[key]; tb == nil && bw.Rate > 0 {
+		if len(m) >= maxThrottleBuckets {
+			for k, v := range m {
+				if v.full() {
+					delete(m, k)
+				}
+			}
+		}
+		tb = newTokenBucket(bw)
+		m[key] = tb
+	}
+	return
+}
+
+// buckets returns the token buckets that apply to username and host.
+func (th *Throttle) buckets(username, host string) (tbs []*tokenBucket) {
+	th.mu.Lock()
+	defer th.mu.Unlock()
+	if th.global == nil && th.Global.Rate > 0 {
+		th.global = newTokenBucket(th.Global)
+	}
+	if th.users == nil {
+		th.users = make(map[string]*tokenBucket)
+		th.hosts = make(map[string]*tokenBucket)
+	}
+	userbw, ok := th.Users[username]
+	if !ok {
+		userbw = th.PerUser
+	}
+	host = normalizeHost(host)
+	hostbw, ok := th.Hosts[host]
+	if !ok {
+		hostbw = th.PerHost
+	}
+	for _, tb := range []*tokenBucket{th.global, getTokenBucket(th.users, username, userbw), getTokenBucket(th.hosts, host, hostbw)} {
+		if tb != nil {
+			tbs = append(tbs, tb)
+		}
+	}
+	return
+}
+
+// throttledReader waits for tokens from all buckets for the data it reads.
+type throttledReader struct {
+	io.Reader
+	ctx     context.Context
+	buckets []*tokenBucket
+}
+
+func (tr throttledReader) Read(p []byte) (n int, err error) {
+	if len(p) > maxThrottleChunk {
+		p = p[:maxThrottleChunk]
+	}
+	if n, err = tr.Reader.Read(p); n > 0 {
+		var delay time.Duration
+		for _, tb := range tr.buckets {
+			delay = max(delay, tb.reserve(n))
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			defer timer.Stop()
+			select {
+			case <-timer.C:
+			case <-tr.ctx.Done():
+				err = tr.ctx.Err()
+			}
+		}
+	}
+	return
+}
+
+// reader wraps r to be throttled for the session, if any limits apply.
+func (th *Throttle) reader(sess *session, r io.Reader) io.Reader {
+	host, _, err := net.SplitHostPort(sess.target)
+	if err != nil {
+		host = sess.target
+	}
+	if buckets := th.buckets(sess.getUsername(), host); len(buckets) > 0 {
+		r = throttledReader{Reader: r, ctx: sess.ctx, buckets: buckets}
+	}
+	return r
+}
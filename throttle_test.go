@@ -0,0 +1,95 @@
+package httpproxy
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := newTokenBucket(Bandwidth{Rate: 1000, Burst: 100})
+	if d := tb.reserve(100); d != 0 {
+		t.Error(d)
+	}
+	if d := tb.reserve(100); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Error(d)
+	}
+	if d := tb.reserve(100); d < 190*time.Millisecond || d > 200*time.Millisecond {
+		t.Error(d)
+	}
+	if tb.full() {
+		t.Error("bucket should not be full")
+	}
+}
+
+func TestThrottleBuckets(t *testing.T) {
+	th := &Throttle{
+		Global:  Bandwidth{Rate: 1000},
+		PerUser: Bandwidth{Rate: 100},
+		Users:   map[string]Bandwidth{"vip": {}},
+		Hosts:   map[string]Bandwidth{"slow.example": {Rate: 10}},
+	}
+	if n := len(th.buckets("alice", "fast.example")); n != 2 {
+		t.Error(n)
+	}
+	if n := len(th.buckets("vip", "fast.example")); n != 1 {
+		t.Error(n)
+	}
+	if n := len(th.buckets("vip", "SLOW.example.")); n != 2 {
+		t.Error(n)
+	}
+	a1 := th.buckets("alice", "")
+	a2 := th.buckets("alice", "")
+	b := th.buckets("bob", "")
+	if a1[1] != a2[1] || a1[1] == b[1] || a1[0] != b[0] {
+		t.Error("buckets not shared as expected")
+	}
+}
+
+func TestThrottleServer(t *testing.T) {
+	const size = 20000
+	l := makeEchoListener(t, false)
+	defer l.Close()
+	srv := &Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		Throttle: &Throttle{
+			PerUser: Bandwidth{Rate: 100000, Burst: 10000},
+		},
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	// two concurrent tunnels for the same (anonymous) user share the bandwidth
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, br, resp := openTunnel(t, proxysrv.Listener.Addr().String(), l.Addr().String())
+			defer conn.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Error(resp.Status)
+				return
+			}
+			payload := strings.Repeat("x", size)
+			go io.WriteString(conn, payload)
+			got := make([]byte, size)
+			if _, err := io.ReadFull(br, got); err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(got, []byte(payload)) {
+				t.Error("payload mismatch")
+			}
+		}()
+	}
+	wg.Wait()
+	// 2 tunnels * 2 directions * size bytes, less the burst, at 100000 bytes per second
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond {
+		t.Error(elapsed)
+	}
+}
@@ -0,0 +1,82 @@
+package httpproxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+var ErrTunnelIdle = errors.New("tunnel idle timeout")
+var ErrTunnelMaxDuration = errors.New("tunnel maximum duration exceeded")
+
+// idleReader records the time of the last successful read.
+type idleReader struct {
+	io.Reader
+	last *atomic.Int64
+}
+
+func (ir idleReader) Read(p []byte) (n int, err error) {
+	if n, err = ir.Reader.Read(p); n > 0 {
+		ir.last.Store(time.Now().UnixNano())
+	}
+	return
+}
+
+// watchIdle closes the session once no data has been read in either direction for timeout.
+func (sess *session) watchIdle(timeout time.Duration) {
+	sess.lastActivity.Store(time.Now().UnixNano())
+	go func() {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			select {
+			case <-sess.ctx.Done():
+				return
+			case <-timer.C:
+				idle := time.Since(time.Unix(0, sess.lastActivity.Load()))
+				if idle >= timeout {
+					sess.close(ErrTunnelIdle)
+					return
+				}
+				timer.Reset(timeout - idle)
+			}
+		}
+	}()
+}
+
+// watchTunnel applies the Server's tunnel timeouts and keep-alive settings to sess.
+func (srv *Server) watchTunnel(sess *session, conns ...any) {
+	if srv.TunnelKeepAlive != 0 {
+		for _, c := range conns {
+			setKeepAlive(c, srv.TunnelKeepAlive)
+		}
+	}
+	if srv.TunnelIdleTimeout > 0 {
+		sess.watchIdle(srv.TunnelIdleTimeout)
+	}
+	if srv.TunnelMaxDuration > 0 {
+		timer := time.AfterFunc(srv.TunnelMaxDuration, func() { sess.close(ErrTunnelMaxDuration) })
+		sess.add(releaser(func() { timer.Stop() }))
+	}
+}
+
+// setKeepAlive enables TCP keep-alives with the given period on c if
+// it (or the connection underlying it) supports it. A negative period disables them.
+func setKeepAlive(c any, period time.Duration) {
+	type keepAliver interface {
+		SetKeepAlive(keepalive bool) error
+		SetKeepAlivePeriod(d time.Duration) error
+	}
+	switch v := c.(type) {
+	case *hijackedConn:
+		setKeepAlive(v.Conn, period)
+	case *tls.Conn:
+		setKeepAlive(v.NetConn(), period)
+	case keepAliver:
+		if err := v.SetKeepAlive(period > 0); err == nil && period > 0 {
+			_ = v.SetKeepAlivePeriod(period)
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package httpproxy
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTunnelIdleTimeout(t *testing.T) {
+	l := makeEchoListener(t, false)
+	defer l.Close()
+	rur := newRecordingUsageReporter()
+	srv := &Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		TunnelIdleTimeout: 200 * time.Millisecond,
+		TunnelKeepAlive:   time.Minute,
+		UsageReporter:     rur,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	conn, br, resp := openTunnel(t, proxysrv.Listener.Addr().String(), l.Addr().String())
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	start := time.Now()
+	for range 5 {
+		time.Sleep(100 * time.Millisecond)
+		_, err := io.WriteString(conn, "x")
+		maybeFatal(t, err)
+		readEchoed(t, br, "x")
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Error(err)
+	}
+	if elapsed := time.Since(start); elapsed < 700*time.Millisecond {
+		t.Error(elapsed)
+	}
+	if u := rur.next(t); !errors.Is(u.Err, ErrTunnelIdle) {
+		t.Errorf("%#v", u)
+	}
+}
+
+func TestTunnelMaxDuration(t *testing.T) {
+	l := makeEchoListener(t, false)
+	defer l.Close()
+	rur := newRecordingUsageReporter()
+	srv := &Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		TunnelIdleTimeout: time.Minute,
+		TunnelMaxDuration: 300 * time.Millisecond,
+		TunnelKeepAlive:   -1,
+		UsageReporter:     rur,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	conn, br, resp := openTunnel(t, proxysrv.Listener.Addr().String(), l.Addr().String())
+	defer conn.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	go func() {
+		for {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := io.WriteString(conn, "x"); err != nil {
+				return
+			}
+		}
+	}()
+	if _, err := io.Copy(io.Discard, br); err != nil {
+		t.Error(err)
+	}
+	if u := rur.next(t); !errors.Is(u.Err, ErrTunnelMaxDuration) {
+		t.Errorf("%#v", u)
+	}
+}
+
+func TestWebSocketIdleTimeout(t *testing.T) {
+	l := makeEchoListener(t, true)
+	defer l.Close()
+	srv := &Server{TunnelIdleTimeout: 100 * time.Millisecond}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	conn, err := net.Dial("tcp", proxysrv.Listener.Addr().String())
+	maybeFatal(t, err)
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	target := l.Addr().String()
+	_, err = io.WriteString(conn, "GET http://"+target+"/ HTTP/1.1\r\nHost: "+target+
+		"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	maybeFatal(t, err)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	maybeFatal(t, err)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal(resp.Status)
+	}
+	if _, err := br.ReadByte(); err != io.EOF {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,280 @@
+package httpproxy
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultTraceQueueSize is the number of completed traces a Tracer buffers for export.
+var DefaultTraceQueueSize = 1000
+
+// DefaultTraceExportTimeout limits the time a single SpanExporter.ExportSpans call may take.
+var DefaultTraceExportTimeout = 10 * time.Second
+
+// TraceID is a W3C trace context trace-id.
+type TraceID [16]byte
+
+// SpanID is a W3C trace context parent-id.
+type SpanID [8]byte
+
+func (id TraceID) String() string { return hex.EncodeToString(id[:]) }
+func (id SpanID) String() string  { return hex.EncodeToString(id[:]) }
+func (id TraceID) IsValid() bool  { return id != TraceID{} }
+func (id SpanID) IsValid() bool   { return id != SpanID{} }
+
+// Span is a completed operation within a trace.
+type Span struct {
+	TraceID    TraceID
+	SpanID     SpanID
+	ParentID   SpanID // zero for a root span without a remote parent
+	TraceState string // W3C tracestate, set on the root span
+	Name       string
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]any // values are strings, bools, ints or floats
+	Err        error          // nil if the operation succeeded
+}
+
+// A SpanExporter sends completed spans to a tracing backend.
+type SpanExporter interface {
+	// ExportSpans is called with all spans of a completed tunnel or request.
+	ExportSpans(ctx context.Context, spans []Span) error
+}
+
+// Tracer creates a trace for every CONNECT tunnel, WebSocket relay and proxied request,
+// continuing the one given in the request's traceparent header if any, and forwards
+// the trace context upstream on proxied requests.
+//
+// Spans are recorded for authorization, dialing, TLS handshakes, time to first
+// response byte and data transfer, and queued for export when the trace is sampled.
+// If the queue is full, spans are dropped.
+type Tracer struct {
+	Exporter  SpanExporter  // receives completed spans
+	Logger    Logger        // optional logger for export errors
+	QueueSize int           // optional export queue size, defaults to DefaultTraceQueueSize
+	Timeout   time.Duration // optional export timeout, defaults to DefaultTraceExportTimeout
+	mu        sync.Mutex    // protects following
+	queue     chan []Span
+	done      chan struct{}
+	closed    bool
+}
+
+func newSpanID() (id SpanID) {
+	for !id.IsValid() {
+		u := rand.Uint64()
+		for i := range id {
+			id[i] = byte(u >> (8 * i))
+		}
+	}
+	return
+}
+
+func newTraceID() (id TraceID) {
+	for !id.IsValid() {
+		u1, u2 := rand.Uint64(), rand.Uint64()
+		for i := range 8 {
+			id[i] = byte(u1 >> (8 * i))
+			id[i+8] = byte(u2 >> (8 * i))
+		}
+	}
+	return
+}
+
+func parseHexID(dst []byte, s string) bool {
+	if strings.ToLower(s) != s {
+		return false
+	}
+	n, err := hex.Decode(dst, []byte(s))
+	return err == nil && n == len(dst)
+}
+
+// parseTraceparent parses a W3C traceparent header value.
+func parseTraceparent(s string) (traceID TraceID, parentID SpanID, flags byte, ok bool) {
+	if len(s) < 55 || s[2] != '-' || s[35] != '-' || s[52] != '-' {
+		return
+	}
+	var version, fl [1]byte
+	if !parseHexID(version[:], s[0:2]) || version[0] == 0xff {
+		return
+	}
+	if len(s) > 55 && (version[0] == 0 || s[55] != '-') {
+		return
+	}
+	if parseHexID(traceID[:], s[3:35]) && parseHexID(parentID[:], s[36:52]) && parseHexID(fl[:], s[53:55]) {
+		flags = fl[0]
+		ok = traceID.IsValid() && parentID.IsValid()
+	}
+	return
+}
+
+// trace holds the trace context and child spans of a session.
+type trace struct {
+	traceID  TraceID
+	spanID   SpanID // root span of the session
+	parentID SpanID // remote parent, zero if none
+	flags    byte
+	state    string
+	mu       sync.Mutex // protects following
+	spans    []Span
+}
+
+func (t *trace) sampled() bool {
+	return t.flags&1 != 0
+}
+
+func (t *trace) traceparent() string {
+	return fmt.Sprintf("00-%s-%s-%02x", t.traceID, t.spanID, t.flags)
+}
+
+// inject sets the trace context headers for an upstream request.
+func (t *trace) inject(hdr http.Header) {
+	if t != nil {
+		hdr.Set("Traceparent", t.traceparent())
+		hdr.Del("Tracestate")
+		if t.state != "" {
+			hdr.Set("Tracestate", t.state)
+		}
+	}
+}
+
+// add records a child span of the session's root span.
+func (t *trace) add(name string, start time.Time, err error, keyValuePairs ...any) {
+	if t != nil {
+		span := Span{
+			TraceID:  t.traceID,
+			SpanID:   newSpanID(),
+			ParentID: t.spanID,
+			Name:     name,
+			Start:    start,
+			End:      time.Now(),
+			Err:      err,
+		}
+		for i := 0; i+1 < len(keyValuePairs); i += 2 {
+			if span.Attributes == nil {
+				span.Attributes = make(map[string]any)
+			}
+			span.Attributes[fmt.Sprint(keyValuePairs[i])] = keyValuePairs[i+1]
+		}
+		t.mu.Lock()
+		t.spans = append(t.spans, span)
+		t.mu.Unlock()
+	}
+}
+
+// start returns the trace for a new session for r, or nil if tr is nil.
+func (tr *Tracer) start(r *http.Request) (t *trace) {
+	if tr != nil {
+		t = &trace{spanID: newSpanID()}
+		if traceID, parentID, flags, ok := parseTraceparent(r.Header.Get("Traceparent")); ok {
+			t.traceID = traceID
+			t.parentID = parentID
+			t.flags = flags
+			t.state = strings.Join(r.Header.Values("Tracestate"), ",")
+		} else {
+			t.traceID = newTraceID()
+			t.flags = 1
+		}
+	}
+	return
+}
+
+// finish records the root span of t using u and queues the trace for export if it is sampled.
+func (tr *Tracer) finish(t *trace, u Usage) {
+	if tr != nil && t != nil && t.sampled() {
+		name := u.Method
+		if u.Kind != ConnKindRequest {
+			name += " " + u.Kind
+		}
+		root := Span{
+			TraceID:    t.traceID,
+			SpanID:     t.spanID,
+			ParentID:   t.parentID,
+			TraceState: t.state,
+			Name:       name,
+			Start:      u.Start,
+			End:        u.Start.Add(u.Duration),
+			Err:        u.Err,
+			Attributes: map[string]any{
+				"http.request.method":  u.Method,
+				"url.full":             u.URL,
+				"client.address":       u.Client,
+				"server.address":       u.Target,
+				"proxy.kind":           u.Kind,
+				"proxy.bytes_sent":     u.BytesSent,
+				"proxy.bytes_received": u.BytesReceived,
+			},
+		}
+		if u.StatusCode != 0 {
+			root.Attributes["http.response.status_code"] = u.StatusCode
+		}
+		if u.Username != "" {
+			root.Attributes["enduser.id"] = u.Username
+		}
+		if u.Dialer != "" {
+			root.Attributes["proxy.dialer"] = u.Dialer
+		}
+		t.mu.Lock()
+		spans := append([]Span{root}, t.spans...)
+		t.mu.Unlock()
+		tr.enqueue(spans)
+	}
+}
+
+func (tr *Tracer) enqueue(spans []Span) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	if !tr.closed {
+		if tr.queue == nil {
+			size := tr.QueueSize
+			if size <= 0 {
+				size = DefaultTraceQueueSize
+			}
+			tr.queue = make(chan []Span, size)
+			tr.done = make(chan struct{})
+			go tr.run(tr.queue, tr.done)
+		}
+		select {
+		case tr.queue <- spans:
+		default:
+			if tr.Logger != nil {
+				tr.Logger.Warn("tracer", "dropped", len(spans))
+			}
+		}
+	}
+}
+
+func (tr *Tracer) run(queue <-chan []Span, done chan<- struct{}) {
+	defer close(done)
+	timeout := tr.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTraceExportTimeout
+	}
+	for spans := range queue {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		if err := tr.Exporter.ExportSpans(ctx, spans); err != nil && tr.Logger != nil {
+			tr.Logger.Error("tracer", "error", err)
+		}
+		cancel()
+	}
+}
+
+// Close exports any queued spans and stops the Tracer. Spans completed after Close are dropped.
+func (tr *Tracer) Close() error {
+	tr.mu.Lock()
+	queue, done := tr.queue, tr.done
+	if !tr.closed && queue != nil {
+		close(queue)
+	}
+	tr.closed = true
+	tr.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+	return nil
+}
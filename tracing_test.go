@@ -0,0 +1,169 @@
+package httpproxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type recordingSpanExporter chan []Span
+
+func (rse recordingSpanExporter) ExportSpans(ctx context.Context, spans []Span) error {
+	rse <- spans
+	return nil
+}
+
+func (rse recordingSpanExporter) next(t *testing.T) (spans map[string]Span) {
+	t.Helper()
+	select {
+	case exported := <-rse:
+		spans = make(map[string]Span)
+		for i, span := range exported {
+			if i == 0 {
+				spans["root"] = span
+			} else {
+				spans[span.Name] = span
+			}
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for spans")
+	}
+	return
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for s, want := range map[string]bool{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":     true,
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00-zzz": true,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-zzz": false,
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":     false,
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":     false,
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":     false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":     false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":        false,
+		"00-4bf92f3577b34da6a3ce929d0e0e4736x00f067aa0ba902b7-01":     false,
+		"00-4bf92f3577b34da6a3ce929d0e0e473g-00f067aa0ba902b7-01":     false,
+		"": false,
+	} {
+		traceID, parentID, flags, ok := parseTraceparent(s)
+		if ok != want {
+			t.Errorf("%q: %v", s, ok)
+		}
+		if ok && (traceID.String() != s[3:35] || parentID.String() != s[36:52] || flags != s[54]-'0') {
+			t.Errorf("%q: %v %v %v", s, traceID, parentID, flags)
+		}
+	}
+}
+
+func TestTracerProxy(t *testing.T) {
+	upstream := make(chan http.Header, 1)
+	destsrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstream <- r.Header.Clone()
+		_, _ = w.Write(testBody)
+	}))
+	defer destsrv.Close()
+
+	rse := make(recordingSpanExporter, 10)
+	tracer := &Tracer{Exporter: rse}
+	defer tracer.Close()
+	srv := &Server{
+		CredentialsValidator: StaticCredentials{"foo": "secret"},
+		Tracer:               tracer,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+	req, _ := http.NewRequest(http.MethodGet, destsrv.URL, nil)
+	req.Header.Set("Traceparent", "00-"+traceID+"-"+parentID+"-01")
+	req.Header.Set("Tracestate", "vendor=value")
+	SetBasicAuth(req.Header, "foo", "secret")
+	resp, err := makeClient(t, proxysrv.URL).Do(req)
+	maybeFatal(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	hdr := <-upstream
+	if tp := hdr.Get("Traceparent"); !strings.HasPrefix(tp, "00-"+traceID+"-") || strings.Contains(tp, parentID) || !strings.HasSuffix(tp, "-01") {
+		t.Error(tp)
+	}
+	if ts := hdr.Get("Tracestate"); ts != "vendor=value" {
+		t.Error(ts)
+	}
+
+	spans := rse.next(t)
+	root := spans["root"]
+	if root.TraceID.String() != traceID || root.ParentID.String() != parentID || root.TraceState != "vendor=value" {
+		t.Errorf("%#v", root)
+	}
+	if !strings.Contains(hdr.Get("Traceparent"), root.SpanID.String()) {
+		t.Error(hdr.Get("Traceparent"), root.SpanID)
+	}
+	if root.Attributes["enduser.id"] != "foo" || root.Attributes["http.response.status_code"] != http.StatusOK {
+		t.Error(root.Attributes)
+	}
+	for _, name := range []string{"auth", "dial", "first_byte", "transfer"} {
+		span, ok := spans[name]
+		if !ok || span.ParentID != root.SpanID || span.TraceID != root.TraceID || span.End.Before(span.Start) {
+			t.Errorf("%s: %#v", name, span)
+		}
+	}
+}
+
+func TestTracerConnect(t *testing.T) {
+	l := makeEchoListener(t, false)
+	defer l.Close()
+
+	rse := make(recordingSpanExporter, 10)
+	tracer := &Tracer{Exporter: rse}
+	defer tracer.Close()
+	srv := &Server{
+		ConnectPortPolicy: AnyConnectPort{},
+		Tracer:            tracer,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	conn, br, resp := openTunnel(t, proxysrv.Listener.Addr().String(), l.Addr().String())
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	_, err := io.WriteString(conn, "hello")
+	maybeFatal(t, err)
+	readEchoed(t, br, "hello")
+	conn.Close()
+
+	spans := rse.next(t)
+	root := spans["root"]
+	if root.Name != "CONNECT connect" || root.ParentID.IsValid() || !root.TraceID.IsValid() {
+		t.Errorf("%#v", root)
+	}
+	for _, name := range []string{"auth", "dial", "transfer"} {
+		if span, ok := spans[name]; !ok || span.ParentID != root.SpanID {
+			t.Errorf("%s: %#v", name, span)
+		}
+	}
+}
+
+func TestTracerUnsampled(t *testing.T) {
+	rse := make(recordingSpanExporter, 10)
+	tracer := &Tracer{Exporter: rse}
+	r := httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	r.Header.Set("Traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	tr := tracer.start(r)
+	hdr := http.Header{}
+	tr.inject(hdr)
+	if tp := hdr.Get("Traceparent"); !strings.HasSuffix(tp, "-00") {
+		t.Error(tp)
+	}
+	tracer.finish(tr, Usage{})
+	maybeFatal(t, tracer.Close())
+	if len(rse) != 0 {
+		t.Error(len(rse))
+	}
+}
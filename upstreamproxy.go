@@ -0,0 +1,33 @@
+package httpproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"time"
+)
+
+var ErrUpstreamProxy = errors.New("upstream proxy error")
+
+// proxyHandshake runs handshake on conn, aborting it when ctx is done.
+// If handshake fails, conn is closed.
+func proxyHandshake(ctx context.Context, conn net.Conn, handshake func() error) (err error) {
+	stop := context.AfterFunc(ctx, func() { _ = conn.SetDeadline(time.Unix(1, 0)) })
+	err = handshake()
+	// if stop fails the conn deadline may be set even if the handshake succeeded
+	if (!stop() || err != nil) && ctx.Err() != nil {
+		err = errors.Join(ctx.Err(), err)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+	}
+	return
+}
+
+func dialProxy(ctx context.Context, cd ContextDialer, address string) (net.Conn, error) {
+	if cd == nil {
+		cd = DefaultContextDialer
+	}
+	return cd.DialContext(ctx, "tcp", address)
+}
@@ -0,0 +1,22 @@
+package httpproxy
+
+import (
+	"errors"
+	"time"
+)
+
+var ErrConnKilled = errors.New("connection killed")
+
+// Usage describes a completed CONNECT tunnel, WebSocket relay or proxied request.
+type Usage struct {
+	ConnInfo
+	Duration   time.Duration // time from start until completion
+	StatusCode int           // HTTP status code sent to the client, zero if none was sent
+	Err        error         // nil if completed successfully
+}
+
+// A UsageReporter is informed when a CONNECT tunnel, WebSocket relay or proxied request completes.
+type UsageReporter interface {
+	// ReportUsage is called once for every completed CONNECT tunnel, WebSocket relay or proxied request.
+	ReportUsage(u Usage)
+}
@@ -0,0 +1,113 @@
+package httpproxy
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingUsageReporter struct {
+	mu     sync.Mutex
+	usages []Usage
+	ch     chan struct{}
+}
+
+func newRecordingUsageReporter() *recordingUsageReporter {
+	return &recordingUsageReporter{ch: make(chan struct{}, 100)}
+}
+
+func (rur *recordingUsageReporter) ReportUsage(u Usage) {
+	rur.mu.Lock()
+	rur.usages = append(rur.usages, u)
+	rur.mu.Unlock()
+	rur.ch <- struct{}{}
+}
+
+func (rur *recordingUsageReporter) next(t *testing.T) (u Usage) {
+	t.Helper()
+	select {
+	case <-rur.ch:
+	case <-time.After(10 * time.Second):
+		t.Fatal("timeout waiting for usage")
+	}
+	rur.mu.Lock()
+	defer rur.mu.Unlock()
+	u = rur.usages[0]
+	rur.usages = rur.usages[1:]
+	return
+}
+
+func TestUsageReporter(t *testing.T) {
+	l := makeEchoListener(t, false)
+	defer l.Close()
+	destsrv := makeHTTPDestSrv(t)
+	defer destsrv.Close()
+
+	rur := newRecordingUsageReporter()
+	srv := &Server{
+		ConnectPortPolicy:    AnyConnectPort{},
+		CredentialsValidator: StaticCredentials{"foo": "secret"},
+		UsageReporter:        rur,
+	}
+	proxysrv := httptest.NewServer(srv)
+	defer proxysrv.Close()
+
+	conn, br, resp := openTunnelAuth(t, proxysrv.Listener.Addr().String(), l.Addr().String(), "foo")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatal(resp.Status)
+	}
+	_, err := io.WriteString(conn, "hello world")
+	maybeFatal(t, err)
+	readEchoed(t, br, "hello world")
+	conn.Close()
+
+	u := rur.next(t)
+	if u.Kind != ConnKindConnect || u.Username != "foo" || u.StatusCode != http.StatusOK || u.Err != nil {
+		t.Errorf("%#v", u)
+	}
+	if u.BytesSent != 11 || u.BytesReceived != 11 || u.Duration <= 0 {
+		t.Errorf("%#v", u)
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, destsrv.URL, io.NopCloser(io.LimitReader(zeroReader{}, 1000)))
+	SetBasicAuth(req.Header, "foo", "secret")
+	resp, err = makeClient(t, proxysrv.URL).Do(req)
+	maybeFatal(t, err)
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	u = rur.next(t)
+	if u.Kind != ConnKindRequest || u.Username != "foo" || u.StatusCode != http.StatusOK || u.Err != nil {
+		t.Errorf("%#v", u)
+	}
+	if u.BytesSent != 1000 || u.BytesReceived != int64(len(testBody)) {
+		t.Errorf("%#v", u)
+	}
+
+	_, _, resp = openTunnelAuth(t, proxysrv.Listener.Addr().String(), l.Addr().String(), "")
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Error(resp.Status)
+	}
+	u = rur.next(t)
+	if u.Kind != ConnKindConnect || u.StatusCode != http.StatusUnauthorized || !errors.Is(u.Err, ErrUnauthorized) {
+		t.Errorf("%#v", u)
+	}
+
+	conn, _, _ = openTunnelAuth(t, proxysrv.Listener.Addr().String(), l.Addr().String(), "foo")
+	defer conn.Close()
+	srv.KillConn(waitForConns(t, srv, 1)[0].ID)
+	if u = rur.next(t); !errors.Is(u.Err, ErrConnKilled) {
+		t.Errorf("%#v", u)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (n int, err error) {
+	clear(p)
+	return len(p), nil
+}